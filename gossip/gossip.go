@@ -198,6 +198,14 @@ func (g *Gossip) RegisterGroup(prefix string, limit int, typeOf GroupType) error
 	return g.is.registerGroup(newGroup(prefix, limit, typeOf))
 }
 
+// RegisterCallback registers a callback to be invoked each time the
+// info for key is added or updated, whether locally or by a peer.
+func (g *Gossip) RegisterCallback(key string, method Callback) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.is.registerCallback(key, method)
+}
+
 // MaxHops returns the maximum number of hops to reach the furthest
 // gossiped information currently in the network.
 func (g *Gossip) MaxHops() uint32 {
@@ -39,13 +39,18 @@ import (
 //
 // infoStores are not thread safe.
 type infoStore struct {
-	Infos    infoMap  // Map from key to info
-	Groups   groupMap // Map from key prefix to groups of infos
-	NodeAddr net.Addr // Address of node owning this info store: "host:port"
-	MaxSeq   int64    // Maximum sequence number inserted
-	seqGen   int64    // Sequence generator incremented each time info is added
+	Infos     infoMap               // Map from key to info
+	Groups    groupMap              // Map from key prefix to groups of infos
+	NodeAddr  net.Addr              // Address of node owning this info store: "host:port"
+	MaxSeq    int64                 // Maximum sequence number inserted
+	seqGen    int64                 // Sequence generator incremented each time info is added
+	callbacks map[string][]Callback // Map from key to callbacks invoked on update
 }
 
+// A Callback is invoked with the key of an info which has been added
+// or updated.
+type Callback func(key string)
+
 // monotonicUnixNano returns a monotonically increasing value for
 // nanoseconds in Unix time. Since equal times are ignored with
 // updates to infos, we're careful to avoid incorrectly ignoring a
@@ -191,6 +196,7 @@ func (is *infoStore) addInfo(i *info) error {
 		if i.seq > is.MaxSeq {
 			is.MaxSeq = i.seq
 		}
+		is.runCallbacks(i.Key)
 		return nil
 	}
 	// Only replace an existing info if new timestamp is greater, or if
@@ -206,9 +212,27 @@ func (is *infoStore) addInfo(i *info) error {
 	if i.seq > is.MaxSeq {
 		is.MaxSeq = i.seq
 	}
+	is.runCallbacks(i.Key)
 	return nil
 }
 
+// registerCallback registers a callback to be invoked each time the
+// info for key is added or updated.
+func (is *infoStore) registerCallback(key string, method Callback) {
+	if is.callbacks == nil {
+		is.callbacks = map[string][]Callback{}
+	}
+	is.callbacks[key] = append(is.callbacks[key], method)
+}
+
+// runCallbacks invokes the callbacks registered for key. Callbacks
+// are run asynchronously, as they may access the info store.
+func (is *infoStore) runCallbacks(key string) {
+	for _, method := range is.callbacks[key] {
+		go method(key)
+	}
+}
+
 // infoCount returns the count of infos stored in groups and the
 // non-group infos map. This is really just an approximation as
 // we don't check whether infos are expired.
@@ -186,6 +186,42 @@ func TestAddInfoSameKeyDifferentHops(t *testing.T) {
 	}
 }
 
+// Verify that callbacks are invoked for updates to their key only,
+// and not for infos which fail to be added.
+func TestCallbacks(t *testing.T) {
+	is := newInfoStore(emptyAddr)
+	keys := make(chan string, 10)
+	is.registerCallback("a", func(key string) { keys <- key })
+
+	info1 := is.newInfo("a", float64(1), time.Second)
+	info2 := is.newInfo("b", float64(2), time.Second)
+	info3 := is.newInfo("a", float64(3), time.Second)
+	for _, i := range []*info{info1, info2, info3} {
+		if err := is.addInfo(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Re-adding an older info fails and doesn't invoke the callback.
+	if err := is.addInfo(info1); err == nil {
+		t.Error("expected older info to be rejected")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-keys:
+			if key != "a" {
+				t.Errorf("expected callback for key \"a\"; got %q", key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback %d not invoked", i)
+		}
+	}
+	select {
+	case key := <-keys:
+		t.Errorf("unexpected callback for key %q", key)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
 // Register groups, add and fetch group infos from min/max groups and
 // verify ordering. Add an additional non-group info and fetch that as
 // well.
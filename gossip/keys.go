@@ -28,6 +28,10 @@ const (
 	// KeyConfigAccounting is the accounting configuration map.
 	KeyConfigAccounting = "accounting"
 
+	// KeyAccountingUsage is the usage of each accounting
+	// configuration. The value is a storage.AcctUsageMap.
+	KeyAccountingUsage = "accounting-usage"
+
 	// KeyConfigPermission is the permission configuration map.
 	KeyConfigPermission = "permissions"
 
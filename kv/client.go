@@ -17,7 +17,23 @@
 
 package kv
 
-import "flag"
+import (
+	"flag"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// watchWait is the time a watch waits for writes before returning
+// the resolved timestamp alone.
+const watchWait = 5 * time.Second
 
 // Addr is the tcp address used to connect to the Cockroach cluster.
 var Addr = flag.String("addr", "127.0.0.1:8080", "address for connection to cockroach cluster")
@@ -26,3 +42,177 @@ var Addr = flag.String("addr", "127.0.0.1:8080", "address for connection to cock
 func HTTPAddr() string {
 	return "http://" + *Addr
 }
+
+// A Client provides synchronous, typed access to a DB. Each method
+// blocks until the command completes, the context's deadline expires
+// or the context is cancelled, and returns any error from the
+// response header as a Go error. Every command is assigned a unique
+// ClientCmdID, and commands which fail with a retryable error are
+// retried with the same ClientCmdID until the context is done, so
+// that retries are idempotent.
+//
+// A Client is safe for concurrent access.
+type Client struct {
+	db DB
+	// User is the user on whose behalf commands are sent.
+	User string
+	// TxID, if non-empty, is the transaction in which commands are sent.
+	TxID string
+}
+
+// NewClient returns a client which sends commands to db on behalf
+// of the root user.
+func NewClient(db DB) *Client {
+	return &Client{db: db, User: storage.UserRoot}
+}
+
+// Get returns the value for key. The value's bytes are nil if the
+// key doesn't exist.
+func (c *Client) Get(ctx context.Context, key engine.Key) (engine.Value, error) {
+	args := &storage.GetRequest{RequestHeader: storage.RequestHeader{Key: key}}
+	reply := &storage.GetResponse{}
+	err := c.send(ctx, storage.Get, args, reply)
+	return reply.Value, err
+}
+
+// Put sets the value for key.
+func (c *Client) Put(ctx context.Context, key engine.Key, value []byte) error {
+	args := &storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Key: key},
+		Value:         engine.Value{Bytes: value},
+	}
+	return c.send(ctx, storage.Put, args, &storage.PutResponse{})
+}
+
+// Inc increments the integer value at key by inc and returns the
+// new value. A key which doesn't exist is treated as zero.
+func (c *Client) Inc(ctx context.Context, key engine.Key, inc int64) (int64, error) {
+	args := &storage.IncrementRequest{
+		RequestHeader: storage.RequestHeader{Key: key},
+		Increment:     inc,
+	}
+	reply := &storage.IncrementResponse{}
+	err := c.send(ctx, storage.Increment, args, reply)
+	return reply.NewValue, err
+}
+
+// CPut sets the value for key only if its existing value matches
+// expValue; a nil expValue requires that the key not exist. If the
+// existing value doesn't match, an error is returned along with the
+// actual value, if any.
+func (c *Client) CPut(ctx context.Context, key engine.Key, value, expValue []byte) (*engine.Value, error) {
+	args := &storage.ConditionalPutRequest{
+		RequestHeader: storage.RequestHeader{Key: key},
+		Value:         engine.Value{Bytes: value},
+		ExpValue:      engine.Value{Bytes: expValue},
+	}
+	reply := &storage.ConditionalPutResponse{}
+	err := c.send(ctx, storage.ConditionalPut, args, reply)
+	return reply.ActualValue, err
+}
+
+// Scan returns the key/value pairs from start to end (exclusive) in
+// key order, up to max if non-zero.
+func (c *Client) Scan(ctx context.Context, start, end engine.Key, max int64) ([]engine.KeyValue, error) {
+	args := &storage.ScanRequest{
+		RequestHeader: storage.RequestHeader{Key: start, EndKey: end},
+		MaxResults:    max,
+	}
+	reply := &storage.ScanResponse{}
+	err := c.send(ctx, storage.Scan, args, reply)
+	return reply.Rows, err
+}
+
+// Watch invokes fn with the writes committed to the keys from start
+// to end (exclusive) after timestamp ts, in timestamp order, and with
+// the resolved timestamp, up to which all writes have been delivered.
+// fn is invoked as writes are committed and, in their absence, at
+// least every watchWait to advance the resolved timestamp. If ts is
+// zero, the watch starts at the current time. Watch returns once fn
+// returns an error or the context is done.
+//
+// If the writes since ts have been forgotten by the ranges watched,
+// a *storage.WatchTimestampError is returned; the watcher should then
+// rescan the keys and watch again.
+func (c *Client) Watch(ctx context.Context, start, end engine.Key, ts hlc.Timestamp,
+	fn func(events []storage.WatchEvent, resolved hlc.Timestamp) error) error {
+	for {
+		args := &storage.WatchRequest{
+			RequestHeader:  storage.RequestHeader{Key: start, EndKey: end},
+			StartTimestamp: ts,
+			Wait:           watchWait,
+		}
+		reply := &storage.WatchResponse{}
+		if err := c.send(ctx, storage.Watch, args, reply); err != nil {
+			return err
+		}
+		if err := fn(reply.Events, reply.ResolvedTimestamp); err != nil {
+			return err
+		}
+		if ts.Less(reply.ResolvedTimestamp) {
+			ts = reply.ResolvedTimestamp
+		}
+	}
+}
+
+// Del deletes key.
+func (c *Client) Del(ctx context.Context, key engine.Key) error {
+	args := &storage.DeleteRequest{RequestHeader: storage.RequestHeader{Key: key}}
+	return c.send(ctx, storage.Delete, args, &storage.DeleteResponse{})
+}
+
+// DelRange deletes the keys from start to end (exclusive), up to max
+// if non-zero, and returns the number of keys deleted.
+func (c *Client) DelRange(ctx context.Context, start, end engine.Key, max int64) (int64, error) {
+	args := &storage.DeleteRangeRequest{
+		RequestHeader:      storage.RequestHeader{Key: start, EndKey: end},
+		MaxEntriesToDelete: max,
+	}
+	reply := &storage.DeleteRangeResponse{}
+	err := c.send(ctx, storage.DeleteRange, args, reply)
+	return reply.NumDeleted, err
+}
+
+// send invokes the DB method named by method with args and waits for
+// the response, copying it into reply. Commands failing with a
+// retryable error are retried with backoff until ctx is done. Each
+// attempt sends a copy of args, as the DB may modify the request
+// header (e.g. pushing its timestamp) while executing the command.
+func (c *Client) send(ctx context.Context, method string, args storage.Request, reply storage.Response) error {
+	header := args.Header()
+	header.User = c.User
+	header.TxID = c.TxID
+	header.CmdID = storage.ClientCmdID{
+		WallTime: time.Now().UnixNano(),
+		Random:   rand.Int63(),
+	}
+	backoff := retryBackoff
+	for {
+		attemptArgs := reflect.New(reflect.TypeOf(args).Elem())
+		attemptArgs.Elem().Set(reflect.ValueOf(args).Elem())
+		attemptReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface().(storage.Response)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- ExecuteCmd(c.db, method, attemptArgs.Interface().(storage.Request), attemptReply)
+		}()
+		var err error
+		select {
+		case err = <-errChan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(attemptReply).Elem())
+		if retryErr, ok := err.(util.Retryable); !ok || !retryErr.CanRetry() {
+			return err
+		}
+		log.Warningf("%s failed; retrying in %s: %v", method, backoff, err)
+		select {
+		case <-time.After(backoff):
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.net/context"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// TestClientOperations verifies each of the client's operations
+// against a local DB.
+func TestClientOperations(t *testing.T) {
+	c := NewClient(createTestLocalDB(t))
+	ctx := context.Background()
+
+	if err := c.Put(ctx, engine.Key("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get(ctx, engine.Key("a")); err != nil || !bytes.Equal(val.Bytes, []byte("1")) {
+		t.Errorf("expected value \"1\"; got %q, %v", val.Bytes, err)
+	}
+	if val, err := c.Get(ctx, engine.Key("missing")); err != nil || val.Bytes != nil {
+		t.Errorf("expected no value; got %q, %v", val.Bytes, err)
+	}
+	if newVal, err := c.Inc(ctx, engine.Key("b"), 5); err != nil || newVal != 5 {
+		t.Errorf("expected increment to 5; got %d, %v", newVal, err)
+	}
+	if _, err := c.CPut(ctx, engine.Key("a"), []byte("2"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := c.CPut(ctx, engine.Key("a"), []byte("3"), []byte("1"))
+	if err == nil || actual == nil || !bytes.Equal(actual.Bytes, []byte("2")) {
+		t.Errorf("expected failed conditional put with actual value \"2\"; got %+v, %v", actual, err)
+	}
+	if err := c.Put(ctx, engine.Key("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := c.Scan(ctx, engine.Key("a"), engine.Key("d"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || !bytes.Equal(rows[0].Key, engine.Key("a")) || !bytes.Equal(rows[1].Key, engine.Key("b")) {
+		t.Errorf("expected to scan keys \"a\" and \"b\"; got %+v", rows)
+	}
+	if err := c.Del(ctx, engine.Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if num, err := c.DelRange(ctx, engine.Key("a"), engine.Key("d"), 0); err != nil || num != 2 {
+		t.Errorf("expected 2 keys deleted; got %d, %v", num, err)
+	}
+	if rows, err := c.Scan(ctx, engine.Key("a"), engine.Key("d"), 0); err != nil || len(rows) != 0 {
+		t.Errorf("expected all keys deleted; got %+v, %v", rows, err)
+	}
+}
+
+// TestClientWatch verifies that a watch delivers writes in timestamp
+// order along with advancing resolved timestamps.
+func TestClientWatch(t *testing.T) {
+	db := createTestLocalDB(t)
+	c := NewClient(db)
+	ctx := context.Background()
+	start := (<-db.Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot}})).Timestamp
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Put(ctx, engine.Key(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Del(ctx, engine.Key("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	errDone := errors.New("done")
+	var keys []string
+	var lastTS, resolved hlc.Timestamp
+	err := c.Watch(ctx, engine.Key("a"), engine.Key("c"), start, func(events []storage.WatchEvent, ts hlc.Timestamp) error {
+		if ts.Less(resolved) {
+			t.Errorf("resolved timestamp regressed from %+v to %+v", resolved, ts)
+		}
+		resolved = ts
+		for _, e := range events {
+			if e.Value.Timestamp.Less(lastTS) || resolved.Less(e.Value.Timestamp) {
+				t.Errorf("event %q at %+v out of order or unresolved", e.Key, e.Value.Timestamp)
+			}
+			lastTS = e.Value.Timestamp
+			if e.Deleted {
+				keys = append(keys, string(e.Key)+"-")
+			} else {
+				keys = append(keys, string(e.Key))
+			}
+		}
+		if len(keys) < 3 {
+			return nil
+		}
+		return errDone
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b", "a-"}) {
+		t.Errorf("expected events [a b a-]; got %v", keys)
+	}
+
+	// Watches are cancelled along with their context.
+	cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := c.Watch(cancelCtx, engine.Key("a"), engine.Key("c"), resolved, func([]storage.WatchEvent, hlc.Timestamp) error {
+		return nil
+	}); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded; got %v", err)
+	}
+}
+
+// testGetDB is a DB which replies to Get requests by invoking get.
+type testGetDB struct {
+	DB
+	get func(args *storage.GetRequest) *storage.GetResponse
+}
+
+func (db *testGetDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	replyChan := make(chan *storage.GetResponse, 1)
+	if reply := db.get(args); reply != nil {
+		replyChan <- reply
+	}
+	return replyChan
+}
+
+// TestClientDeadline verifies that a command which doesn't complete
+// returns once the context's deadline expires.
+func TestClientDeadline(t *testing.T) {
+	c := NewClient(&testGetDB{get: func(args *storage.GetRequest) *storage.GetResponse {
+		return nil // never reply
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, engine.Key("a")); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded; got %v", err)
+	}
+}
+
+// TestClientRetry verifies that commands failing with a retryable
+// error are retried with the same command ID.
+func TestClientRetry(t *testing.T) {
+	var cmdIDs []storage.ClientCmdID
+	c := NewClient(&testGetDB{get: func(args *storage.GetRequest) *storage.GetResponse {
+		cmdIDs = append(cmdIDs, args.CmdID)
+		reply := &storage.GetResponse{}
+		if len(cmdIDs) == 1 {
+			reply.Error = &storage.RangeNotFoundError{}
+		} else {
+			reply.Value.Bytes = []byte("value")
+		}
+		return reply
+	}})
+	val, err := c.Get(context.Background(), engine.Key("a"))
+	if err != nil || !bytes.Equal(val.Bytes, []byte("value")) {
+		t.Fatalf("expected value after retry; got %q, %v", val.Bytes, err)
+	}
+	if len(cmdIDs) != 2 || cmdIDs[0].IsEmpty() || cmdIDs[0] != cmdIDs[1] {
+		t.Errorf("expected two attempts with the same non-empty command ID; got %+v", cmdIDs)
+	}
+}
+
+// TestClientRetryResetsHeader verifies that a retried command is sent
+// with the header as originally supplied, although the DB modified
+// the header of the failed attempt.
+func TestClientRetryResetsHeader(t *testing.T) {
+	var timestamps []hlc.Timestamp
+	c := NewClient(&testGetDB{get: func(args *storage.GetRequest) *storage.GetResponse {
+		timestamps = append(timestamps, args.Timestamp)
+		reply := &storage.GetResponse{}
+		if len(timestamps) == 1 {
+			// Push the timestamp of the request, as a range does when
+			// it's been read more recently.
+			args.Timestamp = hlc.Timestamp{WallTime: 100}
+			reply.Timestamp = args.Timestamp
+			reply.Error = &storage.RangeNotFoundError{}
+		} else {
+			reply.Value.Bytes = []byte("value")
+		}
+		return reply
+	}})
+	if _, err := c.Get(context.Background(), engine.Key("a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(timestamps) != 2 || timestamps[1] != (hlc.Timestamp{}) {
+		t.Errorf("expected retry with the original timestamp; got %+v", timestamps)
+	}
+}
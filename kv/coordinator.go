@@ -18,11 +18,17 @@
 package kv
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/gob"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -51,27 +57,48 @@ func isTransactional(method string) bool {
 	return ok
 }
 
+// rpcSender is a type which can route RPCs to the ranges holding the
+// request's key. The coordinator uses it to send heartbeats, aborts
+// and intent resolutions; DistDB implements it.
+type rpcSender interface {
+	routeRPCInternal(method string, args storage.Request, replyChan interface{})
+}
+
 // A coordinator coordinates the transaction states for the clients.
 // After a transaction is started, it will send heartbeat messages to the transaction
 // table so that other transactions will know whether this transaction is live.
 // It will keep track of the written keys belonging to this transaction.
 // When the transaction is committed or aborted, it will also clear the write
 // intents for the client.
+//
+// All transactions are serviced by a single goroutine which sleeps
+// until the earliest heartbeat deadline from a min-heap of
+// transactions. Transactions whose clients have not sent a request
+// for longer than their timeout are considered abandoned; they are
+// aborted and their intents resolved.
 type coordinator struct {
-	// TransactionMap is a map from transaction ids to txnMetadata.
-	TransactionMap map[string]txnMetadata
-	db             *DistDB
-	clock          *hlc.Clock
+	db                rpcSender
+	clock             *hlc.Clock
+	heartbeatInterval time.Duration
+	clientTimeout     time.Duration
+
+	mu     sync.Mutex              // Protects txns and heap
+	txns   map[string]*txnMetadata // Map from transaction ID to txnMetadata
+	heap   txnMetadataHeap         // Min-heap of next heartbeat deadlines
+	wakeup chan struct{}           // Signals the heap has a new entry
+	closer chan struct{}           // Closed to stop the heartbeat goroutine
 }
 
 type txnMetadata struct {
-	// keys and endKeys sotre the key ranges affected by this transaction
+	txID string
+
+	// keys and endKeys store the key ranges affected by this transaction
 	// through this coordinator.  By keeping this record, the coordinator
 	// will be able to update the write intent when the transaction is
-	// committed.
+	// committed. An empty endKey means the span is the single key.
 	// TODO(jiajia): Reevaluate the slice datastructure if there are too
-	// many duplicate keys in a transaction.  To make this as a map, we need
-	// to implement a hash to the key type.
+	// many key spans in a transaction; overlapping spans are merged
+	// only when one contains the other.
 	keys    []engine.Key
 	endKeys []engine.Key
 
@@ -85,69 +112,423 @@ type txnMetadata struct {
 	// If this value is set to 0, a default timeout will be used.
 	timeoutDuration time.Duration
 
-	// This is the closer to close the heartbeat goroutine.
-	closer chan struct{}
+	// nextHeartbeat is the time at which the next heartbeat is due.
+	nextHeartbeat time.Time
+	// index is the position of this metadata in the coordinator's heap.
+	index int
+}
+
+// addKeySpan records the key span from key to endKey as having been
+// written by this transaction. Spans already contained in a recorded
+// span are skipped.
+func (tm *txnMetadata) addKeySpan(key, endKey engine.Key) {
+	for i := range tm.keys {
+		if spanContains(tm.keys[i], tm.endKeys[i], key, endKey) {
+			return
+		}
+	}
+	tm.keys = append(tm.keys, key)
+	tm.endKeys = append(tm.endKeys, endKey)
+}
+
+// spanContains returns true if the span [key, endKey) contains the
+// span [key2, endKey2). Empty end keys denote single-key spans.
+func spanContains(key, endKey, key2, endKey2 engine.Key) bool {
+	if len(endKey) == 0 {
+		return len(endKey2) == 0 && bytes.Equal(key, key2)
+	}
+	if len(endKey2) == 0 {
+		return !key2.Less(key) && key2.Less(endKey)
+	}
+	return !key2.Less(key) && !endKey.Less(endKey2)
+}
+
+// hasClientExpired returns true if the client has not sent a request
+// for this transaction within the timeout, measured at time now.
+func (tm *txnMetadata) hasClientExpired(now hlc.Timestamp) bool {
+	return now.WallTime-tm.lastUpdateTS.WallTime > tm.timeoutDuration.Nanoseconds()
+}
+
+// txnMetadataHeap is a min-heap of transaction metadata ordered by
+// next heartbeat time. It implements heap.Interface.
+type txnMetadataHeap []*txnMetadata
+
+func (h txnMetadataHeap) Len() int { return len(h) }
+func (h txnMetadataHeap) Less(i, j int) bool {
+	return h[i].nextHeartbeat.Before(h[j].nextHeartbeat)
+}
+func (h txnMetadataHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+// Push adds x to the heap.
+func (h *txnMetadataHeap) Push(x interface{}) {
+	tm := x.(*txnMetadata)
+	tm.index = len(*h)
+	*h = append(*h, tm)
+}
+
+// Pop removes and returns the last element of the heap.
+func (h *txnMetadataHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	tm := old[n-1]
+	tm.index = -1
+	*h = old[0 : n-1]
+	return tm
 }
 
-// NewCoordinator TODO(jiajia) Add a comment!
-func NewCoordinator(db *DistDB, clock *hlc.Clock) *coordinator {
+// NewCoordinator creates a new transaction coordinator which routes
+// heartbeats, aborts and intent resolutions through db and starts
+// its heartbeat goroutine. Call Stop() to release it.
+func NewCoordinator(db rpcSender, clock *hlc.Clock) *coordinator {
 	tc := &coordinator{
-		db:             db,
-		TransactionMap: make(map[string]txnMetadata),
-		clock:          clock,
+		db:                db,
+		clock:             clock,
+		heartbeatInterval: heartbeatInterval,
+		clientTimeout:     defaultClientTimeout,
+		txns:              make(map[string]*txnMetadata),
+		wakeup:            make(chan struct{}, 1),
+		closer:            make(chan struct{}),
 	}
+	go tc.start()
 	return tc
 }
 
-func (tc *coordinator) addRequest(header *storage.RequestHeader) {
+// Stop stops the heartbeat goroutine.
+func (tc *coordinator) Stop() {
+	close(tc.closer)
+}
+
+// addRequest is called for every transactional request passing
+// through the coordinator. It begins heartbeating new transactions,
+// refreshes the client's last activity and, if the method writes,
+// records the request's key span.
+func (tc *coordinator) addRequest(method string, header *storage.RequestHeader) {
 	// Ignore non-transactional requests.
 	if len(header.TxID) == 0 {
 		return
 	}
-	if _, ok := tc.TransactionMap[header.TxID]; !ok {
-		tc.TransactionMap[header.TxID] = tc.newTxnMetadata()
-		// TODO(jiajia): Reevaluate this logic of creating a goroutine
-		// for each active transaction. Spencer suggests a heap
-		// containing next heartbeat timeouts which is processed by a
-		// single goroutine.
-		go tc.heartbeat(engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(header.TxID)), tc.TransactionMap[header.TxID].closer)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	txnMeta, ok := tc.txns[header.TxID]
+	if !ok {
+		txnMeta = tc.newTxnMetadata(header.TxID)
+		tc.txns[header.TxID] = txnMeta
+		heap.Push(&tc.heap, txnMeta)
+		// Wake the heartbeat goroutine in case this transaction's
+		// deadline is now the earliest.
+		select {
+		case tc.wakeup <- struct{}{}:
+		default:
+		}
 	}
-	txnMeta := tc.TransactionMap[header.TxID]
 	txnMeta.lastUpdateTS = tc.clock.Now()
+	if !storage.IsReadOnly(strings.TrimPrefix(method, "Node.")) {
+		txnMeta.addKeySpan(header.Key, header.EndKey)
+	}
+}
+
+// trackRequest registers a transactional request, or each request of
+// a transactional batch, with the coordinator. Requests may not be
+// made as part of a transaction which has ended: a
+// TransactionStatusError is returned if it has.
+func (tc *coordinator) trackRequest(method string, args storage.Request) error {
+	batch, isBatch := args.(*storage.BatchRequest)
+	var txID string
+	if isBatch {
+		txID = batch.TxID
+	} else if isTransactional(method) {
+		txID = args.Header().TxID
+	}
+	if len(txID) == 0 {
+		return nil
+	}
+	if err := tc.verifyPending(txID); err != nil {
+		return err
+	}
+	if !isBatch {
+		tc.addRequest(method, args.Header())
+		return nil
+	}
+	for _, req := range batch.Requests {
+		reqMethod, err := storage.MethodForRequest(req)
+		if err != nil || !isTransactional("Node."+reqMethod) {
+			continue
+		}
+		header := *req.Header()
+		header.TxID = batch.TxID
+		tc.addRequest("Node."+reqMethod, &header)
+	}
+	return nil
+}
+
+// verifyPending returns a TransactionStatusError if the transaction
+// has ended. Transactions this coordinator tracks are assumed to be
+// pending, as it ends them itself or learns they've been ended by
+// heartbeating them; the status of others is read from the
+// transaction table.
+func (tc *coordinator) verifyPending(txID string) error {
+	tc.mu.Lock()
+	_, ok := tc.txns[txID]
+	tc.mu.Unlock()
+	if ok {
+		return nil
+	}
+	txn, err := tc.getTxn(txID)
+	if err != nil {
+		return err
+	}
+	if txn.Status != storage.PENDING {
+		return &storage.TransactionStatusError{TxID: txID, Status: txn.Status}
+	}
+	return nil
+}
+
+// getTxn reads the record of the transaction from the transaction
+// table. A transaction without a record is pending.
+func (tc *coordinator) getTxn(txID string) (*storage.Transaction, error) {
+	replyChan := make(chan *storage.GetResponse, 1)
+	tc.db.routeRPCInternal("Node.Get", &storage.GetRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txID)),
+			User: storage.UserRoot,
+		},
+	}, replyChan)
+	reply := <-replyChan
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	txn := &storage.Transaction{TxID: txID, Status: storage.PENDING}
+	if len(reply.Value.Bytes) > 0 {
+		if err := gob.NewDecoder(bytes.NewBuffer(reply.Value.Bytes)).Decode(txn); err != nil {
+			return nil, err
+		}
+	}
+	return txn, nil
+}
+
+// endTxn stops tracking the transaction and resolves all intents it
+// wrote through this coordinator, committing or aborting them
+// according to commit. It returns once the intents are resolved.
+func (tc *coordinator) endTxn(txID string, commit bool) {
+	tc.mu.Lock()
+	txnMeta, ok := tc.txns[txID]
+	if ok {
+		tc.removeLocked(txnMeta)
+	}
+	tc.mu.Unlock()
+	if ok {
+		tc.resolveIntents(txnMeta, commit)
+	}
 }
 
-func (tc *coordinator) newTxnMetadata() txnMetadata {
-	return txnMetadata{
+func (tc *coordinator) newTxnMetadata(txID string) *txnMetadata {
+	return &txnMetadata{
+		txID:            txID,
 		keys:            make([]engine.Key, 0, 1),
 		endKeys:         make([]engine.Key, 0, 1),
 		lastUpdateTS:    tc.clock.Now(),
-		timeoutDuration: defaultClientTimeout,
-		closer:          make(chan struct{}),
+		timeoutDuration: tc.clientTimeout,
+		nextHeartbeat:   time.Now().Add(tc.heartbeatInterval),
+	}
+}
+
+// removeLocked removes the transaction from the map and the heap.
+// Assumes the mutex is held.
+func (tc *coordinator) removeLocked(txnMeta *txnMetadata) {
+	delete(tc.txns, txnMeta.txID)
+	if txnMeta.index >= 0 {
+		heap.Remove(&tc.heap, txnMeta.index)
 	}
 }
 
-// TODO(jiajia): how to test this?
-func (tc *coordinator) heartbeat(key engine.Key, closer chan struct{}) {
-	ticker := time.NewTicker(heartbeatInterval)
+// start processes heartbeats for all transactions in a single
+// goroutine, sleeping until the earliest deadline in the heap.
+func (tc *coordinator) start() {
+	timer := time.NewTimer(tc.heartbeatInterval)
+	defer timer.Stop()
 	for {
+		tc.mu.Lock()
+		wait := tc.heartbeatInterval
+		if len(tc.heap) > 0 {
+			wait = tc.heap[0].nextHeartbeat.Sub(time.Now())
+		}
+		tc.mu.Unlock()
+		timer.Reset(wait)
+
 		select {
-		case <-ticker.C:
-			replyChan := make(chan *storage.HeartbeatTransactionResponse, 1)
-			tc.db.routeRPCInternal("Node.HeartbeatTransaction", &storage.HeartbeatTransactionRequest{
-				RequestHeader: storage.RequestHeader{
-					Key:  key,
-					User: storage.UserRoot,
-				},
-			}, replyChan)
-			response := <-replyChan
-			// If the transaction is not in pending state, then we
-			// can stop the heartbeat. It's either aborted or
-			// commited.
-			if response.Status != storage.PENDING {
-				return
+		case <-timer.C:
+			tc.processHeartbeats()
+		case <-tc.wakeup:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-tc.closer:
+			return
+		}
+	}
+}
+
+// processHeartbeats pops every transaction whose heartbeat is due. A
+// transaction whose client has expired is aborted; otherwise a
+// heartbeat is sent and the transaction is pushed back onto the heap
+// with its next deadline.
+func (tc *coordinator) processHeartbeats() {
+	now := time.Now()
+	clockNow := tc.clock.Now()
+	var heartbeats, abandoned []*txnMetadata
+
+	tc.mu.Lock()
+	for len(tc.heap) > 0 && !tc.heap[0].nextHeartbeat.After(now) {
+		txnMeta := heap.Pop(&tc.heap).(*txnMetadata)
+		if txnMeta.hasClientExpired(clockNow) {
+			delete(tc.txns, txnMeta.txID)
+			abandoned = append(abandoned, txnMeta)
+			continue
+		}
+		txnMeta.nextHeartbeat = now.Add(tc.heartbeatInterval)
+		heap.Push(&tc.heap, txnMeta)
+		heartbeats = append(heartbeats, txnMeta)
+	}
+	tc.mu.Unlock()
+
+	for _, txnMeta := range heartbeats {
+		tc.heartbeat(txnMeta)
+	}
+	for _, txnMeta := range abandoned {
+		log.Warningf("transaction %q abandoned by client; aborting", txnMeta.txID)
+		go tc.abort(txnMeta)
+	}
+}
+
+// heartbeat sends a heartbeat for the transaction. The response is
+// awaited asynchronously; if the transaction is no longer pending,
+// it was committed or aborted elsewhere and is no longer tracked.
+func (tc *coordinator) heartbeat(txnMeta *txnMetadata) {
+	replyChan := make(chan *storage.HeartbeatTransactionResponse, 1)
+	tc.db.routeRPCInternal("Node.HeartbeatTransaction", &storage.HeartbeatTransactionRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txnMeta.txID)),
+			User: storage.UserRoot,
+			TxID: txnMeta.txID,
+		},
+	}, replyChan)
+	go func() {
+		response := <-replyChan
+		if response.Error != nil {
+			log.Warningf("heartbeat of transaction %q failed: %v", txnMeta.txID, response.Error)
+			return
+		}
+		if response.Status != storage.PENDING {
+			tc.mu.Lock()
+			removed := tc.txns[txnMeta.txID] == txnMeta
+			if removed {
+				tc.removeLocked(txnMeta)
+			}
+			tc.mu.Unlock()
+			// The intents this coordinator tracked may not have been
+			// resolved by whichever coordinator ended the transaction.
+			if removed {
+				tc.resolveIntents(txnMeta, response.Status == storage.COMMITTED)
 			}
-		case <-closer:
+		}
+	}()
+}
+
+// abort marks an abandoned transaction as aborted in the transaction
+// table and then resolves its intents.
+func (tc *coordinator) abort(txnMeta *txnMetadata) {
+	replyChan := make(chan *storage.EndTransactionResponse, 1)
+	tc.db.routeRPCInternal("Node.EndTransaction", &storage.EndTransactionRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txnMeta.txID)),
+			User: storage.UserRoot,
+			TxID: txnMeta.txID,
+		},
+		Commit: false,
+	}, replyChan)
+	if reply := <-replyChan; reply.Error != nil {
+		log.Errorf("unable to abort abandoned transaction %q: %v", txnMeta.txID, reply.Error)
+		return
+	}
+	tc.resolveIntents(txnMeta, false)
+}
+
+// resolveWriteIntent resolves the write intent which blocked a
+// request, if the intent's transaction has ended or was abandoned. A
+// pending transaction is abandoned if neither its record nor the
+// intent has been updated within storage.TxnHeartbeatTimeout, as its
+// coordinator would have heartbeat it; it's aborted before its intent
+// is resolved. The intents of live transactions are left in place.
+func (tc *coordinator) resolveWriteIntent(intentErr *storage.WriteIntentError) {
+	txn, err := tc.getTxn(intentErr.TxID)
+	if err != nil {
+		log.Warningf("unable to read record of transaction %q: %v", intentErr.TxID, err)
+		return
+	}
+	status, lastActive := txn.Status, intentErr.Timestamp
+	if lastActive.Less(txn.LastHeartbeat) {
+		lastActive = txn.LastHeartbeat
+	}
+	if status == storage.PENDING {
+		if tc.clock.Now().WallTime-lastActive.WallTime < storage.TxnHeartbeatTimeout.Nanoseconds() {
 			return
 		}
+		log.Warningf("aborting transaction %q, inactive since %s", intentErr.TxID, time.Unix(0, lastActive.WallTime))
+		endChan := make(chan *storage.EndTransactionResponse, 1)
+		tc.db.routeRPCInternal("Node.EndTransaction", &storage.EndTransactionRequest{
+			RequestHeader: storage.RequestHeader{
+				Key:  engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(intentErr.TxID)),
+				User: storage.UserRoot,
+				TxID: intentErr.TxID,
+			},
+			Commit: false,
+		}, endChan)
+		status = storage.ABORTED
+		if reply := <-endChan; reply.Error != nil {
+			// The transaction's coordinator may have committed it first.
+			statusErr, ok := reply.Error.(*storage.TransactionStatusError)
+			if !ok {
+				log.Errorf("unable to abort abandoned transaction %q: %v", intentErr.TxID, reply.Error)
+				return
+			}
+			status = statusErr.Status
+		}
+	}
+	resolveChan := make(chan *storage.InternalResolveIntentResponse, 1)
+	tc.db.routeRPCInternal("Node.InternalResolveIntent", &storage.InternalResolveIntentRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  intentErr.Key,
+			User: storage.UserRoot,
+			TxID: intentErr.TxID,
+		},
+		Commit: status == storage.COMMITTED,
+	}, resolveChan)
+	if reply := <-resolveChan; reply.Error != nil {
+		log.Warningf("failed to resolve intent of transaction %q at %q: %v", intentErr.TxID, intentErr.Key, reply.Error)
+	}
+}
+
+// resolveIntents sends a request to resolve the intents in each key
+// span written by the transaction, committing or aborting them
+// according to commit.
+func (tc *coordinator) resolveIntents(txnMeta *txnMetadata, commit bool) {
+	for i, key := range txnMeta.keys {
+		replyChan := make(chan *storage.InternalResolveIntentResponse, 1)
+		tc.db.routeRPCInternal("Node.InternalResolveIntent", &storage.InternalResolveIntentRequest{
+			RequestHeader: storage.RequestHeader{
+				Key:    key,
+				EndKey: txnMeta.endKeys[i],
+				User:   storage.UserRoot,
+				TxID:   txnMeta.txID,
+			},
+			Commit: commit,
+		}, replyChan)
+		if reply := <-replyChan; reply.Error != nil {
+			log.Warningf("failed to resolve intents for transaction %q at %q-%q: %v",
+				txnMeta.txID, key, txnMeta.endKeys[i], reply.Error)
+		}
 	}
 }
@@ -0,0 +1,213 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+//
+// Author: Jiajia Han (hanjia18@gmail.com)
+
+package kv
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// testSender records the RPCs routed by the coordinator and replies
+// to heartbeats with a configurable transaction status.
+type testSender struct {
+	sync.Mutex
+	methods []string
+	args    []storage.Request
+	status  storage.TransactionStatus
+}
+
+func (ts *testSender) routeRPCInternal(method string, args storage.Request, replyChan interface{}) {
+	ts.Lock()
+	ts.methods = append(ts.methods, method)
+	ts.args = append(ts.args, args)
+	status := ts.status
+	ts.Unlock()
+	replyVal := reflect.New(reflect.TypeOf(replyChan).Elem().Elem())
+	if hr, ok := replyVal.Interface().(*storage.HeartbeatTransactionResponse); ok {
+		hr.Status = status
+	}
+	reflect.ValueOf(replyChan).Send(replyVal)
+}
+
+// count returns the number of RPCs sent for method.
+func (ts *testSender) count(method string) int {
+	ts.Lock()
+	defer ts.Unlock()
+	var n int
+	for _, m := range ts.methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+func createTestCoordinator(ts *testSender, clock *hlc.Clock) *coordinator {
+	tc := &coordinator{
+		db:                ts,
+		clock:             clock,
+		heartbeatInterval: 5 * time.Millisecond,
+		clientTimeout:     time.Second,
+		txns:              make(map[string]*txnMetadata),
+		wakeup:            make(chan struct{}, 1),
+		closer:            make(chan struct{}),
+	}
+	go tc.start()
+	return tc
+}
+
+func (tc *coordinator) numTxns() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return len(tc.txns)
+}
+
+// TestCoordinatorAddRequest verifies that only writes record key
+// spans and that contained spans are not recorded twice.
+func TestCoordinatorAddRequest(t *testing.T) {
+	manual := hlc.ManualClock(0)
+	tc := createTestCoordinator(&testSender{}, hlc.NewClock(manual.UnixNano))
+	defer tc.Stop()
+
+	requests := []struct {
+		method      string
+		key, endKey string
+	}{
+		{"Node.Get", "a", ""},
+		{"Node.Put", "a", ""},
+		{"Node.Put", "a", ""},
+		{"Node.DeleteRange", "b", "d"},
+		{"Node.Put", "c", ""},
+		{"Node.Scan", "x", "z"},
+	}
+	for _, r := range requests {
+		tc.addRequest(r.method, &storage.RequestHeader{
+			Key:    engine.Key(r.key),
+			EndKey: engine.Key(r.endKey),
+			TxID:   "txn",
+		})
+	}
+	tc.addRequest("Node.Put", &storage.RequestHeader{Key: engine.Key("a")})
+
+	if n := tc.numTxns(); n != 1 {
+		t.Fatalf("expected 1 transaction; got %d", n)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	txnMeta := tc.txns["txn"]
+	expKeys := []engine.Key{engine.Key("a"), engine.Key("b")}
+	expEndKeys := []engine.Key{engine.Key(""), engine.Key("d")}
+	if !reflect.DeepEqual(txnMeta.keys, expKeys) || !reflect.DeepEqual(txnMeta.endKeys, expEndKeys) {
+		t.Errorf("expected spans %q-%q; got %q-%q", expKeys, expEndKeys, txnMeta.keys, txnMeta.endKeys)
+	}
+}
+
+// TestCoordinatorHeartbeat verifies that a single goroutine heartbeats
+// all active transactions and stops once a transaction is no longer
+// pending.
+func TestCoordinatorHeartbeat(t *testing.T) {
+	ts := &testSender{}
+	manual := hlc.ManualClock(0)
+	tc := createTestCoordinator(ts, hlc.NewClock(manual.UnixNano))
+	defer tc.Stop()
+
+	tc.addRequest("Node.Put", &storage.RequestHeader{Key: engine.Key("a"), TxID: "txn1"})
+	tc.addRequest("Node.Put", &storage.RequestHeader{Key: engine.Key("b"), TxID: "txn2"})
+	if err := util.IsTrueWithin(func() bool {
+		return ts.count("Node.HeartbeatTransaction") >= 4
+	}, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once heartbeats report the transactions committed, they are removed.
+	ts.Lock()
+	ts.status = storage.COMMITTED
+	ts.Unlock()
+	if err := util.IsTrueWithin(func() bool { return tc.numTxns() == 0 }, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCoordinatorAbandonedTxn verifies that a transaction whose client
+// has been silent longer than the timeout is aborted and its intents
+// resolved.
+func TestCoordinatorAbandonedTxn(t *testing.T) {
+	ts := &testSender{}
+	manual := hlc.ManualClock(0)
+	tc := createTestCoordinator(ts, hlc.NewClock(manual.UnixNano))
+	defer tc.Stop()
+
+	tc.addRequest("Node.Put", &storage.RequestHeader{Key: engine.Key("a"), TxID: "txn"})
+	tc.addRequest("Node.DeleteRange", &storage.RequestHeader{
+		Key: engine.Key("b"), EndKey: engine.Key("c"), TxID: "txn",
+	})
+	manual = hlc.ManualClock(tc.clientTimeout.Nanoseconds() + 1)
+
+	if err := util.IsTrueWithin(func() bool {
+		return ts.count("Node.InternalResolveIntent") == 2
+	}, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if n := ts.count("Node.EndTransaction"); n != 1 {
+		t.Errorf("expected 1 abort; got %d", n)
+	}
+	if n := tc.numTxns(); n != 0 {
+		t.Errorf("expected abandoned transaction to be removed; got %d", n)
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	for i, m := range ts.methods {
+		switch args := ts.args[i].(type) {
+		case *storage.EndTransactionRequest:
+			if args.Commit || args.TxID != "txn" {
+				t.Errorf("unexpected abort request %+v", args)
+			}
+		case *storage.InternalResolveIntentRequest:
+			if args.Commit || args.TxID != "txn" {
+				t.Errorf("unexpected %s request %+v", m, args)
+			}
+		}
+	}
+}
+
+// TestCoordinatorEndTxn verifies that ending a transaction stops its
+// heartbeat and resolves its intents.
+func TestCoordinatorEndTxn(t *testing.T) {
+	ts := &testSender{}
+	manual := hlc.ManualClock(0)
+	tc := createTestCoordinator(ts, hlc.NewClock(manual.UnixNano))
+	defer tc.Stop()
+
+	tc.addRequest("Node.Put", &storage.RequestHeader{Key: engine.Key("a"), TxID: "txn"})
+	tc.endTxn("txn", true)
+	if n := tc.numTxns(); n != 0 {
+		t.Errorf("expected no transactions; got %d", n)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		return ts.count("Node.InternalResolveIntent") == 1
+	}, 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
@@ -44,11 +46,13 @@ type DB interface {
 	Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse
 	DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse
 	Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
+	Watch(args *storage.WatchRequest) <-chan *storage.WatchResponse
 	EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse
 	AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse
 	ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse
 	EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse
 	EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse
+	Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse
 }
 
 // GetI fetches the value at the specified key and deserializes it
@@ -94,6 +98,24 @@ func PutI(db DB, key engine.Key, value interface{}, timestamp hlc.Timestamp) err
 	return pr.Error
 }
 
+// ExecuteCmd synchronously invokes the DB method named by method with
+// args, copying the response into reply, which must be of the
+// response type corresponding to method. Returns the error from the
+// response header, if any.
+func ExecuteCmd(db DB, method string, args storage.Request, reply storage.Response) error {
+	m := reflect.ValueOf(db).MethodByName(method)
+	if !m.IsValid() {
+		return util.Errorf("unknown KV method %q", method)
+	}
+	replyChan := m.Call([]reflect.Value{reflect.ValueOf(args)})[0]
+	replyVal, ok := replyChan.Recv()
+	if !ok {
+		return util.Errorf("%s: reply channel closed without response", method)
+	}
+	reflect.ValueOf(reply).Elem().Set(replyVal.Elem())
+	return reply.Header().Error
+}
+
 // BootstrapRangeDescriptor sets meta1 and meta2 values for KeyMax,
 // using the provided replica.
 func BootstrapRangeDescriptor(db DB, desc storage.RangeDescriptor, timestamp hlc.Timestamp) error {
@@ -156,6 +178,16 @@ func UpdateRangeDescriptor(db DB, meta storage.RangeMetadata,
 	desc storage.RangeDescriptor, timestamp hlc.Timestamp) error {
 	// TODO(spencer): a lot more work here to actually implement this.
 
+	// Write meta1 if the range holds "meta2" records.
+	if bytes.Compare(meta.StartKey, engine.KeyMetaMax) < 0 {
+		key := engine.MakeKey(engine.KeyMeta1Prefix, meta.EndKey)
+		if bytes.HasPrefix(meta.EndKey, engine.KeyMeta2Prefix) {
+			key = engine.RangeMetaKey(meta.EndKey)
+		}
+		if err := PutI(db, key, desc, timestamp); err != nil {
+			return err
+		}
+	}
 	// Write meta2.
 	key := engine.MakeKey(engine.KeyMeta2Prefix, meta.EndKey)
 	if err := PutI(db, key, desc, timestamp); err != nil {
@@ -188,6 +220,11 @@ const (
 	retryBackoff           = 1 * time.Second
 	maxRetryBackoff        = 30 * time.Second
 
+	// distWatchWait is the maximum time a range waits for events to
+	// watch before replying. It's shorter than defaultSendNextTimeout,
+	// so that waiting watches aren't sent on to other replicas.
+	distWatchWait = 500 * time.Millisecond
+
 	// Maximum number of ranges to return from an internal range lookup.
 	// TODO(mrtracy): This value should be configurable.
 	rangeLookupMaxRanges = 8
@@ -223,14 +260,22 @@ func NewDB(gossip *gossip.Gossip) *DistDB {
 	return db
 }
 
-// verifyPermissions verifies that the requesting user (header.User)
-// has permission to read/write (capabilities depend on method
-// name). In the event that multiple permission configs apply to the
-// key range implicated by the command, the lowest common denominator
-// for permission. For example, if a scan crosses two permission
-// configs, both configs must allow read permissions or the entire
-// scan will fail.
-func (db *DistDB) verifyPermissions(method string, header *storage.RequestHeader) error {
+// Close stops the transaction coordinator.
+func (db *DistDB) Close() {
+	db.coordinator.Stop()
+}
+
+// VerifyPermissions verifies that the requesting user (header.User)
+// has permission to read/write (capabilities depend on method name,
+// which may be qualified by the "Node." RPC service name). In the
+// event that multiple permission configs apply to the key range
+// implicated by the command, the lowest common denominator for
+// permission. For example, if a scan crosses two permission configs,
+// both configs must allow read permissions or the entire scan will
+// fail. The requests of a batch are verified individually, on behalf
+// of the batch's user.
+func (db *DistDB) VerifyPermissions(method string, args storage.Request) error {
+	method = strings.TrimPrefix(method, "Node.")
 	// Get permissions map from gossip.
 	permMap, err := db.gossip.GetInfo(gossip.KeyConfigPermission)
 	if err != nil {
@@ -239,22 +284,42 @@ func (db *DistDB) verifyPermissions(method string, header *storage.RequestHeader
 	if permMap == nil {
 		return util.Errorf("perm configs not available; cannot execute %s", method)
 	}
+	header := args.Header()
+	batch, ok := args.(*storage.BatchRequest)
+	if !ok {
+		return verifyPermissions(permMap.(storage.PrefixConfigMap), method, header, header.User)
+	}
+	for _, req := range batch.Requests {
+		reqMethod, err := storage.MethodForRequest(req)
+		if err != nil {
+			return err
+		}
+		if err := verifyPermissions(permMap.(storage.PrefixConfigMap), reqMethod, req.Header(), header.User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyPermissions verifies that user may invoke method over the key
+// range of header, according to permMap.
+func verifyPermissions(permMap storage.PrefixConfigMap, method string, header *storage.RequestHeader, user string) error {
 	// Visit PermConfig(s) which apply to the method's key range.
 	//   - For each, verify each PermConfig allows reads or writes as method requires.
 	end := header.EndKey
 	if end == nil {
 		end = header.Key
 	}
-	return permMap.(storage.PrefixConfigMap).VisitPrefixes(
+	return permMap.VisitPrefixes(
 		header.Key, end, func(start, end engine.Key, config interface{}) error {
 			perm := config.(*storage.PermConfig)
-			if storage.NeedReadPerm(method) && !perm.CanRead(header.User) {
+			if storage.NeedReadPerm(method) && !perm.CanRead(user) {
 				return util.Errorf("user %q cannot read range %q-%q; permissions: %+v",
-					header.User, string(start), string(end), perm)
+					user, string(start), string(end), perm)
 			}
-			if storage.NeedWritePerm(method) && !perm.CanWrite(header.User) {
-				return util.Errorf("user %q cannot read range %q-%q; permissions: %+v",
-					header.User, string(start), string(end), perm)
+			if storage.NeedWritePerm(method) && !perm.CanWrite(user) {
+				return util.Errorf("user %q cannot write range %q-%q; permissions: %+v",
+					user, string(start), string(end), perm)
 			}
 			return nil
 		})
@@ -397,19 +462,39 @@ func sendErrorReply(err error, replyChan interface{}) {
 // response value on the replyChan channel when the call is
 // complete.
 func (db *DistDB) routeRPC(method string, args storage.Request, replyChan interface{}) {
-	if isTransactional(method) {
-		db.coordinator.addRequest(args.Header())
+	// Verify permissions before registering the request with the
+	// coordinator so that a rejected request doesn't start a
+	// transaction.
+	if err := db.VerifyPermissions(method, args); err != nil {
+		sendErrorReply(err, replyChan)
+		return
 	}
-	db.routeRPCInternal(method, args, replyChan)
+	// The coordinator may read the transaction table to verify that
+	// the request's transaction is pending.
+	go func() {
+		if err := db.coordinator.trackRequest(method, args); err != nil {
+			sendErrorReply(err, replyChan)
+			return
+		}
+		db.sendRoutedRPC(method, args, replyChan)
+	}()
 }
 
+// routeRPCInternal verifies permissions and routes the RPC without
+// registering it with the transaction coordinator. It's used by the
+// coordinator itself to send heartbeats, aborts and resolutions.
 func (db *DistDB) routeRPCInternal(method string, args storage.Request, replyChan interface{}) {
-	// Verify permissions.
-	if err := db.verifyPermissions(method, args.Header()); err != nil {
+	if err := db.VerifyPermissions(method, args); err != nil {
 		sendErrorReply(err, replyChan)
 		return
 	}
+	db.sendRoutedRPC(method, args, replyChan)
+}
 
+// sendRoutedRPC looks up the range holding the request's key and
+// sends the RPC to its replicas, retrying on stale range metadata.
+// Permissions must already have been verified.
+func (db *DistDB) sendRoutedRPC(method string, args storage.Request, replyChan interface{}) {
 	// Retry logic for lookup of range by key and RPCs to range replicas.
 	go func() {
 		retryOpts := util.RetryOptions{
@@ -419,14 +504,43 @@ func (db *DistDB) routeRPCInternal(method string, args storage.Request, replyCha
 			Constant:    2,
 			MaxAttempts: 0, // retry indefinitely
 		}
+		header := args.Header()
+		innerChan := reflect.MakeChan(reflect.TypeOf(replyChan), 1)
 		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
-			rangeMeta, err := db.rangeCache.LookupRangeMetadata(args.Header().Key)
+			rangeMeta, err := db.rangeCache.LookupRangeMetadata(header.Key)
+			if err == nil && len(header.EndKey) > 0 && !header.EndKey.Less(header.Key) &&
+				!rangeMeta.ContainsKeyRange(header.Key, header.EndKey) {
+				// The request's key span crosses range boundaries and
+				// must be split by the caller; retrying can't help.
+				return true, storage.NewRangeKeyMismatchError(header.Key, header.EndKey,
+					storage.RangeMetadata{RangeDescriptor: *rangeMeta})
+			}
 			if err == nil {
-				err = db.sendRPC(rangeMeta.Replicas, method, args, replyChan)
+				err = db.sendRPC(rangeMeta.Replicas, method, args, innerChan.Interface())
+			}
+			if err == nil {
+				// A range key mismatch means the range has split or
+				// merged since its metadata was cached; evict and retry.
+				// All other replies are passed through to the caller.
+				reply, _ := innerChan.Recv()
+				replyErr := reply.Interface().(storage.Response).Header().Error
+				if mismatchErr, ok := replyErr.(*storage.RangeKeyMismatchError); ok {
+					err = mismatchErr
+				} else if intentErr, ok := replyErr.(*storage.WriteIntentError); ok {
+					// The request is blocked by another transaction's
+					// write intent. Resolve it if that transaction has
+					// ended or was abandoned, and retry.
+					log.Infof("%s blocked: %v", method, intentErr)
+					db.coordinator.resolveWriteIntent(intentErr)
+					return false, nil
+				} else {
+					reflect.ValueOf(replyChan).Send(reply)
+					return true, nil
+				}
 			}
 			if err != nil {
 				// Range metadata might be out of date - evict it.
-				db.rangeCache.EvictCachedRangeMetadata(args.Header().Key)
+				db.rangeCache.EvictCachedRangeMetadata(header.Key)
 
 				// If retryable, allow outer loop to retry.
 				if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
@@ -484,27 +598,215 @@ func (db *DistDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResp
 	return replyChan
 }
 
-// DeleteRange .
+// DeleteRange deletes the keys from args.Key to args.EndKey, up to
+// args.MaxEntriesToDelete if non-zero. The request is split at range
+// boundaries and sent to each range in turn; see walkSpan().
 func (db *DistDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
-	// TODO(spencer): range of keys.
 	replyChan := make(chan *storage.DeleteRangeResponse, 1)
-	db.routeRPC("Node.DeleteRange", args, replyChan)
+	go func() {
+		reply := &storage.DeleteRangeResponse{}
+		reply.Error = db.walkSpan(&args.RequestHeader, args.MaxEntriesToDelete,
+			func(key, endKey engine.Key, max int64) (int64, error) {
+				rangeArgs := *args
+				rangeArgs.Key, rangeArgs.EndKey, rangeArgs.MaxEntriesToDelete = key, endKey, max
+				rangeReplyChan := make(chan *storage.DeleteRangeResponse, 1)
+				db.routeRPC("Node.DeleteRange", &rangeArgs, rangeReplyChan)
+				rangeReply := <-rangeReplyChan
+				if rangeReply.Error != nil {
+					return 0, rangeReply.Error
+				}
+				if reply.Timestamp.Less(rangeReply.Timestamp) {
+					reply.Timestamp = rangeReply.Timestamp
+				}
+				reply.NumDeleted += rangeReply.NumDeleted
+				return rangeReply.NumDeleted, nil
+			})
+		replyChan <- reply
+	}()
 	return replyChan
 }
 
-// Scan .
+// Scan returns the key/value pairs from args.Key to args.EndKey in
+// key order, up to args.MaxResults if non-zero. The request is split
+// at range boundaries and sent to each range in turn; see walkSpan().
 func (db *DistDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
-	// TODO(spencer): range of keys.
 	replyChan := make(chan *storage.ScanResponse, 1)
-	db.routeRPC("Node.Scan", args, replyChan)
+	go func() {
+		reply := &storage.ScanResponse{}
+		reply.Error = db.walkSpan(&args.RequestHeader, args.MaxResults,
+			func(key, endKey engine.Key, max int64) (int64, error) {
+				rangeArgs := *args
+				rangeArgs.Key, rangeArgs.EndKey, rangeArgs.MaxResults = key, endKey, max
+				rangeReplyChan := make(chan *storage.ScanResponse, 1)
+				db.routeRPC("Node.Scan", &rangeArgs, rangeReplyChan)
+				rangeReply := <-rangeReplyChan
+				if rangeReply.Error != nil {
+					return 0, rangeReply.Error
+				}
+				if reply.Timestamp.Less(rangeReply.Timestamp) {
+					reply.Timestamp = rangeReply.Timestamp
+				}
+				reply.Rows = append(reply.Rows, rangeReply.Rows...)
+				return int64(len(rangeReply.Rows)), nil
+			})
+		if reply.Error != nil {
+			reply.Rows = nil
+		}
+		replyChan <- reply
+	}()
 	return replyChan
 }
 
-// EndTransaction .
+// Watch returns the writes committed to the keys from args.Key to
+// args.EndKey after args.StartTimestamp, in timestamp order, and the
+// timestamp up to which they're resolved (see storage.WatchResponse).
+// The request is split at range boundaries and sent to each range in
+// turn. The reply's resolved timestamp is the least of the ranges',
+// and events after it are left to the next watch. If no events are
+// found, the ranges are watched anew until args.Wait has elapsed;
+// each range waits at most distWatchWait before replying.
+//
+// TODO(spencer): ranges are watched one at a time, so a write to a
+// range which was already watched may go unnoticed until the other
+// ranges have waited in turn.
+func (db *DistDB) Watch(args *storage.WatchRequest) <-chan *storage.WatchResponse {
+	replyChan := make(chan *storage.WatchResponse, 1)
+	go func() {
+		deadline := time.Now().Add(args.Wait)
+		watchArgs := *args
+		for {
+			reply := db.watchSpan(&watchArgs, deadline)
+			if reply.Error != nil || len(reply.Events) > 0 || !time.Now().Before(deadline) {
+				replyChan <- reply
+				return
+			}
+			// No events were committed up to the resolved timestamp, so
+			// the next watch may start from it.
+			watchArgs.StartTimestamp = reply.ResolvedTimestamp
+		}
+	}()
+	return replyChan
+}
+
+// watchSpan sends the watch to each range of its key span, waiting
+// until deadline, but at most distWatchWait, in each range until
+// events are found.
+func (db *DistDB) watchSpan(args *storage.WatchRequest, deadline time.Time) *storage.WatchResponse {
+	reply := &storage.WatchResponse{}
+	var events []storage.WatchEvent
+	first := true
+	reply.Error = db.walkSpan(&args.RequestHeader, 0,
+		func(key, endKey engine.Key, _ int64) (int64, error) {
+			rangeArgs := *args
+			rangeArgs.Key, rangeArgs.EndKey, rangeArgs.Wait = key, endKey, 0
+			if len(events) == 0 {
+				if rangeArgs.Wait = deadline.Sub(time.Now()); rangeArgs.Wait > distWatchWait {
+					rangeArgs.Wait = distWatchWait
+				}
+			}
+			rangeReplyChan := make(chan *storage.WatchResponse, 1)
+			db.routeRPC("Node.Watch", &rangeArgs, rangeReplyChan)
+			rangeReply := <-rangeReplyChan
+			if rangeReply.Error != nil {
+				return 0, rangeReply.Error
+			}
+			if reply.Timestamp.Less(rangeReply.Timestamp) {
+				reply.Timestamp = rangeReply.Timestamp
+			}
+			if first || rangeReply.ResolvedTimestamp.Less(reply.ResolvedTimestamp) {
+				reply.ResolvedTimestamp = rangeReply.ResolvedTimestamp
+				first = false
+			}
+			events = append(events, rangeReply.Events...)
+			return int64(len(rangeReply.Events)), nil
+		})
+	if reply.Error != nil {
+		return reply
+	}
+	for _, e := range events {
+		if !reply.ResolvedTimestamp.Less(e.Value.Timestamp) {
+			reply.Events = append(reply.Events, e)
+		}
+	}
+	sort.Stable(storage.WatchEventSlice(reply.Events))
+	return reply
+}
+
+// walkSpan splits the key span of header at range boundaries and
+// invokes send for each range's portion of the span in key order,
+// with the maximum number of results remaining. send returns the
+// number of results produced by its portion. If max is non-zero, the
+// walk stops once max results have been produced. If a portion is
+// rejected with a RangeKeyMismatchError, the range has split or
+// merged since its metadata was cached; the cached metadata is
+// evicted and the remainder of the span is split anew.
+func (db *DistDB) walkSpan(header *storage.RequestHeader, max int64,
+	send func(key, endKey engine.Key, max int64) (int64, error)) error {
+	if len(header.EndKey) == 0 {
+		_, err := send(header.Key, header.EndKey, max)
+		return err
+	}
+	retryOpts := util.RetryOptions{
+		Backoff:     retryBackoff,
+		MaxBackoff:  maxRetryBackoff,
+		Constant:    2,
+		MaxAttempts: 0, // retry indefinitely
+	}
+	for key := header.Key; key.Less(header.EndKey); {
+		retryOpts.Tag = fmt.Sprintf("sending %q-%q", key, header.EndKey)
+		var endKey engine.Key
+		var count int64
+		err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
+			desc, err := db.rangeCache.LookupRangeMetadata(key)
+			if err != nil {
+				if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+					log.Warningf("failed to look up range for %q: %v", key, err)
+					return false, nil
+				}
+				return true, err
+			}
+			endKey = header.EndKey
+			if desc.EndKey.Less(endKey) {
+				endKey = desc.EndKey
+			}
+			if count, err = send(key, endKey, max); err != nil {
+				if _, ok := err.(*storage.RangeKeyMismatchError); ok {
+					log.Warningf("range for %q-%q is stale: %v", key, endKey, err)
+					db.rangeCache.EvictCachedRangeMetadata(key)
+					return false, nil
+				}
+			}
+			return true, err
+		})
+		if err != nil {
+			return err
+		}
+		if max > 0 {
+			if max -= count; max <= 0 {
+				break
+			}
+		}
+		key = endKey
+	}
+	return nil
+}
+
+// EndTransaction commits or aborts the transaction specified by
+// args.TxID. On success, the coordinator stops heartbeating the
+// transaction and resolves its intents before replying, so that a
+// committed transaction's writes are visible once it replies.
 func (db *DistDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
 	// TODO(spencer): multiple keys here...
+	innerChan := make(chan *storage.EndTransactionResponse, 1)
+	db.routeRPC("Node.EndTransaction", args, innerChan)
 	replyChan := make(chan *storage.EndTransactionResponse, 1)
-	db.routeRPC("Node.EndTransaction", args, replyChan)
+	go func() {
+		reply := <-innerChan
+		if reply.Error == nil && len(args.TxID) != 0 {
+			db.coordinator.endTxn(args.TxID, args.Commit)
+		}
+		replyChan <- reply
+	}()
 	return replyChan
 }
 
@@ -542,3 +844,165 @@ func (db *DistDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *st
 	db.routeRPC("Node.EnqueueMessage", args, replyChan)
 	return replyChan
 }
+
+// Batch executes the requests of a batch, splitting it into one batch
+// per implicated range. The per-range batches are sent in parallel and
+// their responses reassembled in the order of the original requests.
+// If any request fails, the batch reply carries the error of the
+// first failed request in the original order. Each per-range batch is
+// applied atomically, but a batch spanning ranges may be applied in
+// part; use a transaction for atomicity across ranges.
+func (db *DistDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+	go func() {
+		replyChan <- db.batch(args, func(rbArgs *storage.BatchRequest) *storage.BatchResponse {
+			rbReplyChan := make(chan *storage.BatchResponse, 1)
+			db.routeRPC("Node.Batch", rbArgs, rbReplyChan)
+			return <-rbReplyChan
+		})
+	}()
+	return replyChan
+}
+
+// A rangeBatch holds the requests of a batch addressed to one range.
+type rangeBatch struct {
+	args    *storage.BatchRequest
+	indexes []int // Indexes of the batch's requests in the original batch
+}
+
+// batch synchronously executes the batch args, invoking send to
+// execute each per-range batch. If a per-range batch is rejected with
+// a RangeKeyMismatchError, the range has split or merged since its
+// metadata was cached; the cached metadata is evicted and the
+// batch's requests are grouped by range anew and resent. See Batch().
+func (db *DistDB) batch(args *storage.BatchRequest, send func(*storage.BatchRequest) *storage.BatchResponse) *storage.BatchResponse {
+	reply := &storage.BatchResponse{Responses: make([]storage.Response, len(args.Requests))}
+	methods := make([]string, len(args.Requests))
+	pending := make([]int, len(args.Requests))
+	for i, req := range args.Requests {
+		method, err := storage.MethodForRequest(req)
+		if err != nil {
+			reply.Error = err
+			return reply
+		}
+		methods[i] = method
+		pending[i] = i
+	}
+
+	retryOpts := util.RetryOptions{
+		Tag:         "sending batch",
+		Backoff:     retryBackoff,
+		MaxBackoff:  maxRetryBackoff,
+		Constant:    2,
+		MaxAttempts: 0, // retry indefinitely
+	}
+	var sent int // Number of range batches sent so far
+	err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
+		batches, err := db.groupByRange(args, pending, sent)
+		if err != nil {
+			return true, err
+		}
+		sent += len(batches)
+		pending = db.sendRangeBatches(args, batches, methods, send, reply)
+		return len(pending) == 0, nil
+	})
+	if err != nil {
+		reply.Error = err
+		return reply
+	}
+	for _, subReply := range reply.Responses {
+		if err := subReply.Header().Error; err != nil {
+			reply.Error = err
+			break
+		}
+	}
+	return reply
+}
+
+// groupByRange groups the requests of args at the indexes pending by
+// the range containing their keys, according to the range metadata
+// cache, preserving the order of requests within each range. sent is
+// the number of range batches already sent for args, from which the
+// command IDs of the new range batches are derived.
+func (db *DistDB) groupByRange(args *storage.BatchRequest, pending []int, sent int) ([]*rangeBatch, error) {
+	var batches []*rangeBatch
+	byRange := map[string]*rangeBatch{} // Keyed by range start key
+	for _, i := range pending {
+		desc, err := db.rangeCache.LookupRangeMetadata(args.Requests[i].Header().Key)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := byRange[string(desc.StartKey)]
+		if !ok {
+			rb = &rangeBatch{
+				args: &storage.BatchRequest{
+					RequestHeader: storage.RequestHeader{
+						Timestamp: args.Timestamp,
+						User:      args.User,
+						TxID:      args.TxID,
+					},
+				},
+			}
+			if n := sent + len(batches); n == 0 {
+				// Only the first range batch inherits the client
+				// command ID; the others are derived from it so
+				// that retries of each are idempotent.
+				rb.args.CmdID = args.CmdID
+			} else if !args.CmdID.IsEmpty() {
+				rb.args.CmdID = storage.ClientCmdID{
+					WallTime: args.CmdID.WallTime,
+					Random:   args.CmdID.Random + int64(n),
+				}
+			}
+			byRange[string(desc.StartKey)] = rb
+			batches = append(batches, rb)
+		}
+		rb.args.Add(args.Requests[i])
+		rb.indexes = append(rb.indexes, i)
+	}
+	return batches, nil
+}
+
+// sendRangeBatches sends the range batches in parallel and sets the
+// responses to their requests in reply, in the order of the original
+// requests of args. The indexes of requests whose range batch was
+// rejected with a RangeKeyMismatchError are returned, in order, and
+// the stale range metadata is evicted.
+func (db *DistDB) sendRangeBatches(args *storage.BatchRequest, batches []*rangeBatch, methods []string,
+	send func(*storage.BatchRequest) *storage.BatchResponse, reply *storage.BatchResponse) []int {
+	replies := make([]chan *storage.BatchResponse, len(batches))
+	for i, rb := range batches {
+		replies[i] = make(chan *storage.BatchResponse, 1)
+		go func(rbArgs *storage.BatchRequest, replyChan chan<- *storage.BatchResponse) {
+			replyChan <- send(rbArgs)
+		}(rb.args, replies[i])
+	}
+
+	var mismatched []int
+	for i, rb := range batches {
+		rbReply := <-replies[i]
+		if _, ok := rbReply.Error.(*storage.RangeKeyMismatchError); ok {
+			log.Warningf("range for %q-%q is stale: %v", rb.args.Key, rb.args.EndKey, rbReply.Error)
+			db.rangeCache.EvictCachedRangeMetadata(rb.args.Key)
+			mismatched = append(mismatched, rb.indexes...)
+			continue
+		}
+		if reply.Timestamp.Less(rbReply.Timestamp) {
+			reply.Timestamp = rbReply.Timestamp
+		}
+		for j, idx := range rb.indexes {
+			var subReply storage.Response
+			if j < len(rbReply.Responses) && rbReply.Responses[j] != nil {
+				subReply = rbReply.Responses[j]
+			} else {
+				// The request wasn't executed; report the range
+				// batch's error in its response.
+				subReply, _ = storage.NewResponse(methods[idx])
+				subReply.Header().Error = rbReply.Error
+			}
+			reply.Responses[idx] = subReply
+		}
+	}
+	sort.Ints(mismatched)
+	return mismatched
+}
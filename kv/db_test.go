@@ -0,0 +1,229 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// newTestSpanDB returns a DistDB whose range metadata is looked up
+// from a test metadata DB split at the specified keys.
+func newTestSpanDB(t *testing.T, splits ...string) (*DistDB, *testMetadataDB) {
+	mdb := newTestMetadataDB()
+	for _, split := range splits {
+		mdb.splitRange(t, engine.Key(split))
+	}
+	db := &DistDB{rangeCache: NewRangeMetadataCache(mdb)}
+	mdb.cache = db.rangeCache
+	return db, mdb
+}
+
+// TestWalkSpan verifies that a key span is split at range boundaries
+// and walked in key order, stopping once the maximum number of
+// results has been produced.
+func TestWalkSpan(t *testing.T) {
+	db, _ := newTestSpanDB(t, "c", "f")
+	testCases := []struct {
+		max      int64
+		expSends []string
+	}{
+		{0, []string{`"a"-"c" 0`, `"c"-"f" 0`, `"f"-"z" 0`}},
+		{3, []string{`"a"-"c" 3`, `"c"-"f" 1`}},
+		{4, []string{`"a"-"c" 4`, `"c"-"f" 2`}},
+	}
+	for i, test := range testCases {
+		var sends []string
+		header := &storage.RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("z")}
+		err := db.walkSpan(header, test.max, func(key, endKey engine.Key, max int64) (int64, error) {
+			sends = append(sends, fmt.Sprintf("%q-%q %d", key, endKey, max))
+			return 2, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sends, test.expSends) {
+			t.Errorf("%d: expected sends %v; got %v", i, test.expSends, sends)
+		}
+	}
+}
+
+// TestWalkSpanRangeKeyMismatch verifies that a portion of a span
+// rejected with a RangeKeyMismatchError causes the stale range
+// metadata to be evicted and the remainder of the span to be split
+// anew.
+func TestWalkSpanRangeKeyMismatch(t *testing.T) {
+	db, mdb := newTestSpanDB(t, "c")
+	// Cache the metadata of both ranges before splitting again.
+	for _, key := range []string{"a", "c"} {
+		if _, err := db.rangeCache.LookupRangeMetadata(engine.Key(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mdb.splitRange(t, engine.Key("d"))
+
+	var sends []string
+	header := &storage.RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("z")}
+	err := db.walkSpan(header, 0, func(key, endKey engine.Key, max int64) (int64, error) {
+		sends = append(sends, fmt.Sprintf("%q-%q", key, endKey))
+		if string(key) == "c" && string(endKey) == "z" {
+			return 0, storage.NewRangeKeyMismatchError(key, endKey, storage.RangeMetadata{})
+		}
+		return 0, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expSends := []string{`"a"-"c"`, `"c"-"z"`, `"c"-"d"`, `"d"-"z"`}
+	if !reflect.DeepEqual(sends, expSends) {
+		t.Errorf("expected sends %v; got %v", expSends, sends)
+	}
+}
+
+// TestBatchRangeKeyMismatch verifies that a batch is split into one
+// batch per range and that a range batch rejected with a
+// RangeKeyMismatchError, because the range has split since its
+// metadata was cached, is split anew and resent.
+func TestBatchRangeKeyMismatch(t *testing.T) {
+	db, mdb := newTestSpanDB(t, "c")
+	// Cache the metadata of both ranges before splitting again.
+	for _, key := range []string{"a", "c"} {
+		if _, err := db.rangeCache.LookupRangeMetadata(engine.Key(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mdb.splitRange(t, engine.Key("d"))
+
+	args := &storage.BatchRequest{}
+	for _, key := range []string{"e", "a", "c"} {
+		args.Add(&storage.PutRequest{RequestHeader: storage.RequestHeader{Key: engine.Key(key)}})
+	}
+	var mu sync.Mutex
+	var sends []string
+	reply := db.batch(args, func(rbArgs *storage.BatchRequest) *storage.BatchResponse {
+		mu.Lock()
+		sends = append(sends, fmt.Sprintf("%q-%q", rbArgs.Key, rbArgs.EndKey))
+		mu.Unlock()
+		rbReply := &storage.BatchResponse{}
+		if rbArgs.Key.Less(engine.Key("d")) && engine.Key("d").Less(rbArgs.EndKey) {
+			rbReply.Error = storage.NewRangeKeyMismatchError(rbArgs.Key, rbArgs.EndKey, storage.RangeMetadata{})
+			return rbReply
+		}
+		for _, req := range rbArgs.Requests {
+			rbReply.Responses = append(rbReply.Responses, &storage.PutResponse{
+				ResponseHeader: storage.ResponseHeader{Error: fmt.Errorf("%s", req.Header().Key)},
+			})
+		}
+		return rbReply
+	})
+	sort.Strings(sends)
+	expSends := []string{`"a"-"a\x00"`, `"c"-"c\x00"`, `"c"-"e\x00"`, `"e"-"e\x00"`}
+	if !reflect.DeepEqual(sends, expSends) {
+		t.Errorf("expected sends %v; got %v", expSends, sends)
+	}
+	// Each response, identified by the key in its error, is returned
+	// in the order of the original requests.
+	for i, key := range []string{"e", "a", "c"} {
+		if err := reply.Responses[i].Header().Error; err == nil || err.Error() != key {
+			t.Errorf("%d: expected response for %q; got %v", i, key, err)
+		}
+	}
+}
+
+// gossipTestPermConfigs sets up db's gossip instance with the
+// specified permission configs.
+func gossipTestPermConfigs(t *testing.T, db *DistDB, configs ...*storage.PrefixConfig) {
+	db.gossip = gossip.New(rpc.LoadInsecureTLSConfig())
+	configMap, err := storage.NewPrefixConfigMap(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.gossip.AddInfo(gossip.KeyConfigPermission, configMap, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVerifyPermissionsBatch verifies that the permissions of a batch
+// are verified for each of its requests, rather than requiring read
+// and write permission over the batch's whole key span.
+func TestVerifyPermissionsBatch(t *testing.T) {
+	db, _ := newTestSpanDB(t)
+	readOnly := &storage.PermConfig{Read: []string{"foo"}, Write: []string{storage.UserRoot}}
+	readWrite := &storage.PermConfig{Read: []string{"foo"}, Write: []string{"foo"}}
+	gossipTestPermConfigs(t, db,
+		&storage.PrefixConfig{Prefix: engine.KeyMin, Config: readOnly},
+		&storage.PrefixConfig{Prefix: engine.Key("a"), Config: readWrite})
+
+	testCases := []struct {
+		reqs   []storage.Request
+		expErr bool
+	}{
+		{[]storage.Request{
+			&storage.PutRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a1")}},
+			&storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("b")}},
+		}, false},
+		{[]storage.Request{
+			&storage.PutRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a1")}},
+			&storage.PutRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("b")}},
+		}, true},
+	}
+	for i, test := range testCases {
+		args := &storage.BatchRequest{RequestHeader: storage.RequestHeader{User: "foo"}}
+		for _, req := range test.reqs {
+			args.Add(req)
+		}
+		if err := db.VerifyPermissions("Node.Batch", args); (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+	}
+}
+
+// TestRouteRPCRejectedNotTracked verifies that a transactional request
+// which fails the permission check is not registered with the
+// transaction coordinator.
+func TestRouteRPCRejectedNotTracked(t *testing.T) {
+	db, _ := newTestSpanDB(t)
+	readOnly := &storage.PermConfig{Read: []string{"foo"}, Write: []string{storage.UserRoot}}
+	gossipTestPermConfigs(t, db, &storage.PrefixConfig{Prefix: engine.KeyMin, Config: readOnly})
+	manual := hlc.ManualClock(0)
+	db.coordinator = createTestCoordinator(&testSender{}, hlc.NewClock(manual.UnixNano))
+	defer db.coordinator.Stop()
+
+	header := storage.RequestHeader{Key: engine.Key("a"), User: "foo", TxID: "txn1"}
+	putReply := <-db.Put(&storage.PutRequest{RequestHeader: header})
+	if putReply.Error == nil {
+		t.Error("expected put by user without write permission to fail")
+	}
+	batchArgs := &storage.BatchRequest{RequestHeader: header}
+	batchArgs.Add(&storage.PutRequest{RequestHeader: header})
+	batchReply := <-db.Batch(batchArgs)
+	if batchReply.Error == nil {
+		t.Error("expected batch put by user without write permission to fail")
+	}
+	if n := db.coordinator.numTxns(); n != 0 {
+		t.Errorf("expected no tracked transactions; got %d", n)
+	}
+}
@@ -0,0 +1,787 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// The endpoints and headers of the RESTful API served by package
+// kv/rest, which imports this package.
+const (
+	restEntryPrefix     = "/kv/entry/"
+	restRangePrefix     = "/kv/range/"
+	restCounterPrefix   = "/kv/counter/"
+	restWatchPrefix     = "/kv/watch/"
+	restTxnPrefix       = "/kv/txn/"
+	restTxnHeader       = "X-Cockroach-Txn"
+	restValueTypeHeader = "X-Cockroach-Value-Type"
+	restRetryableHeader = "X-Cockroach-Retryable"
+	jsonContentType     = "application/json"
+	// maxWatchWait bounds the wait of a watch sent via the REST API.
+	maxWatchWait = 10 * time.Second
+)
+
+const (
+	// defaultHTTPDBMaxAttempts is the default maximum number of
+	// attempts to send a request via an HTTPDB.
+	defaultHTTPDBMaxAttempts = 10
+)
+
+// An httpDBError is an error replied by a node's REST API. The
+// message and whether the request may be retried are preserved.
+type httpDBError struct {
+	Message   string
+	Retryable bool
+}
+
+// Error implements the error interface.
+func (e *httpDBError) Error() string { return e.Message }
+
+// CanRetry implements the Retryable interface.
+func (e *httpDBError) CanRetry() bool { return e.Retryable }
+
+// A restEntry is the JSON representation of a key/value pair served
+// by the REST API.
+type restEntry struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	Type      string `json:"type"`
+	Checksum  uint32 `json:"checksum"`
+	Timestamp string `json:"timestamp"`
+	Deleted   bool   `json:"deleted"` // Set only for watch events
+}
+
+// value returns the entry's value.
+func (e *restEntry) value() (engine.Value, error) {
+	tag, err := parseValueTag(e.Type)
+	if err != nil {
+		return engine.Value{}, err
+	}
+	ts, err := parseTimestamp(e.Timestamp)
+	if err != nil {
+		return engine.Value{}, err
+	}
+	value := engine.Value{Bytes: e.Value, Tag: tag, Checksum: e.Checksum, Timestamp: ts}
+	if value.Bytes == nil {
+		// A JSON null and an empty value are indistinguishable; the
+		// entry exists, so its value isn't nil.
+		value.Bytes = []byte{}
+	}
+	return value, nil
+}
+
+// parseValueTag returns the value tag named s.
+func parseValueTag(s string) (engine.ValueTag, error) {
+	for _, tag := range []engine.ValueTag{engine.TagBytes, engine.TagInteger} {
+		if s == tag.String() {
+			return tag, nil
+		}
+	}
+	return 0, util.Errorf("unknown value type %q", s)
+}
+
+// formatTimestamp formats a timestamp as the REST API does: its wall
+// time and logical component, separated by a period.
+func formatTimestamp(ts hlc.Timestamp) string {
+	return fmt.Sprintf("%d.%d", ts.WallTime, ts.Logical)
+}
+
+// parseTimestamp parses a timestamp formatted by formatTimestamp.
+func parseTimestamp(s string) (hlc.Timestamp, error) {
+	var ts hlc.Timestamp
+	parts := strings.SplitN(s, ".", 2)
+	var err error
+	if ts.WallTime, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return hlc.Timestamp{}, util.Errorf("invalid timestamp %q", s)
+	}
+	if len(parts) == 2 {
+		if ts.Logical, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return hlc.Timestamp{}, util.Errorf("invalid timestamp %q", s)
+		}
+	}
+	return ts, nil
+}
+
+// An HTTPDB provides methods to access a key value store via the
+// RESTful HTTP API of package kv/rest served by each node. Requests
+// are sent to one node at a time from a list of node addresses,
+// failing over to the next address if a node is unreachable or
+// unavailable. Requests which fail with a retryable error are retried
+// according to RetryOpts.
+//
+// The REST API exposes the methods which clients use to read and
+// write keys: Contains, Get, Put, ConditionalPut, Increment, Delete,
+// DeleteRange, Scan, Watch and EndTransaction. Requests carrying a
+// transaction ID are sent within that transaction. The remaining
+// methods of the DB interface, which are used by nodes of the
+// cluster, aren't exposed and fail.
+type HTTPDB struct {
+	// RetryOpts specifies the backoff and the maximum number of
+	// attempts for requests which fail with a retryable error or
+	// which can't reach any node. Once attempts are exhausted, the
+	// error of the last attempt is returned. Increments are only
+	// retried if the node replied, as an increment which a node
+	// received without replying may have been applied.
+	RetryOpts util.RetryOptions
+	// User and Password, if User is non-empty, authenticate requests
+	// via HTTP basic authentication. Requests sent via HTTPS may
+	// instead be authenticated by the client certificate of the TLS
+	// config. Requests are executed on behalf of the authenticated
+	// user, regardless of the user in their headers.
+	User, Password string
+
+	client *http.Client
+	scheme string
+	addrs  []string // host:port addresses of nodes
+
+	mu   sync.Mutex // Protects next
+	next int        // Index in addrs of the next node to try
+}
+
+// NewHTTPDB returns a DB which sends requests to the nodes at the
+// specified host:port addresses. If tlsConfig is not nil, requests
+// are sent via HTTPS.
+func NewHTTPDB(addrs []string, tlsConfig *tls.Config) *HTTPDB {
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	return &HTTPDB{
+		RetryOpts: util.RetryOptions{
+			Backoff:     retryBackoff,
+			MaxBackoff:  maxRetryBackoff,
+			Constant:    2,
+			MaxAttempts: defaultHTTPDBMaxAttempts,
+		},
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   defaultRPCTimeout,
+		},
+		scheme: scheme,
+		addrs:  addrs,
+	}
+}
+
+// A restRequest is an HTTP request to the REST API, without the
+// scheme and address of the node it's sent to.
+type restRequest struct {
+	method  string
+	path    string
+	query   url.Values
+	body    []byte
+	header  http.Header
+	idempot bool // True if the request may be resent after a node fails to reply
+}
+
+// newRESTRequest returns a request for the path of the REST API,
+// within the transaction txID if it's not empty.
+func newRESTRequest(method, path, txID string) *restRequest {
+	req := &restRequest{
+		method:  method,
+		path:    path,
+		query:   url.Values{},
+		header:  http.Header{},
+		idempot: true,
+	}
+	req.header.Set("Accept", jsonContentType)
+	if len(txID) > 0 {
+		req.header.Set(restTxnHeader, txID)
+	}
+	return req
+}
+
+// entryPath returns the path of the entry endpoint for key.
+func entryPath(prefix string, key engine.Key) string {
+	return prefix + url.QueryEscape(string(key))
+}
+
+// executeCmd executes the request via the REST API and sets the
+// response in reply. If no node replies, or if the reply carries a
+// retryable error, the request is retried; if attempts are exhausted,
+// the reply carries the error of the last attempt. Errors are
+// returned in the reply header.
+func (db *HTTPDB) executeCmd(method string, args storage.Request, reply storage.Response) {
+	retryOpts := db.RetryOpts
+	retryOpts.Tag = fmt.Sprintf("sending %s via http", method)
+	var lastErr error
+	err := util.RetryWithBackoff(retryOpts, func() (bool, error) {
+		reply.Header().Error = nil
+		lastErr = db.send(args, reply)
+		if lastErr == nil {
+			lastErr = reply.Header().Error
+		}
+		if retryErr, ok := lastErr.(util.Retryable); ok && retryErr.CanRetry() {
+			log.Warningf("failed to invoke %s: %v", method, lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil || lastErr != nil {
+		reply.Header().Error = lastErr
+	}
+}
+
+// send translates the request into requests of the REST API and sends
+// them, setting the response in reply. The KV error of a request is
+// set in the reply; an error is returned if the request couldn't be
+// sent.
+func (db *HTTPDB) send(args storage.Request, reply storage.Response) error {
+	header := args.Header()
+	switch t := args.(type) {
+	case *storage.ContainsRequest:
+		resp, err := db.do(newRESTRequest("HEAD", entryPath(restEntryPrefix, t.Key), header.TxID))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		r := reply.(*storage.ContainsResponse)
+		switch resp.StatusCode {
+		case http.StatusOK:
+			r.Exists = true
+			r.Tag, r.Error = parseValueTag(resp.Header.Get(restValueTypeHeader))
+		case http.StatusNotFound:
+		default:
+			r.Error = restError(resp)
+		}
+	case *storage.GetRequest:
+		value, err := db.getEntry(t.Key, header.TxID)
+		if err != nil {
+			return err
+		}
+		r := reply.(*storage.GetResponse)
+		r.Value, r.Error = value.value, value.err
+	case *storage.PutRequest:
+		req := newRESTRequest("PUT", entryPath(restEntryPrefix, t.Key), header.TxID)
+		req.body = t.Value.Bytes
+		return db.sendWrite(req, t.Key, reply)
+	case *storage.ConditionalPutRequest:
+		req := newRESTRequest("PUT", entryPath(restEntryPrefix, t.Key), header.TxID)
+		req.body = t.Value.Bytes
+		if t.ExpValue.Bytes == nil {
+			req.header.Set("If-None-Match", "*")
+		} else if ok, err := db.setPrecondition(req, t.Key, t.ExpValue, header.TxID, reply); !ok {
+			return err
+		}
+		return db.sendWrite(req, t.Key, reply)
+	case *storage.IncrementRequest:
+		req := newRESTRequest("POST", entryPath(restCounterPrefix, t.Key), header.TxID)
+		req.body = []byte(strconv.FormatInt(t.Increment, 10))
+		req.idempot = false
+		resp, err := db.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		r := reply.(*storage.IncrementResponse)
+		if resp.StatusCode != http.StatusOK {
+			r.Error = restKeyError(resp, t.Key)
+			return nil
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		r.NewValue, r.Error = strconv.ParseInt(string(body), 10, 64)
+	case *storage.DeleteRequest:
+		req := newRESTRequest("DELETE", entryPath(restEntryPrefix, t.Key), header.TxID)
+		if t.ExpValue.Bytes != nil {
+			if ok, err := db.setPrecondition(req, t.Key, t.ExpValue, header.TxID, reply); !ok {
+				return err
+			}
+		}
+		return db.sendWrite(req, t.Key, reply)
+	case *storage.DeleteRangeRequest:
+		req := newRESTRequest("DELETE", restRangePrefix, header.TxID)
+		req.query.Set("start", string(t.Key))
+		req.query.Set("end", string(t.EndKey))
+		if t.MaxEntriesToDelete > 0 {
+			req.query.Set("limit", strconv.FormatInt(t.MaxEntriesToDelete, 10))
+		}
+		resp, err := db.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		r := reply.(*storage.DeleteRangeResponse)
+		if resp.StatusCode != http.StatusOK {
+			r.Error = restError(resp)
+			return nil
+		}
+		r.Error = json.NewDecoder(resp.Body).Decode(&r.NumDeleted)
+	case *storage.ScanRequest:
+		req := newRESTRequest("GET", restRangePrefix, header.TxID)
+		req.query.Set("start", string(t.Key))
+		req.query.Set("end", string(t.EndKey))
+		if t.MaxResults > 0 {
+			req.query.Set("limit", strconv.FormatInt(t.MaxResults, 10))
+		}
+		resp, err := db.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		r := reply.(*storage.ScanResponse)
+		if resp.StatusCode != http.StatusOK {
+			r.Error = restError(resp)
+			return nil
+		}
+		var entries []restEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return err
+		}
+		r.Rows = make([]engine.KeyValue, len(entries))
+		for i := range entries {
+			r.Rows[i].Key = engine.Key(entries[i].Key)
+			if r.Rows[i].Value, r.Error = entries[i].value(); r.Error != nil {
+				return nil
+			}
+		}
+	case *storage.WatchRequest:
+		return db.watch(t, reply.(*storage.WatchResponse))
+	case *storage.EndTransactionRequest:
+		action := "abort"
+		if t.Commit {
+			action = "commit"
+		}
+		resp, err := db.do(newRESTRequest("POST", restTxnPrefix+action, header.TxID))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			reply.Header().Error = restError(resp)
+		}
+	default:
+		method, _ := storage.MethodForRequest(args)
+		reply.Header().Error = util.Errorf("%s is not exposed by the REST API", method)
+	}
+	return nil
+}
+
+// A restValue is the value of a key read via the REST API, its ETag
+// and the error of the read, if any.
+type restValue struct {
+	value engine.Value
+	etag  string
+	err   error
+}
+
+// getEntry reads the value of key via the REST API. The value's
+// bytes are nil if the key doesn't exist.
+func (db *HTTPDB) getEntry(key engine.Key, txID string) (restValue, error) {
+	resp, err := db.do(newRESTRequest("GET", entryPath(restEntryPrefix, key), txID))
+	if err != nil {
+		return restValue{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var entry restEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+			return restValue{}, err
+		}
+		value, err := entry.value()
+		return restValue{value: value, etag: resp.Header.Get("ETag"), err: err}, nil
+	case http.StatusNotFound:
+		return restValue{}, nil
+	}
+	return restValue{err: restError(resp)}, nil
+}
+
+// setPrecondition makes req conditional on the value of key matching
+// expValue, as ConditionalPut and Delete require. The current value is
+// read and, if it matches, its ETag is set in the If-Match header, so
+// that the write fails if the value changes in the meantime. Returns
+// false if the request shouldn't be sent, with the condition's failure
+// set in reply or the error which prevented reading the value.
+func (db *HTTPDB) setPrecondition(req *restRequest, key engine.Key, expValue engine.Value,
+	txID string, reply storage.Response) (bool, error) {
+	cur, err := db.getEntry(key, txID)
+	if err != nil || cur.err != nil {
+		reply.Header().Error = cur.err
+		return false, err
+	}
+	if cur.value.Bytes == nil {
+		reply.Header().Error = &storage.ConditionFailedError{}
+		return false, nil
+	}
+	if !bytes.Equal(expValue.Bytes, cur.value.Bytes) ||
+		(expValue.Timestamp != (hlc.Timestamp{}) && expValue.Timestamp != cur.value.Timestamp) {
+		reply.Header().Error = &storage.ConditionFailedError{ActualValue: &cur.value}
+		return false, nil
+	}
+	req.header.Set("If-Match", cur.etag)
+	return true, nil
+}
+
+// sendWrite sends a write of key, which replies with no body on
+// success, and sets its error, if any, in reply. A failed
+// precondition is replied as a ConditionFailedError carrying the
+// actual value of key, if it exists.
+func (db *HTTPDB) sendWrite(req *restRequest, key engine.Key, reply storage.Response) error {
+	resp, err := db.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		cfErr := &storage.ConditionFailedError{}
+		if resp.Header.Get(restValueTypeHeader) != "" {
+			var entry restEntry
+			if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+				return err
+			}
+			value, err := entry.value()
+			if err != nil {
+				return err
+			}
+			cfErr.ActualValue = &value
+		}
+		reply.Header().Error = cfErr
+	default:
+		reply.Header().Error = restKeyError(resp, key)
+	}
+	return nil
+}
+
+// watch reads the first batch of writes streamed by a watch via the
+// REST API, waiting at most args.Wait for them, and closes the stream.
+func (db *HTTPDB) watch(args *storage.WatchRequest, reply *storage.WatchResponse) error {
+	req := newRESTRequest("GET", restWatchPrefix, args.TxID)
+	endKey := args.EndKey
+	if len(endKey) == 0 {
+		endKey = engine.NextKey(args.Key)
+	}
+	req.query.Set("start", string(args.Key))
+	req.query.Set("end", string(endKey))
+	if args.StartTimestamp != (hlc.Timestamp{}) {
+		req.query.Set("timestamp", formatTimestamp(args.StartTimestamp))
+	}
+	// The REST API bounds the wait, as does the range.
+	wait := args.Wait
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	req.query.Set("wait", wait.String())
+	resp, err := db.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		reply.Error = &storage.WatchTimestampError{StartTimestamp: args.StartTimestamp}
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		reply.Error = restError(resp)
+		return nil
+	}
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return err
+	}
+	var batch struct {
+		Events   []restEntry `json:"events"`
+		Resolved string      `json:"resolved"`
+	}
+	if err := json.Unmarshal(line, &batch); err != nil {
+		return err
+	}
+	if reply.ResolvedTimestamp, reply.Error = parseTimestamp(batch.Resolved); reply.Error != nil {
+		return nil
+	}
+	reply.Events = make([]storage.WatchEvent, len(batch.Events))
+	for i, e := range batch.Events {
+		reply.Events[i] = storage.WatchEvent{Key: engine.Key(e.Key), Deleted: e.Deleted}
+		if reply.Events[i].Value, reply.Error = e.value(); reply.Error != nil {
+			return nil
+		}
+		if e.Deleted {
+			reply.Events[i].Value = engine.Value{Timestamp: reply.Events[i].Value.Timestamp}
+		}
+	}
+	return nil
+}
+
+// restError returns the error replied by the REST API in resp. The
+// error is retryable if the RetryableHeader is set.
+func restError(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	var jsonErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(msg, &jsonErr); err == nil && len(jsonErr.Error) > 0 {
+		msg = []byte(jsonErr.Error)
+	}
+	return &httpDBError{
+		Message:   fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(msg))),
+		Retryable: resp.Header.Get(restRetryableHeader) == "true",
+	}
+}
+
+// restKeyError is like restError, but an operation on a value of the
+// wrong type at key is returned as an engine.ValueTypeError.
+func restKeyError(resp *http.Response, key engine.Key) error {
+	if resp.StatusCode == http.StatusBadRequest {
+		if actual, err := parseValueTag(resp.Header.Get(restValueTypeHeader)); err == nil {
+			expected := engine.TagInteger
+			if actual == engine.TagInteger {
+				expected = engine.TagBytes
+			}
+			return &engine.ValueTypeError{Key: key, Expected: expected, Actual: actual}
+		}
+	}
+	return restError(resp)
+}
+
+// do sends the request to each node in turn, starting with the node
+// which last replied, until one replies with a status other than 502
+// Bad Gateway, 503 Service Unavailable or 504 Gateway Timeout, and
+// returns its response. A retryable error is returned if no node
+// replies; if req isn't idempotent, only nodes which couldn't be
+// connected to are skipped.
+func (db *HTTPDB) do(req *restRequest) (*http.Response, error) {
+	if len(db.addrs) == 0 {
+		return nil, util.Errorf("no node addresses specified")
+	}
+	db.mu.Lock()
+	start := db.next
+	db.mu.Unlock()
+	var lastErr error
+	for i := 0; i < len(db.addrs); i++ {
+		idx := (start + i) % len(db.addrs)
+		u := url.URL{Scheme: db.scheme, Host: db.addrs[idx], Path: req.path, RawQuery: req.query.Encode()}
+		httpReq, err := http.NewRequest(req.method, u.String(), bytes.NewReader(req.body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.header {
+			httpReq.Header[k] = v
+		}
+		if len(db.User) > 0 {
+			httpReq.SetBasicAuth(db.User, db.Password)
+		}
+		resp, err := db.client.Do(httpReq)
+		if err != nil {
+			lastErr = err
+			if !req.idempot && !isDialError(err) {
+				return nil, util.Errorf("%s %s: no reply: %v", req.method, req.path, err)
+			}
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			lastErr = restError(resp)
+			resp.Body.Close()
+			continue
+		}
+		db.mu.Lock()
+		db.next = idx
+		db.mu.Unlock()
+		return resp, nil
+	}
+	return nil, &httpDBError{
+		Message:   fmt.Sprintf("%s %s: no node replied; last error: %v", req.method, req.path, lastErr),
+		Retryable: true,
+	}
+}
+
+// isDialError returns true if err, returned by an http.Client, is a
+// failure to connect, in which case the request wasn't received.
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// Contains sends the request via HTTP.
+func (db *HTTPDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
+	replyChan := make(chan *storage.ContainsResponse, 1)
+	go func() {
+		reply := &storage.ContainsResponse{}
+		db.executeCmd(storage.Contains, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Get sends the request via HTTP.
+func (db *HTTPDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	replyChan := make(chan *storage.GetResponse, 1)
+	go func() {
+		reply := &storage.GetResponse{}
+		db.executeCmd(storage.Get, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Put sends the request via HTTP.
+func (db *HTTPDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	replyChan := make(chan *storage.PutResponse, 1)
+	go func() {
+		reply := &storage.PutResponse{}
+		db.executeCmd(storage.Put, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// ConditionalPut sends the request via HTTP.
+func (db *HTTPDB) ConditionalPut(args *storage.ConditionalPutRequest) <-chan *storage.ConditionalPutResponse {
+	replyChan := make(chan *storage.ConditionalPutResponse, 1)
+	go func() {
+		reply := &storage.ConditionalPutResponse{}
+		db.executeCmd(storage.ConditionalPut, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Increment sends the request via HTTP.
+func (db *HTTPDB) Increment(args *storage.IncrementRequest) <-chan *storage.IncrementResponse {
+	replyChan := make(chan *storage.IncrementResponse, 1)
+	go func() {
+		reply := &storage.IncrementResponse{}
+		db.executeCmd(storage.Increment, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Delete sends the request via HTTP.
+func (db *HTTPDB) Delete(args *storage.DeleteRequest) <-chan *storage.DeleteResponse {
+	replyChan := make(chan *storage.DeleteResponse, 1)
+	go func() {
+		reply := &storage.DeleteResponse{}
+		db.executeCmd(storage.Delete, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// DeleteRange sends the request via HTTP.
+func (db *HTTPDB) DeleteRange(args *storage.DeleteRangeRequest) <-chan *storage.DeleteRangeResponse {
+	replyChan := make(chan *storage.DeleteRangeResponse, 1)
+	go func() {
+		reply := &storage.DeleteRangeResponse{}
+		db.executeCmd(storage.DeleteRange, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Scan sends the request via HTTP.
+func (db *HTTPDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse {
+	replyChan := make(chan *storage.ScanResponse, 1)
+	go func() {
+		reply := &storage.ScanResponse{}
+		db.executeCmd(storage.Scan, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// Watch sends the request via HTTP.
+func (db *HTTPDB) Watch(args *storage.WatchRequest) <-chan *storage.WatchResponse {
+	replyChan := make(chan *storage.WatchResponse, 1)
+	go func() {
+		reply := &storage.WatchResponse{}
+		db.executeCmd(storage.Watch, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// EndTransaction sends the request via HTTP.
+func (db *HTTPDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
+	replyChan := make(chan *storage.EndTransactionResponse, 1)
+	go func() {
+		reply := &storage.EndTransactionResponse{}
+		db.executeCmd(storage.EndTransaction, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// AccumulateTS isn't exposed by the REST API and fails.
+func (db *HTTPDB) AccumulateTS(args *storage.AccumulateTSRequest) <-chan *storage.AccumulateTSResponse {
+	replyChan := make(chan *storage.AccumulateTSResponse, 1)
+	reply := &storage.AccumulateTSResponse{}
+	db.executeCmd(storage.AccumulateTS, args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+// ReapQueue isn't exposed by the REST API and fails.
+func (db *HTTPDB) ReapQueue(args *storage.ReapQueueRequest) <-chan *storage.ReapQueueResponse {
+	replyChan := make(chan *storage.ReapQueueResponse, 1)
+	reply := &storage.ReapQueueResponse{}
+	db.executeCmd(storage.ReapQueue, args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+// EnqueueUpdate isn't exposed by the REST API and fails.
+func (db *HTTPDB) EnqueueUpdate(args *storage.EnqueueUpdateRequest) <-chan *storage.EnqueueUpdateResponse {
+	replyChan := make(chan *storage.EnqueueUpdateResponse, 1)
+	reply := &storage.EnqueueUpdateResponse{}
+	db.executeCmd(storage.EnqueueUpdate, args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+// EnqueueMessage isn't exposed by the REST API and fails.
+func (db *HTTPDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *storage.EnqueueMessageResponse {
+	replyChan := make(chan *storage.EnqueueMessageResponse, 1)
+	reply := &storage.EnqueueMessageResponse{}
+	db.executeCmd(storage.EnqueueMessage, args, reply)
+	replyChan <- reply
+	return replyChan
+}
+
+// Batch isn't exposed by the REST API and fails.
+func (db *HTTPDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+	reply := &storage.BatchResponse{}
+	db.executeCmd(storage.Batch, args, reply)
+	replyChan <- reply
+	return replyChan
+}
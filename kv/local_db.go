@@ -20,26 +20,32 @@ package kv
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
 // A LocalDB provides methods to access a collection of local stores.
 type LocalDB struct {
-	mu       sync.RWMutex             // Protects storeMap and addrs
-	storeMap map[int32]*storage.Store // Map from StoreID to Store
-	ranges   storage.RangeSlice       // *Range slice sorted by end key
+	mu          sync.RWMutex             // Protects storeMap and addrs
+	storeMap    map[int32]*storage.Store // Map from StoreID to Store
+	ranges      storage.RangeSlice       // *Range slice sorted by end key
+	coordinator *coordinator             // Coordinates transactions of local clients
 }
 
 // NewLocalDB returns a local-only KV DB for direct access to a store.
 func NewLocalDB() *LocalDB {
-	return &LocalDB{
+	db := &LocalDB{
 		storeMap: make(map[int32]*storage.Store),
 	}
+	db.coordinator = NewCoordinator(db, hlc.NewClock(hlc.UnixNano))
+	return db
 }
 
 // GetStoreCount returns the number of stores this node is exporting.
@@ -97,8 +103,9 @@ func (db *LocalDB) VisitStores(visitor func(s *storage.Store) error) error {
 	return nil
 }
 
-// Close closes all stores.
+// Close stops the transaction coordinator and closes all stores.
 func (db *LocalDB) Close() {
+	db.coordinator.Stop()
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 	for _, store := range db.storeMap {
@@ -132,7 +139,17 @@ func (db *LocalDB) lookupReplica(key engine.Key) *storage.Replica {
 // up from the store map if specified by header.Replica; otherwise,
 // the command is being executed locally, and the replica is
 // determined via lookup of header.Key in the ranges slice.
+//
+// Transactional requests are registered with the coordinator, and
+// fail if their transaction has ended. A
+// request blocked by the write intent of a transaction which has
+// ended or was abandoned resolves the intent, so that the request
+// succeeds when retried.
 func (db *LocalDB) executeCmd(method string, args storage.Request, reply storage.Response) {
+	if err := db.coordinator.trackRequest("Node."+method, args); err != nil {
+		reply.Header().Error = err
+		return
+	}
 	// If the replica isn't specified in the header, look it up.
 	var err error
 	var store *storage.Store
@@ -155,11 +172,25 @@ func (db *LocalDB) executeCmd(method string, args storage.Request, reply storage
 	}
 	if err != nil {
 		reply.Header().Error = err
-	} else {
-		store.ExecuteCmd(method, args, reply)
+	} else if err := store.ExecuteCmd(method, args, reply); err != nil && reply.Header().Error == nil {
+		reply.Header().Error = err
+	}
+	if intentErr, ok := reply.Header().Error.(*storage.WriteIntentError); ok {
+		db.coordinator.resolveWriteIntent(intentErr)
 	}
 }
 
+// routeRPCInternal executes the RPC asynchronously, sending the reply
+// on replyChan. The transaction coordinator uses it to send
+// heartbeats, aborts and resolutions, none of which it tracks.
+func (db *LocalDB) routeRPCInternal(method string, args storage.Request, replyChan interface{}) {
+	replyVal := reflect.New(reflect.TypeOf(replyChan).Elem().Elem())
+	go func() {
+		db.executeCmd(strings.TrimPrefix(method, "Node."), args, replyVal.Interface().(storage.Response))
+		reflect.ValueOf(replyChan).Send(replyVal)
+	}()
+}
+
 // Contains passes through to local range.
 func (db *LocalDB) Contains(args *storage.ContainsRequest) <-chan *storage.ContainsResponse {
 	replyChan := make(chan *storage.ContainsResponse, 1)
@@ -248,12 +279,27 @@ func (db *LocalDB) Scan(args *storage.ScanRequest) <-chan *storage.ScanResponse
 	return replyChan
 }
 
-// EndTransaction passes through to local range.
+// Watch passes through to local range.
+func (db *LocalDB) Watch(args *storage.WatchRequest) <-chan *storage.WatchResponse {
+	replyChan := make(chan *storage.WatchResponse, 1)
+	reply := &storage.WatchResponse{}
+	go func() {
+		db.executeCmd(storage.Watch, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
+
+// EndTransaction passes through to local range. On success, the
+// transaction's intents are resolved before replying.
 func (db *LocalDB) EndTransaction(args *storage.EndTransactionRequest) <-chan *storage.EndTransactionResponse {
 	replyChan := make(chan *storage.EndTransactionResponse, 1)
 	reply := &storage.EndTransactionResponse{}
 	go func() {
 		db.executeCmd(storage.EndTransaction, args, reply)
+		if reply.Error == nil && len(args.TxID) != 0 {
+			db.coordinator.endTxn(args.TxID, args.Commit)
+		}
 		replyChan <- reply
 	}()
 	return replyChan
@@ -302,3 +348,15 @@ func (db *LocalDB) EnqueueMessage(args *storage.EnqueueMessageRequest) <-chan *s
 	}()
 	return replyChan
 }
+
+// Batch passes through to local range. All requests in the batch
+// must fall within a single local range.
+func (db *LocalDB) Batch(args *storage.BatchRequest) <-chan *storage.BatchResponse {
+	replyChan := make(chan *storage.BatchResponse, 1)
+	reply := &storage.BatchResponse{}
+	go func() {
+		db.executeCmd(storage.Batch, args, reply)
+		replyChan <- reply
+	}()
+	return replyChan
+}
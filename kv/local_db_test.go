@@ -21,10 +21,30 @@ package kv
 import (
 	"testing"
 
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
+// createTestLocalDB returns a LocalDB with a single in-memory store
+// holding a single range which spans the entire key space.
+func createTestLocalDB(t *testing.T) *LocalDB {
+	manual := hlc.ManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	store := storage.NewStore(clock, engine.NewInMem(engine.Attributes{}, 1<<20), nil, multiraft.NewLocalRPCTransport())
+	if err := store.Bootstrap(storage.StoreIdent{NodeID: 1, StoreID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	replica := storage.Replica{NodeID: 1, StoreID: 1, RangeID: 1}
+	if _, err := store.CreateRange(engine.KeyMin, engine.KeyMax, []storage.Replica{replica}); err != nil {
+		t.Fatal(err)
+	}
+	db := NewLocalDB()
+	db.AddStore(store)
+	return db
+}
+
 func TestReplicaLookup(t *testing.T) {
 
 	db := NewLocalDB()
@@ -149,7 +149,10 @@ func (rmc *RangeMetadataCache) getCachedRangeMetadata(key engine.Key) (
 	rmc.rangeCacheMu.RLock()
 	defer rmc.rangeCacheMu.RUnlock()
 
-	k, v, ok := rmc.rangeCache.Ceil(rangeCacheKey(metaKey))
+	// Ranges are cached by the metadata key of their end key, which
+	// they don't contain. The range containing key is thus the first
+	// whose metadata key sorts strictly after key's.
+	k, v, ok := rmc.rangeCache.Ceil(rangeCacheKey(engine.NextKey(metaKey)))
 	if !ok {
 		return nil, nil
 	}
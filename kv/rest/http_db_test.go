@@ -0,0 +1,276 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package rest_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/kv/rest"
+	"github.com/cockroachdb/cockroach/server"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// startHTTPDBServer starts a REST server executing requests against
+// db and returns it along with an HTTPDB which sends requests to it,
+// with fast retries. Requests are executed on behalf of the user they
+// authenticate via basic authentication, or of the root user if they
+// don't; the HTTPDB doesn't authenticate.
+func startHTTPDBServer(db kv.DB, useTLS bool) (*httptest.Server, *kv.HTTPDB) {
+	restServer := rest.NewRESTServer(db)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := storage.UserRoot
+		const prefix = "Basic "
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, prefix))
+			user = strings.SplitN(string(decoded), ":", 2)[0]
+		}
+		restServer.HandleAction(w, r, user)
+	})
+	var s *httptest.Server
+	var httpDB *kv.HTTPDB
+	if useTLS {
+		s = httptest.NewTLSServer(handler)
+		// The test server's certificate is self-signed.
+		httpDB = kv.NewHTTPDB([]string{s.Listener.Addr().String()},
+			&tls.Config{InsecureSkipVerify: true})
+	} else {
+		s = httptest.NewServer(handler)
+		httpDB = kv.NewHTTPDB([]string{s.Listener.Addr().String()}, nil)
+	}
+	httpDB.RetryOpts.Backoff = 1 * time.Millisecond
+	httpDB.RetryOpts.MaxAttempts = 3
+	return s, httpDB
+}
+
+// newTestDB returns the DB of a newly bootstrapped cluster.
+func newTestDB(t *testing.T) kv.DB {
+	db, err := server.BootstrapCluster("test-cluster", engine.NewInMem(engine.Attributes{}, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestHTTPDB verifies that the requests of the KV API exposed by the
+// REST API, sent via an HTTPDB with and without TLS, are executed
+// against the server's DB, and that others fail.
+func TestHTTPDB(t *testing.T) {
+	for _, useTLS := range []bool{false, true} {
+		s, db := startHTTPDBServer(newTestDB(t), useTLS)
+		header := func(key string) storage.RequestHeader {
+			return storage.RequestHeader{Key: engine.Key(key), User: storage.UserRoot}
+		}
+
+		if reply := <-db.Put(&storage.PutRequest{RequestHeader: header("a"), Value: engine.Value{Bytes: []byte("value")}}); reply.Error != nil {
+			t.Fatalf("tls=%t: %v", useTLS, reply.Error)
+		}
+		gr := <-db.Get(&storage.GetRequest{RequestHeader: header("a")})
+		if gr.Error != nil || !bytes.Equal(gr.Value.Bytes, []byte("value")) || gr.Value.Timestamp.WallTime == 0 {
+			t.Errorf("tls=%t: expected value with timestamp; got %+v, %v", useTLS, gr.Value, gr.Error)
+		}
+		if gr := <-db.Get(&storage.GetRequest{RequestHeader: header("missing")}); gr.Error != nil || gr.Value.Bytes != nil {
+			t.Errorf("tls=%t: expected missing key; got %q, %v", useTLS, gr.Value.Bytes, gr.Error)
+		}
+		if cr := <-db.Contains(&storage.ContainsRequest{RequestHeader: header("a")}); cr.Error != nil || !cr.Exists {
+			t.Errorf("tls=%t: expected key to exist; got %v", useTLS, cr.Error)
+		}
+
+		// A failed conditional put replies with the actual value.
+		cpr := <-db.ConditionalPut(&storage.ConditionalPutRequest{
+			RequestHeader: header("a"),
+			Value:         engine.Value{Bytes: []byte("new")},
+		})
+		if cfErr, ok := cpr.Error.(*storage.ConditionFailedError); !ok || cfErr.ActualValue == nil ||
+			!bytes.Equal(cfErr.ActualValue.Bytes, []byte("value")) {
+			t.Errorf("tls=%t: expected condition failed error with actual value; got %v", useTLS, cpr.Error)
+		}
+		cpr = <-db.ConditionalPut(&storage.ConditionalPutRequest{
+			RequestHeader: header("a"),
+			Value:         engine.Value{Bytes: []byte("new")},
+			ExpValue:      engine.Value{Bytes: []byte("value")},
+		})
+		if cpr.Error != nil {
+			t.Errorf("tls=%t: %v", useTLS, cpr.Error)
+		}
+
+		// Counters.
+		for i, exp := range []int64{2, 5} {
+			ir := <-db.Increment(&storage.IncrementRequest{RequestHeader: header("b"), Increment: int64(i + 2)})
+			if ir.Error != nil || ir.NewValue != exp {
+				t.Errorf("tls=%t: expected %d; got %d, %v", useTLS, exp, ir.NewValue, ir.Error)
+			}
+		}
+		ir := <-db.Increment(&storage.IncrementRequest{RequestHeader: header("a"), Increment: 1})
+		if typeErr, ok := ir.Error.(*engine.ValueTypeError); !ok || typeErr.Actual != engine.TagBytes {
+			t.Errorf("tls=%t: expected value type error; got %v", useTLS, ir.Error)
+		}
+
+		// Scans and range deletes.
+		sr := <-db.Scan(&storage.ScanRequest{
+			RequestHeader: storage.RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("c"), User: storage.UserRoot},
+		})
+		if sr.Error != nil || len(sr.Rows) != 2 || !bytes.Equal(sr.Rows[1].Key, engine.Key("b")) ||
+			sr.Rows[1].Value.Tag != engine.TagInteger {
+			t.Errorf("tls=%t: unexpected scan rows %+v, %v", useTLS, sr.Rows, sr.Error)
+		}
+		drr := <-db.DeleteRange(&storage.DeleteRangeRequest{
+			RequestHeader: storage.RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("c"), User: storage.UserRoot},
+		})
+		if drr.Error != nil || drr.NumDeleted != 2 {
+			t.Errorf("tls=%t: expected 2 keys deleted; got %d, %v", useTLS, drr.NumDeleted, drr.Error)
+		}
+
+		// Methods not exposed by the REST API fail.
+		br := <-db.Batch(&storage.BatchRequest{RequestHeader: header("a")})
+		if br.Error == nil || !strings.Contains(br.Error.Error(), "not exposed") {
+			t.Errorf("tls=%t: expected batch to fail; got %v", useTLS, br.Error)
+		}
+		s.Close()
+	}
+}
+
+// TestHTTPDBWatch verifies that watches sent via an HTTPDB return the
+// resolved timestamp, and that watches of forgotten writes fail with a
+// WatchTimestampError.
+func TestHTTPDBWatch(t *testing.T) {
+	s, db := startHTTPDBServer(newTestDB(t), false)
+	defer s.Close()
+	header := storage.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot}
+	wr := <-db.Watch(&storage.WatchRequest{RequestHeader: header})
+	if wr.Error != nil || len(wr.Events) != 0 || wr.ResolvedTimestamp.WallTime == 0 {
+		t.Errorf("expected no events and a resolved timestamp; got %+v", wr)
+	}
+	wr = <-db.Watch(&storage.WatchRequest{RequestHeader: header, StartTimestamp: hlc.Timestamp{WallTime: 1}})
+	if _, ok := wr.Error.(*storage.WatchTimestampError); !ok {
+		t.Errorf("expected watch timestamp error; got %v", wr.Error)
+	}
+}
+
+// TestHTTPDBFailover verifies that requests fail over to the next
+// node if a node is unreachable, and fail with a retryable error once
+// attempts are exhausted if no node is.
+func TestHTTPDBFailover(t *testing.T) {
+	s, _ := startHTTPDBServer(newTestDB(t), false)
+	defer s.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	db := kv.NewHTTPDB([]string{unreachable.Listener.Addr().String(),
+		unavailable.Listener.Addr().String(), s.Listener.Addr().String()}, nil)
+	db.RetryOpts.Backoff = 1 * time.Millisecond
+	db.RetryOpts.MaxAttempts = 3
+
+	put := &storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot},
+		Value:         engine.Value{Bytes: []byte("value")},
+	}
+	if reply := <-db.Put(put); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+
+	db = kv.NewHTTPDB([]string{unreachable.Listener.Addr().String(), unavailable.Listener.Addr().String()}, nil)
+	db.RetryOpts.Backoff = 1 * time.Millisecond
+	db.RetryOpts.MaxAttempts = 3
+	reply := <-db.Put(put)
+	if retryErr, ok := reply.Error.(util.Retryable); !ok || !retryErr.CanRetry() ||
+		!strings.Contains(reply.Error.Error(), "no node replied") {
+		t.Errorf("expected request to fail with no reachable nodes; got %v", reply.Error)
+	}
+}
+
+// A getDB is a DB which serves gets with a function. Its other
+// methods aren't implemented.
+type getDB struct {
+	kv.DB
+	get func(*storage.GetRequest) *storage.GetResponse
+}
+
+// Get implements the DB interface.
+func (db *getDB) Get(args *storage.GetRequest) <-chan *storage.GetResponse {
+	replyChan := make(chan *storage.GetResponse, 1)
+	replyChan <- db.get(args)
+	return replyChan
+}
+
+// TestHTTPDBRetry verifies that requests failing with retryable
+// errors are retried until attempts are exhausted, and that other
+// errors are returned with their message intact.
+func TestHTTPDBRetry(t *testing.T) {
+	var attempts int
+	s, db := startHTTPDBServer(&getDB{get: func(args *storage.GetRequest) *storage.GetResponse {
+		attempts++
+		reply := &storage.GetResponse{}
+		switch string(args.Key) {
+		case "retry":
+			if attempts == 1 {
+				reply.Error = &storage.RangeNotFoundError{}
+			}
+		case "exhaust":
+			reply.Error = &storage.RangeNotFoundError{}
+		case "fail":
+			reply.Error = util.Errorf("failed get")
+		}
+		return reply
+	}}, false)
+	defer s.Close()
+
+	get := func(key string) *storage.GetResponse {
+		attempts = 0
+		return <-db.Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key(key)}})
+	}
+	if reply := get("retry"); reply.Error != nil || attempts != 2 {
+		t.Errorf("expected retry to succeed on second attempt; got %v after %d attempts", reply.Error, attempts)
+	}
+	if reply := get("exhaust"); reply.Error == nil || attempts != db.RetryOpts.MaxAttempts {
+		t.Errorf("expected %d attempts to fail; got %v after %d attempts", db.RetryOpts.MaxAttempts, reply.Error, attempts)
+	}
+	if reply := get("fail"); reply.Error == nil || !strings.Contains(reply.Error.Error(), "failed get") || attempts != 1 {
+		t.Errorf("expected \"failed get\" error without retries; got %v after %d attempts", reply.Error, attempts)
+	}
+}
+
+// TestHTTPDBAuthentication verifies that requests authenticate as the
+// HTTPDB's user, so that they're executed on its behalf.
+func TestHTTPDBAuthentication(t *testing.T) {
+	var users []string
+	s, db := startHTTPDBServer(&getDB{get: func(args *storage.GetRequest) *storage.GetResponse {
+		users = append(users, args.User)
+		return &storage.GetResponse{}
+	}}, false)
+	defer s.Close()
+	db.User, db.Password = "alice", "secret"
+	get := &storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot}}
+	if reply := <-db.Get(get); reply.Error != nil {
+		t.Fatal(reply.Error)
+	}
+	if len(users) != 1 || users[0] != "alice" {
+		t.Errorf("expected request on behalf of \"alice\"; got %v", users)
+	}
+}
@@ -18,16 +18,24 @@
 package rest
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -40,13 +48,44 @@ const (
 	RangePrefix = APIPrefix + "range/"
 	// CounterPrefix is the prefix for the endpoint that increments a key by a given amount.
 	CounterPrefix = APIPrefix + "counter/"
+	// WatchPrefix is the prefix for the endpoint that streams the writes
+	// committed to a range of keys.
+	WatchPrefix = APIPrefix + "watch/"
+	// TxnPrefix is the prefix for the endpoints that begin, commit and
+	// abort transactions.
+	TxnPrefix = APIPrefix + "txn/"
+	// TxnHeader is the request header which makes entry, range and
+	// counter operations part of the transaction it names. Its value
+	// is the transaction ID returned when the transaction is begun.
+	TxnHeader = "X-Cockroach-Txn"
+	// ValueTypeHeader is the response header which holds the type of
+	// the value at a key, such as "bytes" or "integer".
+	ValueTypeHeader = "X-Cockroach-Value-Type"
+	// RetryableHeader is the response header which is set to "true"
+	// if the request failed with an error which may succeed if the
+	// request is retried.
+	RetryableHeader = "X-Cockroach-Retryable"
+	// CursorHeader is the response header which holds the cursor from
+	// which to resume a range scan cut short by its limit. The cursor
+	// is passed as the "cursor" query parameter of the next scan.
+	CursorHeader = "X-Cockroach-Cursor"
+	// rangeScanBatchSize is the number of key/value pairs fetched per
+	// scan request while streaming the results of a range scan.
+	rangeScanBatchSize = 100
+	// watchWait is the time a watch waits for writes before streaming
+	// the resolved timestamp alone.
+	watchWait = 5 * time.Second
+	// maxWatchWait bounds the "wait" query parameter of a watch.
+	maxWatchWait = 10 * time.Second
+	// jsonContentType is the content type of JSON responses.
+	jsonContentType = "application/json"
 )
 
 // Function signture for an HTTP handler that only takes a writer and a request
-type actionHandler func(*Server, http.ResponseWriter, *http.Request)
+type actionHandler func(*Server, http.ResponseWriter, *request)
 
 // Function signture for an HTTP handler that takes a writer and a request and a storage key
-type actionKeyHandler func(*Server, http.ResponseWriter, *http.Request, engine.Key)
+type actionKeyHandler func(*Server, http.ResponseWriter, *request, engine.Key)
 
 // Maps various path + HTTP method combos to specific server methods
 var routingTable = map[string]map[string]actionHandler{
@@ -58,16 +97,25 @@ var routingTable = map[string]map[string]actionHandler{
 		"HEAD":   makeActionWithKey((*Server).handleEntryHeadAction),
 	},
 	RangePrefix: {
-	// TODO(zbrock + matthew) not supported yet!
+		"GET":    (*Server).handleRangeScanAction,
+		"DELETE": (*Server).handleRangeDeleteAction,
 	},
 	CounterPrefix: {
 		"GET":  (*Server).handleIncrementAction,
 		"POST": (*Server).handleIncrementAction,
 	},
+	WatchPrefix: {
+		"GET": (*Server).handleWatchAction,
+	},
+	TxnPrefix: {
+		"POST": (*Server).handleTxnAction,
+	},
 }
 
 // A Server provides a RESTful HTTP API to interact with
-// an underlying key-value store.
+// an underlying key-value store. Operations are executed on behalf of
+// the user authenticated by the HTTP server, which is passed to
+// HandleAction.
 type Server struct {
 	db kv.DB // Key-value database client
 }
@@ -77,29 +125,122 @@ func NewRESTServer(db kv.DB) *Server {
 	return &Server{db: db}
 }
 
+// A request is an HTTP request along with the user who authenticated
+// it.
+type request struct {
+	*http.Request
+	user string
+}
+
 // HandleAction arbitrates requests to the appropriate function
-// based on the request’s HTTP method.
-func (s *Server) HandleAction(w http.ResponseWriter, r *http.Request) {
+// based on the request’s HTTP method. The request is served on
+// behalf of user, the user who authenticated it; anonymous requests,
+// whose user is empty, are rejected.
+func (s *Server) HandleAction(w http.ResponseWriter, httpReq *http.Request, user string) {
+	r := &request{Request: httpReq, user: user}
+	if len(user) == 0 {
+		httpError(w, r, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
 	for endPoint, epRoutes := range routingTable {
 		if strings.HasPrefix(r.URL.Path, endPoint) {
 			epHandler := epRoutes[r.Method]
 			if epHandler == nil {
-				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				httpError(w, r, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 				return
 			}
 			epHandler(s, w, r)
 			return
 		}
 	}
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	httpError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	return
 }
 
+// A jsonEntry is the JSON representation of a key/value pair and the
+// timestamp at which the value was written. The value is
+// base64-encoded.
+type jsonEntry struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	Type      string `json:"type"`
+	Checksum  uint32 `json:"checksum"`
+	Timestamp string `json:"timestamp"`
+}
+
+func newJSONEntry(key engine.Key, value engine.Value) jsonEntry {
+	return jsonEntry{
+		Key:       string(key),
+		Value:     value.Bytes,
+		Type:      value.Tag.String(),
+		Checksum:  value.Checksum,
+		Timestamp: formatTimestamp(value.Timestamp),
+	}
+}
+
+// A jsonError is the JSON representation of an error.
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// acceptsJSON returns true if the request's Accept header lists the
+// JSON content type.
+func acceptsJSON(r *request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == jsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// httpError replies to the request with the error message and HTTP
+// code. The error is a JSON object if the client accepts JSON and
+// plain text otherwise.
+func httpError(w http.ResponseWriter, r *request, msg string, code int) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(jsonError{Error: msg})
+}
+
+// kvError replies to the request with an error returned by the KV
+// API. An operation on a value of the wrong type is a bad request, and
+// the actual type of the value is set in the ValueTypeHeader; a watch
+// of writes which have been forgotten is gone; an operation on a key
+// written by another pending transaction, or in a transaction which
+// has ended, conflicts; all other errors are internal server errors.
+// If the error may succeed if the request is retried, the
+// RetryableHeader is set.
+func kvError(w http.ResponseWriter, r *request, err error) {
+	if retryErr, ok := err.(util.Retryable); ok && retryErr.CanRetry() {
+		w.Header().Set(RetryableHeader, "true")
+	}
+	if typeErr, ok := err.(*engine.ValueTypeError); ok {
+		w.Header().Set(ValueTypeHeader, typeErr.Actual.String())
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := err.(*storage.WatchTimestampError); ok {
+		httpError(w, r, err.Error(), http.StatusGone)
+		return
+	}
+	switch err.(type) {
+	case *storage.WriteIntentError, *storage.TransactionStatusError:
+		httpError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	httpError(w, r, err.Error(), http.StatusInternalServerError)
+}
+
 func makeActionWithKey(act actionKeyHandler) actionHandler {
-	return func(s *Server, w http.ResponseWriter, r *http.Request) {
+	return func(s *Server, w http.ResponseWriter, r *request) {
 		key, err := dbKey(r.URL.Path, EntryPrefix)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			httpError(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
 		act(s, w, r, key)
@@ -118,10 +259,77 @@ func dbKey(path, apiPrefix string) (engine.Key, error) {
 	return nil, err
 }
 
-func (s *Server) handleIncrementAction(w http.ResponseWriter, r *http.Request) {
+// requestHeader returns the header of a KV request for the span from
+// key to endKey made on behalf of the HTTP request r. The request is
+// made by the user who authenticated r, as part of the transaction
+// named by r's TxnHeader, if any.
+func requestHeader(r *request, key, endKey engine.Key) storage.RequestHeader {
+	return storage.RequestHeader{
+		Key:    key,
+		EndKey: endKey,
+		User:   r.user,
+		TxID:   r.Header.Get(TxnHeader),
+	}
+}
+
+// A jsonTxn is the JSON representation of a newly begun transaction.
+type jsonTxn struct {
+	TxID string `json:"txid"`
+}
+
+// handleTxnAction begins, commits or aborts a transaction according
+// to the path following TxnPrefix: "begin", "commit" or "abort".
+//
+// Beginning a transaction returns a new transaction ID in the
+// TxnHeader and as a JSON object. Entry, range and counter operations
+// made with the ID in the TxnHeader are part of the transaction: its
+// writes are stored as write intents, which its own reads see. Other
+// operations on keys the transaction has written conflict with it
+// until it ends; they fail with 409 Conflict and the RetryableHeader
+// set, or wait for it to end, depending on the database the server is
+// built on. Watches aren't supported within a transaction.
+//
+// Committing or aborting requires the transaction's ID in the
+// TxnHeader. Committing makes all of the transaction's writes visible
+// atomically; aborting discards them. Either fails with 409 Conflict
+// if the transaction has already ended. A transaction whose client
+// sends no operations for several seconds is considered abandoned
+// and is aborted.
+func (s *Server) handleTxnAction(w http.ResponseWriter, r *request) {
+	txID := r.Header.Get(TxnHeader)
+	switch action := strings.TrimPrefix(r.URL.Path, TxnPrefix); action {
+	case "begin":
+		if txID != "" {
+			httpError(w, r, "nested transactions are not supported", http.StatusBadRequest)
+			return
+		}
+		txID = uuid.New()
+		w.Header().Set(TxnHeader, txID)
+		w.Header().Set("Content-Type", jsonContentType)
+		json.NewEncoder(w).Encode(jsonTxn{TxID: txID})
+	case "commit", "abort":
+		if txID == "" {
+			httpError(w, r, TxnHeader+" header required", http.StatusBadRequest)
+			return
+		}
+		er := <-s.db.EndTransaction(&storage.EndTransactionRequest{
+			RequestHeader: requestHeader(r, engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txID)), nil),
+			Commit:        action == "commit",
+		})
+		if er.Error != nil {
+			kvError(w, r, er.Error)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		httpError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleIncrementAction(w http.ResponseWriter, r *request) {
 	key, err := dbKey(r.URL.Path, CounterPrefix)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		httpError(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -131,100 +339,538 @@ func (s *Server) handleIncrementAction(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		b, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			httpError(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer r.Body.Close()
 		inputVal, err = strconv.ParseInt(string(b), 10, 64)
 		if err != nil {
-			http.Error(w, "Could not parse int64 for increment", http.StatusBadRequest)
+			httpError(w, r, "Could not parse int64 for increment", http.StatusBadRequest)
 			return
 		}
 	}
 
 	gr := <-s.db.Increment(&storage.IncrementRequest{
-		RequestHeader: storage.RequestHeader{
-			Key:  key,
-			User: storage.UserRoot,
-		},
-		Increment: inputVal,
+		RequestHeader: requestHeader(r, key, nil),
+		Increment:     inputVal,
 	})
 	if gr.Error != nil {
-		http.Error(w, gr.Error.Error(), http.StatusInternalServerError)
+		kvError(w, r, gr.Error)
 		return
 	}
+	w.Header().Set(ValueTypeHeader, engine.TagInteger.String())
+	w.Header().Set("Content-Type", jsonContentType)
 	fmt.Fprintf(w, "%d", gr.NewValue)
 }
 
-func (s *Server) handleEntryPutAction(w http.ResponseWriter, r *http.Request, key engine.Key) {
+func (s *Server) handleEntryPutAction(w http.ResponseWriter, r *request, key engine.Key) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
-	pr := <-s.db.Put(&storage.PutRequest{
-		RequestHeader: storage.RequestHeader{
-			Key:  key,
-			User: storage.UserRoot,
-		},
-		Value: engine.Value{Bytes: b},
-	})
-	if pr.Error != nil {
-		http.Error(w, pr.Error.Error(), http.StatusInternalServerError)
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case ifNoneMatch == "*":
+		// The key must not exist.
+		err = s.conditionalPut(r, key, engine.Value{Bytes: b}, engine.Value{})
+	case ifNoneMatch != "":
+		httpError(w, r, "If-None-Match supports only \"*\"", http.StatusBadRequest)
+		return
+	case ifMatch != "":
+		cur, ok := s.matchEntry(w, r, key, ifMatch)
+		if !ok {
+			return
+		}
+		err = s.conditionalPut(r, key, engine.Value{Bytes: b}, cur)
+	default:
+		pr := <-s.db.Put(&storage.PutRequest{
+			RequestHeader: requestHeader(r, key, nil),
+			Value:         engine.Value{Bytes: b},
+		})
+		err = pr.Error
+	}
+	if cfErr, ok := err.(*storage.ConditionFailedError); ok {
+		preconditionFailed(w, r, key, cfErr.ActualValue)
+		return
+	}
+	if err != nil {
+		kvError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) handleEntryGetAction(w http.ResponseWriter, r *http.Request, key engine.Key) {
-	gr := <-s.db.Get(&storage.GetRequest{
-		RequestHeader: storage.RequestHeader{
-			Key:  key,
-			User: storage.UserRoot,
-		},
-	})
-	if gr.Error != nil {
-		http.Error(w, gr.Error.Error(), http.StatusInternalServerError)
+func (s *Server) handleEntryGetAction(w http.ResponseWriter, r *request, key engine.Key) {
+	value, err := s.getEntry(r, key)
+	if err != nil {
+		kvError(w, r, err)
 		return
 	}
 	// An empty key will not be nil, but have zero length.
-	if gr.Value.Bytes == nil {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	if value.Bytes == nil {
+		httpError(w, r, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	fmt.Fprintf(w, "%s", string(gr.Value.Bytes))
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag(value)) {
+		w.Header().Set("ETag", etag(value))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeEntry(w, r, key, value, http.StatusOK)
 }
 
-func (s *Server) handleEntryHeadAction(w http.ResponseWriter, r *http.Request, key engine.Key) {
+func (s *Server) handleEntryHeadAction(w http.ResponseWriter, r *request, key engine.Key) {
 	cr := <-s.db.Contains(&storage.ContainsRequest{
-		RequestHeader: storage.RequestHeader{
-			Key:  key,
-			User: storage.UserRoot,
-		},
+		RequestHeader: requestHeader(r, key, nil),
 	})
 	if cr.Error != nil {
-		http.Error(w, cr.Error.Error(), http.StatusInternalServerError)
+		kvError(w, r, cr.Error)
 		return
 	}
 	if !cr.Exists {
-		http.Error(w, "", http.StatusNotFound)
+		httpError(w, r, "", http.StatusNotFound)
 		return
 	}
+	w.Header().Set(ValueTypeHeader, cr.Tag.String())
+	if cr.Tag == engine.TagBytes {
+		value, err := s.getEntry(r, key)
+		if err != nil {
+			kvError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", etag(value))
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) handleEntryDeleteAction(w http.ResponseWriter, r *http.Request, key engine.Key) {
-	dr := <-s.db.Delete(&storage.DeleteRequest{
-		RequestHeader: storage.RequestHeader{
-			Key:  key,
-			User: storage.UserRoot,
-		},
+func (s *Server) handleEntryDeleteAction(w http.ResponseWriter, r *request, key engine.Key) {
+	var err error
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case ifNoneMatch == "*":
+		// Deleting a key which doesn't exist is a no-op, so all that
+		// remains is to verify that it doesn't.
+		value, err := s.getEntry(r, key)
+		if err != nil {
+			kvError(w, r, err)
+			return
+		}
+		if value.Bytes != nil {
+			preconditionFailed(w, r, key, &value)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case ifNoneMatch != "":
+		httpError(w, r, "If-None-Match supports only \"*\"", http.StatusBadRequest)
+		return
+	case ifMatch != "":
+		cur, ok := s.matchEntry(w, r, key, ifMatch)
+		if !ok {
+			return
+		}
+		// The delete fails if the value has changed in the meantime.
+		dr := <-s.db.Delete(&storage.DeleteRequest{
+			RequestHeader: requestHeader(r, key, nil),
+			ExpValue:      cur,
+		})
+		err = dr.Error
+	default:
+		dr := <-s.db.Delete(&storage.DeleteRequest{
+			RequestHeader: requestHeader(r, key, nil),
+		})
+		err = dr.Error
+	}
+	if cfErr, ok := err.(*storage.ConditionFailedError); ok {
+		preconditionFailed(w, r, key, cfErr.ActualValue)
+		return
+	}
+	if err != nil {
+		kvError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// getEntry returns the value of key. The value's bytes are nil if
+// the key doesn't exist.
+func (s *Server) getEntry(r *request, key engine.Key) (engine.Value, error) {
+	gr := <-s.db.Get(&storage.GetRequest{
+		RequestHeader: requestHeader(r, key, nil),
+	})
+	return gr.Value, gr.Error
+}
+
+// matchEntry returns the current value of key if its ETag is listed
+// in the If-Match header ifMatch. Otherwise, the request is failed
+// with the current value and false is returned.
+func (s *Server) matchEntry(w http.ResponseWriter, r *request, key engine.Key, ifMatch string) (engine.Value, bool) {
+	value, err := s.getEntry(r, key)
+	if err != nil {
+		kvError(w, r, err)
+		return engine.Value{}, false
+	}
+	if value.Bytes == nil {
+		preconditionFailed(w, r, key, nil)
+		return engine.Value{}, false
+	}
+	if !etagMatches(ifMatch, etag(value)) {
+		preconditionFailed(w, r, key, &value)
+		return engine.Value{}, false
+	}
+	return value, true
+}
+
+// conditionalPut sets key to value if its existing value matches
+// expValue; if expValue's bytes are nil, the key must not exist.
+func (s *Server) conditionalPut(r *request, key engine.Key, value, expValue engine.Value) error {
+	cr := <-s.db.ConditionalPut(&storage.ConditionalPutRequest{
+		RequestHeader: requestHeader(r, key, nil),
+		Value:         value,
+		ExpValue:      expValue,
+	})
+	return cr.Error
+}
+
+// etag returns the entity tag of a value, derived from its checksum
+// and the timestamp at which it was written, so that rewriting a key
+// with the same bytes changes its tag.
+func etag(value engine.Value) string {
+	return fmt.Sprintf("\"%08x-%x-%x\"", value.Checksum, value.Timestamp.WallTime, value.Timestamp.Logical)
+}
+
+// etagMatches returns true if the comma-separated list of entity tags
+// from an If-Match or If-None-Match header is "*" or includes tag.
+func etagMatches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEntry replies to the request with value, its type and ETag, using
+// the HTTP code. The value is a JSON envelope if the client accepts
+// JSON and raw bytes otherwise.
+func writeEntry(w http.ResponseWriter, r *request, key engine.Key, value engine.Value, code int) {
+	w.Header().Set(ValueTypeHeader, value.Tag.String())
+	w.Header().Set("ETag", etag(value))
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(newJSONEntry(key, value))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(code)
+	w.Write(value.Bytes)
+}
+
+// preconditionFailed replies to a conditional request whose condition
+// failed with the actual value of key, or an error if the key doesn't
+// exist.
+func preconditionFailed(w http.ResponseWriter, r *request, key engine.Key, actual *engine.Value) {
+	if actual == nil {
+		httpError(w, r, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	writeEntry(w, r, key, *actual, http.StatusPreconditionFailed)
+}
+
+// rangeBounds parses the start and end keys of a range request from
+// the "start" and "end" query parameters. The end key is required so
+// that requests are bounded.
+func rangeBounds(r *request) (engine.Key, engine.Key, error) {
+	start, end := engine.Key(r.FormValue("start")), engine.Key(r.FormValue("end"))
+	if len(end) == 0 {
+		return nil, nil, fmt.Errorf("end key required")
+	}
+	if !start.Less(end) {
+		return nil, nil, fmt.Errorf("start key %q must be less than end key %q", start, end)
+	}
+	return start, end, nil
+}
+
+// handleRangeScanAction replies with the key/value pairs from start
+// to end as a JSON array. If the positive "limit" query parameter is
+// specified, at most limit pairs are returned and, if keys remain
+// beyond them, the cursor from which to resume the scan is set in the
+// CursorHeader. Otherwise, the pairs are fetched and flushed to the
+// client in batches.
+func (s *Server) handleRangeScanAction(w http.ResponseWriter, r *request) {
+	start, end, err := rangeBounds(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var limit int64
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if limit, err = strconv.ParseInt(limitStr, 10, 64); err != nil || limit <= 0 {
+			httpError(w, r, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		key, err := base64.URLEncoding.DecodeString(cursor)
+		if err != nil || engine.Key(key).Less(start) || !engine.Key(key).Less(end) {
+			httpError(w, r, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		start = key
+	}
+	if limit > 0 {
+		s.scanPage(w, r, start, end, limit)
+		return
+	}
+
+	var count int64
+	enc := json.NewEncoder(w)
+	for first := true; ; first = false {
+		rows, err := s.scan(r, start, end, rangeScanBatchSize)
+		if err != nil {
+			if first {
+				kvError(w, r, err)
+				return
+			}
+			// The response is already underway; abandon it, leaving
+			// the JSON array unterminated so the client sees the failure.
+			log.Errorf("failed to scan %q-%q: %v", start, end, err)
+			return
+		}
+		if first {
+			w.Header().Set("Content-Type", jsonContentType)
+			fmt.Fprint(w, "[")
+		}
+		for _, row := range rows {
+			if count > 0 {
+				fmt.Fprint(w, ",")
+			}
+			if err := enc.Encode(newJSONEntry(row.Key, row.Value)); err != nil {
+				log.Errorf("failed to write scan results: %v", err)
+				return
+			}
+			count++
+		}
+		if len(rows) < rangeScanBatchSize {
+			break
+		}
+		start = engine.NextKey(rows[len(rows)-1].Key)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	fmt.Fprint(w, "]")
+}
+
+// scan returns at most max key/value pairs from start to end.
+func (s *Server) scan(r *request, start, end engine.Key, max int64) ([]engine.KeyValue, error) {
+	sr := <-s.db.Scan(&storage.ScanRequest{
+		RequestHeader: requestHeader(r, start, end),
+		MaxResults:    max,
+	})
+	return sr.Rows, sr.Error
+}
+
+// scanPage replies with at most limit key/value pairs from start to
+// end as a JSON array.
+// The page is buffered so that the cursor, the key from which to
+// resume the scan, can be set in the CursorHeader before the body is
+// written. The cursor is only set if keys remain.
+func (s *Server) scanPage(w http.ResponseWriter, r *request, start, end engine.Key, limit int64) {
+	// Fetch one pair beyond the limit to learn whether keys remain.
+	var rows []engine.KeyValue
+	for int64(len(rows)) <= limit {
+		max := limit + 1 - int64(len(rows))
+		if max > rangeScanBatchSize {
+			max = rangeScanBatchSize
+		}
+		batch, err := s.scan(r, start, end, max)
+		if err != nil {
+			kvError(w, r, err)
+			return
+		}
+		rows = append(rows, batch...)
+		if int64(len(batch)) < max {
+			break
+		}
+		start = engine.NextKey(rows[len(rows)-1].Key)
+	}
+	if int64(len(rows)) > limit {
+		w.Header().Set(CursorHeader, base64.URLEncoding.EncodeToString(rows[limit].Key))
+		rows = rows[:limit]
+	}
+	entries := make([]jsonEntry, len(rows))
+	for i, row := range rows {
+		entries[i] = newJSONEntry(row.Key, row.Value)
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.Errorf("failed to write scan results: %v", err)
+	}
+}
+
+// handleRangeDeleteAction deletes the keys from start to end, or at
+// most the number given by the positive "limit" query parameter if
+// specified, and replies with the number of keys deleted as a JSON
+// number.
+func (s *Server) handleRangeDeleteAction(w http.ResponseWriter, r *request) {
+	start, end, err := rangeBounds(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var limit int64
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		if limit, err = strconv.ParseInt(limitStr, 10, 64); err != nil || limit <= 0 {
+			httpError(w, r, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	dr := <-s.db.DeleteRange(&storage.DeleteRangeRequest{
+		RequestHeader:      requestHeader(r, start, end),
+		MaxEntriesToDelete: limit,
 	})
 	if dr.Error != nil {
-		http.Error(w, dr.Error.Error(), http.StatusInternalServerError)
+		kvError(w, r, dr.Error)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", jsonContentType)
+	fmt.Fprintf(w, "%d", dr.NumDeleted)
+}
+
+// A jsonWatchEvent is the JSON representation of a watched write. Its
+// timestamp is the one at which the write was committed.
+type jsonWatchEvent struct {
+	jsonEntry
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// A jsonWatchBatch is the JSON representation of a batch of watched
+// writes, in timestamp order, and of the timestamp up to which all
+// writes have been delivered.
+type jsonWatchBatch struct {
+	Events   []jsonWatchEvent `json:"events"`
+	Resolved string           `json:"resolved"`
+}
+
+// formatTimestamp formats a timestamp as its wall time and logical
+// component, separated by a period.
+func formatTimestamp(ts hlc.Timestamp) string {
+	return fmt.Sprintf("%d.%d", ts.WallTime, ts.Logical)
+}
+
+// parseTimestamp parses a timestamp formatted by formatTimestamp. The
+// logical component may be omitted.
+func parseTimestamp(s string) (hlc.Timestamp, error) {
+	var ts hlc.Timestamp
+	parts := strings.SplitN(s, ".", 2)
+	var err error
+	if ts.WallTime, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return hlc.Timestamp{}, err
+	}
+	if len(parts) == 2 {
+		if ts.Logical, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return hlc.Timestamp{}, err
+		}
+	}
+	return ts, nil
+}
+
+// handleWatchAction streams the writes committed to the keys from
+// start to end after the "timestamp" query parameter, or after the
+// current time if it's omitted. The response is a stream of JSON
+// objects, one per line, each holding a batch of writes in timestamp
+// order and the resolved timestamp, up to which all writes have been
+// delivered. A batch is flushed to the client as soon as writes are
+// committed and, in their absence, every watchWait, or every duration
+// given by the "wait" query parameter (such as "500ms"), which may not
+// exceed maxWatchWait. An interrupted
+// watch is resumed by passing the last resolved timestamp as the
+// "timestamp" parameter. Ranges retain only their most recent writes
+// (at most 10000 per range), in memory, and forget them when a node
+// restarts or a range moves to another node. If the writes since the
+// timestamp have been forgotten, the request fails with status 410;
+// the client should then rescan the keys and watch again. Writes
+// within a transaction are streamed once it commits. The stream ends
+// when the client disconnects.
+func (s *Server) handleWatchAction(w http.ResponseWriter, r *request) {
+	if r.Header.Get(TxnHeader) != "" {
+		httpError(w, r, "watches are not supported within a transaction", http.StatusBadRequest)
+		return
+	}
+	start, end, err := rangeBounds(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ts hlc.Timestamp
+	if tsStr := r.FormValue("timestamp"); tsStr != "" {
+		if ts, err = parseTimestamp(tsStr); err != nil {
+			httpError(w, r, "invalid timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	wait := watchWait
+	if waitStr := r.FormValue("wait"); waitStr != "" {
+		if wait, err = time.ParseDuration(waitStr); err != nil || wait < 0 || wait > maxWatchWait {
+			httpError(w, r, fmt.Sprintf("wait must be a duration of at most %s", maxWatchWait), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The stream ends once the client disconnects; response writers
+	// which can't notify of that leave it to a failed write.
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	enc := json.NewEncoder(w)
+	for first := true; ; first = false {
+		select {
+		case <-closed:
+			return
+		default:
+		}
+		wr := <-s.db.Watch(&storage.WatchRequest{
+			RequestHeader:  requestHeader(r, start, end),
+			StartTimestamp: ts,
+			Wait:           wait,
+		})
+		if wr.Error != nil {
+			if first {
+				kvError(w, r, wr.Error)
+				return
+			}
+			// The response is already underway; end it with the error.
+			log.Errorf("failed to watch %q-%q: %v", start, end, wr.Error)
+			enc.Encode(jsonError{Error: wr.Error.Error()})
+			return
+		}
+		if first {
+			w.Header().Set("Content-Type", jsonContentType)
+		}
+		batch := jsonWatchBatch{
+			Events:   make([]jsonWatchEvent, len(wr.Events)),
+			Resolved: formatTimestamp(wr.ResolvedTimestamp),
+		}
+		for i, e := range wr.Events {
+			batch.Events[i] = jsonWatchEvent{
+				jsonEntry: newJSONEntry(e.Key, e.Value),
+				Deleted:   e.Deleted,
+			}
+		}
+		if err := enc.Encode(batch); err != nil {
+			log.Errorf("failed to write watch results: %v", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if ts.Less(wr.ResolvedTimestamp) {
+			ts = wr.ResolvedTimestamp
+		}
+	}
 }
@@ -22,10 +22,15 @@ package rest_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -34,6 +39,7 @@ import (
 	"github.com/cockroachdb/cockroach/server"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -267,36 +273,40 @@ func TestIncrement(t *testing.T) {
 		},
 		{
 			NewRequest("GET", "some_key", "", rest.CounterPrefix),
-			NewResponse(200, "0"),
+			NewResponse(200, "0", "application/json"),
 		},
 		{
 			NewRequest("POST", "some_key", "2", rest.CounterPrefix),
-			NewResponse(200, "2"),
+			NewResponse(200, "2", "application/json"),
 		},
 		{
 			NewRequest("GET", "some_key", "", rest.CounterPrefix),
-			NewResponse(200, "2"),
+			NewResponse(200, "2", "application/json"),
 		},
 		{
 			NewRequest("POST", "some_key", "-3", rest.CounterPrefix),
-			NewResponse(200, "-1"),
+			NewResponse(200, "-1", "application/json"),
 		},
 		{
 			NewRequest("POST", "some_key", "0", rest.CounterPrefix),
-			NewResponse(200, "-1"),
+			NewResponse(200, "-1", "application/json"),
 		},
 	})
 }
 
 func TestCounterAndEntryInteraction(t *testing.T) {
-	// TODO(zbrock + matthew) Counters and Entries aren't currently distinguished in the storage layer. When they are, implement checking for types.
-	t.Skip("Counter operations shouldn't work on Entry values and vice versa")
+	s := startNewServer()
+	// Set our key as an Entry.
+	pr := <-s.db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Key: engine.Key("some_entry"), User: storage.UserRoot},
+		Value:         engine.Value{Bytes: []byte("some value")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	entryErr := `key "some_entry" holds a value of type bytes; expected integer` + "\n"
+	counterErr := `key "some_counter" holds a value of type integer; expected bytes` + "\n"
 	runHTTPTestFixture(t, []RequestResponse{
-		// Set our key as an Entry.
-		{
-			NewRequest("POST", "some_entry", "some value"),
-			NewResponse(200),
-		},
 		// Counter operations should fail.
 		//		{ TODO(zbrock+matthew) Implement HEAD for Counter API
 		//			NewRequest("HEAD", "some_entry", "", rest.CounterPrefix),
@@ -304,31 +314,47 @@ func TestCounterAndEntryInteraction(t *testing.T) {
 		//		},
 		{
 			NewRequest("GET", "some_entry", "", rest.CounterPrefix),
-			NewResponse(400, statusText(400)),
+			NewResponse(400, entryErr),
 		},
 		{
 			NewRequest("POST", "some_entry", "2", rest.CounterPrefix),
-			NewResponse(400, statusText(400)),
+			NewResponse(400, entryErr),
 		},
 		// Set our key as a Counter.
 		{
 			NewRequest("POST", "some_counter", "2", rest.CounterPrefix),
-			NewResponse(200, "2"),
+			NewResponse(200, "2", "application/json"),
 		},
-		// Entry operations should fail.
+		// HEAD reports the counter exists; other entry operations fail.
 		{
 			NewRequest("HEAD", "some_counter"),
-			NewResponse(400, statusText(400)),
+			NewResponse(200, "", ""),
 		},
 		{
 			NewRequest("GET", "some_counter"),
-			NewResponse(400, statusText(400)),
+			NewResponse(400, counterErr),
 		},
 		{
 			NewRequest("POST", "some_counter", "some value"),
-			NewResponse(400, statusText(400)),
+			NewResponse(400, counterErr),
 		},
-	})
+	}, s)
+
+	// HEAD and GET report the type of the value.
+	for key, expType := range map[string]string{"some_entry": "bytes", "some_counter": "integer"} {
+		resp, err := http.Head(s.httpServer.URL + rest.EntryPrefix + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if valueType := resp.Header.Get(rest.ValueTypeHeader); valueType != expType {
+			t.Errorf("%s: expected value type %q; got %q", key, expType, valueType)
+		}
+	}
+	var entry scanEntry
+	if status := getJSON(t, s.httpServer.URL+rest.EntryPrefix+"some_entry", &entry); status != 200 || entry.Type != "bytes" {
+		t.Errorf("expected JSON entry of type bytes; got %d, %+v", status, entry)
+	}
 }
 
 // TestNullPrefixedKeys makes sure that the internal system keys are not accessible through the HTTP API.
@@ -402,6 +428,677 @@ func TestKeysAndBodyArePreserved(t *testing.T) {
 	}
 }
 
+// getJSON issues a GET request for url accepting JSON and decodes
+// the response body into v. Returns the response status code.
+func getJSON(t *testing.T, url string, v interface{}) int {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type; got %q", ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestJSONEntry(t *testing.T) {
+	s := startNewServer()
+	pr := <-s.db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Key: engine.Key("my_key"), User: storage.UserRoot},
+		Value:         engine.Value{Bytes: []byte("is cool")},
+	})
+	if pr.Error != nil {
+		t.Fatal(pr.Error)
+	}
+	// Raw bytes remain the default.
+	runHTTPTestFixture(t, []RequestResponse{
+		{
+			NewRequest("GET", "my_key"),
+			NewResponse(200, "is cool", "application/octet-stream"),
+		},
+	}, s)
+
+	var entry scanEntry
+	if status := getJSON(t, s.httpServer.URL+rest.EntryPrefix+"my_key", &entry); status != 200 {
+		t.Fatalf("expected status 200; got %d", status)
+	}
+	if entry.Key != "my_key" || string(entry.Value) != "is cool" || entry.Checksum != crc32.ChecksumIEEE([]byte("is cool")) {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	var jsonErr struct {
+		Error string `json:"error"`
+	}
+	if status := getJSON(t, s.httpServer.URL+rest.EntryPrefix+"missing_key", &jsonErr); status != 404 || jsonErr.Error != "Not Found" {
+		t.Errorf("expected JSON not found error; got %d, %+v", status, jsonErr)
+	}
+	if status := getJSON(t, s.httpServer.URL+rest.CounterPrefix, &jsonErr); status != 400 || jsonErr.Error != "empty key not allowed" {
+		t.Errorf("expected JSON bad request error; got %d, %+v", status, jsonErr)
+	}
+}
+
+// entryRequest issues a request with the specified method, body and
+// header against key's entry endpoint. Returns the response status
+// code, body and ETag.
+func (s *kvTestServer) entryRequest(t *testing.T, method, key, body string, header http.Header) (int, string, string) {
+	req, err := http.NewRequest(method, s.httpServer.URL+rest.EntryPrefix+key, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b), resp.Header.Get("ETag")
+}
+
+// TestConditionalEntry verifies that GET and HEAD return an ETag and
+// that PUT and DELETE requests are conditional on If-Match and
+// If-None-Match, replying with the actual value when the condition
+// fails.
+func TestConditionalEntry(t *testing.T) {
+	s := startNewServer()
+	ifMatch := func(etag string) http.Header { return http.Header{"If-Match": {etag}} }
+	ifNoneMatch := http.Header{"If-None-Match": {"*"}}
+
+	// Create the key only if it doesn't exist.
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "v1", ifNoneMatch); status != 200 {
+		t.Fatalf("expected conditional create to succeed; got %d", status)
+	}
+	status, body, etag1 := s.entryRequest(t, "PUT", "key", "v2", ifNoneMatch)
+	if status != 412 || body != "v1" || etag1 == "" {
+		t.Errorf("expected 412 with actual value and ETag; got %d, %q, %q", status, body, etag1)
+	}
+	if status, _, etag := s.entryRequest(t, "HEAD", "key", "", nil); status != 200 || etag != etag1 {
+		t.Errorf("expected HEAD to return ETag %q; got %d, %q", etag1, status, etag)
+	}
+	if status, body, etag := s.entryRequest(t, "GET", "key", "", nil); status != 200 || body != "v1" || etag != etag1 {
+		t.Errorf("expected GET to return value with ETag %q; got %d, %q, %q", etag1, status, body, etag)
+	}
+	if status, _, _ := s.entryRequest(t, "GET", "key", "", http.Header{"If-None-Match": {etag1}}); status != 304 {
+		t.Errorf("expected GET of unmodified value to return 304; got %d", status)
+	}
+
+	// Update the key only if its ETag matches.
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "v2", ifMatch(etag1)); status != 200 {
+		t.Fatalf("expected conditional update to succeed; got %d", status)
+	}
+	_, _, etag2 := s.entryRequest(t, "HEAD", "key", "", nil)
+	if etag2 == etag1 {
+		t.Fatalf("expected ETag to change from %q", etag1)
+	}
+	status, body, etag := s.entryRequest(t, "PUT", "key", "v3", ifMatch(etag1))
+	if status != 412 || body != "v2" || etag != etag2 {
+		t.Errorf("expected 412 with actual value and ETag %q; got %d, %q, %q", etag2, status, body, etag)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "missing", "v", ifMatch("*")); status != 412 {
+		t.Errorf("expected conditional update of missing key to fail; got %d", status)
+	}
+
+	// Delete the key only if its ETag matches.
+	if status, body, _ := s.entryRequest(t, "DELETE", "key", "", ifMatch(etag1)); status != 412 || body != "v2" {
+		t.Errorf("expected 412 with actual value; got %d, %q", status, body)
+	}
+	if status, body, _ := s.entryRequest(t, "DELETE", "key", "", ifNoneMatch); status != 412 || body != "v2" {
+		t.Errorf("expected 412 with actual value; got %d, %q", status, body)
+	}
+	if status, _, _ := s.entryRequest(t, "DELETE", "key", "", ifMatch(etag2)); status != 200 {
+		t.Fatalf("expected conditional delete to succeed; got %d", status)
+	}
+	if val, err := s.rawGet(engine.Key("key")); err != nil || val != nil {
+		t.Errorf("expected key to be deleted; got %q, %v", val, err)
+	}
+	if status, _, _ := s.entryRequest(t, "DELETE", "key", "", ifNoneMatch); status != 200 {
+		t.Errorf("expected conditional delete of missing key to succeed; got %d", status)
+	}
+}
+
+// TestEntryETagTimestamp verifies that the ETag of a value changes
+// when the key is rewritten with the same bytes, so that a conditional
+// update based on the previous write fails.
+func TestEntryETagTimestamp(t *testing.T) {
+	s := startNewServer()
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "v", nil); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	_, _, etag1 := s.entryRequest(t, "HEAD", "key", "", nil)
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "v", nil); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	_, _, etag2 := s.entryRequest(t, "HEAD", "key", "", nil)
+	if etag1 == "" || etag1 == etag2 {
+		t.Fatalf("expected ETag to change on rewrite; got %q, %q", etag1, etag2)
+	}
+	status, body, etag := s.entryRequest(t, "PUT", "key", "w", http.Header{"If-Match": {etag1}})
+	if status != 412 || body != "v" || etag != etag2 {
+		t.Errorf("expected 412 with actual value and ETag %q; got %d, %q, %q", etag2, status, body, etag)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "w", http.Header{"If-Match": {etag2}}); status != 200 {
+		t.Errorf("expected conditional update with current ETag to succeed; got %d", status)
+	}
+}
+
+// A userRecordingDB records the user of each Put request.
+type userRecordingDB struct {
+	kv.DB
+	users []string
+}
+
+func (db *userRecordingDB) Put(args *storage.PutRequest) <-chan *storage.PutResponse {
+	db.users = append(db.users, args.User)
+	return db.DB.Put(args)
+}
+
+// TestAuthenticatedUser verifies that operations are executed on
+// behalf of the user who authenticated the request and that
+// anonymous requests are rejected.
+func TestAuthenticatedUser(t *testing.T) {
+	s := startNewServer()
+	db := &userRecordingDB{DB: s.db}
+	restServer := rest.NewRESTServer(db)
+	put := func(user string) int {
+		req, err := http.NewRequest("PUT", rest.EntryPrefix+"a", strings.NewReader("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		restServer.HandleAction(w, req, user)
+		return w.Code
+	}
+	if code := put("alice"); code != http.StatusOK {
+		t.Errorf("expected 200; got %d", code)
+	}
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous request to be rejected with 401; got %d", code)
+	}
+	if len(db.users) != 1 || db.users[0] != "alice" {
+		t.Errorf("expected one put on behalf of \"alice\"; got %v", db.users)
+	}
+}
+
+// txnRequest issues a request for the transaction action with the
+// transaction ID in the transaction header, if not empty.
+func (s *kvTestServer) txnRequest(t *testing.T, action, txID string) *http.Response {
+	req, err := http.NewRequest("POST", s.httpServer.URL+rest.TxnPrefix+action, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txID != "" {
+		req.Header.Set(rest.TxnHeader, txID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// beginTxn begins a transaction and returns its ID.
+func (s *kvTestServer) beginTxn(t *testing.T) string {
+	resp := s.txnRequest(t, "begin", "")
+	txID := resp.Header.Get(rest.TxnHeader)
+	if resp.StatusCode != 200 || txID == "" {
+		t.Fatalf("expected transaction to begin; got %d, %q", resp.StatusCode, txID)
+	}
+	return txID
+}
+
+// counterRequest increments the counter at key by delta with the
+// specified header and returns the response status code and body.
+func (s *kvTestServer) counterRequest(t *testing.T, key string, delta int64, header http.Header) (int, string) {
+	req, err := http.NewRequest("POST", s.httpServer.URL+rest.CounterPrefix+key, strings.NewReader(strconv.FormatInt(delta, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// TestTransaction verifies that transactions are begun, committed and
+// aborted via the transaction endpoints and that a transaction's
+// writes are applied when it commits.
+func TestTransaction(t *testing.T) {
+	s := startNewServer()
+	if status, _, _ := s.entryRequest(t, "PUT", "key4", "value4", nil); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	txID := s.beginTxn(t)
+	txn := http.Header{rest.TxnHeader: {txID}}
+	if status := s.txnRequest(t, "begin", txID).StatusCode; status != 400 {
+		t.Errorf("expected nested transaction to be rejected; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "value", txn); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key2", "value2", txn); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "DELETE", "key2", "", txn); status != 200 {
+		t.Fatalf("expected delete to succeed; got %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status, body := s.counterRequest(t, "key3", 1, txn); status != 200 || body != strconv.Itoa(i+1) {
+			t.Fatalf("expected increment within transaction to succeed; got %d, %q", status, body)
+		}
+	}
+	req, err := http.NewRequest("DELETE", s.httpServer.URL+rest.RangePrefix+"?start=key4&end=key5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = txn
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected range delete within transaction to succeed; got %d", resp.StatusCode)
+	}
+	if status := s.txnRequest(t, "commit", "").StatusCode; status != 400 {
+		t.Errorf("expected commit without transaction to be rejected; got %d", status)
+	}
+	if status := s.txnRequest(t, "commit", txID).StatusCode; status != 200 {
+		t.Fatalf("expected commit to succeed; got %d", status)
+	}
+	if status, body, _ := s.entryRequest(t, "GET", "key", "", nil); status != 200 || body != "value" {
+		t.Errorf("expected committed value; got %d, %q", status, body)
+	}
+	if status, _, _ := s.entryRequest(t, "GET", "key2", "", nil); status != 404 {
+		t.Errorf("expected key deleted within transaction to be absent; got %d", status)
+	}
+	if status, body := s.counterRequest(t, "key3", 0, nil); status != 200 || body != "2" {
+		t.Errorf("expected committed increments; got %d, %q", status, body)
+	}
+	if status, _, _ := s.entryRequest(t, "GET", "key4", "", nil); status != 404 {
+		t.Errorf("expected key deleted by range within transaction to be absent; got %d", status)
+	}
+	if status := s.txnRequest(t, "commit", txID).StatusCode; status != 409 {
+		t.Errorf("expected second commit to conflict; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "GET", "key", "", txn); status != 409 {
+		t.Errorf("expected read in committed transaction to conflict; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "late", txn); status != 409 {
+		t.Errorf("expected write in committed transaction to conflict; got %d", status)
+	}
+	if status := s.txnRequest(t, "rollback", txID).StatusCode; status != 404 {
+		t.Errorf("expected unknown action to be rejected; got %d", status)
+	}
+}
+
+// TestTransactionIsolation verifies that other requests conflict with
+// the keys a pending transaction has written, while reads within the
+// transaction see its writes.
+func TestTransactionIsolation(t *testing.T) {
+	s := startNewServer()
+	if status, _, _ := s.entryRequest(t, "PUT", "b", "old", nil); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "c", "old", nil); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	txID := s.beginTxn(t)
+	txn := http.Header{rest.TxnHeader: {txID}}
+	for _, key := range []string{"a", "b"} {
+		if status, _, _ := s.entryRequest(t, "PUT", key, "new", txn); status != 200 {
+			t.Fatalf("expected put to succeed; got %d", status)
+		}
+	}
+	if status, _, _ := s.entryRequest(t, "DELETE", "c", "", txn); status != 200 {
+		t.Fatalf("expected delete to succeed; got %d", status)
+	}
+
+	// Other requests conflict with the transaction's writes, which
+	// aren't applied until it commits.
+	for _, method := range []string{"GET", "HEAD", "PUT", "DELETE"} {
+		if status, _, _ := s.entryRequest(t, method, "c", "other", nil); status != 409 {
+			t.Errorf("expected %s of key written by pending transaction to conflict; got %d", method, status)
+		}
+	}
+	resp, err := http.Get(s.httpServer.URL + rest.RangePrefix + "?start=a&end=z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 409 || resp.Header.Get(rest.RetryableHeader) != "true" {
+		t.Errorf("expected scan over pending transaction's writes to conflict and be retryable; got %d", resp.StatusCode)
+	}
+	if val, err := s.rawGet(engine.Key("a")); err != nil || val != nil {
+		t.Errorf("expected nothing written for uncommitted put; got %q, %v", val, err)
+	}
+	if val, err := s.rawGet(engine.Key("b")); err != nil || string(val) != "old" {
+		t.Errorf("expected uncommitted update not to be applied; got %q, %v", val, err)
+	}
+
+	// Reads within the transaction see its writes.
+	if status, body, _ := s.entryRequest(t, "GET", "a", "", txn); status != 200 || body != "new" {
+		t.Errorf("expected transaction to read its own put; got %d, %q", status, body)
+	}
+	if status, _, _ := s.entryRequest(t, "HEAD", "c", "", txn); status != 404 {
+		t.Errorf("expected transaction to read its own delete; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "a", "newer", http.Header{rest.TxnHeader: {txID}, "If-None-Match": {"*"}}); status != 412 {
+		t.Errorf("expected conditional put to see the transaction's write; got %d", status)
+	}
+	req, err := http.NewRequest("GET", s.httpServer.URL+rest.RangePrefix+"?start=a&end=z&limit=10", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = txn
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var entries []scanEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "a" || entries[1].Key != "b" || string(entries[1].Value) != "new" {
+		t.Errorf("expected scan within transaction to see its writes; got %+v", entries)
+	}
+
+	// Once committed, all of the transaction's writes are visible.
+	if status := s.txnRequest(t, "commit", txID).StatusCode; status != 200 {
+		t.Fatalf("expected commit to succeed; got %d", status)
+	}
+	entries, _ = s.rangeScan(t, url.Values{"start": {"a"}, "end": {"z"}})
+	if len(entries) != 2 || entries[0].Key != "a" || entries[1].Key != "b" || string(entries[1].Value) != "new" {
+		t.Errorf("expected scan to see committed writes; got %+v", entries)
+	}
+}
+
+// TestTransactionAbort verifies that an aborted transaction's writes
+// are never visible and that it can no longer be used.
+func TestTransactionAbort(t *testing.T) {
+	s := startNewServer()
+	txID := s.beginTxn(t)
+	txn := http.Header{rest.TxnHeader: {txID}}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "value", txn); status != 200 {
+		t.Fatalf("expected put to succeed; got %d", status)
+	}
+	if status := s.txnRequest(t, "abort", txID).StatusCode; status != 200 {
+		t.Fatalf("expected abort to succeed; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "GET", "key", "", nil); status != 404 {
+		t.Errorf("expected aborted put to be invisible; got %d", status)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "value", txn); status != 409 {
+		t.Errorf("expected put in aborted transaction to conflict; got %d", status)
+	}
+	if status := s.txnRequest(t, "abort", txID).StatusCode; status != 200 {
+		t.Errorf("expected second abort to succeed; got %d", status)
+	}
+	if status := s.txnRequest(t, "commit", txID).StatusCode; status != 409 {
+		t.Errorf("expected commit of aborted transaction to conflict; got %d", status)
+	}
+	if val, err := s.rawGet(engine.Key("key")); err != nil || val != nil {
+		t.Errorf("expected aborted put never to be written; got %q, %v", val, err)
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "key", "other", nil); status != 200 {
+		t.Errorf("expected put after abort to succeed; got %d", status)
+	}
+}
+
+// TestTransactionConflict verifies that a concurrent writer can't
+// modify the keys a pending transaction has written, so that the
+// transaction's commit applies all of its writes.
+func TestTransactionConflict(t *testing.T) {
+	s := startNewServer()
+	txID := s.beginTxn(t)
+	txn := http.Header{rest.TxnHeader: {txID}}
+	for _, key := range []string{"a", "b"} {
+		if status, _, _ := s.entryRequest(t, "PUT", key, "txn", txn); status != 200 {
+			t.Fatalf("expected put to succeed; got %d", status)
+		}
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "b", "other", nil); status != 409 {
+		t.Errorf("expected concurrent put to conflict; got %d", status)
+	}
+	other := http.Header{rest.TxnHeader: {s.beginTxn(t)}}
+	if status, _, _ := s.entryRequest(t, "PUT", "b", "other", other); status != 409 {
+		t.Errorf("expected put by another transaction to conflict; got %d", status)
+	}
+	if status := s.txnRequest(t, "commit", txID).StatusCode; status != 200 {
+		t.Fatalf("expected commit to succeed; got %d", status)
+	}
+	for _, key := range []string{"a", "b"} {
+		if status, body, _ := s.entryRequest(t, "GET", key, "", nil); status != 200 || body != "txn" {
+			t.Errorf("expected committed write to %q; got %d, %q", key, status, body)
+		}
+	}
+	if status, _, _ := s.entryRequest(t, "PUT", "b", "other", nil); status != 200 {
+		t.Errorf("expected put after commit to succeed; got %d", status)
+	}
+}
+
+// scanEntry is a key/value pair returned as JSON.
+type scanEntry struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Type     string `json:"type"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// rangeScan scans the range at the given query and returns the
+// decoded entries and the cursor header.
+func (s *kvTestServer) rangeScan(t *testing.T, query url.Values) ([]scanEntry, string) {
+	resp, err := http.Get(s.httpServer.URL + rest.RangePrefix + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("expected status 200 scanning %v; got %d: %s", query, resp.StatusCode, b)
+	}
+	var entries []scanEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries, resp.Header.Get(rest.CursorHeader)
+}
+
+func TestRangeScan(t *testing.T) {
+	s := startNewServer()
+	var expKeys []string
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("range_%03d", i)
+		expKeys = append(expKeys, key)
+		if err := kv.PutI(s.db, engine.Key(key), i, hlc.Timestamp{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unlimited scan spanning multiple batches.
+	entries, cursor := s.rangeScan(t, url.Values{"start": {"range_"}, "end": {"range_z"}})
+	if len(entries) != len(expKeys) || cursor != "" {
+		t.Fatalf("expected %d entries and no cursor; got %d, %q", len(expKeys), len(entries), cursor)
+	}
+	for i, entry := range entries {
+		if entry.Key != expKeys[i] || len(entry.Value) == 0 {
+			t.Errorf("%d: expected key %q with value; got %+v", i, expKeys[i], entry)
+		}
+	}
+
+	// Paginate using cursors.
+	var keys []string
+	query := url.Values{"start": {"range_"}, "end": {"range_z"}, "limit": {"120"}}
+	for pages := 0; ; pages++ {
+		entries, cursor := s.rangeScan(t, query)
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+		if cursor == "" {
+			if pages != 2 {
+				t.Errorf("expected 3 pages; got %d", pages+1)
+			}
+			break
+		}
+		query.Set("cursor", cursor)
+	}
+	if !reflect.DeepEqual(keys, expKeys) {
+		t.Errorf("expected paginated keys %v; got %v", expKeys, keys)
+	}
+
+	// No cursor is returned when a page ends exactly at the last key.
+	query = url.Values{"start": {"range_"}, "end": {"range_z"}, "limit": {"125"}}
+	entries, cursor = s.rangeScan(t, query)
+	if len(entries) != 125 || cursor == "" {
+		t.Fatalf("expected 125 entries and a cursor; got %d, %q", len(entries), cursor)
+	}
+	query.Set("cursor", cursor)
+	if entries, cursor = s.rangeScan(t, query); len(entries) != 125 || cursor != "" {
+		t.Errorf("expected 125 entries and no cursor; got %d, %q", len(entries), cursor)
+	}
+	if entries[len(entries)-1].Key != expKeys[len(expKeys)-1] {
+		t.Errorf("expected last key %q; got %q", expKeys[len(expKeys)-1], entries[len(entries)-1].Key)
+	}
+
+	runHTTPTestFixture(t, []RequestResponse{
+		{
+			NewRequest("GET", "?start=a", "", rest.RangePrefix),
+			NewResponse(400, "end key required\n"),
+		},
+		{
+			NewRequest("GET", "?start=b&end=a", "", rest.RangePrefix),
+			NewResponse(400, "start key \"b\" must be less than end key \"a\"\n"),
+		},
+		{
+			NewRequest("GET", "?start=a&end=b&limit=0", "", rest.RangePrefix),
+			NewResponse(400, "limit must be a positive integer\n"),
+		},
+		{
+			NewRequest("GET", "?start=a&end=b&cursor=Yw==", "", rest.RangePrefix),
+			NewResponse(400, "invalid cursor\n"),
+		},
+	}, s)
+}
+
+func TestRangeDelete(t *testing.T) {
+	s := startNewServer()
+	for _, key := range []string{"range_a", "range_b", "range_c"} {
+		if err := kv.PutI(s.db, engine.Key(key), key, hlc.Timestamp{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runHTTPTestFixture(t, []RequestResponse{
+		{
+			NewRequest("DELETE", "?start=range_a", "", rest.RangePrefix),
+			NewResponse(400, "end key required\n"),
+		},
+		{
+			NewRequest("DELETE", "?start=range_a&end=range_c", "", rest.RangePrefix),
+			NewResponse(200, "2", "application/json"),
+		},
+	}, s)
+	if entries, _ := s.rangeScan(t, url.Values{"start": {"range_"}, "end": {"range_z"}}); len(entries) != 1 || entries[0].Key != "range_c" {
+		t.Errorf("expected only \"range_c\" to remain; got %+v", entries)
+	}
+}
+
+// watchBatch is a batch of watched writes returned as JSON.
+type watchBatch struct {
+	Events []struct {
+		scanEntry
+		Timestamp string `json:"timestamp"`
+		Deleted   bool   `json:"deleted"`
+	} `json:"events"`
+	Resolved string `json:"resolved"`
+}
+
+func TestWatch(t *testing.T) {
+	s := startNewServer()
+	start := (<-s.db.Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("watch_a"), User: storage.UserRoot}})).Timestamp
+	for _, key := range []string{"watch_a", "other"} {
+		if err := kv.PutI(s.db, engine.Key(key), key, hlc.Timestamp{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := url.Values{"start": {"watch_"}, "end": {"watch_z"}, "timestamp": {fmt.Sprintf("%d.%d", start.WallTime, start.Logical)}}
+	resp, err := http.Get(s.httpServer.URL + rest.WatchPrefix + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected status 200 with JSON; got %d, %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	dec := json.NewDecoder(resp.Body)
+	var batch watchBatch
+	if err := dec.Decode(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Events) != 1 || batch.Events[0].Key != "watch_a" || batch.Events[0].Deleted || batch.Resolved == "" {
+		t.Fatalf("expected write to \"watch_a\"; got %+v", batch)
+	}
+	if ts := batch.Events[0].Timestamp; ts == "" || ts == "0.0" {
+		t.Errorf("expected write to carry its commit timestamp; got %q", ts)
+	}
+
+	// Writes committed while the watch is underway are streamed.
+	if dr := <-s.db.Delete(&storage.DeleteRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("watch_a"), User: storage.UserRoot}}); dr.Error != nil {
+		t.Fatal(dr.Error)
+	}
+	if err := dec.Decode(&batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Events) != 1 || batch.Events[0].Key != "watch_a" || !batch.Events[0].Deleted {
+		t.Fatalf("expected deletion of \"watch_a\"; got %+v", batch)
+	}
+
+	runHTTPTestFixture(t, []RequestResponse{
+		{
+			NewRequest("GET", "?start=watch_", "", rest.WatchPrefix),
+			NewResponse(400, "end key required\n"),
+		},
+		{
+			NewRequest("GET", "?start=watch_&end=watch_z&timestamp=x", "", rest.WatchPrefix),
+			NewResponse(400, "invalid timestamp\n"),
+		},
+	}, s)
+
+	// A watch of forgotten writes is gone.
+	resp, err = http.Get(s.httpServer.URL + rest.WatchPrefix + "?start=watch_&end=watch_z&timestamp=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 410 {
+		t.Errorf("expected status 410 watching forgotten writes; got %d", resp.StatusCode)
+	}
+}
+
 func runHTTPTestFixture(t *testing.T, testcases []RequestResponse, args ...*kvTestServer) *kvTestServer {
 	var s *kvTestServer
 
@@ -478,7 +1175,8 @@ func startNewServer() *kvTestServer {
 	// Initialize the REST server.
 	s.rest = rest.NewRESTServer(s.db)
 	s.httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s.rest.HandleAction(w, r)
+		// Requests are authenticated as the root user.
+		s.rest.HandleAction(w, r, storage.UserRoot)
 	}))
 
 	return s
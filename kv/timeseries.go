@@ -0,0 +1,218 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+const (
+	// TimeSeriesInterval is the span of time covered by a single time
+	// series key. Each key holds one count per TimeSeriesResolution
+	// within the interval.
+	TimeSeriesInterval = time.Minute
+	// TimeSeriesResolution is the finest resolution at which time
+	// series data is stored.
+	TimeSeriesResolution = time.Second
+)
+
+// A TimeSeriesDatapoint is a single downsampled value of a time
+// series, as returned by QueryTimeSeries.
+type TimeSeriesDatapoint struct {
+	Timestamp int64 // Start of the sample period in Unix seconds
+	Value     int64 // Sum of all counts, or last gauge value, within the sample period
+}
+
+// MakeTimeSeriesKey returns the key holding counts for the named time
+// series over the TimeSeriesInterval which contains t. Keys for a
+// series sort in time order.
+func MakeTimeSeriesKey(name string, t time.Time) engine.Key {
+	k := encoding.EncodeString(append([]byte(nil), engine.KeyTimeSeriesPrefix...), name)
+	return engine.Key(encoding.EncodeInt(k, t.Truncate(TimeSeriesInterval).Unix()))
+}
+
+// decodeTimeSeriesKey returns the series name and the start of the
+// interval encoded in a key made by MakeTimeSeriesKey.
+func decodeTimeSeriesKey(key engine.Key) (string, time.Time, error) {
+	if !bytes.HasPrefix(key, engine.KeyTimeSeriesPrefix) {
+		return "", time.Time{}, util.Errorf("key %q is not a time series key", key)
+	}
+	b, name := encoding.DecodeString(key[len(engine.KeyTimeSeriesPrefix):])
+	_, secs := encoding.DecodeInt(b)
+	return name, time.Unix(secs, 0), nil
+}
+
+// MakeTimeSeriesGaugeKey returns the key holding the value of the
+// named gauge series at the TimeSeriesResolution slot which contains
+// t. Keys for a series sort in time order.
+func MakeTimeSeriesGaugeKey(name string, t time.Time) engine.Key {
+	k := encoding.EncodeString(append([]byte(nil), engine.KeyTimeSeriesGaugePrefix...), name)
+	return engine.Key(encoding.EncodeInt(k, t.Truncate(TimeSeriesResolution).Unix()))
+}
+
+// decodeTimeSeriesGaugeKey returns the series name and the sample
+// time encoded in a key made by MakeTimeSeriesGaugeKey.
+func decodeTimeSeriesGaugeKey(key engine.Key) (string, time.Time, error) {
+	if !bytes.HasPrefix(key, engine.KeyTimeSeriesGaugePrefix) {
+		return "", time.Time{}, util.Errorf("key %q is not a gauge time series key", key)
+	}
+	b, name := encoding.DecodeString(key[len(engine.KeyTimeSeriesGaugePrefix):])
+	_, secs := encoding.DecodeInt(b)
+	return name, time.Unix(secs, 0), nil
+}
+
+// AccumulateTimeSeries adds value to the count of the named time
+// series at time t.
+func AccumulateTimeSeries(db DB, name string, t time.Time, value int64) error {
+	offset := t.Sub(t.Truncate(TimeSeriesInterval)) / TimeSeriesResolution
+	counts := make([]int64, offset+1)
+	counts[offset] = value
+	reply := <-db.AccumulateTS(&storage.AccumulateTSRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  MakeTimeSeriesKey(name, t),
+			User: storage.UserRoot,
+		},
+		Counts: counts,
+	})
+	return reply.Error
+}
+
+// RecordTimeSeriesGauge sets the value of the named gauge series at
+// time t. Unlike AccumulateTimeSeries, values aren't merged: a later
+// value recorded within the same TimeSeriesResolution slot replaces
+// the earlier one.
+func RecordTimeSeriesGauge(db DB, name string, t time.Time, value int64) error {
+	return PutI(db, MakeTimeSeriesGaugeKey(name, t), value, hlc.Timestamp{})
+}
+
+// QueryTimeSeries reads the named time series over the window
+// [start, end) and downsamples it to the supplied resolution, which
+// must be a positive multiple of TimeSeriesResolution. Each returned
+// datapoint sums the counts within its sample period; periods whose
+// counts are all zero are omitted. Datapoints are returned in time order.
+func QueryTimeSeries(db DB, name string, start, end time.Time, resolution time.Duration) ([]TimeSeriesDatapoint, error) {
+	if resolution <= 0 || resolution%TimeSeriesResolution != 0 {
+		return nil, util.Errorf("resolution %s is not a positive multiple of %s", resolution, TimeSeriesResolution)
+	}
+	start = start.Truncate(TimeSeriesResolution)
+	if !start.Before(end) {
+		return nil, nil
+	}
+	reply := <-db.Scan(&storage.ScanRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:    MakeTimeSeriesKey(name, start),
+			EndKey: engine.NextKey(MakeTimeSeriesKey(name, end)),
+			User:   storage.UserRoot,
+		},
+	})
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+
+	samples := map[int64]int64{}
+	for _, row := range reply.Rows {
+		_, intervalStart, err := decodeTimeSeriesKey(row.Key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := encoding.GobDecode(row.Value.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ts, ok := val.(engine.TimeSeries)
+		if !ok {
+			return nil, util.Errorf("value at key %q is not a time series: %T", row.Key, val)
+		}
+		for i, count := range ts {
+			t := intervalStart.Add(time.Duration(i) * TimeSeriesResolution)
+			if count == 0 || t.Before(start) || !t.Before(end) {
+				continue
+			}
+			sample := start.Add(t.Sub(start) / resolution * resolution).Unix()
+			samples[sample] += count
+		}
+	}
+
+	datapoints := make([]TimeSeriesDatapoint, 0, len(samples))
+	for ts, value := range samples {
+		datapoints = append(datapoints, TimeSeriesDatapoint{Timestamp: ts, Value: value})
+	}
+	sort.Sort(timeSeriesDatapoints(datapoints))
+	return datapoints, nil
+}
+
+// QueryTimeSeriesGauge reads the named gauge series over the window
+// [start, end) and downsamples it to the supplied resolution, which
+// must be a positive multiple of TimeSeriesResolution. Each returned
+// datapoint holds the last value recorded within its sample period;
+// periods without recorded values are omitted. Datapoints are returned
+// in time order.
+func QueryTimeSeriesGauge(db DB, name string, start, end time.Time, resolution time.Duration) ([]TimeSeriesDatapoint, error) {
+	if resolution <= 0 || resolution%TimeSeriesResolution != 0 {
+		return nil, util.Errorf("resolution %s is not a positive multiple of %s", resolution, TimeSeriesResolution)
+	}
+	start = start.Truncate(TimeSeriesResolution)
+	if !start.Before(end) {
+		return nil, nil
+	}
+	reply := <-db.Scan(&storage.ScanRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:    MakeTimeSeriesGaugeKey(name, start),
+			EndKey: MakeTimeSeriesGaugeKey(name, end.Add(TimeSeriesResolution-1)),
+			User:   storage.UserRoot,
+		},
+	})
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+
+	// Rows are returned in time order, so later values within a
+	// sample period replace earlier ones.
+	datapoints := []TimeSeriesDatapoint{}
+	for _, row := range reply.Rows {
+		_, t, err := decodeTimeSeriesGaugeKey(row.Key)
+		if err != nil {
+			return nil, err
+		}
+		var value int64
+		if err := gob.NewDecoder(bytes.NewBuffer(row.Value.Bytes)).Decode(&value); err != nil {
+			return nil, err
+		}
+		sample := start.Add(t.Sub(start) / resolution * resolution).Unix()
+		if n := len(datapoints); n > 0 && datapoints[n-1].Timestamp == sample {
+			datapoints[n-1].Value = value
+			continue
+		}
+		datapoints = append(datapoints, TimeSeriesDatapoint{Timestamp: sample, Value: value})
+	}
+	return datapoints, nil
+}
+
+// timeSeriesDatapoints implements sort.Interface, ordering by timestamp.
+type timeSeriesDatapoints []TimeSeriesDatapoint
+
+func (tsd timeSeriesDatapoints) Len() int           { return len(tsd) }
+func (tsd timeSeriesDatapoints) Swap(i, j int)      { tsd[i], tsd[j] = tsd[j], tsd[i] }
+func (tsd timeSeriesDatapoints) Less(i, j int) bool { return tsd[i].Timestamp < tsd[j].Timestamp }
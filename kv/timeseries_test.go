@@ -0,0 +1,165 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package kv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestTimeSeriesKeyOrdering verifies that time series keys sort first
+// by name and then by time and that they decode correctly.
+func TestTimeSeriesKeyOrdering(t *testing.T) {
+	t0 := time.Unix(1400000000, 0)
+	keys := [][]byte{
+		MakeTimeSeriesKey("a", t0),
+		MakeTimeSeriesKey("a", t0.Add(TimeSeriesInterval)),
+		MakeTimeSeriesKey("a", t0.Add(100*TimeSeriesInterval)),
+		MakeTimeSeriesKey("b", t0.Add(-TimeSeriesInterval)),
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Errorf("%d: expected %q < %q", i, keys[i-1], keys[i])
+		}
+	}
+	name, start, err := decodeTimeSeriesKey(MakeTimeSeriesKey("a", t0.Add(30*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "a" || !start.Equal(t0.Truncate(TimeSeriesInterval)) {
+		t.Errorf("unexpected decoding: %q %s", name, start)
+	}
+}
+
+// TestTimeSeriesAccumulateAndQuery verifies that accumulated values
+// are summed and downsampled over the queried window.
+func TestTimeSeriesAccumulateAndQuery(t *testing.T) {
+	db := createTestLocalDB(t)
+	defer db.Close()
+
+	t0 := time.Unix(1400000000, 0).Truncate(TimeSeriesInterval)
+	updates := []struct {
+		name   string
+		offset time.Duration
+		value  int64
+	}{
+		{"a", 0, 1},
+		{"a", 0, 2},
+		{"a", 5 * time.Second, 3},
+		{"a", 59 * time.Second, 4},
+		{"a", 61 * time.Second, 5},
+		{"a", 3 * time.Minute, 6},
+		{"b", 0, 100},
+	}
+	for _, u := range updates {
+		if err := AccumulateTimeSeries(db, u.name, t0.Add(u.offset), u.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		start, end time.Duration
+		resolution time.Duration
+		expected   []TimeSeriesDatapoint
+	}{
+		{0, 10 * time.Minute, time.Second, []TimeSeriesDatapoint{
+			{t0.Unix(), 3}, {t0.Unix() + 5, 3}, {t0.Unix() + 59, 4}, {t0.Unix() + 61, 5}, {t0.Unix() + 180, 6},
+		}},
+		{0, 10 * time.Minute, time.Minute, []TimeSeriesDatapoint{
+			{t0.Unix(), 10}, {t0.Unix() + 60, 5}, {t0.Unix() + 180, 6},
+		}},
+		{0, 10 * time.Minute, 10 * time.Minute, []TimeSeriesDatapoint{
+			{t0.Unix(), 21},
+		}},
+		// Window boundaries are respected within an interval.
+		{5 * time.Second, 61 * time.Second, 30 * time.Second, []TimeSeriesDatapoint{
+			{t0.Unix() + 5, 3}, {t0.Unix() + 35, 4},
+		}},
+		{4 * time.Minute, 10 * time.Minute, time.Minute, []TimeSeriesDatapoint{}},
+	}
+	for i, test := range testCases {
+		datapoints, err := QueryTimeSeries(db, "a", t0.Add(test.start), t0.Add(test.end), test.resolution)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(datapoints, test.expected) {
+			t.Errorf("%d: expected %v; got %v", i, test.expected, datapoints)
+		}
+	}
+
+	if _, err := QueryTimeSeries(db, "a", t0, t0.Add(time.Minute), 1500*time.Millisecond); err == nil {
+		t.Error("expected error querying with sub-second resolution")
+	}
+}
+
+// TestTimeSeriesGaugeRecordAndQuery verifies that recorded gauge
+// values aren't summed and that each sample period reports the last
+// value recorded within it.
+func TestTimeSeriesGaugeRecordAndQuery(t *testing.T) {
+	db := createTestLocalDB(t)
+	defer db.Close()
+
+	t0 := time.Unix(1400000000, 0).Truncate(TimeSeriesInterval)
+	updates := []struct {
+		offset time.Duration
+		value  int64
+	}{
+		{0, 5},
+		{500 * time.Millisecond, 7}, // replaces the value recorded at t0
+		{10 * time.Second, 3},
+		{20 * time.Second, 4},
+		{90 * time.Second, 8},
+	}
+	for _, u := range updates {
+		if err := RecordTimeSeriesGauge(db, "g", t0.Add(u.offset), u.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		start, end time.Duration
+		resolution time.Duration
+		expected   []TimeSeriesDatapoint
+	}{
+		{0, 10 * time.Minute, time.Second, []TimeSeriesDatapoint{
+			{t0.Unix(), 7}, {t0.Unix() + 10, 3}, {t0.Unix() + 20, 4}, {t0.Unix() + 90, 8},
+		}},
+		{0, 10 * time.Minute, time.Minute, []TimeSeriesDatapoint{
+			{t0.Unix(), 4}, {t0.Unix() + 60, 8},
+		}},
+		// The end of the window is exclusive.
+		{0, 20 * time.Second, time.Minute, []TimeSeriesDatapoint{
+			{t0.Unix(), 3},
+		}},
+		{2 * time.Minute, 10 * time.Minute, time.Minute, []TimeSeriesDatapoint{}},
+	}
+	for i, test := range testCases {
+		datapoints, err := QueryTimeSeriesGauge(db, "g", t0.Add(test.start), t0.Add(test.end), test.resolution)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(datapoints, test.expected) {
+			t.Errorf("%d: expected %v; got %v", i, test.expected, datapoints)
+		}
+	}
+
+	// Gauges aren't visible as accumulated time series.
+	if datapoints, err := QueryTimeSeries(db, "g", t0, t0.Add(10*time.Minute), time.Minute); err != nil || len(datapoints) != 0 {
+		t.Errorf("expected no accumulated datapoints; got %v, %v", datapoints, err)
+	}
+}
@@ -54,6 +54,14 @@ func main() {
 		Name: "cockroach",
 		Commands: []*commander.Command{
 			server.CmdInit,
+			server.CmdGetAcct,
+			server.CmdLsAccts,
+			server.CmdRmAcct,
+			server.CmdSetAcct,
+			server.CmdGetPerms,
+			server.CmdLsPerms,
+			server.CmdRmPerms,
+			server.CmdSetPerms,
 			server.CmdGetZone,
 			server.CmdLsZones,
 			server.CmdRmZone,
@@ -25,6 +25,11 @@ type EventLeaderElection struct {
 }
 
 // An EventCommandCommitted is broadcast whenever a command has been committed.
+// Index is the command's position in the group's log; after a restart,
+// commands may be committed again and applications should skip those
+// they have already applied.
 type EventCommandCommitted struct {
+	GroupID GroupID
+	Index   int
 	Command []byte
 }
@@ -30,14 +30,14 @@ import (
 )
 
 // NodeID is a unique non-zero identifier for the node within the cluster.
-type NodeID int32
+type NodeID int64
 
 // GroupID is a unique identifier for a consensus group within the cluster.
 type GroupID int64
 
 // isSet returns true if the NodeID is valid (i.e. non-zero)
 func (n NodeID) isSet() bool {
-	return int32(n) != 0
+	return int64(n) != 0
 }
 
 // Config contains the parameters necessary to construct a MultiRaft object.
@@ -185,6 +185,34 @@ func (m *MultiRaft) CreateGroup(groupID GroupID, initialMembers []NodeID) error
 	return <-op.ch
 }
 
+// ChangeGroupMembership replaces the members of a group on this node. Non-voting members
+// receive the group's log but neither vote nor count towards a quorum; a node being added to a
+// group is a non-voting member until it has caught up. The change takes effect immediately, so
+// the application should make the same change on all nodes at the same position in the group's
+// log, for example when applying a committed command. A node which is no longer a voting member
+// stops leading and does not call elections.
+func (m *MultiRaft) ChangeGroupMembership(groupID GroupID, members GroupMembers) error {
+	if len(members.Members) == 0 {
+		return util.Error("group must have at least one voting member")
+	}
+	for _, id := range members.allNodes() {
+		if !id.isSet() {
+			return util.Error("Invalid NodeID")
+		}
+	}
+	op := &changeMembershipOp{groupID, members, make(chan error)}
+	m.ops <- op
+	return <-op.ch
+}
+
+// RemoveGroup leaves a group on this node, dropping its state and failing any RPCs still
+// waiting on it. The group's persisted log and election state are left in place.
+func (m *MultiRaft) RemoveGroup(groupID GroupID) error {
+	op := &removeGroupOp{groupID, make(chan error)}
+	m.ops <- op
+	return <-op.ch
+}
+
 // SubmitCommand sends a command (a binary blob) to the cluster.  This method returns
 // when the command has been successfully sent, not when it has been committed.
 // TODO(bdarnell): should SubmitCommand wait until the commit?
@@ -250,6 +278,12 @@ type group struct {
 	nextIndex  map[NodeID]int // default: lastLogIndex + 1
 	matchIndex map[NodeID]int // default: 0
 
+	// stepDownIndex is set when the leader is removed as a voting member. It keeps leading
+	// until each voting member has acknowledged the log up to stepDownIndex together with a
+	// commit index at least as high, as recorded in stepDownAcks; see changeMembership.
+	stepDownIndex int
+	stepDownAcks  map[NodeID]bool
+
 	// a List of *pendingCall
 	pendingCalls list.List
 
@@ -291,7 +325,9 @@ func (g *group) findQuorumIndexInNodes(nodes []NodeID) int {
 		indices = append(indices, g.matchIndex[nodeID])
 	}
 	sort.Ints(indices)
-	quorumPos := len(indices)/2 + 1
+	// The indices are sorted in ascending order, so the largest index
+	// reached by a quorum is the quorum'th from the end.
+	quorumPos := len(indices) - (len(indices)/2 + 1)
 	return indices[quorumPos]
 }
 
@@ -302,6 +338,21 @@ type createGroupOp struct {
 	ch    chan error
 }
 
+// maxCatchUpEntries is the maximum number of entries sent at once to a
+// member which is catching up with the leader's log.
+const maxCatchUpEntries = 100
+
+type changeMembershipOp struct {
+	groupID GroupID
+	members GroupMembers
+	ch      chan error
+}
+
+type removeGroupOp struct {
+	groupID GroupID
+	ch      chan error
+}
+
 type submitCommandOp struct {
 	groupID GroupID
 	command []byte
@@ -327,6 +378,9 @@ type state struct {
 	electionTimer *time.Timer
 	responses     chan *rpc.Call
 	writeTask     *writeTask
+	// persisted holds the state loaded from storage at startup of
+	// groups which haven't been created yet.
+	persisted map[GroupID]*GroupPersistentState
 }
 
 func newState(m *MultiRaft) *state {
@@ -338,6 +392,7 @@ func newState(m *MultiRaft) *state {
 		nodes:       make(map[NodeID]*node),
 		responses:   make(chan *rpc.Call, 100),
 		writeTask:   newWriteTask(m.Storage),
+		persisted:   make(map[GroupID]*GroupPersistentState),
 	}
 }
 
@@ -360,6 +415,9 @@ func (s *state) nextElectionTimer() *time.Timer {
 
 func (s *state) start() {
 	log.V(1).Infof("node %v starting", s.nodeID)
+	for gs := range s.Storage.LoadGroups() {
+		s.persisted[gs.GroupID] = gs
+	}
 	go s.writeTask.start()
 	for {
 		electionTimer := s.nextElectionTimer()
@@ -381,6 +439,12 @@ func (s *state) start() {
 			case *createGroupOp:
 				s.createGroup(op)
 
+			case *changeMembershipOp:
+				s.changeMembership(op)
+
+			case *removeGroupOp:
+				s.removeGroup(op)
+
 			case *submitCommandOp:
 				s.submitCommand(op)
 
@@ -405,6 +469,11 @@ func (s *state) start() {
 
 		case call := <-s.responses:
 			log.V(6).Infof("node %v: got response %v", s.nodeID, call)
+			if call.Error != nil {
+				// The reply is empty; treat the message as lost.
+				log.V(4).Infof("node %v: %s failed: %v", s.nodeID, call.ServiceMethod, call.Error)
+				break
+			}
 			switch call.ServiceMethod {
 			case requestVoteName:
 				s.requestVoteResponse(call.Args.(*RequestVoteRequest), call.Reply.(*RequestVoteResponse))
@@ -434,6 +503,9 @@ func (s *state) start() {
 func (s *state) stop() {
 	log.V(6).Infof("node %v stopping", s.nodeID)
 	for _, n := range s.nodes {
+		if n.client == nil {
+			continue
+		}
 		err := n.client.conn.Close()
 		if err != nil {
 			log.Warning("error stopping client:", err)
@@ -449,30 +521,178 @@ func (s *state) createGroup(op *createGroupOp) {
 		op.ch <- util.Errorf("group %v already exists", op.group.groupID)
 		return
 	}
+	// A group this node belonged to before restarting resumes from its
+	// persisted election state and log.
+	if gs, ok := s.persisted[op.group.groupID]; ok {
+		g := op.group
+		electionState := gs.ElectionState
+		g.electionState = &electionState
+		g.persistedElectionState = &gs.ElectionState
+		g.lastLogIndex, g.persistedLastIndex = gs.LastLogIndex, gs.LastLogIndex
+		g.lastLogTerm, g.persistedLastTerm = gs.LastLogTerm, gs.LastLogTerm
+		delete(s.persisted, g.groupID)
+	}
 	for _, member := range op.group.committedMembers.Members {
-		if node, ok := s.nodes[member]; ok {
-			node.refCount++
-			continue
+		s.addNodeRef(member)
+	}
+	s.updateElectionDeadline(op.group)
+	s.groups[op.group.groupID] = op.group
+	op.ch <- nil
+}
+
+func (s *state) removeGroup(op *removeGroupOp) {
+	log.V(6).Infof("node %v removing group %v", s.nodeID, op.groupID)
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	for _, id := range g.committedMembers.allNodes() {
+		s.releaseNodeRef(id)
+	}
+	for e := g.pendingCalls.Front(); e != nil; e = e.Next() {
+		call := e.Value.(*pendingCall).call
+		call.Error = util.Errorf("group %v removed", op.groupID)
+		call.Done <- call
+	}
+	delete(s.groups, op.groupID)
+	delete(s.dirtyGroups, op.groupID)
+	op.ch <- nil
+}
+
+// addNodeRef adds a reference to the connection to the given node, connecting to it if
+// necessary.
+func (s *state) addNodeRef(id NodeID) {
+	n, ok := s.nodes[id]
+	if !ok {
+		n = &node{nodeID: id}
+		s.nodes[id] = n
+	}
+	n.refCount++
+	s.connect(n)
+}
+
+// releaseNodeRef releases a reference added by addNodeRef, closing the connection once no
+// group references it.
+func (s *state) releaseNodeRef(id NodeID) {
+	n, ok := s.nodes[id]
+	if !ok {
+		return
+	}
+	n.refCount--
+	if n.refCount > 0 {
+		return
+	}
+	if n.client != nil {
+		if err := n.client.conn.Close(); err != nil {
+			log.Warning("error closing client:", err)
 		}
-		conn, err := s.Transport.Connect(member)
+	}
+	delete(s.nodes, id)
+}
+
+// connect returns the client for the given node, connecting to it if not yet connected.
+// Returns nil if the node can't be reached; messages to it are dropped, as they would be
+// if sent, and connecting is retried with the next message.
+func (s *state) connect(n *node) *asyncClient {
+	if n.client == nil {
+		conn, err := s.Transport.Connect(n.nodeID)
 		if err != nil {
-			op.ch <- err
-			return
+			log.V(1).Infof("node %v: unable to connect to node %v: %v", s.nodeID, n.nodeID, err)
+			return nil
+		}
+		n.client = &asyncClient{n.nodeID, conn, s.responses}
+	}
+	return n.client
+}
+
+// client returns the client for the given node, or nil if the node isn't a member of any
+// group or can't be reached.
+func (s *state) client(id NodeID) *asyncClient {
+	n, ok := s.nodes[id]
+	if !ok {
+		return nil
+	}
+	return s.connect(n)
+}
+
+func (s *state) changeMembership(op *changeMembershipOp) {
+	log.V(6).Infof("node %v changing membership of group %v to %+v", s.nodeID, op.groupID, op.members)
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
+	oldNodes := map[NodeID]bool{}
+	for _, id := range g.committedMembers.allNodes() {
+		oldNodes[id] = true
+	}
+	newNodes := map[NodeID]bool{}
+	for _, id := range op.members.allNodes() {
+		newNodes[id] = true
+		if !oldNodes[id] {
+			s.addNodeRef(id)
+		}
+	}
+	for id := range oldNodes {
+		if !newNodes[id] {
+			s.releaseNodeRef(id)
+		}
+	}
+	members := op.members
+	g.committedMembers = &members
+	if g.currentMembers != nil {
+		g.currentMembers = g.committedMembers
+	}
+	g.stepDownIndex = 0
+	if !g.committedMembers.isVoter(s.nodeID) {
+		switch g.role {
+		case RoleLeader:
+			// The remaining members may not yet know that the change has
+			// committed, and only then can they elect a new leader. Keep
+			// replicating to them until they do, accepting no new commands.
+			g.stepDownIndex = g.commitIndex
+			g.stepDownAcks = make(map[NodeID]bool)
+			s.broadcastEntries(g, nil)
+		case RoleCandidate:
+			g.role = RoleFollower
+			s.updateElectionDeadline(g)
 		}
-		s.nodes[member] = &node{member, 1, &asyncClient{member, conn, s.responses}}
 	}
-	s.updateElectionDeadline(op.group)
-	s.groups[op.group.groupID] = op.group
 	op.ch <- nil
 }
 
+// maybeStepDown steps down a leader which has been removed from its group once all voting
+// members have acknowledged the change. Returns true if the leader stepped down.
+func (s *state) maybeStepDown(g *group) bool {
+	for _, id := range g.committedMembers.Members {
+		if !g.stepDownAcks[id] {
+			return false
+		}
+	}
+	log.V(1).Infof("node %v removed from group %v; becoming follower", s.nodeID, g.groupID)
+	g.role = RoleFollower
+	g.stepDownIndex = 0
+	g.stepDownAcks = nil
+	s.updateElectionDeadline(g)
+	return true
+}
+
 func (s *state) submitCommand(op *submitCommandOp) {
 	log.V(6).Infof("node %v submitting command to group %v", s.nodeID, op.groupID)
-	g := s.groups[op.groupID]
+	g, ok := s.groups[op.groupID]
+	if !ok {
+		op.ch <- util.Errorf("unknown group %v", op.groupID)
+		return
+	}
 	if g.role != RoleLeader {
 		op.ch <- util.Error("TODO(bdarnell): forward commands to leader")
 		return
 	}
+	if g.stepDownIndex > 0 {
+		op.ch <- util.Errorf("node %v is no longer a voting member of group %v", s.nodeID, g.groupID)
+		return
+	}
 
 	g.lastLogIndex++
 	entry := &LogEntry{
@@ -504,6 +724,8 @@ func (s *state) requestVoteRequest(req *RequestVoteRequest, resp *RequestVoteRes
 	resp.Term = g.electionState.CurrentTerm
 	g.pendingCalls.PushBack(&pendingCall{call, g.electionState.CurrentTerm, -1})
 	s.updateDirtyStatus(g)
+	// If the vote is already persistent, there's no write to wait for.
+	s.resolvePendingCalls(g)
 }
 
 func hasMajority(votes map[NodeID]bool, members []NodeID) bool {
@@ -517,7 +739,10 @@ func hasMajority(votes map[NodeID]bool, members []NodeID) bool {
 }
 
 func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteResponse) {
-	g := s.groups[req.GroupID]
+	g, ok := s.groups[req.GroupID]
+	if !ok {
+		return
+	}
 	if resp.Term < g.electionState.CurrentTerm {
 		return
 	}
@@ -550,23 +775,50 @@ func (s *state) requestVoteResponse(req *RequestVoteRequest, resp *RequestVoteRe
 // min(leaderCommit, last log index)
 func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntriesResponse,
 	call *rpc.Call) {
-	g := s.groups[req.GroupID]
+	g, ok := s.groups[req.GroupID]
+	if !ok {
+		call.Error = util.Errorf("unknown group %v", req.GroupID)
+		call.Done <- call
+		return
+	}
 	resp.Term = g.electionState.CurrentTerm
 	if req.Term < g.electionState.CurrentTerm {
 		resp.Success = false
 		call.Done <- call
 		return
 	}
-	// TODO(bdarnell): check prevLogIndex and terms
-	g.pendingEntries = append(g.pendingEntries, req.Entries...)
-	if len(g.pendingEntries) > 0 {
-		lastEntry := g.pendingEntries[len(g.pendingEntries)-1]
-		g.lastLogIndex = lastEntry.Index
-		g.lastLogTerm = lastEntry.Term
+	lastIndex := g.persistedLastIndex
+	if req.LeaderID != s.nodeID {
+		// A valid request from the leader resets the election timeout.
+		s.updateElectionDeadline(g)
+		// If entries preceding those sent are missing, the leader resends
+		// its log from the end of ours.
+		// TODO(bdarnell): check terms
+		if req.PrevLogIndex > g.lastLogIndex {
+			resp.Success = false
+			resp.LastLogIndex = g.lastLogIndex
+			call.Done <- call
+			return
+		}
+		// Entries may be sent more than once while we catch up.
+		for _, entry := range req.Entries {
+			if entry.Index <= g.lastLogIndex {
+				continue
+			}
+			g.pendingEntries = append(g.pendingEntries, entry)
+			g.lastLogIndex = entry.Index
+			g.lastLogTerm = entry.Term
+		}
+		s.updateDirtyStatus(g)
+		lastIndex = g.lastLogIndex
 	}
-	s.updateDirtyStatus(g)
+	// Otherwise, the leader's own log already holds the entries it
+	// broadcasts; they were persisted before being sent. Appending
+	// them again would rewind lastLogIndex past entries submitted
+	// since.
 	resp.Success = true
-	g.pendingCalls.PushBack(&pendingCall{call, -1, g.lastLogIndex})
+	g.pendingCalls.PushBack(&pendingCall{call, -1, lastIndex})
+	s.resolvePendingCalls(g)
 	s.commitEntries(g, req.LeaderCommit)
 }
 
@@ -576,15 +828,38 @@ func (s *state) appendEntriesRequest(req *AppendEntriesRequest, resp *AppendEntr
 // If there exists an N such that N > commitIndex, a majority of matchIndex[i] ≥ N, and
 // log[N].term == currentTerm: set commitIndex = N (§5.3, §5.4).
 func (s *state) appendEntriesResponse(req *AppendEntriesRequest, resp *AppendEntriesResponse) {
-	g := s.groups[req.GroupID]
+	g, ok := s.groups[req.GroupID]
+	if !ok || g.role != RoleLeader {
+		return
+	}
+	dest := req.DestNode
+	advanced := false
 	if resp.Success {
-		if len(req.Entries) > 0 {
-			lastIndex := req.Entries[len(req.Entries)-1].Index
-			g.nextIndex[req.DestNode] = lastIndex + 1
-			g.matchIndex[req.DestNode] = lastIndex
+		if lastIndex := req.PrevLogIndex + len(req.Entries); lastIndex > g.matchIndex[dest] {
+			g.matchIndex[dest] = lastIndex
+			advanced = true
 		}
-	} else {
-		g.nextIndex[req.DestNode]--
+		g.nextIndex[dest] = g.matchIndex[dest] + 1
+		if g.stepDownIndex > 0 && req.LeaderCommit >= g.stepDownIndex &&
+			g.matchIndex[dest] >= g.stepDownIndex {
+			g.stepDownAcks[dest] = true
+			if s.maybeStepDown(g) {
+				return
+			}
+		}
+	} else if resp.Term <= req.Term {
+		// The follower is missing entries; resume from the end of its log.
+		lastIndex := resp.LastLogIndex
+		if lastIndex < g.matchIndex[dest] {
+			lastIndex = g.matchIndex[dest]
+		}
+		g.nextIndex[dest] = lastIndex + 1
+		advanced = true
+	}
+	// Keep sending to a follower which is catching up rather than
+	// waiting for the next heartbeat.
+	if advanced && g.nextIndex[dest] <= g.persistedLastIndex {
+		s.sendAppendEntries(g, dest, nil)
 	}
 
 	s.commitEntries(g, g.findQuorumIndex())
@@ -613,25 +888,87 @@ func (s *state) broadcastEntries(g *group, entries []*LogEntry) {
 		return
 	}
 	log.V(6).Infof("node %v: broadcasting entries to followers", s.nodeID)
-	for _, id := range g.currentMembers.Members {
-		node := s.nodes[id]
-		node.client.appendEntries(&AppendEntriesRequest{
-			RequestHeader: RequestHeader{s.nodeID, id},
-			GroupID:       g.groupID,
-			Term:          g.electionState.CurrentTerm,
-			LeaderID:      s.nodeID,
-			PrevLogIndex:  g.persistedLastIndex,
-			PrevLogTerm:   g.persistedLastTerm,
-			LeaderCommit:  g.commitIndex,
-			Entries:       entries,
-		})
+	for _, id := range g.currentMembers.allNodes() {
+		s.sendAppendEntries(g, id, entries)
+	}
+}
+
+// sendAppendEntries sends entries, which follow the leader's persisted log, to the given
+// member of a group. A member known to be missing earlier entries is sent those instead, read
+// from storage, in batches of at most maxCatchUpEntries.
+func (s *state) sendAppendEntries(g *group, id NodeID, entries []*LogEntry) {
+	client := s.client(id)
+	if client == nil {
+		return
 	}
+	prevIndex, prevTerm := g.persistedLastIndex, g.persistedLastTerm
+	if next := g.nextIndex[id]; next > 0 && next <= prevIndex {
+		last := prevIndex
+		if last-next+1 > maxCatchUpEntries {
+			last = next + maxCatchUpEntries - 1
+		}
+		// Read the entry preceding those missing for its term.
+		first := next - 1
+		if first < 1 {
+			first = 1
+		}
+		missing, err := s.readLogEntries(g.groupID, first, last)
+		if err != nil {
+			s.strictErrorLog("node %v: unable to read log of group %v: %v", s.nodeID, g.groupID, err)
+			return
+		}
+		prevIndex, prevTerm = 0, 0
+		if next > 1 {
+			prevIndex, prevTerm = missing[0].Index, missing[0].Term
+			missing = missing[1:]
+		}
+		if last == g.persistedLastIndex {
+			entries = append(missing, entries...)
+		} else {
+			entries = missing
+		}
+	}
+	client.appendEntries(&AppendEntriesRequest{
+		RequestHeader: RequestHeader{s.nodeID, id},
+		GroupID:       g.groupID,
+		Term:          g.electionState.CurrentTerm,
+		LeaderID:      s.nodeID,
+		PrevLogIndex:  prevIndex,
+		PrevLogTerm:   prevTerm,
+		LeaderCommit:  g.commitIndex,
+		Entries:       entries,
+	})
+}
+
+// readLogEntries synchronously reads the entries of a group's log from firstIndex to
+// lastIndex inclusive.
+func (s *state) readLogEntries(groupID GroupID, firstIndex, lastIndex int) ([]*LogEntry, error) {
+	ch := make(chan *LogEntryState, 100)
+	go s.Storage.GetLogEntries(groupID, firstIndex, lastIndex, ch)
+	var entries []*LogEntry
+	var err error
+	for es := range ch {
+		if es.Error != nil {
+			err = es.Error
+			continue
+		}
+		entry := es.Entry
+		entries = append(entries, &entry)
+	}
+	if err == nil && len(entries) != lastIndex-firstIndex+1 {
+		err = util.Errorf("read %d entries; expected %d", len(entries), lastIndex-firstIndex+1)
+	}
+	return entries, err
 }
 
 func (s *state) handleWriteResponse(response *writeResponse) {
 	log.V(6).Infof("node %v got write response: %#v", s.nodeID, *response)
 	for groupID, persistedGroup := range response.groups {
-		g := s.groups[groupID]
+		g, ok := s.groups[groupID]
+		if !ok {
+			// The group was removed while its state was being written.
+			continue
+		}
 		if persistedGroup.electionState != nil {
 			g.persistedElectionState = persistedGroup.electionState
 		}
@@ -647,37 +984,58 @@ func (s *state) handleWriteResponse(response *writeResponse) {
 		// already considers committed.
 		s.commitEntries(g, g.leaderCommitIndex)
 
-		// Resolve any pending RPCs that have been waiting for persistence to catch up.
-		var toDelete []*list.Element
-		for e := g.pendingCalls.Front(); e != nil; e = e.Next() {
-			call := e.Value.(*pendingCall)
-			if g.persistedElectionState == nil || g.persistedLastIndex == -1 {
-				continue
-			}
-			if call.term != -1 && call.term > g.persistedElectionState.CurrentTerm {
-				continue
-			}
-			if call.logIndex != -1 && call.logIndex > g.persistedLastIndex {
-				continue
-			}
-			call.call.Done <- call.call
-			toDelete = append(toDelete, e)
+		s.resolvePendingCalls(g)
+		s.updateDirtyStatus(g)
+	}
+}
+
+// resolvePendingCalls responds to any pending RPCs that have been
+// waiting for persistence to catch up.
+func (s *state) resolvePendingCalls(g *group) {
+	var toDelete []*list.Element
+	for e := g.pendingCalls.Front(); e != nil; e = e.Next() {
+		call := e.Value.(*pendingCall)
+		if g.persistedElectionState == nil || g.persistedLastIndex == -1 {
+			continue
 		}
-		for _, e := range toDelete {
-			g.pendingCalls.Remove(e)
+		if call.term != -1 && call.term > g.persistedElectionState.CurrentTerm {
+			continue
 		}
-		s.updateDirtyStatus(g)
+		if call.logIndex != -1 && call.logIndex > g.persistedLastIndex {
+			continue
+		}
+		call.call.Done <- call.call
+		toDelete = append(toDelete, e)
+	}
+	for _, e := range toDelete {
+		g.pendingCalls.Remove(e)
 	}
 }
 
 func (s *state) handleElectionTimers(now time.Time) {
 	for _, g := range s.groups {
 		if !now.Before(g.electionDeadline) {
-			s.becomeCandidate(g)
+			if g.role == RoleLeader {
+				s.sendHeartbeat(g)
+			} else if g.committedMembers.isVoter(s.nodeID) {
+				s.becomeCandidate(g)
+			} else {
+				// Non-voting members wait for a leader.
+				s.updateElectionDeadline(g)
+			}
 		}
 	}
 }
 
+// sendHeartbeat broadcasts an empty AppendEntriesRequest to the
+// followers of a group for which this node is the leader, preventing
+// them from calling an election. The next heartbeat is scheduled well
+// within the minimum election timeout.
+func (s *state) sendHeartbeat(g *group) {
+	s.broadcastEntries(g, nil)
+	g.electionDeadline = s.Clock.Now().Add(s.ElectionTimeoutMin / 2)
+}
+
 func (s *state) becomeCandidate(g *group) {
 	log.V(1).Infof("node %v becoming candidate (was %v) for group %s", s.nodeID, g.role, g.groupID)
 	if g.role == RoleLeader {
@@ -691,8 +1049,11 @@ func (s *state) becomeCandidate(g *group) {
 	g.currentMembers = g.committedMembers
 	s.updateElectionDeadline(g)
 	for _, id := range g.currentMembers.Members {
-		node := s.nodes[id]
-		node.client.requestVote(&RequestVoteRequest{
+		client := s.client(id)
+		if client == nil {
+			continue
+		}
+		client.requestVote(&RequestVoteRequest{
 			RequestHeader: RequestHeader{s.nodeID, id},
 			GroupID:       g.groupID,
 			Term:          g.electionState.CurrentTerm,
@@ -728,13 +1089,21 @@ func (s *state) commitEntries(g *group, leaderCommitIndex int) {
 	// TODO(bdarnell): move storage access (incl. the channel iteration) to a goroutine
 	entries := make(chan *LogEntryState, 100)
 	go s.Storage.GetLogEntries(g.groupID, g.commitIndex+1, index, entries)
+	committed := g.commitIndex
 	for entry := range entries {
+		if entry.Error != nil {
+			// Commit the entries read so far; the remainder will be
+			// retried on the next commit.
+			s.strictErrorLog("node %v: unable to read log of group %v: %v", s.nodeID, g.groupID, entry.Error)
+			break
+		}
 		log.V(6).Infof("node %v: committing %+v", s.nodeID, entry)
 		if entry.Entry.Type == LogEntryCommand {
-			s.sendEvent(&EventCommandCommitted{entry.Entry.Payload})
+			s.sendEvent(&EventCommandCommitted{g.groupID, entry.Index, entry.Entry.Payload})
 		}
+		committed = entry.Index
 	}
-	g.commitIndex = index
+	g.commitIndex = committed
 	s.broadcastEntries(g, nil)
 }
 
@@ -178,3 +178,74 @@ func TestSlowStorage(t *testing.T) {
 		t.Errorf("unexpected value in committed command: %v", commit.Command)
 	}
 }
+
+func TestMembershipChange(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 2)
+	cluster.clocks[0].triggerElection()
+	<-cluster.events[0].LeaderElection
+
+	commands := []string{"a", "b", "c"}
+	for _, command := range commands[:2] {
+		cluster.nodes[0].SubmitCommand(groupID, []byte(command))
+		for i := 0; i < 2; i++ {
+			<-cluster.events[i].CommandCommitted
+		}
+	}
+
+	// Add the third node as a non-voting member. It catches up with the
+	// entries committed before it joined.
+	members := GroupMembers{
+		Members:          []NodeID{cluster.nodes[0].nodeID, cluster.nodes[1].nodeID},
+		NonVotingMembers: []NodeID{cluster.nodes[2].nodeID},
+	}
+	if err := cluster.nodes[2].CreateGroup(groupID, members.Members); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range cluster.nodes {
+		if err := node.ChangeGroupMembership(groupID, members); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cluster.nodes[0].SubmitCommand(groupID, []byte(commands[2]))
+	for i, command := range commands {
+		commit := <-cluster.events[2].CommandCommitted
+		if commit.Index != i+1 || string(commit.Command) != command {
+			t.Errorf("expected command %q at index %d; got %q at %d", command, i+1, commit.Command, commit.Index)
+		}
+	}
+
+	// Invalid memberships are rejected.
+	if err := cluster.nodes[0].ChangeGroupMembership(groupID, GroupMembers{NonVotingMembers: members.Members}); err == nil {
+		t.Error("expected membership without voting members to be rejected")
+	}
+	if err := cluster.nodes[0].ChangeGroupMembership(GroupID(2), members); err == nil {
+		t.Error("expected membership change of unknown group to fail")
+	}
+}
+
+func TestRemoveGroup(t *testing.T) {
+	cluster := newTestCluster(3, t)
+	defer cluster.stop()
+	groupID := GroupID(1)
+	cluster.createGroup(groupID, 3)
+	cluster.clocks[0].triggerElection()
+	<-cluster.events[0].LeaderElection
+
+	// The remaining nodes still form a quorum after the third leaves.
+	if err := cluster.nodes[2].RemoveGroup(groupID); err != nil {
+		t.Fatal(err)
+	}
+	cluster.nodes[0].SubmitCommand(groupID, []byte("command"))
+	for i := 0; i < 2; i++ {
+		commit := <-cluster.events[i].CommandCommitted
+		if string(commit.Command) != "command" {
+			t.Errorf("unexpected value in committed command: %v", commit.Command)
+		}
+	}
+	if err := cluster.nodes[2].RemoveGroup(groupID); err == nil {
+		t.Error("expected removal of unknown group to fail")
+	}
+}
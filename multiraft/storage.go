@@ -75,6 +75,36 @@ type GroupMembers struct {
 	NonVotingMembers []NodeID
 }
 
+// isVoter returns true if the given node is a voting member.
+func (m *GroupMembers) isVoter(id NodeID) bool {
+	for _, member := range m.Members {
+		if member == id {
+			return true
+		}
+	}
+	for _, member := range m.ProposedMembers {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// allNodes returns the voting and non-voting members, each listed once.
+func (m *GroupMembers) allNodes() []NodeID {
+	var nodes []NodeID
+	seen := map[NodeID]bool{}
+	for _, list := range [][]NodeID{m.Members, m.ProposedMembers, m.NonVotingMembers} {
+		for _, id := range list {
+			if !seen[id] {
+				seen[id] = true
+				nodes = append(nodes, id)
+			}
+		}
+	}
+	return nodes
+}
+
 // GroupPersistentState is a unified view of the readable data (except for log entries)
 // about a group; used by Storage.LoadGroups.
 type GroupPersistentState struct {
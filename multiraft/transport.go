@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/rpc"
 
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
@@ -93,7 +94,11 @@ func (lt *localRPCTransport) Stop(id NodeID) {
 }
 
 func (lt *localRPCTransport) Connect(id NodeID) (ClientInterface, error) {
-	address := lt.listeners[id].Addr().String()
+	listener, ok := lt.listeners[id]
+	if !ok {
+		return nil, util.Errorf("unknown node %v", id)
+	}
+	address := listener.Addr().String()
 	client, err := rpc.Dial("tcp", address)
 	if err != nil {
 		return nil, err
@@ -143,6 +148,9 @@ type AppendEntriesRequest struct {
 type AppendEntriesResponse struct {
 	Term    int
 	Success bool
+	// LastLogIndex is the index of the last entry in the follower's log. It is set when
+	// the request fails because entries preceding those sent are missing.
+	LastLogIndex int
 }
 
 // ServerInterface is a generic interface based on net/rpc.
@@ -0,0 +1,26 @@
+#!/bin/bash
+
+# Regenerates the test certificates: a CA and a node certificate
+# signed by it. The node certificate's common name must be "node"
+# (security.NodeUser), which identifies its holder as a Cockroach node
+# rather than a user. Run from this directory.
+
+set -e -x
+
+DAYS=3650
+SUBJ="/C=US/ST=New York/L=New York/O=Cockroach"
+
+openssl genrsa -traditional -out ca.key 2048
+openssl req -new -x509 -sha256 -days $DAYS -key ca.key -out ca.crt \
+  -subj "$SUBJ/CN=Test CA"
+
+openssl genrsa -traditional -out node.key 2048
+openssl req -new -sha256 -key node.key -out node.csr \
+  -subj "$SUBJ/OU=test/CN=node"
+cat > node.ext <<EOE
+extendedKeyUsage = clientAuth, serverAuth
+subjectAltName = IP:127.0.0.1, DNS:localhost
+EOE
+openssl x509 -req -sha256 -days $DAYS -in node.csr -CA ca.crt -CAkey ca.key \
+  -CAcreateserial -extfile node.ext -out node.crt
+rm -f node.csr node.ext ca.srl
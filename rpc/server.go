@@ -18,18 +18,32 @@
 package rpc
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
 	"net/rpc"
 	"sync"
 
+	"github.com/cockroachdb/cockroach/security"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
+// An Authenticator authenticates each request received by a Server
+// before it's served. user is the user named by the peer's TLS
+// certificate, or empty if the connection doesn't use TLS; method is
+// the RPC service method and args the decoded request. The
+// authenticator may modify args, for example to record the user; if
+// it returns an error, the request is rejected with that error.
+type Authenticator func(user, method string, args interface{}) error
+
 // Server is a Cockroach-specific RPC server with an embedded go RPC
 // server struct. By default it handles a simple heartbeat protocol
-// to measure link health. It also supports close callbacks.
+// to measure link health. It also supports close callbacks and
+// authentication of requests.
 //
 // TODO(spencer): heartbeat protocol should also measure link latency
 // and clock skew.
@@ -43,6 +57,7 @@ type Server struct {
 	addr           net.Addr              // Server address; may change if picking unused port
 	closed         bool                  // Set upon invocation of Close()
 	closeCallbacks []func(conn net.Conn) // Slice of callbacks to invoke on conn close
+	authenticator  Authenticator         // Authenticates requests, if not nil
 }
 
 // NewServer creates a new instance of Server.
@@ -65,6 +80,14 @@ func (s *Server) AddCloseCallback(cb func(conn net.Conn)) {
 	s.closeCallbacks = append(s.closeCallbacks, cb)
 }
 
+// SetAuthenticator sets the authenticator invoked for each request
+// received on connections accepted thereafter.
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticator = auth
+}
+
 // Start runs the RPC server. After this method returns, the socket
 // will have been bound. Use Server.Addr() to ascertain server address.
 func (s *Server) Start() error {
@@ -151,6 +174,12 @@ func (s *Server) Addr() net.Addr {
 	return s.addr
 }
 
+// TLSConfig returns the TLS configuration with which the server
+// listens, which is also used by clients connecting to its peers.
+func (s *Server) TLSConfig() *TLSConfig {
+	return s.tlsConfig
+}
+
 // Close closes the listener.
 func (s *Server) Close() {
 	s.mu.Lock()
@@ -165,7 +194,24 @@ func (s *Server) Close() {
 // serveConn synchronously serves a single connection. When the
 // connection is closed, close callbacks are invoked.
 func (s *Server) serveConn(conn net.Conn) {
-	s.ServeConn(conn)
+	var user string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Warningf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		user, _ = security.UserFromTLS(&state)
+	}
+	s.mu.RLock()
+	auth := s.authenticator
+	s.mu.RUnlock()
+	if auth == nil {
+		s.ServeConn(conn)
+	} else {
+		s.ServeCodec(&authCodec{ServerCodec: newGobServerCodec(conn), user: user, auth: auth})
+	}
 	s.mu.Lock()
 	if s.closeCallbacks != nil {
 		for _, cb := range s.closeCallbacks {
@@ -175,3 +221,88 @@ func (s *Server) serveConn(conn net.Conn) {
 	s.mu.Unlock()
 	conn.Close()
 }
+
+// An authCodec wraps a server codec, passing each decoded request to
+// an authenticator along with the user of the connection.
+type authCodec struct {
+	rpc.ServerCodec
+	user   string
+	method string // Service method of the request being read
+	auth   Authenticator
+}
+
+// ReadRequestHeader implements the rpc.ServerCodec interface.
+func (c *authCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = r.ServiceMethod
+	return err
+}
+
+// ReadRequestBody implements the rpc.ServerCodec interface. An error
+// returned by the authenticator is returned to the client in place of
+// a reply.
+func (c *authCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil || body == nil {
+		return err
+	}
+	return c.auth(c.user, c.method, body)
+}
+
+// A gobServerCodec is the gob-encoding server codec used by the go
+// RPC package's ServeConn, which doesn't export it.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+// ReadRequestHeader implements the rpc.ServerCodec interface.
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+// ReadRequestBody implements the rpc.ServerCodec interface.
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+// WriteResponse implements the rpc.ServerCodec interface.
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header; shut down the connection.
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the body; shut down the connection.
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// Close implements the rpc.ServerCodec interface.
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
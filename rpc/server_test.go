@@ -18,6 +18,8 @@
 package rpc
 
 import (
+	"net/rpc"
+	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/util"
@@ -59,3 +61,43 @@ func TestUpdatedAddr(t *testing.T) {
 	checkUpdateMatches(t, "unix", "address", "address", "address")
 	checkUpdateFails(t, "unix", "address", "anotheraddress")
 }
+
+// TestServerAuthenticator verifies that requests are passed to the
+// server's authenticator, and that requests it rejects fail with its
+// error. Connections without TLS have no user.
+func TestServerAuthenticator(t *testing.T) {
+	s := NewServer(util.MakeRawAddr("tcp", "127.0.0.1:0"), LoadInsecureTLSConfig())
+	var users, methods []string
+	s.SetAuthenticator(func(user, method string, args interface{}) error {
+		users = append(users, user)
+		methods = append(methods, method)
+		if args.(*PingRequest).Ping == "reject" {
+			return util.Errorf("rejected")
+		}
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	client, err := rpc.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := &PingResponse{}
+	if err := client.Call("Heartbeat.Ping", &PingRequest{Ping: "ping"}, reply); err != nil || reply.Pong != "ping" {
+		t.Errorf("expected pong; got %q, %v", reply.Pong, err)
+	}
+	if err := client.Call("Heartbeat.Ping", &PingRequest{Ping: "reject"}, reply); err == nil || !strings.HasSuffix(err.Error(), "rejected") {
+		t.Errorf("expected request to be rejected; got %v", err)
+	}
+	// The connection remains usable after a rejected request.
+	if err := client.Call("Heartbeat.Ping", &PingRequest{Ping: "ping"}, reply); err != nil {
+		t.Error(err)
+	}
+	if len(users) != 3 || users[0] != "" || methods[0] != "Heartbeat.Ping" {
+		t.Errorf("expected three anonymous Heartbeat.Ping requests; got users %q, methods %v", users, methods)
+	}
+}
@@ -42,6 +42,9 @@ type TLSConfig struct {
 // - ca.crt   -- the certificate of the cluster CA
 // - node.crt -- the certificate of this node; should be signed by the CA
 // - node.key -- the private key of this node
+//
+// The certificate's common name should be security.NodeUser, which
+// identifies the node to its peers as a node rather than a user.
 func LoadTLSConfig(certDir string) (*TLSConfig, error) {
 	cert, err := tls.LoadX509KeyPair(
 		path.Join(certDir, "node.crt"),
@@ -85,6 +88,12 @@ func LoadInsecureTLSConfig() *TLSConfig {
 	}
 }
 
+// Config returns the underlying TLS configuration, or nil if TLS is
+// disabled.
+func (c *TLSConfig) Config() *tls.Config {
+	return c.config
+}
+
 // LoadTestTLSConfig loads the test TLSConfig included with the project. It requires
 // a path to the project root.
 // TODO Maybe instead of returning err, take a testing.T?  And move to tls_test?
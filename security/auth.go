@@ -0,0 +1,33 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import "crypto/tls"
+
+// NodeUser is the common name of the certificates of Cockroach
+// nodes. Nodes are trusted to send requests on behalf of any user.
+const NodeUser = "node"
+
+// UserFromTLS returns the user named by the common name of the
+// verified peer certificate of a TLS connection, if any. state may be
+// nil if the connection doesn't use TLS.
+func UserFromTLS(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	user := state.VerifiedChains[0][0].Subject.CommonName
+	return user, len(user) > 0
+}
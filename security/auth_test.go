@@ -0,0 +1,56 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+)
+
+// TestUserFromTLS verifies that the user is the common name of a
+// verified peer certificate.
+func TestUserFromTLS(t *testing.T) {
+	pemData, err := ioutil.ReadFile("../resources/test_certs/node.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		t.Fatal("unable to decode test certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := UserFromTLS(nil); ok {
+		t.Error("expected no user without TLS")
+	}
+	// Unverified certificates don't authenticate the peer.
+	if _, ok := UserFromTLS(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); ok {
+		t.Error("expected no user for an unverified certificate")
+	}
+	state := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	if user, ok := UserFromTLS(state); !ok || user != NodeUser {
+		t.Errorf("expected user %q; got %q", NodeUser, user)
+	}
+}
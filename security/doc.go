@@ -0,0 +1,24 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+/*
+Package security provides the primitives used to authenticate the
+users on whose behalf requests are sent to Cockroach.
+
+Requests are authenticated either by a TLS client certificate, whose
+common name is the name of the user, or by a password, which is
+stored salted and hashed as a user's Credentials.
+*/
+package security
@@ -0,0 +1,94 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	// saltLen is the length in bytes of the random salt of a password.
+	saltLen = 16
+	// hashLen is the length in bytes of a password's hash.
+	hashLen = 32
+	// defaultIterations is the number of iterations of the key
+	// derivation function used to hash new passwords.
+	defaultIterations = 10000
+)
+
+// Credentials hold the salted hash of a user's password. The hash is
+// derived from the password using PBKDF2 with HMAC-SHA256. Credentials
+// are stored gob-encoded under engine.KeyUserPrefix + user name.
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	Hash       []byte
+}
+
+// HashPassword returns credentials holding the hash of password
+// salted with random bytes.
+func HashPassword(password string) (*Credentials, error) {
+	if len(password) == 0 {
+		return nil, util.Errorf("password must not be empty")
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, util.Errorf("unable to generate salt: %v", err)
+	}
+	hash := pbkdf2([]byte(password), salt, defaultIterations, hashLen)
+	return &Credentials{Salt: salt, Iterations: defaultIterations, Hash: hash}, nil
+}
+
+// Verify returns true if password hashes to the credentials' hash.
+func (c *Credentials) Verify(password string) bool {
+	if len(password) == 0 || c.Iterations <= 0 || len(c.Hash) == 0 {
+		return false
+	}
+	hash := pbkdf2([]byte(password), c.Salt, c.Iterations, len(c.Hash))
+	return subtle.ConstantTimeCompare(hash, c.Hash) == 1
+}
+
+// pbkdf2 derives a key of keyLen bytes from password and salt using
+// PBKDF2 (RFC 2898) with HMAC-SHA256 as the pseudorandom function.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	var blockIndex [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(blockIndex[:], block)
+		prf.Write(blockIndex[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestPasswordHashing verifies that hashed credentials verify only
+// the password they were created from.
+func TestPasswordHashing(t *testing.T) {
+	creds, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !creds.Verify("secret") {
+		t.Error("expected password to verify")
+	}
+	for _, password := range []string{"", "Secret", "secret "} {
+		if creds.Verify(password) {
+			t.Errorf("expected password %q not to verify", password)
+		}
+	}
+	// Passwords are salted.
+	other, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other.Hash) == string(creds.Hash) {
+		t.Error("expected hashes of the same password to differ")
+	}
+	if _, err := HashPassword(""); err == nil {
+		t.Error("expected error hashing an empty password")
+	}
+	if (&Credentials{}).Verify("secret") {
+		t.Error("expected empty credentials not to verify")
+	}
+}
+
+// TestPBKDF2 verifies the key derivation function against test
+// vectors for PBKDF2-HMAC-SHA256.
+func TestPBKDF2(t *testing.T) {
+	testCases := []struct {
+		password, salt string
+		iterations     int
+		keyLen         int
+		expKey         string
+	}{
+		{"password", "salt", 1, 32, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, 32, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, 32, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 40,
+			"348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	}
+	for i, test := range testCases {
+		key := pbkdf2([]byte(test.password), []byte(test.salt), test.iterations, test.keyLen)
+		if hex.EncodeToString(key) != test.expKey {
+			t.Errorf("%d: expected key %s; got %x", i, test.expKey, key)
+		}
+	}
+}
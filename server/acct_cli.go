@@ -0,0 +1,129 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"flag"
+
+	commander "code.google.com/p/go-commander"
+)
+
+// A CmdGetAcct command displays the acct config for the specified
+// prefix.
+var CmdGetAcct = &commander.Command{
+	UsageLine: "get-acct [options] <key-prefix>",
+	Short:     "fetches and displays the accounting config",
+	Long: `
+Fetches and displays the accounting configuration for <key-prefix>.
+The key prefix should be escaped via URL query escaping if it
+contains non-ascii bytes or spaces.
+`,
+	Run:  runGetAcct,
+	Flag: *flag.CommandLine,
+}
+
+// runGetAcct invokes the REST API with GET action and key prefix as path.
+func runGetAcct(cmd *commander.Command, args []string) {
+	runGetConfig(cmd, args, acctKeyPrefix, "accounting")
+}
+
+// A CmdLsAccts command displays a list of acct configs by prefix.
+var CmdLsAccts = &commander.Command{
+	UsageLine: "ls-accts [options] [key-regexp]",
+	Short:     "list all accounting configs by key prefix",
+	Long: `
+List accounting configs. If a regular expression is given, the results
+of the listing are filtered by key prefixes matching the regexp. The
+key prefix should be escaped via URL query escaping if it contains
+non-ascii bytes or spaces.
+`,
+	Run:  runLsAccts,
+	Flag: *flag.CommandLine,
+}
+
+// runLsAccts invokes the REST API with GET action and no path, which
+// fetches a list of all accounting configuration prefixes. The
+// optional regexp is applied to the complete list and matching
+// prefixes displayed.
+func runLsAccts(cmd *commander.Command, args []string) {
+	runLsConfigs(cmd, args, acctKeyPrefix, "accounting")
+}
+
+// A CmdRmAcct command removes an acct config by prefix.
+var CmdRmAcct = &commander.Command{
+	UsageLine: "rm-acct [options] <key-prefix>",
+	Short:     "remove an accounting config by key prefix",
+	Long: `
+Remove an existing accounting config by key prefix. No action is taken
+if no accounting configuration exists for the specified key prefix.
+Note that this command can affect only a single accounting config
+with an exactly matching prefix. The default accounting config cannot
+be removed. The key prefix should be escaped via URL query escaping if
+it contains non-ascii bytes or spaces.
+`,
+	Run:  runRmAcct,
+	Flag: *flag.CommandLine,
+}
+
+// runRmAcct invokes the REST API with DELETE action and key prefix as
+// path.
+func runRmAcct(cmd *commander.Command, args []string) {
+	runRmConfig(cmd, args, acctKeyPrefix, "accounting")
+}
+
+// A CmdSetAcct command creates a new or updates an existing acct
+// config.
+var CmdSetAcct = &commander.Command{
+	UsageLine: "set-acct [options] <key-prefix> <acct-config-file>",
+	Short:     "create or update accounting config for key prefix",
+	Long: `
+Create or update an accounting config for the specified key prefix
+(first argument: <key-prefix>) to the contents of the specified file
+(second argument: <acct-config-file>). The key prefix should be
+escaped via URL query escaping if it contains non-ascii bytes or
+spaces.
+
+The accounting config format has the following YAML schema:
+
+  cluster_id: <cluster-id>
+  max_bytes: <quota-in-bytes>
+  max_keys: <quota-in-keys>
+
+For example:
+
+  cluster_id: accounting-team
+  max_bytes: 1073741824
+  max_keys: 1000000
+
+An accounting config governs the keys for which it has the longest
+matching key prefix. Writes which would grow the bytes of keys and
+values or the number of keys it governs beyond its quotas are
+rejected. Quotas which are omitted or zero are unlimited. Quotas are
+soft limits: writes are checked against the most recently gossiped
+usage, so concurrent writes may overshoot a quota before further
+writes are rejected. The usage of each accounting config is available
+via the /_admin/usage endpoint.
+`,
+	Run:  runSetAcct,
+	Flag: *flag.CommandLine,
+}
+
+// runSetAcct invokes the REST API with POST action and key prefix as
+// path. The specified configuration file is read from disk and sent
+// as the POST body.
+func runSetAcct(cmd *commander.Command, args []string) {
+	runSetConfig(cmd, args, acctKeyPrefix, "accounting")
+}
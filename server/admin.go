@@ -18,6 +18,8 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -25,38 +27,52 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
 )
 
 const (
 	// adminKeyPrefix is the prefix for RESTful endpoints used to
 	// provide an administrative interface to the cockroach cluster.
 	adminKeyPrefix = "/_admin/"
+	// acctKeyPrefix is the prefix for accounting configuration changes.
+	acctKeyPrefix = adminKeyPrefix + "acct"
+	// permKeyPrefix is the prefix for permission configuration changes.
+	permKeyPrefix = adminKeyPrefix + "perms"
 	// zoneKeyPrefix is the prefix for zone configuration changes.
 	zoneKeyPrefix = adminKeyPrefix + "zones"
+	// usageKeyPrefix is the prefix for querying the usage of
+	// accounting configurations.
+	usageKeyPrefix = adminKeyPrefix + "usage"
+	// userKeyPrefix is the prefix for changes to the passwords of
+	// users. The suffix is the user name.
+	userKeyPrefix = adminKeyPrefix + "users/"
 )
 
 // A actionHandler is an interface which provides Get, Put & Delete
-// to satisfy administrative REST APIs.
+// to satisfy administrative REST APIs. Each is invoked on behalf of
+// user.
 type actionHandler interface {
-	Put(path string, body []byte, r *http.Request) error
-	Get(path string, r *http.Request) (body []byte, contentType string, err error)
-	Delete(path string, r *http.Request) error
+	Put(path string, body []byte, user string) error
+	Get(path string, user string) (body []byte, contentType string, err error)
+	Delete(path string, user string) error
 }
 
 // A adminServer provides a RESTful HTTP API to administration of
 // the cockroach cluster.
 type adminServer struct {
 	kvDB kv.DB // Key-value database client
-	zone *zoneHandler
+	acct *configHandler
+	perm *configHandler
+	zone *configHandler
 }
 
 // newAdminServer allocates and returns a new REST server for
 // administrative APIs.
 func newAdminServer(kvDB kv.DB) *adminServer {
-	return &adminServer{
-		kvDB: kvDB,
-		zone: &zoneHandler{kvDB: kvDB},
-	}
+	s := &adminServer{kvDB: kvDB}
+	s.acct, s.perm, s.zone = newConfigHandlers(kvDB)
+	return s
 }
 
 // handleHealthz responds to health requests from monitoring services.
@@ -65,18 +81,126 @@ func (s *adminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "ok")
 }
 
+// handleAcctAction handles actions for accounting configuration by method.
+func (s *adminServer) handleAcctAction(w http.ResponseWriter, r *http.Request, user string) {
+	s.handleAction(s.acct, acctKeyPrefix, w, r, user)
+}
+
+// handlePermAction handles actions for permission configuration by method.
+func (s *adminServer) handlePermAction(w http.ResponseWriter, r *http.Request, user string) {
+	s.handleAction(s.perm, permKeyPrefix, w, r, user)
+}
+
 // handleZoneAction handles actions for zone configuration by method.
-func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request) {
+func (s *adminServer) handleZoneAction(w http.ResponseWriter, r *http.Request, user string) {
+	s.handleAction(s.zone, zoneKeyPrefix, w, r, user)
+}
+
+// handleAction dispatches a request to handler by method. The path
+// passed to the handler is the request's URL path stripped of prefix.
+func (s *adminServer) handleAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request, user string) {
 	switch r.Method {
 	case "GET":
-		s.handleGetAction(s.zone, w, r)
+		s.handleGetAction(handler, prefix, w, r, user)
+	case "PUT", "POST":
+		s.handlePutAction(handler, prefix, w, r, user)
+	case "DELETE":
+		s.handleDeleteAction(handler, prefix, w, r, user)
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	}
+}
+
+// handleUserAction sets the password of a user, which is PUT as the
+// request body, or deletes the user. Changes are made on behalf of
+// requester, the authenticated user, who must have permission to
+// write the user's credentials; by default, only the root user does.
+func (s *adminServer) handleUserAction(w http.ResponseWriter, r *http.Request, requester string) {
+	user, err := unescapePath(r.URL.Path, userKeyPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(user) == 0 {
+		http.Error(w, "no user specified", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
 	case "PUT", "POST":
-		s.handlePutAction(s.zone, w, r)
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+		if err := putCredentials(s.kvDB, requester, user, strings.TrimRight(string(b), "\r\n")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	case "DELETE":
-		s.handleDeleteAction(s.zone, w, r)
+		dr := <-s.kvDB.Delete(&storage.DeleteRequest{
+			RequestHeader: storage.RequestHeader{Key: userKey(user), User: requester},
+		})
+		if dr.Error != nil {
+			http.Error(w, dr.Error.Error(), http.StatusInternalServerError)
+			return
+		}
 	default:
 		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUsageAction responds to GET requests for the usage of
+// accounting configs with JSON. If a key prefix is specified as the
+// path, its usage is returned; otherwise, the usage of all accounting
+// configs with recorded usage is returned, by URL query escaped key
+// prefix. Usage is read on behalf of the authenticated user.
+func (s *adminServer) handleUsageAction(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	path, err := unescapePath(r.URL.Path, usageKeyPrefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end := engine.KeyAccountingUsagePrefix, engine.PrefixEndKey(engine.KeyAccountingUsagePrefix)
+	if len(path) > 0 {
+		start = storage.MakeAcctUsageKey(engine.Key(path[1:]))
+		end = engine.NextKey(start)
+	}
+	sr := <-s.kvDB.Scan(&storage.ScanRequest{
+		RequestHeader: storage.RequestHeader{Key: start, EndKey: end, User: user},
+		MaxResults:    maxGetResults,
+	})
+	if sr.Error != nil {
+		http.Error(w, sr.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	usageMap := map[string]storage.AcctUsage{}
+	for _, kv := range sr.Rows {
+		usage, err := storage.DecodeAcctUsage(kv.Value.Bytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		usageMap[url.QueryEscape(string(bytes.TrimPrefix(kv.Key, engine.KeyAccountingUsagePrefix)))] = usage
+	}
+	var out interface{} = usageMap
+	if len(path) > 0 {
+		// A prefix without recorded usage has none.
+		out = usageMap[url.QueryEscape(path[1:])]
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
 func unescapePath(path, prefix string) (string, error) {
@@ -87,8 +211,8 @@ func unescapePath(path, prefix string) (string, error) {
 	return result, nil
 }
 
-func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handlePutAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request, user string) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -99,20 +223,20 @@ func (s *adminServer) handlePutAction(handler actionHandler, w http.ResponseWrit
 		return
 	}
 	defer r.Body.Close()
-	if err = handler.Put(path, b, r); err != nil {
+	if err = handler.Put(path, b, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleGetAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request, user string) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	b, contentType, err := handler.Get(path, r)
+	b, contentType, err := handler.Get(path, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -121,13 +245,13 @@ func (s *adminServer) handleGetAction(handler actionHandler, w http.ResponseWrit
 	fmt.Fprintf(w, "%s", string(b))
 }
 
-func (s *adminServer) handleDeleteAction(handler actionHandler, w http.ResponseWriter, r *http.Request) {
-	path, err := unescapePath(r.URL.Path, zoneKeyPrefix)
+func (s *adminServer) handleDeleteAction(handler actionHandler, prefix string, w http.ResponseWriter, r *http.Request, user string) {
+	path, err := unescapePath(r.URL.Path, prefix)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err = handler.Delete(path, r); err != nil {
+	if err = handler.Delete(path, user); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
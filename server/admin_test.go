@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/log"
 )
@@ -38,7 +39,17 @@ func startAdminServer() *httptest.Server {
 	}
 	admin := newAdminServer(db)
 	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		admin.handleZoneAction(w, r)
+		// Requests are authenticated as the root user.
+		switch {
+		case strings.HasPrefix(r.URL.Path, acctKeyPrefix):
+			admin.handleAcctAction(w, r, storage.UserRoot)
+		case strings.HasPrefix(r.URL.Path, permKeyPrefix):
+			admin.handlePermAction(w, r, storage.UserRoot)
+		case strings.HasPrefix(r.URL.Path, usageKeyPrefix):
+			admin.handleUsageAction(w, r, storage.UserRoot)
+		default:
+			admin.handleZoneAction(w, r, storage.UserRoot)
+		}
 	}))
 	if strings.HasPrefix(httpServer.URL, "http://") {
 		*kv.Addr = strings.TrimPrefix(httpServer.URL, "http://")
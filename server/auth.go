@@ -0,0 +1,161 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/security"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// userKey returns the key under which the credentials of user are
+// stored.
+func userKey(user string) engine.Key {
+	return engine.MakeKey(engine.KeyUserPrefix, engine.Key(user))
+}
+
+// A userHandlerFunc serves an HTTP request on behalf of user, the
+// user who authenticated it.
+type userHandlerFunc func(w http.ResponseWriter, r *http.Request, user string)
+
+// authenticated returns a handler which authenticates requests and
+// serves them with handler on behalf of the authenticated user.
+// Anonymous requests and those failing authentication are rejected.
+func (s *server) authenticated(handler userHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.authenticateHTTP(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cockroach"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r, user)
+	}
+}
+
+// anyUser adapts handler, which serves requests regardless of the
+// user who made them, to a userHandlerFunc.
+func anyUser(handler http.HandlerFunc) userHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ string) {
+		handler(w, r)
+	}
+}
+
+// authenticateHTTP returns the user on whose behalf an HTTP request is
+// made: the user named by the client certificate, if one was
+// presented, or otherwise the user whose password is supplied via
+// HTTP basic authentication. An error is returned for anonymous
+// requests and for unknown users or invalid passwords.
+func (s *server) authenticateHTTP(r *http.Request) (string, error) {
+	if user, ok := security.UserFromTLS(r.TLS); ok {
+		return user, nil
+	}
+	user, password, ok := basicAuth(r)
+	if !ok {
+		return "", util.Errorf("authentication required")
+	}
+	creds := &security.Credentials{}
+	ok, _, err := kv.GetI(s.kvDB, userKey(user), creds)
+	if err != nil {
+		log.Warningf("unable to look up credentials of user %q: %v", user, err)
+	}
+	if !ok || err != nil || !creds.Verify(password) {
+		return "", util.Errorf("invalid user name or password")
+	}
+	return user, nil
+}
+
+// basicAuth returns the user name and password supplied via HTTP
+// basic authentication in the Authorization header of r, if any.
+func basicAuth(r *http.Request) (string, string, bool) {
+	const prefix = "Basic "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, prefix))
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.Index(string(decoded), ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return string(decoded[:i]), string(decoded[i+1:]), true
+}
+
+// authenticateRPC is the authenticator of the RPC server of a secure
+// cluster. Anonymous peers, which presented no certificate naming a
+// user, are rejected. Nodes are trusted to send requests on behalf of
+// any user. Other peers are users, who may only invoke the public
+// methods of the KV API; their requests are executed on their behalf
+// once their permissions are verified.
+func (s *server) authenticateRPC(user, method string, args interface{}) error {
+	if len(user) == 0 {
+		return util.Errorf("anonymous peers may not invoke %s", method)
+	}
+	if user == security.NodeUser || strings.HasPrefix(method, "Heartbeat.") {
+		return nil
+	}
+	req, ok := args.(storage.Request)
+	if !ok || !strings.HasPrefix(method, "Node.") || !storage.IsPublic(strings.TrimPrefix(method, "Node.")) {
+		return util.Errorf("user %q may not invoke %s", user, method)
+	}
+	req.Header().User = user
+	if batch, ok := req.(*storage.BatchRequest); ok {
+		for _, bReq := range batch.Requests {
+			bMethod, err := storage.MethodForRequest(bReq)
+			if err != nil {
+				return err
+			}
+			if !storage.IsPublic(bMethod) {
+				return util.Errorf("user %q may not invoke %s", user, bMethod)
+			}
+			bReq.Header().User = user
+		}
+	}
+	return s.kvDB.VerifyPermissions(method, req)
+}
+
+// putCredentials stores the hashed password of user on behalf of
+// requester, who must have permission to write the user's key.
+func putCredentials(db kv.DB, requester, user, password string) error {
+	if len(user) == 0 {
+		return util.Errorf("no user specified")
+	}
+	creds, err := security.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(creds); err != nil {
+		return err
+	}
+	pr := <-db.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{Key: userKey(user), User: requester},
+		Value:         engine.Value{Bytes: buf.Bytes()},
+	})
+	return pr.Error
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv/rest"
+	"github.com/cockroachdb/cockroach/security"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// sendAs sends an HTTP request to the test server, authenticated as
+// user with password unless user is empty, and returns the response
+// code and body.
+func sendAs(t *testing.T, user, password, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, "http://"+*httpAddr+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user) > 0 {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// waitForPermConfigs waits until permission configs have been
+// gossiped, after which requests may be authorized.
+func waitForPermConfigs(t *testing.T, s *server) {
+	if err := util.IsTrueWithin(func() bool {
+		permMap, err := s.gossip.GetInfo(gossip.KeyConfigPermission)
+		return err == nil && permMap != nil
+	}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHTTPAuthentication verifies that HTTP requests are authenticated
+// by password, that anonymous requests and invalid passwords are
+// rejected and that requests are executed on behalf of the
+// authenticated user.
+func TestHTTPAuthentication(t *testing.T) {
+	s := startServer()
+	waitForPermConfigs(t, s)
+	if err := putCredentials(s.kvDB, storage.UserRoot, storage.UserRoot, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := rest.EntryPrefix + "auth-test"
+	if code, _ := sendAs(t, "", "", "PUT", entry, "value"); code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous request to be rejected; got %d", code)
+	}
+	if code, _ := sendAs(t, storage.UserRoot, "wrong", "PUT", entry, "value"); code != http.StatusUnauthorized {
+		t.Errorf("expected invalid password to be rejected; got %d", code)
+	}
+	if code, _ := sendAs(t, "unknown", "secret", "PUT", entry, "value"); code != http.StatusUnauthorized {
+		t.Errorf("expected unknown user to be rejected; got %d", code)
+	}
+	if code, body := sendAs(t, storage.UserRoot, "secret", "PUT", entry, "value"); code != http.StatusOK {
+		t.Errorf("expected root to write entry; got %d: %s", code, body)
+	}
+
+	// Root may set the passwords of other users, who are authorized
+	// according to their permissions.
+	if code, body := sendAs(t, storage.UserRoot, "secret", "PUT", userKeyPrefix+"alice", "password\n"); code != http.StatusOK {
+		t.Fatalf("expected root to set password; got %d: %s", code, body)
+	}
+	if code, body := sendAs(t, "alice", "password", "GET", entry, ""); code != http.StatusInternalServerError ||
+		!strings.Contains(body, `user "alice" cannot read`) {
+		t.Errorf("expected alice to be denied read permission; got %d: %s", code, body)
+	}
+	if code, body := sendAs(t, "alice", "password", "PUT", userKeyPrefix+"alice", "new"); code != http.StatusInternalServerError ||
+		!strings.Contains(body, `user "alice" cannot write`) {
+		t.Errorf("expected alice to be denied setting passwords; got %d: %s", code, body)
+	}
+	if code, body := sendAs(t, storage.UserRoot, "secret", "DELETE", userKeyPrefix+"alice", ""); code != http.StatusOK {
+		t.Errorf("expected root to delete user; got %d: %s", code, body)
+	}
+	if code, _ := sendAs(t, "alice", "password", "GET", entry, ""); code != http.StatusUnauthorized {
+		t.Errorf("expected deleted user to be rejected; got %d", code)
+	}
+}
+
+// TestRPCAuthentication verifies that requests from nodes are trusted
+// while requests from users are executed on their behalf, subject to
+// their permissions, and may not invoke internal methods. Anonymous
+// requests are rejected.
+func TestRPCAuthentication(t *testing.T) {
+	s := startServer()
+	waitForPermConfigs(t, s)
+	newGet := func() *storage.GetRequest {
+		return &storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a"), User: storage.UserRoot}}
+	}
+
+	for _, method := range []string{"Node.Get", "Heartbeat.Ping"} {
+		if err := s.authenticateRPC("", method, newGet()); err == nil {
+			t.Errorf("expected anonymous %s request to be rejected", method)
+		}
+	}
+	args := newGet()
+	if err := s.authenticateRPC(security.NodeUser, "Node.Get", args); err != nil || args.User != storage.UserRoot {
+		t.Errorf("expected request from node to be trusted; got user %q, %v", args.User, err)
+	}
+	args = newGet()
+	if err := s.authenticateRPC("alice", "Node.Get", args); err == nil || args.User != "alice" {
+		t.Errorf("expected request on behalf of alice to be denied; got user %q, %v", args.User, err)
+	}
+	if err := s.authenticateRPC(storage.UserRoot, "Node.Get", newGet()); err != nil {
+		t.Errorf("expected root to be permitted; got %v", err)
+	}
+	lookup := &storage.InternalRangeLookupRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("a")}}
+	if err := s.authenticateRPC(storage.UserRoot, "Node.InternalRangeLookup", lookup); err == nil {
+		t.Error("expected internal method to be rejected")
+	}
+	batch := &storage.BatchRequest{}
+	batch.Add(newGet())
+	batch.Add(lookup)
+	if err := s.authenticateRPC(storage.UserRoot, "Node.Batch", batch); err == nil {
+		t.Error("expected batch holding internal method to be rejected")
+	}
+	if err := s.authenticateRPC(storage.UserRoot, "Gossip.Gossip", &gossip.GossipRequest{}); err == nil {
+		t.Error("expected gossip from user to be rejected")
+	}
+}
+
+// TestInsecureServerLoopback verifies that a server without certs
+// refuses to serve RPC on an address other hosts may connect to.
+func TestInsecureServerLoopback(t *testing.T) {
+	origRPCAddr := *rpcAddr
+	defer func() { *rpcAddr = origRPCAddr }()
+	*rpcAddr = "0.0.0.0:0"
+	if _, err := newServer(); err == nil || !strings.Contains(err.Error(), "-certs is required") {
+		t.Errorf("expected server on non-loopback address to be refused; got %v", err)
+	}
+	*rpcAddr = "127.0.0.1:0"
+	if _, err := newServer(); err != nil {
+		t.Errorf("expected server on loopback address to be created; got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	maxGetResults = 1 << 16 // TODO(spencer): maybe we need paged query support
+)
+
+// A configHandler implements the actionHandler interface for one type
+// of config stored by key prefix: accounting, permission or zone
+// configs. Configs are read and written on behalf of the user who
+// authenticated the request.
+type configHandler struct {
+	kvDB      kv.DB                 // Key-value database client
+	name      string                // Name of the config type, e.g. "zone"
+	keyPrefix engine.Key            // Key prefix under which configs are stored
+	newConfig func() storage.Config // Returns a new, empty config
+}
+
+// newConfigHandlers returns handlers for accounting, permission and
+// zone configs, respectively.
+func newConfigHandlers(kvDB kv.DB) (acct, perm, zone *configHandler) {
+	acct = &configHandler{
+		kvDB:      kvDB,
+		name:      "accounting",
+		keyPrefix: engine.KeyConfigAccountingPrefix,
+		newConfig: func() storage.Config { return &storage.AcctConfig{} },
+	}
+	perm = &configHandler{
+		kvDB:      kvDB,
+		name:      "permission",
+		keyPrefix: engine.KeyConfigPermissionPrefix,
+		newConfig: func() storage.Config { return &storage.PermConfig{} },
+	}
+	zone = &configHandler{
+		kvDB:      kvDB,
+		name:      "zone",
+		keyPrefix: engine.KeyConfigZonePrefix,
+		newConfig: func() storage.Config { return &storage.ZoneConfig{} },
+	}
+	return
+}
+
+// configKey returns the key of the config for the key prefix given
+// by path, stripped of its leading "/" path delimiter.
+func (ch *configHandler) configKey(path string) engine.Key {
+	return engine.MakeKey(ch.keyPrefix, engine.Key(path[1:]))
+}
+
+// Put writes a config for the specified key prefix "key". The config
+// is parsed from the input "body" and stored gob-encoded. The
+// specified body must be valid utf8 and must parse into a valid
+// config of the handler's type.
+func (ch *configHandler) Put(path string, body []byte, user string) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for %s Put", ch.name)
+	}
+	configStr := string(body)
+	if !utf8.ValidString(configStr) {
+		return util.Errorf("config contents not valid utf8: %q", body)
+	}
+	config := ch.newConfig()
+	if err := storage.ParseConfig(body, config); err != nil {
+		return util.Errorf("%s config has invalid format: %s: %v", ch.name, configStr, err)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(config); err != nil {
+		return err
+	}
+	pr := <-ch.kvDB.Put(&storage.PutRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  ch.configKey(path),
+			User: user,
+		},
+		Value: engine.Value{Bytes: buf.Bytes()},
+	})
+	return pr.Error
+}
+
+// Get retrieves the configuration for the specified key. If the key
+// is empty, all configurations are returned. Otherwise, the leading
+// "/" path delimiter is stripped and the configuration matching the
+// remainder is retrieved. Note that this will retrieve the default
+// config if "key" is equal to "/", and will list all configs if "key"
+// is equal to "". The body result contains JSON-formatted output for
+// a listing of keys and YAML-formatted output for retrieval of a
+// config.
+func (ch *configHandler) Get(path string, user string) (body []byte, contentType string, err error) {
+	// Scan all configs if the key is empty.
+	if len(path) == 0 {
+		sr := <-ch.kvDB.Scan(&storage.ScanRequest{
+			RequestHeader: storage.RequestHeader{
+				Key:    ch.keyPrefix,
+				EndKey: engine.PrefixEndKey(ch.keyPrefix),
+				User:   user,
+			},
+			MaxResults: maxGetResults,
+		})
+		if sr.Error != nil {
+			err = sr.Error
+			return
+		}
+		if len(sr.Rows) == maxGetResults {
+			log.Warningf("retrieved maximum number of results (%d); some may be missing", maxGetResults)
+		}
+		var prefixes []string
+		for _, kv := range sr.Rows {
+			trimmed := bytes.TrimPrefix(kv.Key, ch.keyPrefix)
+			prefixes = append(prefixes, url.QueryEscape(string(trimmed)))
+		}
+		// JSON-encode the prefixes array.
+		contentType = "application/json"
+		if body, err = json.Marshal(prefixes); err != nil {
+			err = util.Errorf("unable to format %s configurations: %v", ch.name, err)
+		}
+	} else {
+		gr := <-ch.kvDB.Get(&storage.GetRequest{
+			RequestHeader: storage.RequestHeader{
+				Key:  ch.configKey(path),
+				User: user,
+			},
+		})
+		if gr.Error != nil {
+			err = gr.Error
+			return
+		}
+		// On get, if there's no config for the requested prefix,
+		// return a not found error.
+		if len(gr.Value.Bytes) == 0 {
+			err = util.Errorf("no config found for key prefix %q", path)
+			return
+		}
+		config := ch.newConfig()
+		if err = gob.NewDecoder(bytes.NewBuffer(gr.Value.Bytes)).Decode(config); err != nil {
+			return
+		}
+		var out []byte
+		if out, err = config.ToYAML(); err != nil {
+			err = util.Errorf("unable to marshal %s config %+v to yaml: %v", ch.name, config, err)
+			return
+		}
+		if !utf8.ValidString(string(out)) {
+			err = util.Errorf("config contents not valid utf8: %q", out)
+			return
+		}
+		contentType = "text/yaml"
+		body = out
+	}
+
+	return
+}
+
+// Delete removes the config specified by key. The default config,
+// for the empty key prefix, cannot be deleted.
+func (ch *configHandler) Delete(path string, user string) error {
+	if len(path) == 0 {
+		return util.Errorf("no path specified for %s Delete", ch.name)
+	}
+	if path == "/" {
+		return util.Errorf("the default %s configuration cannot be deleted", ch.name)
+	}
+	dr := <-ch.kvDB.Delete(&storage.DeleteRequest{
+		RequestHeader: storage.RequestHeader{
+			Key:  ch.configKey(path),
+			User: user,
+		},
+	})
+	if dr.Error != nil {
+		return dr.Error
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	testPermConfig = `
+read: [readonly, readwrite]
+write: [readwrite, writeonly]
+`
+	testAcctConfig = `
+cluster_id: test
+`
+	testInvalidPermConfig = `
+read: [readonly]
+writes: [readwrite]
+`
+)
+
+// createTestFile creates a temporary file holding contents. The
+// caller is responsible for removing it via os.Remove().
+func createTestFile(contents string) string {
+	f, err := ioutil.TempFile("", "test-config")
+	if err != nil {
+		log.Fatalf("failed to open temporary file: %v", err)
+	}
+	defer f.Close()
+	f.Write([]byte(contents))
+	return f.Name()
+}
+
+// Example_setAndGetPerms sets perm configs for a variety of key
+// prefixes and verifies they can be fetched directly, listed and
+// removed. An invalid config is rejected.
+func Example_setAndGetPerms() {
+	httpServer := startAdminServer()
+	defer httpServer.Close()
+	testConfigFn := createTestFile(testPermConfig)
+	defer os.Remove(testConfigFn)
+	invalidConfigFn := createTestFile(testInvalidPermConfig)
+	defer os.Remove(invalidConfigFn)
+
+	for _, key := range []engine.Key{engine.KeyMin, engine.Key("db1")} {
+		prefix := url.QueryEscape(string(key))
+		runSetPerms(CmdSetPerms, []string{prefix, testConfigFn})
+		runGetPerms(CmdGetPerms, []string{prefix})
+	}
+	// The invalid config is rejected, so no config is set for "db2".
+	runSetPerms(CmdSetPerms, []string{"db2", invalidConfigFn})
+	runLsPerms(CmdLsPerms, []string{})
+	runRmPerms(CmdRmPerms, []string{"db1"})
+	runLsPerms(CmdLsPerms, []string{})
+	// Output:
+	// set permission config for key prefix ""
+	// permission config for key prefix "":
+	// read: [readonly, readwrite]
+	// write: [readwrite, writeonly]
+	//
+	// set permission config for key prefix "db1"
+	// permission config for key prefix "db1":
+	// read: [readonly, readwrite]
+	// write: [readwrite, writeonly]
+	//
+	// [default]
+	// db1
+	// removed permission config for key prefix "db1"
+	// [default]
+}
+
+// Example_setAndGetAcct sets acct configs for a variety of key
+// prefixes and verifies they can be fetched directly, listed and
+// removed.
+func Example_setAndGetAcct() {
+	httpServer := startAdminServer()
+	defer httpServer.Close()
+	testConfigFn := createTestFile(testAcctConfig)
+	defer os.Remove(testConfigFn)
+
+	runSetAcct(CmdSetAcct, []string{"db1", testConfigFn})
+	runGetAcct(CmdGetAcct, []string{"db1"})
+	runLsAccts(CmdLsAccts, []string{})
+	runRmAcct(CmdRmAcct, []string{"db1"})
+	runLsAccts(CmdLsAccts, []string{})
+	// Output:
+	// set accounting config for key prefix "db1"
+	// accounting config for key prefix "db1":
+	// cluster_id: test
+	//
+	// [default]
+	// db1
+	// removed accounting config for key prefix "db1"
+	// [default]
+}
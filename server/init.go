@@ -24,10 +24,16 @@ import (
 
 	commander "code.google.com/p/go-commander"
 	"code.google.com/p/go-uuid/uuid"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/log"
 )
 
+// rootPassword is the password of the root user set when a cluster
+// is initialized.
+var rootPassword = flag.String("root_password", "", "password of the root user, "+
+	"set by init; if empty, root may only authenticate by client certificate")
+
 // A CmdInit command initializes a new Cockroach cluster.
 var CmdInit = &commander.Command{
 	UsageLine: "init <bootstrap store>",
@@ -45,6 +51,9 @@ For example:
 
   cockroach init hdd,7200rpm=/mnt/hda1
 
+If -root_password is specified, it's set as the password of the root
+user, who may then authenticate via HTTP basic authentication.
+
 To start the cluster after initialization, run "cockroach start".
 `,
 	Run:  runInit,
@@ -77,6 +86,12 @@ func runInit(cmd *commander.Command, args []string) {
 		return
 	}
 	defer localDB.Close()
+	if len(*rootPassword) > 0 {
+		if err := putCredentials(localDB, storage.UserRoot, storage.UserRoot, *rootPassword); err != nil {
+			log.Errorf("Failed to set root password: %v", err)
+			return
+		}
+	}
 	fmt.Fprintf(os.Stdout, "Cockroach cluster %s has been initialized\n", clusterID)
 	fmt.Fprintf(os.Stdout, "To start the cluster, run \"cockroach start\"\n")
 }
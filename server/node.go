@@ -25,6 +25,7 @@ import (
 
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
@@ -60,6 +61,8 @@ type Node struct {
 	gossip     *gossip.Gossip         // Nodes gossip cluster ID, node ID -> host:port
 	distDB     kv.DB                  // Global KV DB; used to access global id generators
 	localDB    *kv.LocalDB            // Local KV DB for access to node-local stores
+	transport  multiraft.Transport    // Carries raft traffic of the node's stores
+	changer    *replicaChanger        // Adds replicas to and removes them from ranges
 	closer     chan struct{}
 
 	maxAvailPrefix string // Prefix for max avail capacity gossip topic
@@ -113,7 +116,9 @@ func BootstrapCluster(clusterID string, eng engine.Engine) (
 	}
 	clock := hlc.NewClock(hlc.UnixNano)
 	now := clock.Now()
-	s := storage.NewStore(clock, eng, nil)
+	// The store is bootstrapped offline; the raft group of its only
+	// range has no other members to communicate with.
+	s := storage.NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
 
 	// Verify the store isn't already part of a cluster.
 	if s.Ident.ClusterID != "" {
@@ -151,6 +156,7 @@ func BootstrapCluster(clusterID string, eng engine.Engine) (
 	// Initialize range addressing records and default administrative configs.
 	desc := storage.RangeDescriptor{
 		StartKey: engine.KeyMin,
+		EndKey:   engine.KeyMax,
 		Replicas: []storage.Replica{replica},
 	}
 	if err := kv.BootstrapRangeDescriptor(localDB, desc, now); err != nil {
@@ -208,6 +214,14 @@ func (n *Node) start(rpcServer *rpc.Server, clock *hlc.Clock,
 	engines []engine.Engine, attrs engine.Attributes) error {
 	n.initDescriptor(rpcServer.Addr(), attrs)
 	rpcServer.RegisterName("Node", n)
+	transport, err := newRPCTransport(n.gossip, rpcServer, rpcServer.TLSConfig())
+	if err != nil {
+		return err
+	}
+	n.transport = transport
+	if n.changer, err = newReplicaChanger(n, rpcServer, clock); err != nil {
+		return err
+	}
 
 	if err := n.initStores(clock, engines); err != nil {
 		return err
@@ -233,15 +247,20 @@ func (n *Node) initStores(clock *hlc.Clock, engines []engine.Engine) error {
 	bootstraps := list.New()
 
 	for _, e := range engines {
-		s := storage.NewStore(clock, e, n.gossip)
+		s := storage.NewStore(clock, e, n.gossip, n.transport)
 		// If not bootstrapped, add to list.
 		if !s.IsBootstrapped() {
 			bootstraps.PushBack(s)
 			continue
 		}
-		// Otherwise, initialize each store in turn.
+		// Otherwise, initialize each store in turn. Ranges which can't
+		// be loaded are logged, but don't prevent the store from serving
+		// the remainder.
 		if err := s.Init(); err != nil {
-			return err
+			if _, ok := err.(*storage.RangeLoadError); !ok {
+				return err
+			}
+			log.Errorf("store %s: %v", s, err)
 		}
 		if s.Ident.ClusterID != "" {
 			if s.Ident.StoreID == 0 {
@@ -253,6 +272,9 @@ func (n *Node) initStores(clock *hlc.Clock, engines []engine.Engine) error {
 			}
 			log.Infof("initialized store %s: %+v", s, capacity)
 			n.localDB.AddStore(s)
+			if err := n.startStoreQueues(s); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -331,11 +353,40 @@ func (n *Node) bootstrapStores(bootstraps *list.List) {
 		s := e.Value.(*storage.Store)
 		s.Bootstrap(sIdent)
 		n.localDB.AddStore(s)
+		if err := n.startStoreQueues(s); err != nil {
+			log.Fatal(err)
+		}
 		sIdent.StoreID++
 		log.Infof("bootstrapped store %s", s)
 	}
 }
 
+// startStoreQueues starts processing the store's queue of updates
+// enqueued via EnqueueUpdate, garbage collecting replicas removed from
+// the store's ranges, replicating ranges per their zone configs,
+// rebalancing replicas away from the store and garbage collecting
+// cached responses. Updates may address keys anywhere in the cluster
+// and range addressing records are looked up cluster-wide, so both
+// are executed via the global KV DB.
+func (n *Node) startStoreQueues(s *storage.Store) error {
+	exec := func(method string, args storage.Request, reply storage.Response) error {
+		return kv.ExecuteCmd(n.distDB, method, args, reply)
+	}
+	if err := s.StartUpdateQueue(exec); err != nil {
+		return err
+	}
+	if err := s.StartReplicaGCQueue(exec); err != nil {
+		return err
+	}
+	if err := s.StartReplicateQueue(n.changer); err != nil {
+		return err
+	}
+	if err := s.StartRebalanceQueue(n.changer); err != nil {
+		return err
+	}
+	return s.StartResponseCacheGC(*responseCacheWindow)
+}
+
 // connectGossip connects to gossip network and reads cluster ID. If
 // this node is already part of a cluster, the cluster ID is verified
 // for a match. If not part of a cluster, the cluster ID is set. The
@@ -393,7 +444,9 @@ func (n *Node) gossipCapacities() {
 			return nil
 		}
 		gossipPrefix := gossip.KeyMaxAvailCapacityPrefix + storeDesc.CombinedAttrs().SortedString()
-		keyMaxCapacity := gossipPrefix + strconv.FormatInt(int64(storeDesc.Node.NodeID), 10) + "-" +
+		// The node and store IDs follow a "." so the info belongs to the
+		// gossip group.
+		keyMaxCapacity := gossipPrefix + "." + strconv.FormatInt(int64(storeDesc.Node.NodeID), 10) + "-" +
 			strconv.FormatInt(int64(storeDesc.StoreID), 10)
 		// Register gossip group.
 		n.gossip.RegisterGroup(gossipPrefix, gossipGroupLimit, gossip.MaxGroup)
@@ -410,7 +463,11 @@ func (n *Node) executeCmd(method string, args storage.Request, reply storage.Res
 	if err != nil {
 		return err
 	}
-	store.ExecuteCmd(method, args, reply)
+	// Errors which prevent the command from executing, such as a
+	// range key mismatch, are returned to the client in the reply.
+	if err := store.ExecuteCmd(method, args, reply); err != nil && reply.Header().Error == nil {
+		reply.Header().Error = err
+	}
 	return nil
 }
 
@@ -454,6 +511,11 @@ func (n *Node) Scan(args *storage.ScanRequest, reply *storage.ScanResponse) erro
 	return n.executeCmd(storage.Scan, args, reply)
 }
 
+// Watch .
+func (n *Node) Watch(args *storage.WatchRequest, reply *storage.WatchResponse) error {
+	return n.executeCmd(storage.Watch, args, reply)
+}
+
 // EndTransaction .
 func (n *Node) EndTransaction(args *storage.EndTransactionRequest, reply *storage.EndTransactionResponse) error {
 	return n.executeCmd(storage.EndTransaction, args, reply)
@@ -479,7 +541,22 @@ func (n *Node) EnqueueMessage(args *storage.EnqueueMessageRequest, reply *storag
 	return n.executeCmd(storage.EnqueueMessage, args, reply)
 }
 
+// InternalResolveIntent .
+func (n *Node) InternalResolveIntent(args *storage.InternalResolveIntentRequest, reply *storage.InternalResolveIntentResponse) error {
+	return n.executeCmd(storage.InternalResolveIntent, args, reply)
+}
+
+// HeartbeatTransaction .
+func (n *Node) HeartbeatTransaction(args *storage.HeartbeatTransactionRequest, reply *storage.HeartbeatTransactionResponse) error {
+	return n.executeCmd(storage.HeartbeatTransaction, args, reply)
+}
+
 // InternalRangeLookup .
 func (n *Node) InternalRangeLookup(args *storage.InternalRangeLookupRequest, reply *storage.InternalRangeLookupResponse) error {
 	return n.executeCmd(storage.InternalRangeLookup, args, reply)
 }
+
+// Batch .
+func (n *Node) Batch(args *storage.BatchRequest, reply *storage.BatchResponse) error {
+	return n.executeCmd(storage.Batch, args, reply)
+}
@@ -100,9 +100,16 @@ func TestBootstrapCluster(t *testing.T) {
 	}
 	var keys []engine.Key
 	for _, kv := range sr.Rows {
+		// The raft log and state depend on the commands proposed.
+		if bytes.HasPrefix(kv.Key, engine.KeyLocalRaftLogPrefix) ||
+			bytes.HasPrefix(kv.Key, engine.KeyLocalRaftStatePrefix) ||
+			bytes.HasPrefix(kv.Key, engine.KeyLocalRaftAppliedIndexPrefix) {
+			continue
+		}
 		keys = append(keys, kv.Key)
 	}
 	var expectedKeys = []engine.Key{
+		engine.Key("\x00\x00\x00lease-1"),
 		engine.Key("\x00\x00\x00range-1"),
 		engine.Key("\x00\x00\x00range-id-generator"),
 		engine.Key("\x00\x00\x00store-ident"),
@@ -197,3 +204,75 @@ func TestNodeJoin(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestNodeReplicateZone verifies that a range is replicated to a
+// second node when its zone config is changed to require two
+// replicas.
+func TestNodeReplicateZone(t *testing.T) {
+	e := engine.NewInMem(engine.Attributes{}, 1<<20)
+	localDB, err := BootstrapCluster("cluster-1", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start with a zone config requiring a single replica.
+	clock := hlc.NewClock(hlc.UnixNano)
+	zone := storage.ZoneConfig{
+		Replicas:      []engine.Attributes{engine.Attributes{}},
+		RangeMinBytes: 1048576,
+		RangeMaxBytes: 67108864,
+	}
+	zoneKey := engine.MakeKey(engine.KeyConfigZonePrefix, engine.KeyMin)
+	if err := kv.PutI(localDB, zoneKey, zone, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	localDB.Close()
+
+	*gossip.GossipInterval = 10 * time.Millisecond
+	addr1 := util.CreateTestAddr("tcp")
+	server1, node1 := createTestNode(addr1, []engine.Engine{e}, addr1, t)
+	defer server1.Close()
+	engines2 := []engine.Engine{engine.NewInMem(engine.Attributes{}, 1<<20)}
+	server2, node2 := createTestNode(util.CreateTestAddr("tcp"), engines2, server1.Addr(), t)
+	defer server2.Close()
+	if err := util.IsTrueWithin(func() bool { return node2.localDB.GetStoreCount() == 1 }, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make both stores known to the allocator of node 1.
+	node1.gossipCapacities()
+	node2.gossipCapacities()
+	if err := util.IsTrueWithin(func() bool {
+		infos, err := node1.gossip.GetGroupInfos(gossip.KeyMaxAvailCapacityPrefix)
+		return err == nil && len(infos) == 2
+	}, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	zone.Replicas = append(zone.Replicas, engine.Attributes{})
+	if err := kv.PutI(node1.distDB, zoneKey, zone, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	store1, err := node1.localDB.GetStore(&storage.Replica{StoreID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng, err := store1.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(func() bool {
+		replicas := rng.Descriptor().Replicas
+		if len(replicas) != 2 || replicas[1].NodeID != node2.Descriptor.NodeID || replicas[1].State != storage.OK {
+			return false
+		}
+		store2, err := node2.localDB.GetStore(&replicas[1])
+		if err != nil {
+			return false
+		}
+		_, err = store2.GetRange(1)
+		return err == nil
+	}, 5*time.Second); err != nil {
+		t.Errorf("expected range to be replicated to node %d; got %+v: %v",
+			node2.Descriptor.NodeID, rng.Descriptor().Replicas, err)
+	}
+}
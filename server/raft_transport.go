@@ -0,0 +1,186 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	netrpc "net/rpc"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// raftServiceName is the name of the RPC service via which raft
+// messages are delivered. It matches the service methods invoked by
+// multiraft clients.
+const raftServiceName = "MultiRaft"
+
+// raftConnectTimeout bounds the time a raft message waits for the
+// connection to its destination node.
+const raftConnectTimeout = 1 * time.Second
+
+// rpcTransport implements multiraft.Transport, carrying the raft
+// traffic of a node's stores via the node's RPC server. Raft IDs
+// identify stores; messages to a store are sent to the RPC address
+// gossiped for its node and dispatched there by destination raft ID.
+type rpcTransport struct {
+	gossip    *gossip.Gossip
+	tlsConfig *rpc.TLSConfig
+
+	mu      sync.Mutex
+	servers map[multiraft.NodeID]multiraft.ServerInterface
+}
+
+// newRPCTransport returns a transport serving raft messages via
+// rpcServer and sending them using tlsConfig.
+func newRPCTransport(g *gossip.Gossip, rpcServer *rpc.Server, tlsConfig *rpc.TLSConfig) (*rpcTransport, error) {
+	t := &rpcTransport{
+		gossip:    g,
+		tlsConfig: tlsConfig,
+		servers:   map[multiraft.NodeID]multiraft.ServerInterface{},
+	}
+	if err := rpcServer.RegisterName(raftServiceName, &raftService{t}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Listen implements the multiraft.Transport interface.
+func (t *rpcTransport) Listen(id multiraft.NodeID, server multiraft.ServerInterface) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.servers[id]; ok {
+		return util.Errorf("raft ID %d is already listening", id)
+	}
+	t.servers[id] = server
+	return nil
+}
+
+// Stop implements the multiraft.Transport interface.
+func (t *rpcTransport) Stop(id multiraft.NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.servers, id)
+}
+
+// Connect implements the multiraft.Transport interface. The node's
+// address is resolved as each message is sent, as it may not have
+// been gossiped yet and may change.
+func (t *rpcTransport) Connect(id multiraft.NodeID) (multiraft.ClientInterface, error) {
+	return &rpcTransportClient{transport: t, id: id}, nil
+}
+
+// isLocal returns true if the store with the specified raft ID is
+// listening on this transport.
+func (t *rpcTransport) isLocal(id multiraft.NodeID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.servers[id]
+	return ok
+}
+
+// doRPC delivers a raft message to the local server listening on the
+// message's destination raft ID.
+func (t *rpcTransport) doRPC(dest multiraft.NodeID, name string, req, resp interface{}) error {
+	t.mu.Lock()
+	server, ok := t.servers[dest]
+	t.mu.Unlock()
+	if !ok {
+		nodeID, storeID := storage.DecodeRaftNodeID(dest)
+		return util.Errorf("store %d on node %d is not participating in raft", storeID, nodeID)
+	}
+	return server.DoRPC(name, req, resp)
+}
+
+// nodeAddr returns the RPC address gossiped for the node of the store
+// with the specified raft ID.
+func (t *rpcTransport) nodeAddr(id multiraft.NodeID) (net.Addr, error) {
+	nodeID, _ := storage.DecodeRaftNodeID(id)
+	return nodeAddress(t.gossip, nodeID)
+}
+
+// raftService is registered with the RPC server to receive raft
+// messages, which it passes to the transport.
+type raftService struct {
+	transport *rpcTransport
+}
+
+// RequestVote delivers a raft RequestVote message.
+func (s *raftService) RequestVote(req *multiraft.RequestVoteRequest, resp *multiraft.RequestVoteResponse) error {
+	return s.transport.doRPC(req.DestNode, raftServiceName+".RequestVote", req, resp)
+}
+
+// AppendEntries delivers a raft AppendEntries message.
+func (s *raftService) AppendEntries(req *multiraft.AppendEntriesRequest, resp *multiraft.AppendEntriesResponse) error {
+	return s.transport.doRPC(req.DestNode, raftServiceName+".AppendEntries", req, resp)
+}
+
+// rpcTransportClient implements multiraft.ClientInterface, sending
+// raft messages to a store via the RPC client of its node.
+type rpcTransportClient struct {
+	transport *rpcTransport
+	id        multiraft.NodeID
+}
+
+// Go implements the multiraft.ClientInterface. The call is sent once
+// the RPC client has connected; if it can't connect in time, the call
+// completes with an error.
+func (c *rpcTransportClient) Go(serviceMethod string, args interface{}, reply interface{},
+	done chan *netrpc.Call) *netrpc.Call {
+	call := &netrpc.Call{ServiceMethod: serviceMethod, Args: args, Reply: reply, Done: done}
+	// Calls mustn't complete synchronously, as raft may be the
+	// consumer of done. Messages to stores of this node are delivered
+	// directly: a node's address is only gossiped once it has joined
+	// the cluster, which may require its ranges to elect leaders.
+	if c.transport.isLocal(c.id) {
+		go func() {
+			call.Error = c.transport.doRPC(c.id, serviceMethod, args, reply)
+			done <- call
+		}()
+		return call
+	}
+	addr, err := c.transport.nodeAddr(c.id)
+	if err != nil {
+		call.Error = err
+		go func() { done <- call }()
+		return call
+	}
+	client := rpc.NewClient(addr, nil, c.transport.tlsConfig)
+	go func() {
+		select {
+		case <-client.Ready:
+			client.Go(serviceMethod, args, reply, done)
+			return
+		case <-client.Closed:
+			call.Error = util.Errorf("connection to %s closed", addr)
+		case <-time.After(raftConnectTimeout):
+			call.Error = util.Errorf("timed out connecting to %s", addr)
+		}
+		done <- call
+	}()
+	return call
+}
+
+// Close implements the multiraft.ClientInterface. RPC clients are
+// shared by all users of the node's connections, so they're left open.
+func (c *rpcTransportClient) Close() error {
+	return nil
+}
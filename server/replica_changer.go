@@ -0,0 +1,180 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/storage"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// replicaServiceName is the name of the RPC service via which replicas
+// are created on the stores of a node.
+const replicaServiceName = "Replicas"
+
+// replicaConnectTimeout bounds the time a replica change waits for the
+// connection to the node of a new replica.
+const replicaConnectTimeout = 5 * time.Second
+
+// An AddReplicaRequest is the argument to the Replicas.AddReplica RPC,
+// which creates Replica on its store from Snapshot.
+type AddReplicaRequest struct {
+	Replica  storage.Replica
+	Snapshot *storage.RangeSnapshot
+}
+
+// An AddReplicaResponse is the return value of the
+// Replicas.AddReplica RPC.
+type AddReplicaResponse struct{}
+
+// A ReplicaStatusRequest is the argument to the Replicas.Status RPC,
+// which reports the progress of Replica.
+type ReplicaStatusRequest struct {
+	Replica storage.Replica
+}
+
+// A ReplicaStatusResponse is the return value of the Replicas.Status
+// RPC. AppliedIndex is the index of the last raft log entry applied
+// to the replica.
+type ReplicaStatusResponse struct {
+	AppliedIndex int
+}
+
+// replicaChanger implements storage.ReplicaChanger. Replicas are
+// created on the node of their store via its RPC server and range
+// addressing records are updated via the global KV DB.
+type replicaChanger struct {
+	node      *Node
+	tlsConfig *rpc.TLSConfig
+	clock     *hlc.Clock
+}
+
+// newReplicaChanger returns a replica changer for the stores of node,
+// registering the service via which other nodes create replicas on
+// them with rpcServer.
+func newReplicaChanger(node *Node, rpcServer *rpc.Server, clock *hlc.Clock) (*replicaChanger, error) {
+	if err := rpcServer.RegisterName(replicaServiceName, &replicaService{node}); err != nil {
+		return nil, err
+	}
+	return &replicaChanger{
+		node:      node,
+		tlsConfig: rpcServer.TLSConfig(),
+		clock:     clock,
+	}, nil
+}
+
+// AddReplica implements the storage.ReplicaChanger interface.
+func (rc *replicaChanger) AddReplica(replica storage.Replica, snap *storage.RangeSnapshot) error {
+	args := &AddReplicaRequest{Replica: replica, Snapshot: snap}
+	return rc.call(replica, "AddReplica", args, &AddReplicaResponse{})
+}
+
+// IsCaughtUp implements the storage.ReplicaChanger interface.
+func (rc *replicaChanger) IsCaughtUp(replica storage.Replica, appliedIndex int) (bool, error) {
+	reply := &ReplicaStatusResponse{}
+	if err := rc.call(replica, "Status", &ReplicaStatusRequest{Replica: replica}, reply); err != nil {
+		return false, err
+	}
+	return reply.AppliedIndex >= appliedIndex, nil
+}
+
+// UpdateRangeDescriptor implements the storage.ReplicaChanger
+// interface.
+func (rc *replicaChanger) UpdateRangeDescriptor(desc storage.RangeDescriptor) error {
+	meta := storage.RangeMetadata{RangeDescriptor: desc}
+	return kv.UpdateRangeDescriptor(rc.node.distDB, meta, desc, rc.clock.Now())
+}
+
+// call invokes method of the replica service of the node holding
+// replica's store. Calls to this node are made directly.
+func (rc *replicaChanger) call(replica storage.Replica, method string, args, reply interface{}) error {
+	service := &replicaService{rc.node}
+	if replica.NodeID == rc.node.Descriptor.NodeID {
+		switch method {
+		case "AddReplica":
+			return service.AddReplica(args.(*AddReplicaRequest), reply.(*AddReplicaResponse))
+		case "Status":
+			return service.Status(args.(*ReplicaStatusRequest), reply.(*ReplicaStatusResponse))
+		}
+		return util.Errorf("unknown replica service method %q", method)
+	}
+	addr, err := nodeAddress(rc.node.gossip, replica.NodeID)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(addr, nil, rc.tlsConfig)
+	select {
+	case <-client.Ready:
+	case <-client.Closed:
+		return util.Errorf("connection to node %d at %s closed", replica.NodeID, addr)
+	case <-time.After(replicaConnectTimeout):
+		return util.Errorf("timed out connecting to node %d at %s", replica.NodeID, addr)
+	}
+	return client.Call(replicaServiceName+"."+method, args, reply)
+}
+
+// nodeAddress returns the RPC address gossiped for the specified node.
+func nodeAddress(g *gossip.Gossip, nodeID int32) (net.Addr, error) {
+	info, err := g.GetInfo(gossip.MakeNodeIDGossipKey(nodeID))
+	if info == nil || err != nil {
+		return nil, util.Errorf("unable to look up address of node %d: %v", nodeID, err)
+	}
+	return info.(net.Addr), nil
+}
+
+// replicaService is registered with the RPC server to create replicas
+// on the node's stores and report their progress.
+type replicaService struct {
+	node *Node
+}
+
+// store returns the local store of replica.
+func (s *replicaService) store(replica storage.Replica) (*storage.Store, error) {
+	if replica.NodeID != s.node.Descriptor.NodeID {
+		return nil, util.Errorf("replica %+v doesn't belong to node %d", replica, s.node.Descriptor.NodeID)
+	}
+	return s.node.localDB.GetStore(&replica)
+}
+
+// AddReplica creates the requested replica from the snapshot of its
+// range.
+func (s *replicaService) AddReplica(args *AddReplicaRequest, reply *AddReplicaResponse) error {
+	store, err := s.store(args.Replica)
+	if err != nil {
+		return err
+	}
+	return store.AddReplica(args.Snapshot)
+}
+
+// Status reports the applied index of the requested replica.
+func (s *replicaService) Status(args *ReplicaStatusRequest, reply *ReplicaStatusResponse) error {
+	store, err := s.store(args.Replica)
+	if err != nil {
+		return err
+	}
+	rng, err := store.GetRange(args.Replica.RangeID)
+	if err != nil {
+		return err
+	}
+	reply.AppliedIndex = rng.AppliedIndex()
+	return nil
+}
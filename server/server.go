@@ -20,6 +20,7 @@ package server
 
 import (
 	"compress/gzip"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -38,11 +39,14 @@ import (
 	"github.com/cockroachdb/cockroach/kv"
 	"github.com/cockroachdb/cockroach/kv/rest"
 	"github.com/cockroachdb/cockroach/rpc"
+	"github.com/cockroachdb/cockroach/security"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/structured"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
 var (
@@ -76,6 +80,11 @@ var (
 		"node-to-node links and if any node notices it has clock drift in excess "+
 		"of -max_drift, it will commit suicide.")
 
+	responseCacheWindow = flag.Duration("response_cache_window", storage.DefaultResponseCacheWindow, "specify "+
+		"how long responses to client commands are cached to provide idempotence "+
+		"for retries. Cached responses older than -response_cache_window are "+
+		"garbage collected.")
+
 	// Regular expression for capturing data directory specifications.
 	storesRE = regexp.MustCompile(`([^=]+)=([^,]+)(,|$)`)
 )
@@ -107,7 +116,24 @@ A node exports an HTTP API with the following endpoints:
   Health check:           /healthz
   Key-value REST:         %s
   Structured Schema REST: %s
-`, rest.APIPrefix, structured.StructuredKeyPrefix),
+  User passwords:         %s<user>
+  Accounting usage:       %s[/<key-prefix>]
+
+With -certs, the API is served via HTTPS. Requests other than health
+checks must be authenticated, either by a client certificate whose
+common name is the user or by the user's password via HTTP basic
+authentication. Passwords are set by PUTting them to the user
+endpoint, on behalf of a user with permission to write them (by
+default, root). The root password may be set by "cockroach init".
+
+Nodes authenticate each other by their certificates, whose common name
+must be %q; clients connecting via RPC are authenticated as the user
+named by their certificate, and peers presenting no such certificate
+are rejected. Without -certs, peers can't be authenticated and the
+node is insecure: it listens for RPC and HTTP traffic only on loopback
+addresses, so that it serves only processes on its own host, all of
+which are trusted.
+`, rest.APIPrefix, structured.StructuredKeyPrefix, userKeyPrefix, usageKeyPrefix, security.NodeUser),
 	Run:  runStart,
 	Flag: *flag.CommandLine,
 }
@@ -117,14 +143,16 @@ type server struct {
 	mux            *http.ServeMux
 	rpc            *rpc.Server
 	gossip         *gossip.Gossip
-	kvDB           kv.DB
+	kvDB           *kv.DistDB
 	kvREST         *rest.Server
 	node           *Node
 	admin          *adminServer
 	status         *statusServer
+	recorder       *metricsRecorder
 	structuredDB   *structured.DB
 	structuredREST *structured.RESTServer
 	httpListener   *net.Listener // holds http endpoint information
+	tlsConfig      *rpc.TLSConfig
 }
 
 // runStart starts the cockroach node using -stores as the list of
@@ -154,6 +182,11 @@ func runStart(cmd *commander.Command, args []string) {
 		return
 	}
 
+	// The process owns the default metric system; start it before the
+	// server begins recording from it.
+	metrics.Metrics.Start()
+	defer metrics.Metrics.Stop()
+
 	err = s.start(clock, engines, false)
 	defer s.stop()
 	if err != nil {
@@ -236,18 +269,27 @@ func newServer() (*server, error) {
 	if err != nil {
 		host = "127.0.0.1"
 	}
+	// Without certs, peers can't be authenticated, so the node serves
+	// only processes on its own host.
+	insecure := *certDir == ""
+	if insecure {
+		host = "127.0.0.1"
+	}
 
 	// Resolve
 	if strings.HasPrefix(*rpcAddr, ":") {
 		*rpcAddr = host + *rpcAddr
 	}
-	_, err = net.ResolveTCPAddr("tcp", *rpcAddr)
+	addr, err := net.ResolveTCPAddr("tcp", *rpcAddr)
 	if err != nil {
 		return nil, util.Errorf("unable to resolve RPC address %q: %v", *rpcAddr, err)
 	}
 
 	var tlsConfig *rpc.TLSConfig
-	if *certDir == "" {
+	if insecure {
+		if !addr.IP.IsLoopback() {
+			return nil, util.Errorf("RPC address %q is not a loopback address; -certs is required to serve other hosts", *rpcAddr)
+		}
 		tlsConfig = rpc.LoadInsecureTLSConfig()
 	} else {
 		var err error
@@ -257,9 +299,15 @@ func newServer() (*server, error) {
 	}
 
 	s := &server{
-		host: host,
-		mux:  http.NewServeMux(),
-		rpc:  rpc.NewServer(util.MakeRawAddr("tcp", *rpcAddr), tlsConfig),
+		host:      host,
+		mux:       http.NewServeMux(),
+		rpc:       rpc.NewServer(util.MakeRawAddr("tcp", *rpcAddr), tlsConfig),
+		tlsConfig: tlsConfig,
+	}
+	// Without TLS, RPC peers can't be authenticated; they're local
+	// processes, which are trusted.
+	if tlsConfig.Config() != nil {
+		s.rpc.SetAuthenticator(s.authenticateRPC)
 	}
 
 	s.gossip = gossip.New(tlsConfig)
@@ -268,6 +316,7 @@ func newServer() (*server, error) {
 	s.node = NewNode(s.kvDB, s.gossip)
 	s.admin = newAdminServer(s.kvDB)
 	s.status = newStatusServer(s.kvDB)
+	s.recorder = newMetricsRecorder(s.kvDB, metrics.Metrics)
 	s.structuredDB = structured.NewDB(s.kvDB)
 	s.structuredREST = structured.NewRESTServer(s.structuredDB)
 
@@ -308,14 +357,39 @@ func (s *server) start(clock *hlc.Clock, engines []engine.Engine, selfBootstrap
 	}
 	log.Infof("Initialized %d storage engine(s)", len(engines))
 
+	s.recorder.start()
+	log.Infoln("Started metrics recorder")
+
 	s.initHTTP()
 	if strings.HasPrefix(*httpAddr, ":") {
 		*httpAddr = s.host + *httpAddr
 	}
+	config := s.tlsConfig.Config()
+	if config == nil {
+		addr, err := net.ResolveTCPAddr("tcp", *httpAddr)
+		if err != nil {
+			return util.Errorf("unable to resolve HTTP address %q: %v", *httpAddr, err)
+		}
+		if !addr.IP.IsLoopback() {
+			return util.Errorf("HTTP address %q is not a loopback address; -certs is required to serve other hosts", *httpAddr)
+		}
+	}
 	ln, err := net.Listen("tcp", *httpAddr)
 	if err != nil {
 		return util.Errorf("could not listen on %s: %s", *httpAddr, err)
 	}
+	if config != nil {
+		// Clients authenticate either by certificate or by password.
+		httpConfig := &tls.Config{
+			Certificates: config.Certificates,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			RootCAs:      config.RootCAs,
+			ClientCAs:    config.ClientCAs,
+		}
+		ln = tls.NewListener(ln, httpConfig)
+	} else {
+		log.Warningf("Serving HTTP without TLS; passwords are sent in the clear")
+	}
 	// Obtaining the http end point listener is difficult using
 	// http.ListenAndServe(), so we are storing it with the server
 	s.httpListener = &ln
@@ -326,25 +400,41 @@ func (s *server) start(clock *hlc.Clock, engines []engine.Engine, selfBootstrap
 
 func (s *server) initHTTP() {
 	// TODO(shawn) pretty "/" landing page
+	// Health checks are the only requests which needn't be authenticated.
 	s.mux.HandleFunc(adminKeyPrefix+"healthz", s.admin.handleHealthz)
 
 	// Status endpoints:
-	s.mux.HandleFunc(statusKeyPrefix, s.status.handleStatus)
-	s.mux.HandleFunc(statusNodesKeyPrefix, s.status.handleNodeStatus)
-	s.mux.HandleFunc(statusGossipKeyPrefix, s.status.handleGossipStatus)
-	s.mux.HandleFunc(statusStoresKeyPrefix, s.status.handleStoresStatus)
-	s.mux.HandleFunc(statusTransactionsKeyPrefix, s.status.handleTransactionStatus)
-	s.mux.HandleFunc(statusLocalKeyPrefix, s.status.handleLocalStatus)
-
-	s.mux.HandleFunc(zoneKeyPrefix, s.admin.handleZoneAction)
-	s.mux.HandleFunc(rest.APIPrefix, s.kvREST.HandleAction)
-	s.mux.HandleFunc(structured.StructuredKeyPrefix, s.structuredREST.HandleAction)
+	s.mux.HandleFunc(statusKeyPrefix, s.authenticated(anyUser(s.status.handleStatus)))
+	s.mux.HandleFunc(statusNodesKeyPrefix, s.authenticated(anyUser(s.status.handleNodeStatus)))
+	s.mux.HandleFunc(statusGossipKeyPrefix, s.authenticated(anyUser(s.status.handleGossipStatus)))
+	s.mux.HandleFunc(statusStoresKeyPrefix, s.authenticated(anyUser(s.status.handleStoresStatus)))
+	s.mux.HandleFunc(statusTransactionsKeyPrefix, s.authenticated(anyUser(s.status.handleTransactionStatus)))
+	s.mux.HandleFunc(statusLocalKeyPrefix, s.authenticated(anyUser(s.status.handleLocalStatus)))
+	s.mux.HandleFunc(statusTimeSeriesKeyPrefix, s.authenticated(anyUser(s.status.handleTimeSeries)))
+	s.mux.HandleFunc(statusTimeSeriesGaugeKeyPrefix, s.authenticated(anyUser(s.status.handleTimeSeriesGauge)))
+
+	// Config and usage endpoints list all key prefixes at the prefix
+	// itself and address individual key prefixes below it.
+	for prefix, handler := range map[string]userHandlerFunc{
+		acctKeyPrefix:  s.admin.handleAcctAction,
+		permKeyPrefix:  s.admin.handlePermAction,
+		zoneKeyPrefix:  s.admin.handleZoneAction,
+		usageKeyPrefix: s.admin.handleUsageAction,
+	} {
+		s.mux.HandleFunc(prefix, s.authenticated(handler))
+		s.mux.HandleFunc(prefix+"/", s.authenticated(handler))
+	}
+	s.mux.HandleFunc(userKeyPrefix, s.authenticated(s.admin.handleUserAction))
+	s.mux.HandleFunc(rest.APIPrefix, s.authenticated(s.kvREST.HandleAction))
+	s.mux.HandleFunc(structured.StructuredKeyPrefix, s.authenticated(anyUser(s.structuredREST.HandleAction)))
 }
 
 func (s *server) stop() {
 	// TODO(spencer): the http server should exit; this functionality is
 	// slated for go 1.3.
+	s.recorder.stop()
 	s.node.stop()
+	s.kvDB.Close()
 	s.gossip.Stop()
 	s.rpc.Close()
 }
@@ -26,7 +26,11 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"code.google.com/p/go.net/context"
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/storage"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
@@ -46,7 +50,8 @@ func init() {
 
 func startServer() *server {
 	serverTestOnce.Do(func() {
-		s, err := newServer()
+		var err error
+		s, err = newServer()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -241,3 +246,55 @@ func TestGzip(t *testing.T) {
 		t.Errorf("expected body to contain %q, got %q", expected, string(b))
 	}
 }
+
+// TestWatch verifies that writes are delivered to watchers by the
+// distributed KV API, both those committed before the watch and
+// those awaited by it.
+func TestWatch(t *testing.T) {
+	s := startServer()
+	c := kv.NewClient(s.kvDB)
+	ctx := context.Background()
+	gr := <-s.kvDB.Get(&storage.GetRequest{RequestHeader: storage.RequestHeader{Key: engine.Key("watch"), User: storage.UserRoot}})
+	if gr.Error != nil {
+		t.Fatal(gr.Error)
+	}
+	if err := c.Put(ctx, engine.Key("watch-a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys of watched writes are sent on writes; the watch ends
+	// once the write to "watch-b" is seen.
+	errWatchDone := fmt.Errorf("watch done")
+	writes := make(chan string, 10)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.Watch(ctx, engine.Key("watch-"), engine.Key("watch."), gr.Timestamp,
+			func(events []storage.WatchEvent, _ hlc.Timestamp) error {
+				for _, e := range events {
+					writes <- string(e.Key)
+					if string(e.Key) == "watch-b" {
+						return errWatchDone
+					}
+				}
+				return nil
+			})
+	}()
+	for _, expKey := range []string{"watch-a", "watch-b"} {
+		if expKey == "watch-b" {
+			if err := c.Put(ctx, engine.Key("watch-b"), []byte("2")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case key := <-writes:
+			if key != expKey {
+				t.Errorf("expected write to %q; got %q", expKey, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("write to %q not delivered", expKey)
+		}
+	}
+	if err := <-errChan; err != errWatchDone {
+		t.Error(err)
+	}
+}
@@ -43,6 +43,14 @@ const (
 	// statusTransactionsKeyPrefix exposes transaction statistics.
 	statusTransactionsKeyPrefix = statusKeyPrefix + "txns/"
 
+	// statusTimeSeriesKeyPrefix exposes time series data recorded from
+	// node metrics. The series name follows the prefix.
+	statusTimeSeriesKeyPrefix = statusKeyPrefix + "ts/"
+
+	// statusTimeSeriesGaugeKeyPrefix exposes gauge time series data
+	// recorded from node metrics. The series name follows the prefix.
+	statusTimeSeriesGaugeKeyPrefix = statusKeyPrefix + "tsgauge/"
+
 	// statusLocalKeyPrefix exposes the status of the node serving the request.
 	// This is equivalent to GETing statusNodesKeyPrefix/<current-node-id>.
 	// Useful for debuging nodes that aren't communicating with the cluster properly.
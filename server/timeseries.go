@@ -0,0 +1,181 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/kv"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+const (
+	// defaultTimeSeriesWindow is the window queried from the time
+	// series endpoint if no start time is specified.
+	defaultTimeSeriesWindow = time.Hour
+	// defaultTimeSeriesResolution is the resolution at which time
+	// series are downsampled if no resolution is specified.
+	defaultTimeSeriesResolution = time.Minute
+)
+
+// A metricsRecorder subscribes to the raw metrics published by a
+// metrics.MetricSystem at each interval and accumulates them into
+// time series stored in the key value store. Rates, which count
+// events within an interval, are accumulated into time series;
+// gauges, which are sampled once per interval, are recorded as gauge
+// series holding each sampled value. Cumulative counters and
+// histograms are not recorded.
+type metricsRecorder struct {
+	db      kv.DB
+	ms      *metrics.MetricSystem
+	metrics chan *metrics.RawMetricSet
+	closer  chan struct{}
+}
+
+// newMetricsRecorder returns a metricsRecorder which records metrics
+// published by ms into db.
+func newMetricsRecorder(db kv.DB, ms *metrics.MetricSystem) *metricsRecorder {
+	return &metricsRecorder{
+		db:      db,
+		ms:      ms,
+		metrics: make(chan *metrics.RawMetricSet, 1),
+		closer:  make(chan struct{}),
+	}
+}
+
+// start subscribes to raw metrics and launches a goroutine to record
+// each metric set as it's published. The recorder only reads from the
+// metric system; its owner is responsible for starting it.
+func (mr *metricsRecorder) start() {
+	mr.ms.SubscribeToRawMetrics(mr.metrics)
+	go func() {
+		for {
+			select {
+			case set := <-mr.metrics:
+				if err := mr.record(set); err != nil {
+					log.Warningf("failed to record metrics at %s: %v", set.Time, err)
+				}
+			case <-mr.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop unsubscribes from raw metrics and stops recording.
+func (mr *metricsRecorder) stop() {
+	mr.ms.UnsubscribeFromRawMetrics(mr.metrics)
+	close(mr.closer)
+}
+
+// record accumulates the rates and records the gauges of the supplied
+// metric set into series named after each metric at set.Time. Returns the
+// last error encountered, if any; a failure to record one metric
+// doesn't prevent recording the others.
+func (mr *metricsRecorder) record(set *metrics.RawMetricSet) error {
+	var lastErr error
+	for name, count := range set.Rates {
+		if err := kv.AccumulateTimeSeries(mr.db, name, set.Time, int64(count)); err != nil {
+			lastErr = err
+		}
+	}
+	for name, value := range set.Gauges {
+		if err := kv.RecordTimeSeriesGauge(mr.db, name, set.Time, int64(value)); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// handleTimeSeries handles GET requests for time series data. The
+// series name follows statusTimeSeriesKeyPrefix in the path. The
+// query window is specified via the "start" and "end" parameters in
+// Unix seconds, defaulting to the last hour, and the downsampling
+// resolution via the "resolution" parameter as a duration (e.g. "10s",
+// "1m"), defaulting to one minute. Datapoints are returned as a JSON
+// array.
+func (s *statusServer) handleTimeSeries(w http.ResponseWriter, r *http.Request) {
+	s.serveTimeSeries(w, r, statusTimeSeriesKeyPrefix, kv.QueryTimeSeries)
+}
+
+// handleTimeSeriesGauge handles GET requests for gauge time series
+// data. The series name follows statusTimeSeriesGaugeKeyPrefix in the
+// path; query parameters are as for handleTimeSeries.
+func (s *statusServer) handleTimeSeriesGauge(w http.ResponseWriter, r *http.Request) {
+	s.serveTimeSeries(w, r, statusTimeSeriesGaugeKeyPrefix, kv.QueryTimeSeriesGauge)
+}
+
+// serveTimeSeries answers a time series request for the series named
+// after prefix in the path, reading datapoints via query.
+func (s *statusServer) serveTimeSeries(w http.ResponseWriter, r *http.Request, prefix string,
+	query func(kv.DB, string, time.Time, time.Time, time.Duration) ([]kv.TimeSeriesDatapoint, error)) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if name == "" {
+		http.Error(w, "time series name not specified", http.StatusBadRequest)
+		return
+	}
+	start, end, resolution, err := parseTimeSeriesQuery(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	datapoints, err := query(s.kvDB, name, start, end, resolution)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := json.Marshal(datapoints)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseTimeSeriesQuery parses the start, end and resolution query
+// parameters of a time series request, substituting defaults
+// relative to now for any which are missing.
+func parseTimeSeriesQuery(r *http.Request, now time.Time) (start, end time.Time, resolution time.Duration, err error) {
+	end, resolution = now, defaultTimeSeriesResolution
+	if e := r.FormValue("end"); e != "" {
+		secs, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return start, end, resolution, util.Errorf("invalid end %q: %s", e, err)
+		}
+		end = time.Unix(secs, 0)
+	}
+	start = end.Add(-defaultTimeSeriesWindow)
+	if s := r.FormValue("start"); s != "" {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return start, end, resolution, util.Errorf("invalid start %q: %s", s, err)
+		}
+		start = time.Unix(secs, 0)
+	}
+	if res := r.FormValue("resolution"); res != "" {
+		if resolution, err = time.ParseDuration(res); err != nil {
+			return start, end, resolution, util.Errorf("invalid resolution %q: %s", res, err)
+		}
+	}
+	return start, end, resolution, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestParseTimeSeriesQuery verifies defaults and parsing of time
+// series query parameters.
+func TestParseTimeSeriesQuery(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	testCases := []struct {
+		query      string
+		start, end time.Time
+		resolution time.Duration
+		expErr     bool
+	}{
+		{"", now.Add(-defaultTimeSeriesWindow), now, defaultTimeSeriesResolution, false},
+		{"?start=100&end=200&resolution=10s", time.Unix(100, 0), time.Unix(200, 0), 10 * time.Second, false},
+		{"?end=10000", time.Unix(10000, 0).Add(-defaultTimeSeriesWindow), time.Unix(10000, 0), defaultTimeSeriesResolution, false},
+		{"?start=a", time.Time{}, time.Time{}, 0, true},
+		{"?end=a", time.Time{}, time.Time{}, 0, true},
+		{"?resolution=1", time.Time{}, time.Time{}, 0, true},
+	}
+	for i, test := range testCases {
+		r, err := http.NewRequest("GET", "http://localhost"+statusTimeSeriesKeyPrefix+"foo"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, end, resolution, err := parseTimeSeriesQuery(r, now)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+		if test.expErr {
+			continue
+		}
+		if !start.Equal(test.start) || !end.Equal(test.end) || resolution != test.resolution {
+			t.Errorf("%d: expected %s %s %s; got %s %s %s", i, test.start, test.end, test.resolution, start, end, resolution)
+		}
+	}
+}
@@ -18,40 +18,11 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/url"
-	"os"
-	"regexp"
 
 	commander "code.google.com/p/go-commander"
-	"github.com/cockroachdb/cockroach/kv"
-	"github.com/cockroachdb/cockroach/util"
-	"github.com/cockroachdb/cockroach/util/log"
 )
 
-// sendAdminRequest send an HTTP request and processes the response for
-// its body or error message if a non-200 response code.
-func sendAdminRequest(req *http.Request) ([]byte, error) {
-	resp, err := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
-	if err != nil {
-		return nil, util.Errorf("admin REST request failed: %v", err)
-	}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, util.Errorf("unable to read admin REST response: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		return nil, util.Errorf("%s: %s", resp.Status, string(b))
-	}
-	return b, nil
-}
-
 // A CmdGetZone command displays the zone config for the specified
 // prefix.
 var CmdGetZone = &commander.Command{
@@ -68,22 +39,7 @@ non-ascii bytes or spaces.
 
 // runGetZones invokes the REST API with GET action and key prefix as path.
 func runGetZones(cmd *commander.Command, args []string) {
-	if len(args) != 1 {
-		cmd.Usage()
-		return
-	}
-	req, err := http.NewRequest("GET", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], nil)
-	if err != nil {
-		log.Errorf("unable to create request to admin REST endpoint: %v", err)
-		return
-	}
-	// TODO(spencer): need to move to SSL.
-	b, err := sendAdminRequest(req)
-	if err != nil {
-		log.Errorf("admin REST request failed: %v", err)
-		return
-	}
-	fmt.Fprintf(os.Stdout, "zone config for key prefix %q:\n%s\n", args[0], string(b))
+	runGetConfig(cmd, args, zoneKeyPrefix, "zone")
 }
 
 // A CmdLsZones command displays a list of zone configs by prefix.
@@ -105,44 +61,7 @@ non-ascii bytes or spaces.
 // regexp is applied to the complete list and matching prefixes
 // displayed.
 func runLsZones(cmd *commander.Command, args []string) {
-	if len(args) > 1 {
-		cmd.Usage()
-		return
-	}
-	req, err := http.NewRequest("GET", kv.HTTPAddr()+zoneKeyPrefix, nil)
-	if err != nil {
-		log.Errorf("unable to create request to admin REST endpoint: %v", err)
-		return
-	}
-	b, err := sendAdminRequest(req)
-	if err != nil {
-		log.Errorf("admin REST request failed: %v", err)
-		return
-	}
-	var prefixes []string
-	if err = json.Unmarshal(b, &prefixes); err != nil {
-		log.Errorf("unable to parse admin REST response: %v", err)
-		return
-	}
-	var re *regexp.Regexp
-	if len(args) == 1 {
-		if re, err = regexp.Compile(args[0]); err != nil {
-			log.Warningf("invalid regular expression %q; skipping regexp match and listing all zone prefixes", args[0])
-			re = nil
-		}
-	}
-	for _, prefix := range prefixes {
-		if re != nil {
-			unescaped, err := url.QueryUnescape(prefix)
-			if err != nil || !re.MatchString(unescaped) {
-				continue
-			}
-		}
-		if prefix == "" {
-			prefix = "[default]"
-		}
-		fmt.Fprintf(os.Stdout, "%s\n", prefix)
-	}
+	runLsConfigs(cmd, args, zoneKeyPrefix, "zone")
 }
 
 // A CmdRmZone command removes a zone config by prefix.
@@ -163,22 +82,7 @@ contains non-ascii bytes or spaces.
 // runRmZone invokes the REST API with DELETE action and key prefix as
 // path.
 func runRmZone(cmd *commander.Command, args []string) {
-	if len(args) != 1 {
-		cmd.Usage()
-		return
-	}
-	req, err := http.NewRequest("DELETE", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], nil)
-	if err != nil {
-		log.Errorf("unable to create request to admin REST endpoint: %v", err)
-		return
-	}
-	// TODO(spencer): need to move to SSL.
-	_, err = sendAdminRequest(req)
-	if err != nil {
-		log.Errorf("admin REST request failed: %v", err)
-		return
-	}
-	fmt.Fprintf(os.Stdout, "removed zone config for key prefix %q\n", args[0])
+	runRmConfig(cmd, args, zoneKeyPrefix, "zone")
 }
 
 // A CmdSetZone command creates a new or updates an existing zone
@@ -222,26 +126,5 @@ This feature can be taken advantage of to pre-split ranges.
 // path. The specified configuration file is read from disk and sent
 // as the POST body.
 func runSetZone(cmd *commander.Command, args []string) {
-	if len(args) != 2 {
-		cmd.Usage()
-		return
-	}
-	// Read in the config file.
-	body, err := ioutil.ReadFile(args[1])
-	if err != nil {
-		log.Errorf("unable to read zone config file %q: %v", args[1], err)
-		return
-	}
-	req, err := http.NewRequest("POST", kv.HTTPAddr()+zoneKeyPrefix+"/"+args[0], bytes.NewReader(body))
-	if err != nil {
-		log.Errorf("unable to create request to admin REST endpoint: %v", err)
-		return
-	}
-	// TODO(spencer): need to move to SSL.
-	_, err = sendAdminRequest(req)
-	if err != nil {
-		log.Errorf("admin REST request failed: %v", err)
-		return
-	}
-	fmt.Fprintf(os.Stdout, "set zone config for key prefix %q\n", args[0])
+	runSetConfig(cmd, args, zoneKeyPrefix, "zone")
 }
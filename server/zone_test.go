@@ -19,12 +19,10 @@ package server
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/url"
 	"os"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
-	"github.com/cockroachdb/cockroach/util/log"
 )
 
 const (
@@ -41,13 +39,7 @@ range_max_bytes: 67108864
 // removing it. Returns the filename for a subsequent call to
 // os.Remove().
 func createTestConfigFile() string {
-	f, err := ioutil.TempFile("", "test-config")
-	if err != nil {
-		log.Fatalf("failed to open temporary file: %v", err)
-	}
-	defer f.Close()
-	f.Write([]byte(testConfig))
-	return f.Name()
+	return createTestFile(testConfig)
 }
 
 // ExampleSetAndGetZone sets zone configs for a variety of key
@@ -0,0 +1,409 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+func init() {
+	gob.Register(AcctUsageMap{})
+	gob.Register(&QuotaExceededError{})
+}
+
+// AcctUsage holds the storage used by the keys governed by an
+// accounting config, that is the user keys for which the config has
+// the longest matching prefix. System keys are not accounted.
+type AcctUsage struct {
+	Bytes int64 `json:"bytes"` // Bytes of keys and values
+	Keys  int64 `json:"keys"`  // Number of keys
+}
+
+// add returns the sum of the usage and o.
+func (u AcctUsage) add(o AcctUsage) AcctUsage {
+	return AcctUsage{Bytes: u.Bytes + o.Bytes, Keys: u.Keys + o.Keys}
+}
+
+// AcctUsageMap maps from the key prefix of each accounting config to
+// its usage.
+type AcctUsageMap map[string]AcctUsage
+
+// A QuotaExceededError indicates that a write was rejected because it
+// would have grown the usage of an accounting config beyond its
+// quotas.
+type QuotaExceededError struct {
+	Prefix engine.Key // Key prefix of the accounting config
+	Config AcctConfig
+	Usage  AcctUsage // Usage before the rejected write
+}
+
+// Error formats error.
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("write would exceed quota of accounting prefix %q (max_bytes %d, max_keys %d); usage is %d bytes, %d keys",
+		string(e.Prefix), e.Config.MaxBytes, e.Config.MaxKeys, e.Usage.Bytes, e.Usage.Keys)
+}
+
+// MakeAcctUsageKey returns the key at which the usage of the
+// accounting config for the specified key prefix is accumulated.
+// Changes in usage are merged into the key's value as an
+// engine.TimeSeries holding bytes and keys, in that order.
+func MakeAcctUsageKey(prefix engine.Key) engine.Key {
+	return engine.MakeKey(engine.KeyAccountingUsagePrefix, prefix)
+}
+
+// DecodeAcctUsage decodes the value of a key made by
+// MakeAcctUsageKey.
+func DecodeAcctUsage(b []byte) (AcctUsage, error) {
+	val, err := encoding.GobDecode(b)
+	if err != nil {
+		return AcctUsage{}, err
+	}
+	ts, ok := val.(engine.TimeSeries)
+	if !ok {
+		return AcctUsage{}, util.Errorf("accounting usage is not a time series: %T", val)
+	}
+	var usage AcctUsage
+	if len(ts) > 0 {
+		usage.Bytes = ts[0]
+	}
+	if len(ts) > 1 {
+		usage.Keys = ts[1]
+	}
+	return usage, nil
+}
+
+// usageDelta returns the change in usage from replacing the value
+// oldVal of key with newVal. A nil value denotes an absent key.
+func usageDelta(key engine.Key, oldVal, newVal []byte) AcctUsage {
+	var delta AcctUsage
+	if oldVal != nil {
+		delta.Bytes -= int64(len(key) + len(oldVal))
+		delta.Keys--
+	}
+	if newVal != nil {
+		delta.Bytes += int64(len(key) + len(newVal))
+		delta.Keys++
+	}
+	return delta
+}
+
+// lookupAcctConfig returns the key prefix and accounting config
+// governing key, according to the most recently gossiped accounting
+// configs. If they're not available, the default prefix and a nil
+// config are returned.
+func (r *Range) lookupAcctConfig(key engine.Key) (engine.Key, *AcctConfig) {
+	if r.gossip != nil {
+		if info, err := r.gossip.GetInfo(gossip.KeyConfigAccounting); err == nil {
+			pc := info.(PrefixConfigMap).MatchByPrefix(key)
+			return pc.Prefix, pc.Config.(*AcctConfig)
+		}
+	}
+	return engine.KeyMin, nil
+}
+
+// computeUsage returns the changes in usage of the accounting
+// configs which executing args would cause. They are computed once,
+// by the replica proposing args, from the range's current contents
+// and carried in the raft command, so that every replica accounts the
+// same changes. The changes of a batch are returned per request, in
+// order; otherwise, a single change is returned. Changes assume that
+// requests succeed; flushUsage drops those of requests which fail.
+// The command queue must have cleared overlapping commands, so that
+// the range's contents are those against which args will execute.
+func (r *Range) computeUsage(args Request) ([]AcctUsageMap, error) {
+	if r.gossip == nil {
+		return nil, nil
+	}
+	reqs := []Request{args}
+	if batch, ok := args.(*BatchRequest); ok {
+		reqs = batch.Requests
+	}
+	// Values written by earlier requests of a batch, by key.
+	written := map[string][]byte{}
+	get := func(key engine.Key) ([]byte, error) {
+		if val, ok := written[string(key)]; ok {
+			return val, nil
+		}
+		return r.engine.Get(key)
+	}
+	var usage []AcctUsageMap
+	for i, req := range reqs {
+		writes, err := r.usageWrites(req, args.Header().Timestamp, get, written)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range writes {
+			if bytes.HasPrefix(w.Key, engine.KeySystemPrefix) {
+				continue
+			}
+			oldVal, err := get(w.Key)
+			if err != nil {
+				return nil, err
+			}
+			if usage == nil {
+				usage = make([]AcctUsageMap, len(reqs))
+			}
+			if usage[i] == nil {
+				usage[i] = AcctUsageMap{}
+			}
+			prefix, _ := r.lookupAcctConfig(w.Key)
+			usage[i][string(prefix)] = usage[i][string(prefix)].add(usageDelta(w.Key, oldVal, w.Value))
+			written[string(w.Key)] = w.Value
+		}
+	}
+	return usage, nil
+}
+
+// usageWrites returns the keys which executing req would write, along
+// with their new values as stored; a nil value denotes a deletion.
+// The request executes at timestamp, which is the batch's timestamp
+// if req is part of a batch. get returns the current value of a key
+// and written holds the values written by earlier requests of the
+// same batch.
+func (r *Range) usageWrites(req Request, timestamp hlc.Timestamp, get func(engine.Key) ([]byte, error),
+	written map[string][]byte) ([]engine.RawKeyValue, error) {
+	switch t := req.(type) {
+	case *PutRequest:
+		value := t.Value
+		value.Timestamp = timestamp
+		return []engine.RawKeyValue{{Key: t.Key, Value: engine.EncodeValue(t.Key, value)}}, nil
+	case *ConditionalPutRequest:
+		value := t.Value
+		value.Timestamp = timestamp
+		return []engine.RawKeyValue{{Key: t.Key, Value: engine.EncodeValue(t.Key, value)}}, nil
+	case *IncrementRequest:
+		oldVal, err := get(t.Key)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		if oldVal != nil {
+			decoded, err := encoding.Decode(t.Key, oldVal)
+			var ok bool
+			if n, ok = decoded.(int64); err != nil || !ok {
+				return nil, nil // The increment will fail
+			}
+		}
+		if t.Increment == 0 || encoding.WillOverflow(n, t.Increment) {
+			return nil, nil
+		}
+		encoded, err := encoding.Encode(t.Key, n+t.Increment)
+		if err != nil {
+			return nil, err
+		}
+		return []engine.RawKeyValue{{Key: t.Key, Value: encoded}}, nil
+	case *DeleteRequest:
+		return []engine.RawKeyValue{{Key: t.Key}}, nil
+	case *EnqueueMessageRequest:
+		// Messages are deleted once reaped, which is accounted, so
+		// they're accounted as they're enqueued, at the first free
+		// timestamp key as found by EnqueueMessage.
+		prefix := makeInboxMessagePrefix(t.Key)
+		for {
+			key := makeTimestampKey(prefix, timestamp)
+			val, err := get(key)
+			if err != nil {
+				return nil, err
+			}
+			if val == nil {
+				message := t.Message
+				message.Timestamp = timestamp
+				var buf bytes.Buffer
+				if err := gob.NewEncoder(&buf).Encode(message); err != nil {
+					return nil, err
+				}
+				return []engine.RawKeyValue{{Key: key, Value: buf.Bytes()}}, nil
+			}
+			timestamp.Logical++
+		}
+	case *DeleteRangeRequest:
+		kvs, err := r.engine.Scan(t.Key, t.EndKey, t.MaxEntriesToDelete)
+		if err != nil {
+			return nil, err
+		}
+		writes := make([]engine.RawKeyValue, len(kvs))
+		deleted := map[string]struct{}{}
+		for i, kv := range kvs {
+			writes[i].Key = kv.Key
+			deleted[string(kv.Key)] = struct{}{}
+		}
+		// Keys put by earlier requests of the batch are deleted too.
+		if t.MaxEntriesToDelete == 0 {
+			for key, val := range written {
+				if _, ok := deleted[key]; !ok && val != nil && !engine.Key(key).Less(t.Key) && engine.Key(key).Less(t.EndKey) {
+					writes = append(writes, engine.RawKeyValue{Key: engine.Key(key)})
+				}
+			}
+		}
+		return writes, nil
+	}
+	return nil, nil
+}
+
+// flushUsage enqueues the changes in usage carried by cmd, which has
+// just been applied, as AccumulateTS updates to the usage keys of the
+// affected accounting configs. Only the changes of requests which
+// succeeded are enqueued. Every replica enqueues the same updates with
+// the same command IDs, derived from cmd's raft ID, and only the
+// leaseholder's update queue executes them, so that each is counted
+// once.
+func (r *Range) flushUsage(cmd *Cmd) {
+	deltas := AcctUsageMap{}
+	for i, usage := range cmd.Usage {
+		if !requestSucceeded(cmd, i) {
+			break
+		}
+		for prefix, delta := range usage {
+			deltas[prefix] = deltas[prefix].add(delta)
+		}
+	}
+	for prefix, delta := range deltas {
+		if delta == (AcctUsage{}) {
+			continue
+		}
+		h := fnv.New64a()
+		binary.Write(h, binary.BigEndian, cmd.ID)
+		h.Write([]byte(prefix))
+		timestamp := cmd.Args.Header().Timestamp
+		cmdID := ClientCmdID{WallTime: timestamp.WallTime, Random: int64(h.Sum64() >> 1)}
+		update := &AccumulateTSRequest{
+			RequestHeader: RequestHeader{
+				Key:   MakeAcctUsageKey(engine.Key(prefix)),
+				User:  UserRoot,
+				CmdID: cmdID,
+			},
+			Counts: []int64{delta.Bytes, delta.Keys},
+		}
+		args := &EnqueueUpdateRequest{
+			RequestHeader: RequestHeader{Timestamp: timestamp},
+			Update:        update,
+		}
+		reply := &EnqueueUpdateResponse{}
+		if r.EnqueueUpdate(args, reply); reply.Error != nil {
+			log.Errorf("range %d: unable to enqueue usage of accounting prefix %q: %v",
+				r.Meta.RangeID, prefix, reply.Error)
+		}
+	}
+}
+
+// requestSucceeded returns true if the i-th request of cmd, or cmd
+// itself if it's not a batch, executed successfully. The requests of
+// a batch following a failed request aren't executed.
+func requestSucceeded(cmd *Cmd, i int) bool {
+	if batchReply, ok := cmd.Reply.(*BatchResponse); ok {
+		return i < len(batchReply.Responses) && batchReply.Responses[i] != nil &&
+			batchReply.Responses[i].Header().Error == nil
+	}
+	return i == 0 && cmd.Reply.Header().Error == nil
+}
+
+// checkQuota returns a QuotaExceededError if the changes in usage
+// computed for a write would grow the usage of an accounting config
+// beyond its quotas. checkQuota runs while the write holds its place
+// in the command queue, so it must not issue commands of its own; the
+// current usage is taken from the most recently gossiped usage map.
+// Quotas are therefore soft limits: the gossiped usage trails writes
+// by updates still in flight and by the gossip interval, and nothing
+// is reserved for writes admitted meanwhile, so concurrent writes,
+// on this or other ranges, may together overshoot a quota before
+// further writes are rejected.
+func (r *Range) checkQuota(usage []AcctUsageMap) error {
+	deltas := AcctUsageMap{}
+	for _, u := range usage {
+		for prefix, delta := range u {
+			deltas[prefix] = deltas[prefix].add(delta)
+		}
+	}
+	var usageMap AcctUsageMap
+	for prefix, delta := range deltas {
+		if delta.Bytes <= 0 && delta.Keys <= 0 {
+			continue
+		}
+		_, config := r.lookupAcctConfig(engine.Key(prefix))
+		if config == nil || (config.MaxBytes == 0 && config.MaxKeys == 0) {
+			continue
+		}
+		if usageMap == nil {
+			usageMap = r.gossipedUsage()
+		}
+		current := usageMap[prefix]
+		grown := current.add(delta)
+		if (delta.Bytes > 0 && config.MaxBytes > 0 && grown.Bytes > config.MaxBytes) ||
+			(delta.Keys > 0 && config.MaxKeys > 0 && grown.Keys > config.MaxKeys) {
+			return &QuotaExceededError{Prefix: engine.Key(prefix), Config: *config, Usage: current}
+		}
+	}
+	return nil
+}
+
+// gossipedUsage returns the most recently gossiped usage of all
+// accounting configs, or an empty map if none has been gossiped.
+func (r *Range) gossipedUsage() AcctUsageMap {
+	if r.gossip != nil {
+		if info, err := r.gossip.GetInfo(gossip.KeyAccountingUsage); err == nil {
+			return info.(AcctUsageMap)
+		}
+	}
+	return AcctUsageMap{}
+}
+
+// maybeGossipUsage gossips the usage of all accounting configs if
+// the usage keys fall within the range and this replica is the raft
+// leader.
+func (r *Range) maybeGossipUsage() {
+	if r.gossip == nil || !r.IsLeader() || !r.ContainsKey(engine.KeyAccountingUsagePrefix) {
+		return
+	}
+	usageMap, err := r.loadUsageMap()
+	if err != nil {
+		log.Errorf("failed loading accounting usage map: %v", err)
+		return
+	}
+	if err := r.gossip.AddInfo(gossip.KeyAccountingUsage, usageMap, 0*time.Second); err != nil {
+		log.Errorf("failed to gossip accounting usage map: %v", err)
+	}
+}
+
+// loadUsageMap scans the usage keys and returns the usage of each
+// accounting config.
+func (r *Range) loadUsageMap() (AcctUsageMap, error) {
+	prefix := engine.KeyAccountingUsagePrefix
+	kvs, err := r.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	usageMap := AcctUsageMap{}
+	for _, kv := range kvs {
+		usage, err := DecodeAcctUsage(kv.Value)
+		if err != nil {
+			return nil, util.Errorf("unable to decode usage key %q: %v", kv.Key, err)
+		}
+		usageMap[string(bytes.TrimPrefix(kv.Key, prefix))] = usage
+	}
+	return usageMap, nil
+}
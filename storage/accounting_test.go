@@ -0,0 +1,353 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// queuedUsage sums the changes in usage enqueued as updates on the
+// store's update queue, by usage key.
+func queuedUsage(t *testing.T, e engine.Engine) AcctUsageMap {
+	prefix := engine.KeyLocalUpdateQueuePrefix
+	kvs, err := e.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageMap := AcctUsageMap{}
+	for _, kv := range kvs {
+		var qu queuedUpdate
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&qu); err != nil {
+			t.Fatal(err)
+		}
+		update, ok := qu.Update.(*AccumulateTSRequest)
+		if !ok || len(update.Counts) != 2 {
+			t.Fatalf("unexpected queued update %+v", qu.Update)
+		}
+		key := string(update.Key)
+		usageMap[key] = usageMap[key].add(AcctUsage{Bytes: update.Counts[0], Keys: update.Counts[1]})
+	}
+	return usageMap
+}
+
+// TestRangeRecordsUsage verifies that writes enqueue the changes in
+// usage of the accounting configs governing their keys, so that the
+// accumulated usage matches the range's contents.
+func TestRangeRecordsUsage(t *testing.T) {
+	e := createTestEngine(t)
+	if err := engine.PutI(e, engine.MakeKey(engine.KeyConfigAccountingPrefix, engine.Key("b")), AcctConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	s, r, _ := createTestRange(e, t)
+	defer s.Close()
+
+	pArgs, pReply := putArgs("a", "1", 0)
+	if err := r.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	pArgs, pReply = putArgs("a", "333", 0)
+	if err := r.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b1", "b2", "b3"} {
+		pArgs, pReply = putArgs(key, "value", 0)
+		if err := r.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iArgs, iReply := incrementArgs("c", 5, 0)
+	if err := r.ReadWriteCmd(Increment, iArgs, iReply); err != nil {
+		t.Fatal(err)
+	}
+	dArgs := &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key("b1")}}
+	if err := r.ReadWriteCmd(Delete, dArgs, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	drArgs := &DeleteRangeRequest{RequestHeader: RequestHeader{Key: engine.Key("b2"), EndKey: engine.Key("b3")}}
+	if err := r.ReadWriteCmd(DeleteRange, drArgs, &DeleteRangeResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The accumulated usage of each prefix must match its contents.
+	expected := AcctUsageMap{}
+	kvs, err := e.Scan(engine.PrefixEndKey(engine.KeySystemPrefix), engine.KeyMax, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range kvs {
+		prefix, _ := r.lookupAcctConfig(kv.Key)
+		key := string(MakeAcctUsageKey(prefix))
+		expected[key] = expected[key].add(AcctUsage{Bytes: int64(len(kv.Key) + len(kv.Value)), Keys: 1})
+	}
+	if len(expected) != 2 {
+		t.Fatalf("expected keys governed by two accounting configs; got %+v", expected)
+	}
+	if usageMap := queuedUsage(t, e); !reflect.DeepEqual(usageMap, expected) {
+		t.Errorf("expected queued usage %+v; got %+v", expected, usageMap)
+	}
+}
+
+// TestRangeFlushUsageIdempotent verifies that the usage updates
+// enqueued for a command have the same command IDs each time the
+// command is applied, as on each of the range's replicas.
+func TestRangeFlushUsageIdempotent(t *testing.T) {
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+
+	pArgs, pReply := putArgs("a", "1", 0)
+	usage := []AcctUsageMap{{"": usageDelta(engine.Key("a"), nil, []byte("1"))}}
+	cmd := &Cmd{ID: 1, Method: Put, Args: pArgs, Reply: pReply, Usage: usage}
+	var cmdIDs []ClientCmdID
+	for i := 0; i < 2; i++ {
+		r.flushUsage(cmd)
+		kvs, err := s.engine.Scan(engine.KeyLocalUpdateQueuePrefix, engine.PrefixEndKey(engine.KeyLocalUpdateQueuePrefix), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != i+1 {
+			t.Fatalf("expected %d queued updates; got %d", i+1, len(kvs))
+		}
+		var qu queuedUpdate
+		if err := gob.NewDecoder(bytes.NewBuffer(kvs[i].Value)).Decode(&qu); err != nil {
+			t.Fatal(err)
+		}
+		cmdIDs = append(cmdIDs, qu.CmdID)
+	}
+	if cmdIDs[0].IsEmpty() || cmdIDs[0] != cmdIDs[1] {
+		t.Errorf("expected identical non-empty command IDs; got %+v", cmdIDs)
+	}
+}
+
+// TestRangeUsageCountedOnce verifies that the usage of a write to a
+// range with three replicas is accumulated exactly once, by the
+// leaseholder's update queue, although every replica enqueues it.
+func TestRangeUsageCountedOnce(t *testing.T) {
+	zone := ZoneConfig{Replicas: []engine.Attributes{
+		engine.Attributes([]string{"dc1"}),
+		engine.Attributes([]string{"dc2"}),
+		engine.Attributes([]string{"dc3"}),
+	}}
+	store, rng, rq, changer := createTestReplicateQueue(t, zone)
+	defer closeTestStores(changer.stores)
+	if err := rq.replicate(rng); err != nil {
+		t.Fatal(err)
+	}
+	if storeIDs := replicaStores(rng); len(storeIDs) != 3 {
+		t.Fatalf("expected three replicas; got %v", storeIDs)
+	}
+
+	pArgs, pReply := putArgs("a", "value", rng.Meta.RangeID)
+	if err := store.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	index := rng.AppliedIndex()
+	for storeID, s := range changer.stores {
+		replica, err := s.GetRange(rng.Meta.RangeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := util.IsTrueWithin(func() bool { return replica.AppliedIndex() >= index }, 1*time.Second); err != nil {
+			t.Fatalf("replica on store %d didn't catch up: %v", storeID, err)
+		}
+	}
+
+	// readUsage returns the accumulated usage of the default accounting
+	// config.
+	readUsage := func() AcctUsage {
+		gArgs, gReply := getArgs(string(MakeAcctUsageKey(engine.KeyMin)), rng.Meta.RangeID)
+		if err := store.ExecuteCmd(Get, gArgs, gReply); err != nil {
+			t.Fatal(err)
+		}
+		if gReply.Value.Bytes == nil {
+			return AcctUsage{}
+		}
+		usage, err := DecodeAcctUsage(gReply.Value.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return usage
+	}
+	if usage := readUsage(); usage != (AcctUsage{}) {
+		t.Fatalf("expected usage to be left to the update queue; got %+v", usage)
+	}
+
+	// Each store processes its queue twice; only the leaseholder's
+	// executes the usage update.
+	var count int32
+	exec := func(method string, args Request, reply Response) error {
+		if method == AccumulateTS {
+			atomic.AddInt32(&count, 1)
+		}
+		args.Header().Replica = Replica{RangeID: rng.Meta.RangeID}
+		if err := store.ExecuteCmd(method, args, reply); err != nil {
+			return err
+		}
+		return reply.Header().Error
+	}
+	for i := 0; i < 2; i++ {
+		for _, s := range changer.stores {
+			if err := newUpdateQueue(s, exec).process(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c := atomic.LoadInt32(&count); c != 1 {
+		t.Errorf("expected usage update to be executed once; got %d executions", c)
+	}
+	val, err := store.engine.Get(engine.Key("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AcctUsage{Bytes: int64(len("a") + len(val)), Keys: 1}
+	if usage := readUsage(); usage != expected {
+		t.Errorf("expected usage %+v; got %+v", expected, usage)
+	}
+}
+
+// TestRangeQuota verifies that writes which would exceed the quotas
+// of an accounting config are rejected with a QuotaExceededError,
+// while writes which don't grow usage beyond the quotas succeed.
+func TestRangeQuota(t *testing.T) {
+	e := createTestEngine(t)
+	quota := AcctConfig{MaxBytes: 20, MaxKeys: 2}
+	if err := engine.PutI(e, engine.MakeKey(engine.KeyConfigAccountingPrefix, engine.Key("q")), quota); err != nil {
+		t.Fatal(err)
+	}
+	s, r, g := createTestRange(e, t)
+	defer s.Close()
+
+	for _, key := range []string{"q1", "q2"} {
+		pArgs, pReply := putArgs(key, "value", 0)
+		if err := r.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage := AcctUsage{Bytes: 14, Keys: 2}
+	if err := g.AddInfo(gossip.KeyAccountingUsage, AcctUsageMap{"q": usage}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		method string
+		args   Request
+		reply  Response
+		expErr bool
+	}{
+		// Another key exceeds the key quota.
+		{Put, &PutRequest{RequestHeader: RequestHeader{Key: engine.Key("q3")}, Value: engine.Value{Bytes: []byte("v")}}, &PutResponse{}, true},
+		{Increment, &IncrementRequest{RequestHeader: RequestHeader{Key: engine.Key("q3")}, Increment: 1}, &IncrementResponse{}, true},
+		// A larger value exceeds the byte quota.
+		{Put, &PutRequest{RequestHeader: RequestHeader{Key: engine.Key("q1")}, Value: engine.Value{Bytes: []byte("larger value")}}, &PutResponse{}, true},
+		// Quotas apply to writes within batches.
+		{Batch, &BatchRequest{Requests: []Request{
+			&PutRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}, Value: engine.Value{Bytes: []byte("v")}},
+			&PutRequest{RequestHeader: RequestHeader{Key: engine.Key("q3")}, Value: engine.Value{Bytes: []byte("v")}},
+		}}, &BatchResponse{}, true},
+		// Replacing a value with one of the same size is allowed.
+		{Put, &PutRequest{RequestHeader: RequestHeader{Key: engine.Key("q1")}, Value: engine.Value{Bytes: []byte("VALUE")}}, &PutResponse{}, false},
+		// As are deletions and writes to keys governed by other configs.
+		{Delete, &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key("q2")}}, &DeleteResponse{}, false},
+		{Put, &PutRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}, Value: engine.Value{Bytes: []byte("v")}}, &PutResponse{}, false},
+	}
+	for i, test := range testCases {
+		err := r.ReadWriteCmd(test.method, test.args, test.reply)
+		if !test.expErr {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		quotaErr, ok := err.(*QuotaExceededError)
+		if !ok {
+			t.Errorf("%d: expected quota exceeded error; got %v", i, err)
+			continue
+		}
+		if !bytes.Equal(quotaErr.Prefix, engine.Key("q")) || quotaErr.Config != quota || quotaErr.Usage != usage {
+			t.Errorf("%d: unexpected quota exceeded error %+v", i, quotaErr)
+		}
+		if test.reply.Header().Error != err {
+			t.Errorf("%d: expected error to be set in reply", i)
+		}
+	}
+}
+
+// TestRangeQuotaOvershoot verifies that quotas are soft limits:
+// writes are checked against the gossiped usage, so those admitted
+// before it reflects their changes may overshoot a quota, while
+// writes checked against the updated usage are rejected.
+func TestRangeQuotaOvershoot(t *testing.T) {
+	e := createTestEngine(t)
+	quota := AcctConfig{MaxKeys: 2}
+	if err := engine.PutI(e, engine.MakeKey(engine.KeyConfigAccountingPrefix, engine.Key("q")), quota); err != nil {
+		t.Fatal(err)
+	}
+	s, r, g := createTestRange(e, t)
+	defer s.Close()
+
+	if err := g.AddInfo(gossip.KeyAccountingUsage, AcctUsageMap{"q": {Bytes: 7, Keys: 1}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"q1", "q2", "q3"} {
+		pArgs, pReply := putArgs(key, "value", 0)
+		if err := r.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatalf("%s: expected write to be admitted against stale usage; got %v", key, err)
+		}
+	}
+
+	if err := g.AddInfo(gossip.KeyAccountingUsage, AcctUsageMap{"q": {Bytes: 21, Keys: 3}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	pArgs, pReply := putArgs("q4", "value", 0)
+	if err := r.ReadWriteCmd(Put, pArgs, pReply); err == nil {
+		t.Error("expected write to be rejected once gossiped usage exceeds quota")
+	} else if _, ok := err.(*QuotaExceededError); !ok {
+		t.Errorf("expected quota exceeded error; got %v", err)
+	}
+}
+
+// TestRangeGossipUsage verifies that the accumulated usage of all
+// accounting configs is gossiped.
+func TestRangeGossipUsage(t *testing.T) {
+	s, r, g := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+
+	for _, prefix := range []string{"", "db1"} {
+		args := &AccumulateTSRequest{
+			RequestHeader: RequestHeader{Key: MakeAcctUsageKey(engine.Key(prefix))},
+			Counts:        []int64{10, 1},
+		}
+		if err := r.ReadWriteCmd(AccumulateTS, args, &AccumulateTSResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := g.GetInfo(gossip.KeyAccountingUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := AcctUsageMap{"": {Bytes: 10, Keys: 1}, "db1": {Bytes: 10, Keys: 1}}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected gossiped usage %+v; got %+v", expected, info)
+	}
+}
@@ -20,11 +20,19 @@ package storage
 
 import (
 	"math/rand"
+	"sort"
+	"time"
 
+	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 )
 
+// rebalanceSetSize is the number of most- and least-utilized stores
+// between which replicas are rebalanced. Replicas are only moved away
+// from the most-utilized stores, to the least-utilized.
+const rebalanceSetSize = 3
+
 // StoreFinder finds the disks in a datacenter with the most available capacity.
 type StoreFinder func(engine.Attributes) ([]*StoreDescriptor, error)
 
@@ -38,6 +46,41 @@ type allocator struct {
 	rand        rand.Rand
 }
 
+// newAllocator returns an allocator which finds stores amongst those
+// gossiped by their nodes.
+func newAllocator(g *gossip.Gossip) *allocator {
+	return &allocator{
+		storeFinder: gossipStoreFinder(g),
+		rand:        *rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// gossipStoreFinder returns a StoreFinder which finds the stores
+// having the required attributes amongst the store descriptors
+// gossiped under KeyMaxAvailCapacityPrefix. Nodes gossip store
+// descriptors in a group per combination of store attributes, so only
+// stores whose attributes exactly match are found.
+//
+// TODO(spencer): find stores whose attributes are a superset.
+func gossipStoreFinder(g *gossip.Gossip) StoreFinder {
+	return func(required engine.Attributes) ([]*StoreDescriptor, error) {
+		if g == nil {
+			return nil, util.Error("no gossip network from which to find stores")
+		}
+		infos, err := g.GetGroupInfos(gossip.KeyMaxAvailCapacityPrefix + required.SortedString())
+		if err != nil {
+			return nil, err
+		}
+		var stores []*StoreDescriptor
+		for _, info := range infos {
+			if desc, ok := info.(StoreDescriptor); ok && required.IsSubset(desc.CombinedAttrs()) {
+				stores = append(stores, &desc)
+			}
+		}
+		return stores, nil
+	}
+}
+
 // allocate returns a suitable store based on the supplied
 // attributes list. If none are available / suitable, returns an
 // error. It uses the allocator's StoreFinder to select the set of
@@ -57,6 +100,52 @@ func (a *allocator) allocate(required engine.Attributes, existingReplicas []Repl
 	}
 
 	// Randomly pick a node weighted by capacity.
+	if s := a.pick(stores, usedNodes); s != nil {
+		return s, nil
+	}
+	return nil, util.Errorf("unable to find an appropriate store for requested replica attributes")
+}
+
+// rebalanceTarget returns a store to which the source replica should
+// be moved, or nil if no move is warranted. Replicas are moved only
+// from stores amongst the rebalanceSetSize most utilized stores with
+// the source's attributes, to a store amongst the rebalanceSetSize
+// least utilized. With fewer than twice rebalanceSetSize stores, the
+// sets are each limited to half the stores so that they don't
+// overlap. As with allocate, the target is never on a node which
+// already holds a replica and is picked randomly, weighted by
+// available capacity.
+func (a *allocator) rebalanceTarget(source Replica, existingReplicas []Replica) (
+	*StoreDescriptor, error) {
+	stores, err := a.storeFinder(source.Attrs)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(storesByAvail(stores))
+	n := rebalanceSetSize
+	if half := len(stores) / 2; half < n {
+		n = half
+	}
+	overfull := false
+	for _, s := range stores[:n] {
+		if s.Node.NodeID == source.NodeID && s.StoreID == source.StoreID {
+			overfull = true
+			break
+		}
+	}
+	if !overfull {
+		return nil, nil
+	}
+	usedNodes := make(map[int32]struct{})
+	for _, replica := range existingReplicas {
+		usedNodes[replica.NodeID] = struct{}{}
+	}
+	return a.pick(stores[len(stores)-n:], usedNodes), nil
+}
+
+// pick randomly picks a store not on one of the used nodes, weighted
+// by available capacity. Returns nil if there are no candidates.
+func (a *allocator) pick(stores []*StoreDescriptor, usedNodes map[int32]struct{}) *StoreDescriptor {
 	var candidates []*StoreDescriptor
 	var capacityTotal float64
 	for _, s := range stores {
@@ -74,8 +163,16 @@ func (a *allocator) allocate(required engine.Attributes, existingReplicas []Repl
 	for _, c := range candidates {
 		capacitySeen += c.Capacity.PercentAvail()
 		if capacitySeen >= targetCapacity {
-			return c, nil
+			return c
 		}
 	}
-	return nil, util.Errorf("unable to find an appropriate store for requested replica attributes")
+	return nil
 }
+
+// storesByAvail sorts store descriptors by the percentage of their
+// capacity available, from least to most.
+type storesByAvail []*StoreDescriptor
+
+func (s storesByAvail) Len() int           { return len(s) }
+func (s storesByAvail) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s storesByAvail) Less(i, j int) bool { return s[i].Less(*s[j]) }
@@ -288,3 +288,62 @@ func TestExistingReplica(t *testing.T) {
 		t.Errorf("expected result to have node 3 and store 4: %+v", result)
 	}
 }
+
+// unevenStores returns four stores with differing available capacity.
+var unevenStores = func(a engine.Attributes) ([]*StoreDescriptor, error) {
+	var stores []*StoreDescriptor
+	for i, avail := range []int64{90, 10, 80, 20} {
+		stores = append(stores, &StoreDescriptor{
+			StoreID: int32(i + 1),
+			Attrs:   engine.Attributes([]string{"ssd"}),
+			Node: NodeDescriptor{
+				NodeID: int32(i + 1),
+				Attrs:  engine.Attributes([]string{"a"}),
+			},
+			Capacity: engine.StoreCapacity{
+				Capacity:  100,
+				Available: avail,
+			},
+		})
+	}
+	return filterStores(a, stores)
+}
+
+// TestRebalanceTarget verifies that replicas are only moved away from
+// the most utilized stores and to the least utilized.
+func TestRebalanceTarget(t *testing.T) {
+	var a = allocator{
+		storeFinder: unevenStores,
+		rand:        *rand.New(rand.NewSource(0)),
+	}
+	attrs := simpleZoneConfig.Replicas[0]
+	replicaOn := func(storeID int32) Replica {
+		return Replica{NodeID: storeID, StoreID: storeID, Attrs: attrs}
+	}
+	testCases := []struct {
+		source   Replica
+		existing []Replica
+		expStore int32 // 0 for no rebalance
+	}{
+		// Stores 2 & 4 are most utilized; 1 & 3 least.
+		{replicaOn(2), []Replica{replicaOn(2), replicaOn(1)}, 3},
+		{replicaOn(4), []Replica{replicaOn(4), replicaOn(3)}, 1},
+		{replicaOn(2), []Replica{replicaOn(2), replicaOn(1), replicaOn(3)}, 0},
+		// Least utilized stores aren't rebalanced.
+		{replicaOn(1), []Replica{replicaOn(1)}, 0},
+		{replicaOn(3), []Replica{replicaOn(3)}, 0},
+	}
+	for i, test := range testCases {
+		result, err := a.rebalanceTarget(test.source, test.existing)
+		if err != nil {
+			t.Fatalf("%d: unable to find rebalance target: %v", i, err)
+		}
+		if test.expStore == 0 {
+			if result != nil {
+				t.Errorf("%d: expected no rebalance; got %+v", i, result)
+			}
+		} else if result == nil || result.StoreID != test.expStore {
+			t.Errorf("%d: expected rebalance to store %d; got %+v", i, test.expStore, result)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// A CommandQueue maintains an interval tree of keys or key ranges for
+// executing commands. New commands affecting keys or key ranges must
+// wait on already-executing commands which overlap their key range.
+//
+// Before executing, a command invokes GetWait() to acquire a
+// WaitGroup, which is signaled once all overlapping commands on which
+// it must wait have completed: a read-only command waits only for
+// overlapping writes, while a write waits for all overlapping
+// commands, reads and writes alike. Commands which don't overlap
+// never wait on each other.
+//
+// The command is then added to the queue via CommandQueue.Add(start,
+// end Key, readOnly bool), which returns a key for eventual removal.
+// Once the command completes, CommandQueue.Remove(key interface{}) is
+// invoked to remove it and decrement the counts on any pending
+// WaitGroups, possibly signaling commands which were gated by its
+// affected key(s).
+//
+// CommandQueue is not thread safe.
+type CommandQueue struct {
+	cache *util.IntervalCache
+}
+
+type cmd struct {
+	readOnly bool              // True for read-only commands
+	pending  []*sync.WaitGroup // Pending commands gated on this one
+}
+
+// NewCommandQueue returns a new command queue.
+func NewCommandQueue() *CommandQueue {
+	cq := &CommandQueue{
+		cache: util.NewIntervalCache(util.CacheConfig{Policy: util.CacheNone}),
+	}
+	cq.cache.OnEvicted = cq.onEvicted
+	return cq
+}
+
+// onEvicted is called when any entry is removed from the interval
+// tree. This happens on calls to Remove() and to Clear().
+func (cq *CommandQueue) onEvicted(key, value interface{}) {
+	c := value.(*cmd)
+	for _, wg := range c.pending {
+		wg.Done()
+	}
+}
+
+// GetWait increments the supplied WaitGroup according to the number
+// of executing commands with key(s) overlapping the key (start==end)
+// or key range [start, end) on which a command with the specified
+// read-only status must wait: overlapping writes for a read-only
+// command and all overlapping commands otherwise. If end is nil, it
+// is set to start, meaning the command affects a single key. The
+// caller should call wg.Wait() to wait for confirmation that all
+// gating commands have completed or failed.
+func (cq *CommandQueue) GetWait(start, end engine.Key, readOnly bool, wg *sync.WaitGroup) {
+	if end == nil {
+		end = engine.NextKey(start)
+	}
+	for _, c := range cq.cache.GetOverlaps(rangeKey(start), rangeKey(end)) {
+		c := c.(*cmd)
+		if readOnly && c.readOnly {
+			continue
+		}
+		c.pending = append(c.pending, wg)
+		wg.Add(1)
+	}
+}
+
+// Add adds a command to the queue which affects the specified key
+// range. If end is nil, it is set to start, meaning the command
+// affects a single key. The returned interface is the key for the
+// command and must be re-supplied on subsequent invocation of
+// Remove().
+//
+// Add should be invoked after waiting on already-executing commands
+// which overlap the key range via GetWait().
+func (cq *CommandQueue) Add(start, end engine.Key, readOnly bool) interface{} {
+	if end == nil {
+		end = engine.NextKey(start)
+	}
+	key := cq.cache.NewKey(rangeKey(start), rangeKey(end))
+	cq.cache.Add(key, &cmd{readOnly: readOnly})
+	return key
+}
+
+// Remove is invoked to signal that the command associated with the
+// specified key has completed and should be removed. Any commands
+// currently gated by it will be signaled if this is the only command
+// upon which they are still pending.
+//
+// Remove is invoked after a mutating command has been committed to
+// the Raft log and applied to the underlying state machine, or after
+// a read-only command has executed.
+func (cq *CommandQueue) Remove(key interface{}) {
+	cq.cache.Del(key)
+}
+
+// Clear removes all executing commands, signaling any waiting
+// commands.
+func (cq *CommandQueue) Clear() {
+	cq.cache.Clear()
+}
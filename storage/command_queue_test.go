@@ -0,0 +1,234 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// waitForCmd launches a goroutine to wait on the supplied
+// WaitGroup. A channel is returned which signals the completion of
+// the wait.
+func waitForCmd(wg *sync.WaitGroup) <-chan struct{} {
+	cmdDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(cmdDone)
+	}()
+	return cmdDone
+}
+
+// testCmdDone waits for the cmdDone channel to be closed for at most
+// the specified wait duration. Returns true if the command finished
+// in the allotted time, false otherwise.
+func testCmdDone(cmdDone <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-cmdDone:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestCommandQueue(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+
+	// Try a reader with no writes.
+	cq.GetWait(engine.Key("a"), nil, true, &wg)
+	wg.Wait()
+	cq.GetWait(engine.Key("a"), engine.Key("b"), true, &wg)
+	wg.Wait()
+
+	// Add a writer and verify wait group is returned for reader.
+	wk := cq.Add(engine.Key("a"), nil, false)
+	cq.GetWait(engine.Key("a"), nil, true, &wg)
+	readDone := waitForCmd(&wg)
+	if testCmdDone(readDone, 1*time.Millisecond) {
+		t.Fatal("read should not finish with write outstanding")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(readDone, 5*time.Millisecond) {
+		t.Fatal("read should finish with no writes outstanding")
+	}
+}
+
+func TestCommandQueueMultipleWrites(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+
+	// Add multiple writes and add a read which overlaps them all.
+	wk1 := cq.Add(engine.Key("a"), nil, false)
+	wk2 := cq.Add(engine.Key("b"), engine.Key("c"), false)
+	wk3 := cq.Add(engine.Key("0"), engine.Key("d"), false)
+	cq.GetWait(engine.Key("a"), engine.Key("cc"), true, &wg)
+	readDone := waitForCmd(&wg)
+	cq.Remove(wk1)
+	if testCmdDone(readDone, 1*time.Millisecond) {
+		t.Fatal("read should not finish with two writes outstanding")
+	}
+	cq.Remove(wk2)
+	if testCmdDone(readDone, 1*time.Millisecond) {
+		t.Fatal("read should not finish with one write outstanding")
+	}
+	cq.Remove(wk3)
+	if !testCmdDone(readDone, 5*time.Millisecond) {
+		t.Fatal("read should finish with no writes outstanding")
+	}
+}
+
+func TestCommandQueueMultipleReads(t *testing.T) {
+	cq := NewCommandQueue()
+	wg1 := sync.WaitGroup{}
+	wg2 := sync.WaitGroup{}
+	wg3 := sync.WaitGroup{}
+
+	// Add a write which will overlap all reads.
+	wk := cq.Add(engine.Key("a"), engine.Key("d"), false)
+	cq.GetWait(engine.Key("a"), nil, true, &wg1)
+	cq.GetWait(engine.Key("b"), nil, true, &wg2)
+	cq.GetWait(engine.Key("c"), nil, true, &wg3)
+	rd1 := waitForCmd(&wg1)
+	rd2 := waitForCmd(&wg2)
+	rd3 := waitForCmd(&wg3)
+
+	if testCmdDone(rd1, 1*time.Millisecond) ||
+		testCmdDone(rd2, 1*time.Millisecond) ||
+		testCmdDone(rd3, 1*time.Millisecond) {
+		t.Fatal("no reads should finish with write outstanding")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(rd1, 5*time.Millisecond) ||
+		!testCmdDone(rd2, 5*time.Millisecond) ||
+		!testCmdDone(rd3, 5*time.Millisecond) {
+		t.Fatal("reads should finish with no writes outstanding")
+	}
+}
+
+func TestCommandQueueClear(t *testing.T) {
+	cq := NewCommandQueue()
+	wg1 := sync.WaitGroup{}
+	wg2 := sync.WaitGroup{}
+
+	// Add multiple writes and reads which access each.
+	cq.Add(engine.Key("a"), nil, false)
+	cq.Add(engine.Key("b"), nil, false)
+	cq.GetWait(engine.Key("a"), nil, true, &wg1)
+	cq.GetWait(engine.Key("b"), nil, true, &wg2)
+	rd1 := waitForCmd(&wg1)
+	rd2 := waitForCmd(&wg2)
+
+	// Clear the command queue and verify both readers are signaled.
+	cq.Clear()
+
+	if !testCmdDone(rd1, 1*time.Millisecond) ||
+		!testCmdDone(rd2, 1*time.Millisecond) {
+		t.Fatal("reads should finish when clearing command queue")
+	}
+}
+
+// TestCommandQueueReadsDontWaitForReads verifies that reads don't
+// wait on overlapping reads.
+func TestCommandQueueReadsDontWaitForReads(t *testing.T) {
+	cq := NewCommandQueue()
+	wg := sync.WaitGroup{}
+
+	cq.Add(engine.Key("a"), engine.Key("c"), true)
+	cq.GetWait(engine.Key("b"), nil, true, &wg)
+	if !testCmdDone(waitForCmd(&wg), 5*time.Millisecond) {
+		t.Fatal("read should not wait on overlapping read")
+	}
+}
+
+// TestCommandQueueWritesWait verifies that writes wait on overlapping
+// reads and writes, but not on commands to other keys.
+func TestCommandQueueWritesWait(t *testing.T) {
+	cq := NewCommandQueue()
+	wg1 := sync.WaitGroup{}
+	wg2 := sync.WaitGroup{}
+	wg3 := sync.WaitGroup{}
+
+	rk := cq.Add(engine.Key("a"), nil, true)
+	wk := cq.Add(engine.Key("b"), engine.Key("d"), false)
+	// A write to "a" waits on the read of "a".
+	cq.GetWait(engine.Key("a"), nil, false, &wg1)
+	// A write to "c" waits on the write of ["b", "d").
+	cq.GetWait(engine.Key("c"), nil, false, &wg2)
+	// A write to "e" waits on neither.
+	cq.GetWait(engine.Key("e"), nil, false, &wg3)
+	cd1 := waitForCmd(&wg1)
+	cd2 := waitForCmd(&wg2)
+	cd3 := waitForCmd(&wg3)
+
+	if !testCmdDone(cd3, 5*time.Millisecond) {
+		t.Fatal("non-overlapping write should not wait")
+	}
+	if testCmdDone(cd1, 1*time.Millisecond) || testCmdDone(cd2, 1*time.Millisecond) {
+		t.Fatal("overlapping writes should not finish with commands outstanding")
+	}
+	cq.Remove(rk)
+	if !testCmdDone(cd1, 5*time.Millisecond) {
+		t.Fatal("write should finish once overlapping read completes")
+	}
+	if testCmdDone(cd2, 1*time.Millisecond) {
+		t.Fatal("write should not finish with overlapping write outstanding")
+	}
+	cq.Remove(wk)
+	if !testCmdDone(cd2, 5*time.Millisecond) {
+		t.Fatal("write should finish once overlapping write completes")
+	}
+}
+
+// benchmarkCommandQueue adds a command which remains pending for the
+// duration of the benchmark and then runs b.N commands with the
+// specified read-only status against keys which don't overlap it.
+// Each command waits on the queue, is added and is removed. Were any
+// command blocked by the pending command, the benchmark would never
+// complete.
+func benchmarkCommandQueue(b *testing.B, pendingReadOnly, readOnly bool) {
+	cq := NewCommandQueue()
+	cq.Add(engine.Key("a"), engine.Key("b"), pendingReadOnly)
+	keys := make([]engine.Key, 1000)
+	for i := range keys {
+		keys[i] = engine.Key(fmt.Sprintf("c%04d", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		var wg sync.WaitGroup
+		cq.GetWait(key, nil, readOnly, &wg)
+		cmdKey := cq.Add(key, nil, readOnly)
+		wg.Wait()
+		cq.Remove(cmdKey)
+	}
+}
+
+func BenchmarkCommandQueueReadsBehindWrite(b *testing.B) {
+	benchmarkCommandQueue(b, false, true)
+}
+
+func BenchmarkCommandQueueWritesBehindWrite(b *testing.B) {
+	benchmarkCommandQueue(b, false, false)
+}
+
+func BenchmarkCommandQueueWritesBehindRead(b *testing.B) {
+	benchmarkCommandQueue(b, true, false)
+}
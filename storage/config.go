@@ -20,6 +20,8 @@ package storage
 import (
 	"fmt"
 	"net"
+	"reflect"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
@@ -29,6 +31,24 @@ import (
 // UserRoot is the username for the root user.
 const UserRoot = "root"
 
+// ReplicaState describes a replica's part in rebalancing. A
+// rebalance target is added to a range in state REBALANCING and the
+// replica it replaces is marked PENDING_DELETION. Once the target has
+// caught up, the range leader moves it into state OK and removes the
+// source from the range's replicas.
+type ReplicaState int
+
+const (
+	// OK replicas are full members of their range.
+	OK ReplicaState = iota
+	// REBALANCING replicas are rebalance targets catching up with
+	// the range leader.
+	REBALANCING
+	// PENDING_DELETION replicas are rebalance sources, removed once
+	// their targets have caught up.
+	PENDING_DELETION
+)
+
 // Replica describes a replica location by node ID (corresponds to a
 // host:port via lookup on gossip network), store ID (corresponds to
 // a physical device, unique per node) and range ID. Datacenter and
@@ -39,6 +59,7 @@ type Replica struct {
 	StoreID int32
 	RangeID int64
 	Attrs   engine.Attributes // combination of node & store attributes
+	State   ReplicaState      // OK unless the replica is being rebalanced
 }
 
 // RangeDescriptor is the value stored in a range metadata key.
@@ -108,15 +129,120 @@ func (s StoreDescriptor) Less(b util.Ordered) bool {
 	return s.Capacity.PercentAvail() < b.(StoreDescriptor).Capacity.PercentAvail()
 }
 
-// AcctConfig holds accounting configuration.
+// A Config is an accounting, permission or zone config. Configs are
+// stored by key prefix and serialized as YAML for administration.
+type Config interface {
+	// Validate returns an error if the config is invalid.
+	Validate() error
+	// ToYAML serializes the config as YAML.
+	ToYAML() ([]byte, error)
+}
+
+// ParseConfig parses a YAML serialized config into config, which must
+// be a pointer to an AcctConfig, PermConfig or ZoneConfig. Fields
+// unknown to the config's type and invalid configs are rejected.
+func ParseConfig(in []byte, config Config) error {
+	if err := yaml.Unmarshal(in, config); err != nil {
+		return err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return err
+	}
+	if doc != nil {
+		fields, ok := doc.(map[interface{}]interface{})
+		if !ok {
+			return util.Errorf("config must be a YAML mapping of fields to values")
+		}
+		known := yamlFieldNames(reflect.TypeOf(config).Elem())
+		for name := range fields {
+			if _, ok := known[fmt.Sprint(name)]; !ok {
+				return util.Errorf("unknown field %q", fmt.Sprint(name))
+			}
+		}
+	}
+	return config.Validate()
+}
+
+// yamlFieldNames returns the set of YAML field names of the struct
+// type t.
+func yamlFieldNames(t reflect.Type) map[string]struct{} {
+	names := map[string]struct{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = strings.ToLower(f.Name)
+		}
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// AcctConfig holds accounting configuration. The usage of the keys
+// governed by the config (those for which it has the longest
+// matching prefix) is limited by its quotas. A zero quota is
+// unlimited. Quotas are soft limits, which concurrent writes may
+// overshoot; see Range.checkQuota.
 type AcctConfig struct {
-	ClusterID string
+	ClusterID string `yaml:"cluster_id,omitempty"`
+	MaxBytes  int64  `yaml:"max_bytes,omitempty"` // Quota on bytes of keys and values
+	MaxKeys   int64  `yaml:"max_keys,omitempty"`  // Quota on number of keys
+}
+
+// ParseAcctConfig parses a YAML serialized AcctConfig.
+func ParseAcctConfig(in []byte) (*AcctConfig, error) {
+	a := &AcctConfig{}
+	err := ParseConfig(in, a)
+	return a, err
+}
+
+// Validate implements the Config interface. Quotas may not be
+// negative.
+func (a *AcctConfig) Validate() error {
+	if a.MaxBytes < 0 || a.MaxKeys < 0 {
+		return util.Errorf("quotas must not be negative: max_bytes %d, max_keys %d", a.MaxBytes, a.MaxKeys)
+	}
+	return nil
+}
+
+// ToYAML serializes an AcctConfig as YAML.
+func (a *AcctConfig) ToYAML() ([]byte, error) {
+	return yaml.Marshal(a)
 }
 
 // PermConfig holds permission configuration, specifying read/write ACLs.
 type PermConfig struct {
-	Read  []string `yaml:"read,omitempty"`  // ACL lists users with read permissions
-	Write []string `yaml:"write,omitempty"` // ACL lists users with write permissions
+	Read  []string `yaml:"read,omitempty,flow"`  // ACL lists users with read permissions
+	Write []string `yaml:"write,omitempty,flow"` // ACL lists users with write permissions
+}
+
+// ParsePermConfig parses a YAML serialized PermConfig.
+func ParsePermConfig(in []byte) (*PermConfig, error) {
+	p := &PermConfig{}
+	err := ParseConfig(in, p)
+	return p, err
+}
+
+// Validate implements the Config interface. User names must not be
+// empty.
+func (p *PermConfig) Validate() error {
+	for _, users := range [][]string{p.Read, p.Write} {
+		for _, u := range users {
+			if len(u) == 0 {
+				return util.Errorf("permission config lists an empty user name")
+			}
+		}
+	}
+	return nil
+}
+
+// ToYAML serializes a PermConfig as YAML.
+func (p *PermConfig) ToYAML() ([]byte, error) {
+	return yaml.Marshal(p)
 }
 
 // CanRead does a linear search for user to verify read permission.
@@ -151,10 +277,28 @@ type ZoneConfig struct {
 // ParseZoneConfig parses a YAML serialized ZoneConfig.
 func ParseZoneConfig(in []byte) (*ZoneConfig, error) {
 	z := &ZoneConfig{}
-	err := yaml.Unmarshal(in, z)
+	err := ParseConfig(in, z)
 	return z, err
 }
 
+// Validate implements the Config interface. A zone must have at least
+// one replica, and its range size bounds must be non-negative, with
+// the minimum less than the maximum if both are set.
+func (z *ZoneConfig) Validate() error {
+	if len(z.Replicas) == 0 {
+		return util.Errorf("zone config must specify at least one replica")
+	}
+	if z.RangeMinBytes < 0 || z.RangeMaxBytes < 0 {
+		return util.Errorf("zone config range sizes must not be negative: min %d, max %d",
+			z.RangeMinBytes, z.RangeMaxBytes)
+	}
+	if z.RangeMaxBytes != 0 && z.RangeMinBytes >= z.RangeMaxBytes {
+		return util.Errorf("zone config range_min_bytes (%d) must be less than range_max_bytes (%d)",
+			z.RangeMinBytes, z.RangeMaxBytes)
+	}
+	return nil
+}
+
 // ToYAML serializes a ZoneConfig as YAML.
 func (z *ZoneConfig) ToYAML() ([]byte, error) {
 	return yaml.Marshal(z)
@@ -20,6 +20,7 @@ package storage
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
@@ -92,3 +93,35 @@ func TestPermConfig(t *testing.T) {
 		t.Errorf("unexpected read access for user \"bar\"")
 	}
 }
+
+// TestParseConfigValidation verifies that configs with unknown fields
+// or invalid values are rejected when parsed.
+func TestParseConfigValidation(t *testing.T) {
+	testCases := []struct {
+		config Config
+		yaml   string
+		expErr string // Empty if the config is valid
+	}{
+		{&AcctConfig{}, "cluster_id: foo\n", ""},
+		{&AcctConfig{}, "clusterid: foo\n", `unknown field "clusterid"`},
+		{&AcctConfig{}, "max_bytes: 1048576\nmax_keys: 1000\n", ""},
+		{&AcctConfig{}, "max_keys: -1\n", "must not be negative"},
+		{&PermConfig{}, "read: [root, foo]\nwrite: [root]\n", ""},
+		{&PermConfig{}, "read: [root]\nwrites: [root]\n", `unknown field "writes"`},
+		{&PermConfig{}, "read: [root, '']\n", "empty user name"},
+		{&PermConfig{}, "- root\n", "YAML mapping"},
+		{&ZoneConfig{}, yamlConfig, ""},
+		{&ZoneConfig{}, "replicas: [[ssd]]\nrange_min_byte: 1\n", `unknown field "range_min_byte"`},
+		{&ZoneConfig{}, "range_max_bytes: 67108864\n", "at least one replica"},
+		{&ZoneConfig{}, "replicas: [[ssd]]\nrange_min_bytes: -1\n", "must not be negative"},
+		{&ZoneConfig{}, "replicas: [[ssd]]\nrange_min_bytes: 2\nrange_max_bytes: 1\n", "must be less than"},
+	}
+	for i, test := range testCases {
+		err := ParseConfig([]byte(test.yaml), test.config)
+		if test.expErr == "" && err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if test.expErr != "" && (err == nil || !strings.Contains(err.Error(), test.expErr)) {
+			t.Errorf("%d: expected error %q; got %v", i, test.expErr, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"code.google.com/p/biogo.store/llrb"
+)
+
+// A batchEntry is a write buffered by a Batch. If deleted is true,
+// the key was cleared and value is ignored.
+type batchEntry struct {
+	RawKeyValue
+	deleted bool
+}
+
+// Compare implements the llrb.Comparable interface for tree nodes.
+func (e batchEntry) Compare(b llrb.Comparable) int {
+	return bytes.Compare(e.Key, b.(batchEntry).Key)
+}
+
+// A Batch is an Engine which buffers the writes made through it and
+// applies them to an underlying engine atomically when committed.
+// Reads through the batch see its buffered writes. Merges are
+// buffered as the merged value. A Batch isn't safe for concurrent
+// use.
+type Batch struct {
+	engine  Engine
+	updates llrb.Tree
+}
+
+// NewBatch returns a batch buffering writes to engine.
+func NewBatch(engine Engine) *Batch {
+	return &Batch{engine: engine}
+}
+
+// Attrs returns the attributes of the underlying engine.
+func (b *Batch) Attrs() Attributes {
+	return b.engine.Attrs()
+}
+
+// Put buffers a write of value to key.
+func (b *Batch) Put(key Key, value []byte) error {
+	if len(key) == 0 {
+		return emptyKeyError()
+	}
+	b.updates.Insert(batchEntry{RawKeyValue: RawKeyValue{Key: key, Value: value}})
+	return nil
+}
+
+// Get returns the value for the given key, nil otherwise. Buffered
+// writes take precedence over the underlying engine.
+func (b *Batch) Get(key Key) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, emptyKeyError()
+	}
+	if val := b.updates.Get(batchEntry{RawKeyValue: RawKeyValue{Key: key}}); val != nil {
+		if e := val.(batchEntry); !e.deleted {
+			return e.Value, nil
+		}
+		return nil, nil
+	}
+	return b.engine.Get(key)
+}
+
+// Scan returns up to max key/value objects starting from start
+// (inclusive) and ending at end (non-inclusive), merging the
+// buffered writes with the contents of the underlying engine.
+func (b *Batch) Scan(start, end Key, max int64) ([]RawKeyValue, error) {
+	var buffered []batchEntry
+	b.updates.DoRange(func(e llrb.Comparable) (done bool) {
+		buffered = append(buffered, e.(batchEntry))
+		return
+	}, batchEntry{RawKeyValue: RawKeyValue{Key: start}}, batchEntry{RawKeyValue: RawKeyValue{Key: end}})
+
+	// Each buffered write hides at most one key of the underlying
+	// engine, so scanning max+len(buffered) keys of it suffices.
+	engineMax := max
+	if max != 0 {
+		engineMax += int64(len(buffered))
+	}
+	kvs, err := b.engine.Scan(start, end, engineMax)
+	if err != nil {
+		return nil, err
+	}
+	// If the engine scan was truncated, keys past its last may be
+	// missing; buffered writes past it are dropped, which leaves at
+	// least max keys.
+	if engineMax != 0 && int64(len(kvs)) == engineMax {
+		last := kvs[len(kvs)-1].Key
+		for len(buffered) > 0 && last.Less(buffered[len(buffered)-1].Key) {
+			buffered = buffered[:len(buffered)-1]
+		}
+	}
+
+	var scanned []RawKeyValue
+	for len(kvs) > 0 || len(buffered) > 0 {
+		if max != 0 && int64(len(scanned)) >= max {
+			break
+		}
+		if len(buffered) == 0 || (len(kvs) > 0 && kvs[0].Key.Less(buffered[0].Key)) {
+			scanned = append(scanned, kvs[0])
+			kvs = kvs[1:]
+			continue
+		}
+		if len(kvs) > 0 && bytes.Equal(kvs[0].Key, buffered[0].Key) {
+			kvs = kvs[1:]
+		}
+		if !buffered[0].deleted {
+			scanned = append(scanned, buffered[0].RawKeyValue)
+		}
+		buffered = buffered[1:]
+	}
+	return scanned, nil
+}
+
+// Clear buffers the removal of key.
+func (b *Batch) Clear(key Key) error {
+	if len(key) == 0 {
+		return emptyKeyError()
+	}
+	b.updates.Insert(batchEntry{RawKeyValue: RawKeyValue{Key: key}, deleted: true})
+	return nil
+}
+
+// WriteBatch buffers the specified writes, merges and deletions. The
+// list must only contain elements of type Batch{Put,Merge,Delete}.
+func (b *Batch) WriteBatch(cmds []interface{}) error {
+	for i, e := range cmds {
+		var err error
+		switch v := e.(type) {
+		case BatchDelete:
+			err = b.Clear(Key(v))
+		case BatchPut:
+			err = b.Put(v.Key, v.Value)
+		case BatchMerge:
+			err = b.Merge(v.Key, v.Value)
+		default:
+			panic(fmt.Sprintf("illegal operation #%d passed to writeBatch: %v", i, reflect.TypeOf(v)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge merges value into the value of key, as seen through the
+// batch, and buffers the result. See the documentation of goMerge
+// for details.
+func (b *Batch) Merge(key Key, value []byte) error {
+	existing, err := b.Get(key)
+	if err != nil {
+		return err
+	}
+	merged, err := goMerge(existing, value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, merged)
+}
+
+// Capacity returns the capacity of the underlying engine.
+func (b *Batch) Capacity() (StoreCapacity, error) {
+	return b.engine.Capacity()
+}
+
+// Commit atomically applies the buffered writes to the underlying
+// engine.
+func (b *Batch) Commit() error {
+	var cmds []interface{}
+	b.updates.Do(func(e llrb.Comparable) (done bool) {
+		if be := e.(batchEntry); be.deleted {
+			cmds = append(cmds, BatchDelete(be.Key))
+		} else {
+			cmds = append(cmds, BatchPut(be.RawKeyValue))
+		}
+		return
+	})
+	return b.engine.WriteBatch(cmds)
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// TestBatchReadsOwnWrites verifies that reads through a batch see its
+// buffered writes, that the underlying engine doesn't until the batch
+// is committed, and that scans honor their maximum.
+func TestBatchReadsOwnWrites(t *testing.T) {
+	runWithAllEngines(func(e Engine, t *testing.T) {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			if err := e.Put(Key(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := NewBatch(e)
+		if err := b.Put(Key("aa"), []byte("aa")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(Key("b"), []byte("b2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Clear(Key("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Clear(Key("c")); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := b.Get(Key("b")); err != nil || !bytes.Equal(val, []byte("b2")) {
+			t.Errorf("expected batch get of %q to return %q; got %q, %v", "b", "b2", val, err)
+		}
+		if val, err := b.Get(Key("a")); err != nil || val != nil {
+			t.Errorf("expected cleared key %q to be empty; got %q, %v", "a", val, err)
+		}
+		testCases := []struct {
+			max    int64
+			expKVs string
+		}{
+			{0, "aa=aa b=b2 d=d"},
+			{1, "aa=aa"},
+			{2, "aa=aa b=b2"},
+			{3, "aa=aa b=b2 d=d"},
+		}
+		for i, test := range testCases {
+			kvs, err := b.Scan(KeyMin, KeyMax, test.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var s string
+			for j, kv := range kvs {
+				if j > 0 {
+					s += " "
+				}
+				s += fmt.Sprintf("%s=%s", kv.Key, kv.Value)
+			}
+			if s != test.expKVs {
+				t.Errorf("%d: expected scan %q; got %q", i, test.expKVs, s)
+			}
+		}
+
+		if val := mustGet(e, Key("a"), t); !bytes.Equal(val, []byte("a")) {
+			t.Errorf("expected uncommitted batch not to be visible; got %q at %q", val, "a")
+		}
+		if err := b.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		kvs, err := e.Scan(KeyMin, KeyMax, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != 3 || !bytes.Equal(kvs[1].Value, []byte("b2")) {
+			t.Errorf("expected committed batch to be applied; got %v", kvs)
+		}
+	}, t)
+}
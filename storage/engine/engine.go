@@ -21,9 +21,10 @@ package engine
 import (
 	"bytes"
 	"encoding/gob"
-	"reflect"
+	"fmt"
 
 	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util"
 )
 
@@ -92,12 +93,14 @@ func PutI(engine Engine, key Key, value interface{}) error {
 
 // GetI fetches the specified key and gob-deserializes it into
 // "value". Returns true on success or false if the key was not
-// found.
+// found. Values tagged with their type, such as those put via a
+// range, are decoded first (see DecodeValue).
 func GetI(engine Engine, key Key, value interface{}) (bool, error) {
 	val, err := engine.Get(key)
 	if err != nil {
 		return false, err
 	}
+	val = DecodeValue(key, val).Bytes
 	if len(val) == 0 {
 		return false, nil
 	}
@@ -111,7 +114,8 @@ func GetI(engine Engine, key Key, value interface{}) (bool, error) {
 
 // Increment fetches the varint encoded int64 value specified by key
 // and adds "inc" to it then re-encodes as varint. The newly incremented
-// value is returned.
+// value is returned. If key holds a value which isn't an integer, a
+// ValueTypeError is returned.
 func Increment(engine Engine, key Key, inc int64) (int64, error) {
 	// First retrieve existing value.
 	val, err := engine.Get(key)
@@ -119,16 +123,14 @@ func Increment(engine Engine, key Key, inc int64) (int64, error) {
 		return 0, err
 	}
 	var int64Val int64
-	// If the value exists, attempt to decode it as a varint.
-	if len(val) != 0 {
+	// If the value exists, it must be an integer.
+	if val != nil {
 		decoded, err := encoding.Decode(key, val)
-		if err != nil {
-			return 0, err
+		int64Decoded, ok := decoded.(int64)
+		if err != nil || !ok {
+			return 0, &ValueTypeError{Key: key, Expected: TagInteger, Actual: TagBytes}
 		}
-		if _, ok := decoded.(int64); !ok {
-			return 0, util.Errorf("received value of wrong type %v", reflect.TypeOf(decoded))
-		}
-		int64Val = decoded.(int64)
+		int64Val = int64Decoded
 	}
 
 	// Check for overflow and underflow.
@@ -151,6 +153,62 @@ func Increment(engine Engine, key Key, inc int64) (int64, error) {
 	return r, nil
 }
 
+// A ValueTypeError indicates that an operation expecting a value of
+// one type was applied to a key holding a value of another.
+type ValueTypeError struct {
+	Key      Key
+	Expected ValueTag
+	Actual   ValueTag
+}
+
+// Error formats error.
+func (e *ValueTypeError) Error() string {
+	return fmt.Sprintf("key %q holds a value of type %s; expected %s", e.Key, e.Actual, e.Expected)
+}
+
+// EncodeValue returns the representation in which the byte string
+// value is stored at key: its bytes and, unless zero, the timestamp
+// at which it's written, tagged with their type and checksummed (see
+// util/encoding). Integer values are stored by Increment.
+func EncodeValue(key Key, value Value) []byte {
+	if value.Timestamp.WallTime == 0 && value.Timestamp.Logical == 0 {
+		encoded, _ := encoding.Encode(key, value.Bytes)
+		return encoded
+	}
+	encoded, _ := encoding.Encode(key, encoding.TimestampedBytes{
+		Bytes:    value.Bytes,
+		WallTime: value.Timestamp.WallTime,
+		Logical:  value.Timestamp.Logical,
+	})
+	return encoded
+}
+
+// DecodeValue returns the value stored at key as val, along with its
+// type and the timestamp at which it was written, if stored. Values stored by EncodeValue and Increment carry their type.
+// Untagged values, such as those stored by the system via PutI, are
+// byte strings, unless they hold an integer stored before integers
+// were tagged. The bytes of an integer value are its encoded
+// representation.
+func DecodeValue(key Key, val []byte) Value {
+	if val == nil {
+		return Value{}
+	}
+	decoded, err := encoding.Decode(key, val)
+	if err != nil {
+		return Value{Bytes: val}
+	}
+	switch v := decoded.(type) {
+	case int64:
+		encoded, _ := encoding.Encode(key, v)
+		return Value{Bytes: encoded, Tag: TagInteger}
+	case []byte:
+		return Value{Bytes: v}
+	case encoding.TimestampedBytes:
+		return Value{Bytes: v.Bytes, Timestamp: hlc.Timestamp{WallTime: v.WallTime, Logical: v.Logical}}
+	}
+	return Value{Bytes: val}
+}
+
 // ClearRange removes a set of entries, from start (inclusive)
 // to end (exclusive), up to max entries.  If max is 0, all
 // entries between start and end are deleted.  This function
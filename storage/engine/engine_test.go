@@ -20,7 +20,9 @@ package engine
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"math/rand"
 	"os"
@@ -59,7 +61,7 @@ func runWithAllEngines(test func(e Engine, t *testing.T), t *testing.T) {
 		t.Fatalf("could not create new rocksdb db instance at %s: %v", loc, err)
 	}
 	defer func(t *testing.T) {
-		rocksdb.close()
+		rocksdb.Close()
 		if err := rocksdb.destroy(); err != nil {
 			t.Errorf("could not delete rocksdb db at %s: %v", loc, err)
 		}
@@ -368,9 +370,74 @@ func TestEngineIncrement(t *testing.T) {
 		if val != 3 {
 			t.Errorf("expected increment to be %d; got %d", 3, val)
 		}
+		if tag := DecodeValue(Key("a"), mustGet(engine, Key("a"), t)).Tag; tag != TagInteger {
+			t.Errorf("expected counter to have type %s; got %s", TagInteger, tag)
+		}
+
+		// Byte string values, including empty ones, can't be incremented.
+		for _, value := range []string{"3", ""} {
+			if err := engine.Put(Key("b"), []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			if tag := DecodeValue(Key("b"), mustGet(engine, Key("b"), t)).Tag; tag != TagBytes {
+				t.Errorf("expected %q to have type %s; got %s", value, TagBytes, tag)
+			}
+			_, err = Increment(engine, Key("b"), 1)
+			if typeErr, ok := err.(*ValueTypeError); !ok || typeErr.Expected != TagInteger || typeErr.Actual != TagBytes {
+				t.Errorf("expected type mismatch incrementing %q; got %v", value, err)
+			}
+		}
+	}, t)
+}
+
+// TestEngineValueTags verifies that byte string values are stored
+// tagged with their type, even if they look like integers, and that
+// integers stored before they were tagged remain integers.
+func TestEngineValueTags(t *testing.T) {
+	runWithAllEngines(func(engine Engine, t *testing.T) {
+		// A byte string holding an encoded integer is still a byte string.
+		intBytes, err := encoding.Encode(Key("a"), int64(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.Put(Key("a"), EncodeValue(Key("a"), Value{Bytes: intBytes})); err != nil {
+			t.Fatal(err)
+		}
+		if value := DecodeValue(Key("a"), mustGet(engine, Key("a"), t)); value.Tag != TagBytes || !bytes.Equal(value.Bytes, intBytes) {
+			t.Errorf("expected byte string %q; got %+v", intBytes, value)
+		}
+		if _, err := Increment(engine, Key("a"), 1); err == nil {
+			t.Error("expected incrementing a byte string to fail")
+		}
+
+		// An untagged integer: a varint followed by a checksum of key
+		// and varint.
+		varint := make([]byte, binary.MaxVarintLen64)
+		varint = varint[:binary.PutVarint(varint, 1)]
+		crc := crc32.NewIEEE()
+		crc.Write([]byte("b"))
+		crc.Write(varint)
+		if err := engine.Put(Key("b"), crc.Sum(varint)); err != nil {
+			t.Fatal(err)
+		}
+		if tag := DecodeValue(Key("b"), mustGet(engine, Key("b"), t)).Tag; tag != TagInteger {
+			t.Errorf("expected untagged counter to have type %s; got %s", TagInteger, tag)
+		}
+		if val, err := Increment(engine, Key("b"), 1); err != nil || val != 2 {
+			t.Errorf("expected untagged counter to be incremented to 2; got %d, %v", val, err)
+		}
 	}, t)
 }
 
+// mustGet returns the value at key, failing the test on error.
+func mustGet(engine Engine, key Key, t *testing.T) []byte {
+	val, err := engine.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
 func verifyScan(start, end Key, max int64, expKeys []Key, engine Engine, t *testing.T) {
 	kvs, err := engine.Scan(start, end, max)
 	if err != nil {
@@ -20,6 +20,8 @@ package engine
 
 import (
 	"bytes"
+	"fmt"
+	"hash/crc32"
 
 	"github.com/cockroachdb/cockroach/util/hlc"
 )
@@ -32,11 +34,36 @@ func (k Key) Less(l Key) bool {
 	return bytes.Compare(k, l) == -1
 }
 
+// A ValueTag identifies the type of a value.
+type ValueTag int
+
+const (
+	// TagBytes is the tag of a value holding an uninterpreted byte
+	// string. It is the zero value, so untagged values are byte strings.
+	TagBytes ValueTag = iota
+	// TagInteger is the tag of a value holding an integer counter, as
+	// maintained by Increment.
+	TagInteger
+)
+
+// String returns the name of the value type.
+func (t ValueTag) String() string {
+	switch t {
+	case TagBytes:
+		return "bytes"
+	case TagInteger:
+		return "integer"
+	}
+	return fmt.Sprintf("ValueTag(%d)", int(t))
+}
+
 // Value specifies the value at a key. Multiple values at the same key
 // are supported based on timestamp.
 type Value struct {
 	// Bytes is the byte string value.
 	Bytes []byte
+	// Tag is the type of the value.
+	Tag ValueTag
 	// Checksum is a CRC-32-IEEE checksum. A Value will only be used in
 	// a write operation by the database if either its checksum is zero
 	// or the CRC checksum of Bytes matches it.
@@ -47,6 +74,14 @@ type Value struct {
 	Timestamp hlc.Timestamp
 }
 
+// InitChecksum sets the value's checksum to the CRC-32-IEEE checksum
+// of its bytes, if not already set.
+func (v *Value) InitChecksum() {
+	if v.Checksum == 0 {
+		v.Checksum = crc32.ChecksumIEEE(v.Bytes)
+	}
+}
+
 // KeyValue is a pair of Key and Value for returned Key/Value pairs
 // from ScanRequest/ScanResponse. It embeds a Key and a Value.
 type KeyValue struct {
@@ -149,6 +184,10 @@ var (
 	// storage/encoding.go), they will never start with \xff.
 	KeyMax = Key("\xff")
 
+	// KeySystemPrefix is the prefix of all keys reserved for use by
+	// the system, which sort before keys holding user data.
+	KeySystemPrefix = Key("\x00")
+
 	// KeyLocalPrefix is the prefix for keys which hold data local to
 	// a RocksDB instance (and is not replicated), such as accounting
 	// information relevant to the load of ranges. It is chosen to sort before
@@ -172,6 +211,32 @@ var (
 	// KeyLocalRangeResponseCachePrefix is the prefix for keys storing command
 	// responses used to guarantee idempotency (see ResponseCache).
 	KeyLocalRangeResponseCachePrefix = MakeKey(KeyLocalPrefix, Key("respcache-"))
+	// KeyLocalRangeLeasePrefix is the prefix for keys storing the
+	// leader lease of each range. The value is a struct of type Lease.
+	KeyLocalRangeLeasePrefix = MakeKey(KeyLocalPrefix, Key("lease-"))
+	// KeyLocalRaftStatePrefix is the prefix for keys storing the
+	// persistent raft state of each range's raft group, other than its
+	// log. The value is a struct of type multiraft.GroupPersistentState.
+	KeyLocalRaftStatePrefix = MakeKey(KeyLocalPrefix, Key("raftstate-"))
+	// KeyLocalRaftLogPrefix is the prefix for keys storing the raft log
+	// entries of each range's raft group. The suffix is the key-encoded
+	// range ID and log index.
+	KeyLocalRaftLogPrefix = MakeKey(KeyLocalPrefix, Key("raftlog-"))
+	// KeyLocalRaftAppliedIndexPrefix is the prefix for keys storing the
+	// index of the last raft log entry applied to each range.
+	KeyLocalRaftAppliedIndexPrefix = MakeKey(KeyLocalPrefix, Key("raftapplied-"))
+	// KeyLocalUpdateQueuePrefix is the prefix for keys storing updates
+	// enqueued on each range for asynchronous execution (see
+	// EnqueueUpdate). The suffix is the key-encoded range ID followed
+	// by the key-encoded timestamp at which the update was enqueued.
+	KeyLocalUpdateQueuePrefix = MakeKey(KeyLocalPrefix, Key("updateq-"))
+	// KeyLocalIntentPrefix is the prefix for keys storing the write
+	// intents of pending transactions, which are kept apart from the
+	// values of the keys written until the transactions end. The suffix
+	// is the key written.
+	KeyLocalIntentPrefix = MakeKey(KeyLocalPrefix, Key("intent-"))
+	// KeyLocalMax is the end of the range of local keys.
+	KeyLocalMax = PrefixEndKey(KeyLocalPrefix)
 
 	// KeyReplicatedPrefix indicates the beginning of the key range
 	// that is replicated across the cluster.
@@ -192,15 +257,36 @@ var (
 	// KeyConfigAccountingPrefix specifies the key prefix for accounting
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigAccountingPrefix = Key("\x00acct")
+	// KeyAccountingUsagePrefix specifies the key prefix for the usage
+	// of accounting configurations. The suffix is the affected key
+	// prefix (see storage.MakeAcctUsageKey).
+	KeyAccountingUsagePrefix = Key("\x00usage")
 	// KeyConfigPermissionPrefix specifies the key prefix for accounting
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigPermissionPrefix = Key("\x00perm")
 	// KeyConfigZonePrefix specifies the key prefix for zone
 	// configurations. The suffix is the affected key prefix.
 	KeyConfigZonePrefix = Key("\x00zone")
+	// KeyTimeSeriesPrefix specifies the key prefix for time series
+	// data. The suffix is the series name and the start of the
+	// interval covered by the value (see kv.MakeTimeSeriesKey).
+	KeyTimeSeriesPrefix = Key("\x00ts")
+	// KeyTimeSeriesGaugePrefix specifies the key prefix for gauge time
+	// series data. Unlike KeyTimeSeriesPrefix values, gauge values are
+	// overwritten rather than merged. The suffix is the series name and
+	// the sample time (see kv.MakeTimeSeriesGaugeKey).
+	KeyTimeSeriesGaugePrefix = Key("\x00gauge")
+	// KeyInboxMessageInfix separates an inbox key from the suffix of
+	// each message queued to it. The suffix is the key-encoded
+	// timestamp at which the message was enqueued, so messages sort
+	// in delivery order.
+	KeyInboxMessageInfix = Key("\x00msg")
 	// KeyTransactionPrefix specifies the key prefix for transaction
 	// records. The suffix is the transaction id.
 	KeyTransactionPrefix = Key("\x00tx")
+	// KeyUserPrefix specifies the key prefix for the credentials of
+	// users authenticated by password. The suffix is the user name.
+	KeyUserPrefix = Key("\x00user")
 	// KeyNodeIDGenerator contains a sequence generator for node IDs.
 	KeyNodeIDGenerator = Key("\x00node-id-generator")
 	// KeyStoreIDGeneratorPrefix specifies key prefixes for sequence
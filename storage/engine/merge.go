@@ -31,6 +31,7 @@ import (
 func init() {
 	gob.Register(Counter(0))
 	gob.Register(Appender(nil))
+	gob.Register(TimeSeries(nil))
 }
 
 // Mergable types specify two operations:
@@ -89,6 +90,39 @@ func (s Appender) Merge(t Mergable) (Mergable, error) {
 	return append(s, m...), nil
 }
 
+// A TimeSeries is a mergable data type holding a vector of int64
+// counts, one per discrete subtime period. Merging adds the counts
+// element-wise, extending the vector if the update is longer. It is
+// initially empty.
+type TimeSeries []int64
+
+// Init returns an empty TimeSeries.
+func (ts TimeSeries) Init(s []byte) Mergable {
+	return TimeSeries(nil)
+}
+
+// Merge adds the counts of the supplied update to this TimeSeries
+// element-wise and returns an error in case of an integer overflow.
+func (ts TimeSeries) Merge(o Mergable) (Mergable, error) {
+	m, ok := o.(TimeSeries)
+	if !ok {
+		return ts, util.Error("parameter is of wrong type")
+	}
+	result := make(TimeSeries, len(ts), len(ts)+len(m))
+	copy(result, ts)
+	for i, count := range m {
+		if i >= len(result) {
+			result = append(result, count)
+			continue
+		}
+		if encoding.WillOverflow(result[i], count) {
+			return ts, util.Errorf("merge error: %d + %d overflows at index %d", result[i], count, i)
+		}
+		result[i] += count
+	}
+	return result, nil
+}
+
 // goMerge takes existing and update byte slices. It first attempts
 // to gob-unmarshal the update string, returning an error on failure.
 // The unmarshaled value must satisfy the Mergable interface.
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/util/encoding"
@@ -49,6 +50,8 @@ func TestGoMerge(t *testing.T) {
 		{0, "asd"},
 		{float64(1.3), Counter(0)},
 		{Counter(0), nil},
+		{TimeSeries(nil), Counter(0)},
+		{Counter(0), TimeSeries(nil)},
 	}
 	for i, c := range badCombinations {
 		_, err := goMerge(encoding.MustGobEncode(c.old), encoding.MustGobEncode(c.update))
@@ -85,6 +88,20 @@ func TestGoMerge(t *testing.T) {
 		{gibber1, gibber2, append(append([]byte(nil), gibber1...), gibber2...)},
 	}
 
+	testCasesTimeSeries := []struct {
+		old, update, expected TimeSeries
+		wantError             bool
+	}{
+		{nil, nil, nil, false},
+		{nil, TimeSeries{1, 2}, TimeSeries{1, 2}, false},
+		{TimeSeries{1, 2}, nil, TimeSeries{1, 2}, false},
+		{TimeSeries{1, 2}, TimeSeries{3, 4}, TimeSeries{4, 6}, false},
+		{TimeSeries{1}, TimeSeries{0, 0, 5}, TimeSeries{1, 0, 5}, false},
+		{TimeSeries{1, 2, 3}, TimeSeries{-1}, TimeSeries{0, 2, 3}, false},
+		// Overflows.
+		{TimeSeries{0, math.MaxInt64}, TimeSeries{0, 1}, nil, true},
+	}
+
 	for i, c := range testCasesCounter {
 		oEncoded := encoding.MustGobEncode(c.old)
 		uEncoded := encoding.MustGobEncode(c.update)
@@ -119,5 +136,25 @@ func TestGoMerge(t *testing.T) {
 			t.Errorf("goMerge error: %d: want %v, get %v", i, c.expected, result)
 		}
 	}
+	for i, c := range testCasesTimeSeries {
+		oEncoded := encoding.MustGobEncode(c.old)
+		uEncoded := encoding.MustGobEncode(c.update)
+
+		result, err := goMerge(oEncoded, uEncoded)
+		if c.wantError {
+			if err == nil {
+				t.Errorf("goMerge: %d: wanted error but got success", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("goMerge error: %d: %v", i, err)
+			continue
+		}
+		resultDecoded := encoding.MustGobDecode(result)
+		if !reflect.DeepEqual(resultDecoded.(TimeSeries), c.expected) {
+			t.Errorf("goMerge error: %d: want %v, get %v", i, c.expected, resultDecoded)
+		}
+	}
 
 }
@@ -31,6 +31,13 @@ type MVCC struct {
 	engine Engine // The underlying key-value store
 }
 
+// NewMVCC returns a new instance of MVCC wrapping engine.
+func NewMVCC(engine Engine) *MVCC {
+	return &MVCC{
+		engine: engine,
+	}
+}
+
 type keyMetadata struct {
 	TxnID     string // TODO(spencer): replace the TxID with a Txn struct.
 	Timestamp hlc.Timestamp
@@ -392,8 +392,8 @@ func (r *RocksDB) Capacity() (StoreCapacity, error) {
 	return capacity, nil
 }
 
-// close closes the database by deallocating the underlying handle.
-func (r *RocksDB) close() {
+// Close closes the database by deallocating the underlying handle.
+func (r *RocksDB) Close() {
 	C.rocksdb_close(r.rdb)
 	r.rdb = nil
 }
@@ -20,19 +20,50 @@ package storage
 import (
 	"encoding/gob"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
-// A NotLeaderError indicates that the current range is not the
-// leader. If the leader is known, its Replica is set in the error.
+// A NotLeaderError indicates that the current range replica doesn't
+// hold the leader lease. If the leaseholder (or, failing that, the
+// raft leader) is known, its Replica is set in the error.
 type NotLeaderError struct {
-	leader Replica
+	Leader Replica
 }
 
 // Error formats error.
 func (e *NotLeaderError) Error() string {
-	return fmt.Sprintf("range not leader; leader is %+v", e.leader)
+	return fmt.Sprintf("range not leader; leader is %+v", e.Leader)
+}
+
+// A LeaseRejectedError indicates that a requested leader lease was
+// not granted because it conflicts with the existing lease.
+type LeaseRejectedError struct {
+	Requested Lease
+	Existing  Lease
+}
+
+// Error formats error.
+func (e *LeaseRejectedError) Error() string {
+	return fmt.Sprintf("cannot replace lease %+v with %+v", e.Existing, e.Requested)
+}
+
+// A ConditionFailedError indicates that the expected value of a
+// ConditionalPutRequest was not found. ActualValue holds the key's
+// existing value, or is nil if the key doesn't exist.
+type ConditionFailedError struct {
+	ActualValue *engine.Value
+}
+
+// Error formats error.
+func (e *ConditionFailedError) Error() string {
+	if e.ActualValue == nil {
+		return "unexpected value: key does not exist"
+	}
+	return fmt.Sprintf("unexpected value: %q", e.ActualValue.Bytes)
 }
 
 // RangeNotFoundError indicates that a command was sent to a range which
@@ -58,6 +89,27 @@ func (e *RangeNotFoundError) CanRetry() bool {
 	return true
 }
 
+// A RangeLoadError is returned on store initialization when ranges
+// in the store's local range metadata couldn't be loaded. Ranges maps
+// from range ID to the reason the range wasn't loaded.
+type RangeLoadError struct {
+	Ranges map[int64]error
+}
+
+// Error formats error.
+func (e *RangeLoadError) Error() string {
+	var rangeIDs []int
+	for rangeID := range e.Ranges {
+		rangeIDs = append(rangeIDs, int(rangeID))
+	}
+	sort.Ints(rangeIDs)
+	var errs []string
+	for _, rangeID := range rangeIDs {
+		errs = append(errs, fmt.Sprintf("range %d: %v", rangeID, e.Ranges[int64(rangeID)]))
+	}
+	return fmt.Sprintf("unable to load %d range(s): %s", len(errs), strings.Join(errs, "; "))
+}
+
 // RangeKeyMismatchError indicates that a command was sent to a range which did
 // not contain the key(s) specified by the command.
 type RangeKeyMismatchError struct {
@@ -89,9 +141,50 @@ func (e *RangeKeyMismatchError) CanRetry() bool {
 	return true
 }
 
+// A WriteIntentError indicates that a key holds a write intent of a
+// pending transaction other than the request's, which blocks the
+// request until the transaction ends and its intents are resolved.
+type WriteIntentError struct {
+	Key       engine.Key
+	TxID      string        // The transaction which wrote the intent
+	Timestamp hlc.Timestamp // The time at which the intent was written
+}
+
+// Error formats error.
+func (e *WriteIntentError) Error() string {
+	return fmt.Sprintf("key %q holds a write intent of transaction %q", e.Key, e.TxID)
+}
+
+// CanRetry indicates that the request may succeed once the intent has
+// been resolved.
+func (e *WriteIntentError) CanRetry() bool {
+	return true
+}
+
+// A TransactionStatusError indicates that a transaction couldn't be
+// ended as requested because it has already been committed or
+// aborted.
+type TransactionStatusError struct {
+	TxID   string
+	Status TransactionStatus
+}
+
+// Error formats error.
+func (e *TransactionStatusError) Error() string {
+	if e.Status == COMMITTED {
+		return fmt.Sprintf("transaction %q already committed", e.TxID)
+	}
+	return fmt.Sprintf("transaction %q already aborted", e.TxID)
+}
+
 // Init registers storage error types with Gob.
 func init() {
 	gob.Register(&NotLeaderError{})
 	gob.Register(&RangeNotFoundError{})
 	gob.Register(&RangeKeyMismatchError{})
+	gob.Register(&LeaseRejectedError{})
+	gob.Register(&ConditionFailedError{})
+	gob.Register(&engine.ValueTypeError{})
+	gob.Register(&WriteIntentError{})
+	gob.Register(&TransactionStatusError{})
 }
@@ -0,0 +1,228 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// A writeIntent is a write by a pending transaction. It's stored at
+// intentKey(key), apart from the value of the key written, until the
+// transaction ends and the intent is resolved: committing it applies
+// the write, aborting it discards the write.
+type writeIntent struct {
+	TxID      string
+	Value     []byte        // The encoded value written, unless Deleted
+	Deleted   bool          // True if the key was deleted
+	Timestamp hlc.Timestamp // The time at which the intent was written
+}
+
+// intentKey returns the key at which the write intent for key is
+// stored.
+func intentKey(key engine.Key) engine.Key {
+	return engine.MakeKey(engine.KeyLocalIntentPrefix, key)
+}
+
+// A txnEngine is the view of a range's engine by the requests of a
+// transaction, or by non-transactional requests if txID is empty.
+// Keys holding an intent of another transaction may be neither read
+// nor written; doing so fails with a WriteIntentError. The writes of
+// a transaction are stored as intents, which its own reads see, while
+// those of non-transactional requests are applied directly.
+type txnEngine struct {
+	engine.Engine
+	txID      string
+	timestamp hlc.Timestamp
+}
+
+// newTxnEngine returns the view of eng by the requests of the
+// transaction txID at timestamp.
+func newTxnEngine(eng engine.Engine, txID string, timestamp hlc.Timestamp) *txnEngine {
+	return &txnEngine{Engine: eng, txID: txID, timestamp: timestamp}
+}
+
+// ownIntent returns the intent at key if it was written by the view's
+// transaction, nil if there is none, or a WriteIntentError if it was
+// written by another transaction.
+func (e *txnEngine) ownIntent(key engine.Key) (*writeIntent, error) {
+	intent := &writeIntent{}
+	ok, err := engine.GetI(e.Engine, intentKey(key), intent)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if intent.TxID != e.txID {
+		return nil, &WriteIntentError{Key: key, TxID: intent.TxID, Timestamp: intent.Timestamp}
+	}
+	return intent, nil
+}
+
+// Get returns the value of key as seen by the view's transaction.
+func (e *txnEngine) Get(key engine.Key) ([]byte, error) {
+	intent, err := e.ownIntent(key)
+	if err != nil {
+		return nil, err
+	}
+	if intent != nil {
+		if intent.Deleted {
+			return nil, nil
+		}
+		return intent.Value, nil
+	}
+	return e.Engine.Get(key)
+}
+
+// Scan returns up to max key/value pairs from start (inclusive) to
+// end (exclusive) as seen by the view's transaction.
+func (e *txnEngine) Scan(start, end engine.Key, max int64) ([]engine.RawKeyValue, error) {
+	intents, err := e.Engine.Scan(intentKey(start), intentKey(end), 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(intents) == 0 {
+		return e.Engine.Scan(start, end, max)
+	}
+	// Overlay the transaction's own intents on the scanned values.
+	overlay := engine.NewBatch(e.Engine)
+	for _, kv := range intents {
+		key := bytes.TrimPrefix(kv.Key, engine.KeyLocalIntentPrefix)
+		intent, err := e.ownIntent(key)
+		if err != nil {
+			return nil, err
+		}
+		if intent.Deleted {
+			err = overlay.Clear(key)
+		} else {
+			err = overlay.Put(key, intent.Value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return overlay.Scan(start, end, max)
+}
+
+// Put writes value to key, as an intent if the view is a transaction's.
+func (e *txnEngine) Put(key engine.Key, value []byte) error {
+	return e.WriteBatch([]interface{}{engine.BatchPut{Key: key, Value: value}})
+}
+
+// Clear deletes key, as an intent if the view is a transaction's.
+func (e *txnEngine) Clear(key engine.Key) error {
+	return e.WriteBatch([]interface{}{engine.BatchDelete(key)})
+}
+
+// Merge merges value into the value of key. Merges aren't supported
+// within transactions.
+func (e *txnEngine) Merge(key engine.Key, value []byte) error {
+	return e.WriteBatch([]interface{}{engine.BatchMerge{Key: key, Value: value}})
+}
+
+// WriteBatch atomically applies the writes, or stores them as
+// intents if the view is a transaction's. It fails without writing
+// anything if any key written holds an intent of another transaction.
+func (e *txnEngine) WriteBatch(cmds []interface{}) error {
+	writes := make([]interface{}, 0, len(cmds))
+	for i, c := range cmds {
+		var key engine.Key
+		intent := writeIntent{TxID: e.txID, Timestamp: e.timestamp}
+		switch v := c.(type) {
+		case engine.BatchPut:
+			key, intent.Value = v.Key, v.Value
+		case engine.BatchDelete:
+			key, intent.Deleted = engine.Key(v), true
+		case engine.BatchMerge:
+			if len(e.txID) > 0 {
+				return util.Errorf("merges are not supported within transactions")
+			}
+			key = v.Key
+		default:
+			panic(fmt.Sprintf("illegal operation #%d passed to writeBatch: %v", i, reflect.TypeOf(v)))
+		}
+		if _, err := e.ownIntent(key); err != nil {
+			return err
+		}
+		if len(e.txID) == 0 {
+			writes = append(writes, c)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(intent); err != nil {
+			return err
+		}
+		writes = append(writes, engine.BatchPut{Key: intentKey(key), Value: buf.Bytes()})
+	}
+	return e.Engine.WriteBatch(writes)
+}
+
+// InternalResolveIntent commits or aborts the write intents belonging
+// to the transaction args.TxID in the key range from args.Key to
+// args.EndKey. If args.EndKey is empty, only args.Key is resolved.
+// Committing an intent applies its write, which is then recorded for
+// watchers; aborting it discards the write. Intents of other
+// transactions are left in place.
+func (r *Range) InternalResolveIntent(args *InternalResolveIntentRequest, reply *InternalResolveIntentResponse) {
+	endKey := args.EndKey
+	if len(endKey) == 0 {
+		endKey = engine.NextKey(args.Key)
+	}
+	kvs, err := r.engine.Scan(intentKey(args.Key), intentKey(endKey), 0)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	var writes []interface{}
+	var committed []engine.RawKeyValue // A nil value denotes a deletion
+	for _, kv := range kvs {
+		var intent writeIntent
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&intent); err != nil {
+			reply.Error = err
+			return
+		}
+		if intent.TxID != args.TxID {
+			continue
+		}
+		writes = append(writes, engine.BatchDelete(kv.Key))
+		if !args.Commit {
+			continue
+		}
+		key := engine.Key(bytes.TrimPrefix(kv.Key, engine.KeyLocalIntentPrefix))
+		if intent.Deleted {
+			writes = append(writes, engine.BatchDelete(key))
+			committed = append(committed, engine.RawKeyValue{Key: key})
+		} else {
+			writes = append(writes, engine.BatchPut{Key: key, Value: intent.Value})
+			committed = append(committed, engine.RawKeyValue{Key: key, Value: intent.Value})
+		}
+	}
+	if reply.Error = r.engine.WriteBatch(writes); reply.Error != nil {
+		return
+	}
+	for _, kv := range committed {
+		if kv.Value == nil {
+			r.events.recordDelete(kv.Key)
+		} else {
+			r.events.record(kv.Key, kv.Value)
+		}
+		r.configWritten(kv.Key)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// resolveArgs returns an InternalResolveIntentRequest and response
+// pair resolving the intents of txID from key to endKey.
+func resolveArgs(key, endKey, txID string, commit bool) (*InternalResolveIntentRequest, *InternalResolveIntentResponse) {
+	args := &InternalResolveIntentRequest{
+		RequestHeader: RequestHeader{
+			Key:    engine.Key(key),
+			EndKey: engine.Key(endKey),
+			TxID:   txID,
+		},
+		Commit: commit,
+	}
+	return args, &InternalResolveIntentResponse{}
+}
+
+// TestRangeWriteIntents verifies that a transaction's writes are
+// stored as intents which its own reads see, and that other requests
+// may neither read nor write the keys it has written.
+func TestRangeWriteIntents(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "old", 0)
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	pArgs, pReply = putArgs("a", "new", 0)
+	pArgs.TxID = "txn1"
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := store.engine.Get(engine.Key("a")); err != nil || string(engine.DecodeValue(engine.Key("a"), val).Bytes) != "old" {
+		t.Errorf("expected transactional put to leave value in place; got %q, %v", val, err)
+	}
+
+	gArgs, gReply := getArgs("a", 0)
+	gArgs.TxID = "txn1"
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if string(gReply.Value.Bytes) != "new" {
+		t.Errorf("expected transaction to read its own write; got %q", gReply.Value.Bytes)
+	}
+	sArgs := &ScanRequest{RequestHeader: RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("z"), TxID: "txn1"}}
+	sReply := &ScanResponse{}
+	if err := rng.ReadOnlyCmd(Scan, sArgs, sReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 1 || string(sReply.Rows[0].Value.Bytes) != "new" {
+		t.Errorf("expected transaction to scan its own write; got %+v", sReply.Rows)
+	}
+
+	// Requests outside of the transaction are blocked by its intent.
+	for _, txID := range []string{"", "txn2"} {
+		gArgs, gReply := getArgs("a", 0)
+		gArgs.TxID = txID
+		err := rng.ReadOnlyCmd(Get, gArgs, gReply)
+		if intentErr, ok := err.(*WriteIntentError); !ok || intentErr.TxID != "txn1" {
+			t.Errorf("%q: expected get to be blocked by intent of txn1; got %v", txID, err)
+		}
+		pArgs, pReply := putArgs("a", "other", 0)
+		pArgs.TxID = txID
+		if err := rng.ReadWriteCmd(Put, pArgs, pReply); err == nil {
+			t.Errorf("%q: expected put to be blocked by intent", txID)
+		}
+		sArgs.TxID = txID
+		if err := rng.ReadOnlyCmd(Scan, sArgs, sReply); err == nil {
+			t.Errorf("%q: expected scan to be blocked by intent", txID)
+		}
+	}
+}
+
+// TestRangeResolveIntent verifies that committing a transaction's
+// intents applies its writes and aborting them discards the writes,
+// leaving the intents of other transactions in place.
+func TestRangeResolveIntent(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	for _, key := range []string{"a", "b"} {
+		pArgs, pReply := putArgs(key, "old", 0)
+		if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writes := []struct {
+		key, txID string
+		del       bool
+	}{
+		{"a", "txn1", false},
+		{"b", "txn1", true},
+		{"c", "txn1", false},
+		{"d", "txn2", false},
+	}
+	for _, w := range writes {
+		var err error
+		if w.del {
+			dArgs := &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key(w.key), TxID: w.txID}}
+			err = rng.ReadWriteCmd(Delete, dArgs, &DeleteResponse{})
+		} else {
+			pArgs, pReply := putArgs(w.key, w.txID, 0)
+			pArgs.TxID = w.txID
+			err = rng.ReadWriteCmd(Put, pArgs, pReply)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args, reply := resolveArgs("a", "z", "txn1", true)
+	if err := rng.ReadWriteCmd(InternalResolveIntent, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := store.engine.Get(intentKey(engine.Key("d"))); err != nil || val == nil {
+		t.Errorf("expected intent of txn2 to remain; got %q, %v", val, err)
+	}
+	args, reply = resolveArgs("d", "", "txn2", false)
+	if err := rng.ReadWriteCmd(InternalResolveIntent, args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	sArgs := &ScanRequest{RequestHeader: RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("z")}}
+	sReply := &ScanResponse{}
+	if err := rng.ReadOnlyCmd(Scan, sArgs, sReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 2 || string(sReply.Rows[0].Key) != "a" || string(sReply.Rows[0].Value.Bytes) != "txn1" ||
+		string(sReply.Rows[1].Key) != "c" {
+		t.Errorf("expected only committed writes of txn1 to be visible; got %+v", sReply.Rows)
+	}
+	kvs, err := store.engine.Scan(intentKey(engine.KeyMin), intentKey(engine.KeyMax), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Errorf("expected all intents to be resolved; got %d", len(kvs))
+	}
+}
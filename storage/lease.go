@@ -0,0 +1,178 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+const (
+	// leaderLeaseDuration is the duration of the leader leases
+	// requested by range replicas upon becoming raft leader.
+	leaderLeaseDuration = 5 * time.Second
+	// leaderLeaseRenewalInterval is the interval at which the raft
+	// leader checks whether its lease needs to be extended. Leases are
+	// extended once less than half their duration remains.
+	leaderLeaseRenewalInterval = leaderLeaseDuration / 10
+)
+
+// A Lease grants a replica the exclusive right to serve reads and
+// propose commands for its range from Start until Expiration. Leases
+// are granted through raft, so every replica agrees on the holder.
+// A lease may be extended by its holder at any time, but may only be
+// granted to another replica after it expires.
+type Lease struct {
+	Start      hlc.Timestamp
+	Expiration hlc.Timestamp
+	Replica    Replica
+}
+
+// Covers returns true if the lease is valid at timestamp now on a
+// clock which may drift up to maxDrift from the clocks of other
+// replicas. The lease's expiration must be more than maxDrift in the
+// future so that no other replica can believe it has expired.
+func (l *Lease) Covers(now hlc.Timestamp, maxDrift time.Duration) bool {
+	if now.Less(l.Start) {
+		return false
+	}
+	return now.WallTime+maxDrift.Nanoseconds() < l.Expiration.WallTime
+}
+
+// sameReplica returns true if a and b identify the same replica.
+func sameReplica(a, b Replica) bool {
+	return a.NodeID == b.NodeID && a.StoreID == b.StoreID
+}
+
+// makeLeaseKey returns the local key at which the lease of the
+// specified range is stored.
+func makeLeaseKey(rangeID int64) engine.Key {
+	return engine.MakeKey(engine.KeyLocalRangeLeasePrefix, engine.Key(strconv.FormatInt(rangeID, 10)))
+}
+
+// loadLeaderLease reads the range's most recently granted lease, if
+// any, from the engine.
+func (r *Range) loadLeaderLease() error {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	_, err := engine.GetI(r.engine, makeLeaseKey(r.Meta.RangeID), &r.lease)
+	return err
+}
+
+// HasLeaderLease returns true if this replica holds the range's
+// leader lease and the lease is valid at the current time, allowing
+// for the clock's maximum drift.
+func (r *Range) HasLeaderLease() bool {
+	now := r.clock.Now()
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	return sameReplica(r.lease.Replica, r.localReplica()) && r.lease.Covers(now, r.clock.MaxDrift())
+}
+
+// leaderLeaseStart returns the start of the most recently granted
+// leader lease applied by this replica. Leases are granted through
+// raft and extensions restart the lease, so every replica observes the
+// same sequence of lease starts; a replica which lags in applying
+// commands observes an earlier one.
+func (r *Range) leaderLeaseStart() hlc.Timestamp {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	return r.lease.Start
+}
+
+// requestLeaderLease proposes a lease for this replica, starting now,
+// to the range's raft group and waits for it to be granted. If this
+// replica already holds the lease, the lease is extended. Only the
+// raft leader may request a lease.
+func (r *Range) requestLeaderLease() error {
+	now := r.clock.Now()
+	expiration := now
+	expiration.WallTime += leaderLeaseDuration.Nanoseconds()
+	replica := r.localReplica()
+	args := &InternalLeaderLeaseRequest{
+		RequestHeader: RequestHeader{
+			Key:       r.Meta.StartKey,
+			Timestamp: now,
+			User:      UserRoot,
+			Replica:   replica,
+		},
+		Lease: Lease{Start: now, Expiration: expiration, Replica: replica},
+	}
+	cmd := &Cmd{
+		Method: InternalLeaderLease,
+		Args:   args,
+		Reply:  &InternalLeaderLeaseResponse{},
+		done:   make(chan error, 1),
+	}
+	return r.EnqueueCmd(cmd)
+}
+
+// needsLeaseRenewal returns true if this replica doesn't hold the
+// lease or its lease expires within half the lease duration.
+func (r *Range) needsLeaseRenewal() bool {
+	now := r.clock.Now()
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	if !sameReplica(r.lease.Replica, r.localReplica()) {
+		return true
+	}
+	return r.lease.Expiration.WallTime-now.WallTime < leaderLeaseDuration.Nanoseconds()/2
+}
+
+// maintainLeaderLease periodically extends the lease of this replica
+// while it's the raft leader, or requests a new lease if the previous
+// holder's lease has expired. Runs until the range is stopped.
+func (r *Range) maintainLeaderLease() {
+	ticker := time.NewTicker(leaderLeaseRenewalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.IsLeader() && r.needsLeaseRenewal() {
+				if err := r.requestLeaderLease(); err != nil {
+					log.Warningf("range %d: unable to acquire leader lease: %v", r.Meta.RangeID, err)
+				}
+			}
+		case <-r.closer:
+			return
+		}
+	}
+}
+
+// InternalLeaderLease grants the requested lease if the range has no
+// lease, the existing lease is held by the same replica (an
+// extension), or the existing lease expires before the requested
+// lease starts. The granted lease is persisted so that it survives
+// restarts.
+func (r *Range) InternalLeaderLease(args *InternalLeaderLeaseRequest, reply *InternalLeaderLeaseResponse) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	prev := r.lease
+	if !args.Lease.Start.Less(args.Lease.Expiration) ||
+		(!sameReplica(prev.Replica, args.Lease.Replica) && !prev.Expiration.Less(args.Lease.Start)) {
+		reply.Error = &LeaseRejectedError{Requested: args.Lease, Existing: prev}
+		return
+	}
+	if err := engine.PutI(r.engine, makeLeaseKey(r.Meta.RangeID), args.Lease); err != nil {
+		reply.Error = err
+		return
+	}
+	r.lease = args.Lease
+}
@@ -18,7 +18,12 @@
 package storage
 
 import (
+	"reflect"
+	"strings"
+	"time"
+
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
@@ -122,6 +127,7 @@ type ContainsRequest struct {
 type ContainsResponse struct {
 	ResponseHeader
 	Exists bool
+	Tag    engine.ValueTag // The type of the value, if it exists
 }
 
 // A GetRequest is arguments to the Get() method.
@@ -155,7 +161,7 @@ type PutResponse struct {
 type ConditionalPutRequest struct {
 	RequestHeader
 	Value    engine.Value // The value to put
-	ExpValue engine.Value // ExpValue.Bytes empty to test for non-existence
+	ExpValue engine.Value // ExpValue.Bytes empty to test for non-existence; ExpValue.Timestamp, if set, must match too
 }
 
 // A ConditionalPutResponse is the return value from the
@@ -181,9 +187,14 @@ type IncrementResponse struct {
 	NewValue int64
 }
 
-// A DeleteRequest is arguments to the Delete() method.
+// A DeleteRequest is arguments to the Delete() method. If
+// ExpValue.Bytes is set, the key is deleted only if its value equals
+// ExpValue and, if ExpValue.Timestamp is set, was written at that
+// timestamp; otherwise, a ConditionFailedError holding the actual
+// value, if any, is returned.
 type DeleteRequest struct {
 	RequestHeader
+	ExpValue engine.Value // ExpValue.Bytes empty to delete unconditionally
 }
 
 // A DeleteResponse is the return value from the Delete() method.
@@ -219,6 +230,33 @@ type ScanResponse struct {
 	Rows []engine.KeyValue // Empty if no rows were scanned
 }
 
+// A WatchRequest is arguments to the Watch() method. It specifies the
+// key or key range to watch for committed writes, the timestamp after
+// which writes are of interest and how long to wait for them. If
+// StartTimestamp is zero, the watch starts at the time it's executed.
+// Ranges retain only their most recent writes, in memory, so a watch
+// starting too far in the past, or before the replica serving it was
+// started, fails with a WatchTimestampError and the watcher must
+// rescan the keys and watch from the scan's timestamp. The writes of
+// a transaction are delivered once it commits and its intents are
+// resolved.
+type WatchRequest struct {
+	RequestHeader
+	StartTimestamp hlc.Timestamp // Writes at or before this timestamp are skipped
+	Wait           time.Duration // Maximum time to wait for events; 0 to return immediately
+}
+
+// A WatchResponse is the return value from the Watch() method. Events
+// holds the writes committed after the request's StartTimestamp and
+// at or before ResolvedTimestamp, in timestamp order. No writes at or
+// before ResolvedTimestamp remain to be delivered, so the next watch
+// should start from it.
+type WatchResponse struct {
+	ResponseHeader
+	Events            []WatchEvent
+	ResolvedTimestamp hlc.Timestamp
+}
+
 // An EndTransactionRequest is arguments to the EndTransaction() method.
 // It specifies whether to commit or roll back an extant transaction.
 type EndTransactionRequest struct {
@@ -270,7 +308,8 @@ type ReapQueueResponse struct {
 // It specifies the update to enqueue for asynchronous execution.
 // Update is an instance of one of the following messages: PutRequest,
 // IncrementRequest, DeleteRequest, DeleteRangeRequest, or
-// AccountingRequest.
+// AccumulateTSRequest. The update is executed with the command ID in
+// its header, which is chosen when the update is enqueued if empty.
 type EnqueueUpdateRequest struct {
 	RequestHeader
 	Update interface{}
@@ -329,3 +368,168 @@ type HeartbeatTransactionResponse struct {
 	ResponseHeader
 	Status TransactionStatus
 }
+
+// An InternalResolveIntentRequest is arguments to the
+// InternalResolveIntent() method. It is sent by transaction
+// coordinators to commit or abort the write intents written by the
+// transaction specified by TxID within the key range from Key to
+// EndKey (or just Key, if EndKey is empty).
+type InternalResolveIntentRequest struct {
+	RequestHeader
+	Commit bool // False to abort and rollback
+}
+
+// An InternalResolveIntentResponse is the return value from the
+// InternalResolveIntent() method.
+type InternalResolveIntentResponse struct {
+	ResponseHeader
+}
+
+// An InternalLeaderLeaseRequest is arguments to the
+// InternalLeaderLease() method. It is sent by the raft leader of a
+// range to acquire or extend the range's leader lease.
+type InternalLeaderLeaseRequest struct {
+	RequestHeader
+	Lease Lease
+}
+
+// An InternalLeaderLeaseResponse is the return value from the
+// InternalLeaderLease() method.
+type InternalLeaderLeaseResponse struct {
+	ResponseHeader
+}
+
+// An InternalChangeReplicasRequest is arguments to the
+// InternalChangeReplicas() method. It is sent by the raft leader of a
+// range to replace the range's replicas.
+type InternalChangeReplicasRequest struct {
+	RequestHeader
+	Replicas []Replica
+}
+
+// An InternalChangeReplicasResponse is the return value from the
+// InternalChangeReplicas() method.
+type InternalChangeReplicasResponse struct {
+	ResponseHeader
+}
+
+// An InternalDequeueUpdatesRequest is arguments to the
+// InternalDequeueUpdates() method. It is sent by the replica holding
+// a range's leader lease to remove the updates it has executed, or
+// discarded, from the range's update queue.
+type InternalDequeueUpdatesRequest struct {
+	RequestHeader
+	Keys []engine.Key // Keys at which the updates are queued
+}
+
+// An InternalDequeueUpdatesResponse is the return value from the
+// InternalDequeueUpdates() method.
+type InternalDequeueUpdatesResponse struct {
+	ResponseHeader
+}
+
+// A BatchRequest is arguments to the Batch() method. It holds a list
+// of heterogeneous requests which are executed together. The header's
+// Key and EndKey span the keys of all requests in the batch; use Add()
+// to append requests and widen the span accordingly. Requests in the
+// batch inherit the timestamp, user and transaction of the batch.
+type BatchRequest struct {
+	RequestHeader
+	Requests []Request
+}
+
+// Add appends args to the batch, widening the batch header's key
+// span to include the keys implicated by args.
+func (br *BatchRequest) Add(args Request) {
+	header := args.Header()
+	end := header.EndKey
+	if len(end) == 0 {
+		end = engine.NextKey(header.Key)
+	}
+	if len(br.Requests) == 0 || header.Key.Less(br.Key) {
+		br.Key = header.Key
+	}
+	if len(br.Requests) == 0 || br.EndKey.Less(end) {
+		br.EndKey = end
+	}
+	br.Requests = append(br.Requests, args)
+}
+
+// A BatchResponse is the return value from the Batch() method. The
+// responses correspond by index to the requests of the batch. If a
+// request fails, its error is set both in its own response and in
+// the batch response header.
+type BatchResponse struct {
+	ResponseHeader
+	Responses []Response
+}
+
+// MethodForRequest returns the name of the KV API method which
+// accepts args, e.g. "Put" for a *PutRequest.
+func MethodForRequest(args Request) (string, error) {
+	t := reflect.TypeOf(args)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if !strings.HasSuffix(t.Name(), "Request") {
+		return "", util.Errorf("unrecognized request type %T", args)
+	}
+	method := strings.TrimSuffix(t.Name(), "Request")
+	if !NeedReadPerm(method) && !NeedWritePerm(method) {
+		return "", util.Errorf("unrecognized request type %T", args)
+	}
+	return method, nil
+}
+
+// NewResponse returns a new, empty response of the type returned by
+// the KV API method named by method.
+func NewResponse(method string) (Response, error) {
+	var reply Response
+	switch method {
+	case Contains:
+		reply = &ContainsResponse{}
+	case Get:
+		reply = &GetResponse{}
+	case Put:
+		reply = &PutResponse{}
+	case ConditionalPut:
+		reply = &ConditionalPutResponse{}
+	case Increment:
+		reply = &IncrementResponse{}
+	case Delete:
+		reply = &DeleteResponse{}
+	case DeleteRange:
+		reply = &DeleteRangeResponse{}
+	case Scan:
+		reply = &ScanResponse{}
+	case Watch:
+		reply = &WatchResponse{}
+	case EndTransaction:
+		reply = &EndTransactionResponse{}
+	case AccumulateTS:
+		reply = &AccumulateTSResponse{}
+	case ReapQueue:
+		reply = &ReapQueueResponse{}
+	case EnqueueUpdate:
+		reply = &EnqueueUpdateResponse{}
+	case EnqueueMessage:
+		reply = &EnqueueMessageResponse{}
+	case InternalRangeLookup:
+		reply = &InternalRangeLookupResponse{}
+	case InternalResolveIntent:
+		reply = &InternalResolveIntentResponse{}
+	case HeartbeatTransaction:
+		reply = &HeartbeatTransactionResponse{}
+	case InternalLeaderLease:
+		reply = &InternalLeaderLeaseResponse{}
+	case InternalChangeReplicas:
+		reply = &InternalChangeReplicasResponse{}
+	case InternalDequeueUpdates:
+		reply = &InternalDequeueUpdatesResponse{}
+	case Batch:
+		reply = &BatchResponse{}
+	default:
+		return nil, util.Errorf("unrecognized method %s", method)
+	}
+	return reply, nil
+}
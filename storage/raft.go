@@ -18,14 +18,149 @@
 
 package storage
 
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+)
+
+// init registers the request and response types so that commands
+// may be serialized for submission to raft.
+func init() {
+	for _, t := range []interface{}{
+		&ContainsRequest{}, &ContainsResponse{},
+		&GetRequest{}, &GetResponse{},
+		&PutRequest{}, &PutResponse{},
+		&ConditionalPutRequest{}, &ConditionalPutResponse{},
+		&IncrementRequest{}, &IncrementResponse{},
+		&DeleteRequest{}, &DeleteResponse{},
+		&DeleteRangeRequest{}, &DeleteRangeResponse{},
+		&ScanRequest{}, &ScanResponse{},
+		&WatchRequest{}, &WatchResponse{},
+		&EndTransactionRequest{}, &EndTransactionResponse{},
+		&AccumulateTSRequest{}, &AccumulateTSResponse{},
+		&ReapQueueRequest{}, &ReapQueueResponse{},
+		&EnqueueUpdateRequest{}, &EnqueueUpdateResponse{},
+		&EnqueueMessageRequest{}, &EnqueueMessageResponse{},
+		&InternalRangeLookupRequest{}, &InternalRangeLookupResponse{},
+		&InternalResolveIntentRequest{}, &InternalResolveIntentResponse{},
+		&HeartbeatTransactionRequest{}, &HeartbeatTransactionResponse{},
+		&InternalLeaderLeaseRequest{}, &InternalLeaderLeaseResponse{},
+		&InternalChangeReplicasRequest{}, &InternalChangeReplicasResponse{},
+		&InternalDequeueUpdatesRequest{}, &InternalDequeueUpdatesResponse{},
+		&BatchRequest{}, &BatchResponse{},
+	} {
+		gob.Register(t)
+	}
+}
+
+const (
+	// raftElectionTimeoutMin and raftElectionTimeoutMax bound the
+	// randomized interval after which a follower which hasn't heard
+	// from its leader calls an election. The Raft paper suggests
+	// 150-300ms for local networks.
+	raftElectionTimeoutMin = 150 * time.Millisecond
+	raftElectionTimeoutMax = 300 * time.Millisecond
+	// raftLeaderWait is the maximum time a command waits for a newly
+	// started range's raft group to elect its first leader.
+	raftLeaderWait = 2 * time.Second
+)
+
 // A Cmd provides serialization for a read-only or read/write
 // command. Once committed to the Raft log, the command is executed
 // and the result returned via the done channel.
 type Cmd struct {
+	RangeID  int64 // Range (and raft group) to which the command applies
+	ID       int64 // Distinguishes the command from others pending on the range
 	Method   string
 	Args     Request
 	Reply    Response
 	ReadOnly bool
+	Usage    []AcctUsageMap // Changes in usage caused by the command; see computeUsage
 
 	done chan error // Used to signal waiting RPC handler
 }
+
+// encodeCmd serializes cmd for submission to raft.
+func encodeCmd(cmd *Cmd) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCmd deserializes a command committed to raft.
+func decodeCmd(b []byte) (*Cmd, error) {
+	cmd := &Cmd{}
+	if err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// A RangeManager manages the raft groups of ranges. Ranges submit
+// commands through their manager and are notified as commands commit
+// and leaders are elected. Store implements RangeManager.
+type RangeManager interface {
+	// NodeID and StoreID identify the store holding the managed ranges.
+	NodeID() int32
+	StoreID() int32
+	// ProposeRaftCommand submits cmd to the raft group of the range
+	// identified by cmd.RangeID. The command is applied once committed.
+	ProposeRaftCommand(cmd *Cmd) error
+	// ExecuteUpdate synchronously executes a command addressing keys
+	// anywhere in the cluster, such as the usage keys of accounting
+	// configs.
+	ExecuteUpdate(method string, args Request, reply Response) error
+	// ChangeRaftMembership changes the membership of the raft group of
+	// the range described by meta to match its replicas.
+	ChangeRaftMembership(meta RangeMetadata) error
+}
+
+// MakeRaftNodeID returns the raft ID of the store identified by
+// nodeID and storeID. Each store participates in the raft groups of
+// its ranges independently, so raft IDs identify stores rather than
+// nodes: the node ID occupies the upper 32 bits and the store ID the
+// lower 32.
+func MakeRaftNodeID(nodeID, storeID int32) multiraft.NodeID {
+	return multiraft.NodeID(int64(nodeID)<<32 | int64(uint32(storeID)))
+}
+
+// DecodeRaftNodeID returns the node and store IDs of the store with
+// the specified raft ID.
+func DecodeRaftNodeID(id multiraft.NodeID) (nodeID, storeID int32) {
+	return int32(int64(id) >> 32), int32(uint32(int64(id)))
+}
+
+// groupMembers returns the membership of the raft group of the range
+// described by meta, which is formed of the stores holding its
+// replicas. REBALANCING replicas are non-voting members until they
+// have caught up and the change adding them completes. If meta lists
+// no replicas, the local store, identified by nodeID and storeID, is
+// the only member.
+func groupMembers(meta RangeMetadata, nodeID, storeID int32) multiraft.GroupMembers {
+	var members multiraft.GroupMembers
+	seen := map[multiraft.NodeID]struct{}{}
+	for _, replica := range meta.Replicas {
+		if replica.NodeID == 0 {
+			continue
+		}
+		id := MakeRaftNodeID(replica.NodeID, replica.StoreID)
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if replica.State == REBALANCING {
+			members.NonVotingMembers = append(members.NonVotingMembers, id)
+		} else {
+			members.Members = append(members.Members, id)
+		}
+	}
+	if len(members.Members) == 0 {
+		members.Members = []multiraft.NodeID{MakeRaftNodeID(nodeID, storeID)}
+	}
+	return members
+}
@@ -0,0 +1,234 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// makeRaftStateKey returns the key under which the persistent state
+// of the raft group of the specified range is stored.
+func makeRaftStateKey(rangeID int64) engine.Key {
+	return encoding.EncodeInt(append(engine.Key(nil), engine.KeyLocalRaftStatePrefix...), rangeID)
+}
+
+// makeRaftLogPrefix returns the key prefix of the log entries of the
+// raft group of the specified range.
+func makeRaftLogPrefix(rangeID int64) engine.Key {
+	return encoding.EncodeInt(append(engine.Key(nil), engine.KeyLocalRaftLogPrefix...), rangeID)
+}
+
+// makeRaftLogKey returns the key of the log entry at index in the raft
+// log of the specified range. Entries sort by index.
+func makeRaftLogKey(rangeID int64, index int) engine.Key {
+	return encoding.EncodeInt(makeRaftLogPrefix(rangeID), int64(index))
+}
+
+// makeRaftAppliedIndexKey returns the key under which the index of
+// the last raft log entry applied to the specified range is stored.
+func makeRaftAppliedIndexKey(rangeID int64) engine.Key {
+	return encoding.EncodeInt(append(engine.Key(nil), engine.KeyLocalRaftAppliedIndexPrefix...), rangeID)
+}
+
+// raftStorage implements multiraft.Storage, persisting the raft state
+// of a store's ranges in the store's engine. Raft groups are
+// identified by range ID.
+type raftStorage struct {
+	engine engine.Engine
+}
+
+// Verifying implementation of multiraft.Storage interface.
+var _ multiraft.Storage = &raftStorage{}
+
+// LoadGroups implements the multiraft.Storage interface.
+func (rs *raftStorage) LoadGroups() <-chan *multiraft.GroupPersistentState {
+	ch := make(chan *multiraft.GroupPersistentState)
+	go func() {
+		defer close(ch)
+		start := engine.KeyLocalRaftStatePrefix
+		kvs, err := rs.engine.Scan(start, engine.PrefixEndKey(start), 0)
+		if err != nil {
+			log.Errorf("unable to scan raft state: %v", err)
+			return
+		}
+		for _, kv := range kvs {
+			gs := &multiraft.GroupPersistentState{}
+			if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(gs); err != nil {
+				log.Errorf("unable to decode raft state %q: %v", kv.Key, err)
+				continue
+			}
+			ch <- gs
+		}
+	}()
+	return ch
+}
+
+// loadState returns the persistent state of the group, which is
+// empty if none has been stored.
+func (rs *raftStorage) loadState(groupID multiraft.GroupID) (*multiraft.GroupPersistentState, error) {
+	gs := &multiraft.GroupPersistentState{GroupID: groupID}
+	if _, err := engine.GetI(rs.engine, makeRaftStateKey(int64(groupID)), gs); err != nil {
+		return nil, err
+	}
+	return gs, nil
+}
+
+// encodeState gob-encodes the persistent state of a group.
+func encodeState(gs *multiraft.GroupPersistentState) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SetGroupElectionState implements the multiraft.Storage interface.
+func (rs *raftStorage) SetGroupElectionState(groupID multiraft.GroupID,
+	electionState *multiraft.GroupElectionState) error {
+	gs, err := rs.loadState(groupID)
+	if err != nil {
+		return err
+	}
+	gs.ElectionState = *electionState
+	return engine.PutI(rs.engine, makeRaftStateKey(int64(groupID)), gs)
+}
+
+// AppendLogEntries implements the multiraft.Storage interface. The
+// entries and the group's new last index are written atomically.
+func (rs *raftStorage) AppendLogEntries(groupID multiraft.GroupID, entries []*multiraft.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	gs, err := rs.loadState(groupID)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if expectedIndex := gs.LastLogIndex + 1 + i; entry.Index != expectedIndex {
+			return util.Errorf("log index mismatch: expected %d but was %d", expectedIndex, entry.Index)
+		}
+	}
+	batch := make([]interface{}, 0, len(entries)+1)
+	for _, entry := range entries {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+			return err
+		}
+		batch = append(batch, engine.BatchPut{Key: makeRaftLogKey(int64(groupID), entry.Index), Value: buf.Bytes()})
+	}
+	last := entries[len(entries)-1]
+	gs.LastLogIndex, gs.LastLogTerm = last.Index, last.Term
+	state, err := encodeState(gs)
+	if err != nil {
+		return err
+	}
+	batch = append(batch, engine.BatchPut{Key: makeRaftStateKey(int64(groupID)), Value: state})
+	return rs.engine.WriteBatch(batch)
+}
+
+// TruncateLog implements the multiraft.Storage interface.
+func (rs *raftStorage) TruncateLog(groupID multiraft.GroupID, lastIndex int) error {
+	gs, err := rs.loadState(groupID)
+	if err != nil {
+		return err
+	}
+	if lastIndex >= gs.LastLogIndex {
+		return nil
+	}
+	var batch []interface{}
+	for i := lastIndex + 1; i <= gs.LastLogIndex; i++ {
+		batch = append(batch, engine.BatchDelete(makeRaftLogKey(int64(groupID), i)))
+	}
+	gs.LastLogIndex, gs.LastLogTerm = lastIndex, 0
+	if lastIndex > 0 {
+		entry, err := rs.GetLogEntry(groupID, lastIndex)
+		if err != nil {
+			return err
+		}
+		gs.LastLogTerm = entry.Term
+	}
+	state, err := encodeState(gs)
+	if err != nil {
+		return err
+	}
+	batch = append(batch, engine.BatchPut{Key: makeRaftStateKey(int64(groupID)), Value: state})
+	return rs.engine.WriteBatch(batch)
+}
+
+// GetLogEntry implements the multiraft.Storage interface.
+func (rs *raftStorage) GetLogEntry(groupID multiraft.GroupID, index int) (*multiraft.LogEntry, error) {
+	entry := &multiraft.LogEntry{}
+	ok, err := engine.GetI(rs.engine, makeRaftLogKey(int64(groupID), index), entry)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, util.Errorf("raft log of group %d has no entry %d", groupID, index)
+	}
+	return entry, nil
+}
+
+// GetLogEntries implements the multiraft.Storage interface.
+func (rs *raftStorage) GetLogEntries(groupID multiraft.GroupID, firstIndex, lastIndex int,
+	ch chan<- *multiraft.LogEntryState) {
+	defer close(ch)
+	kvs, err := rs.engine.Scan(makeRaftLogKey(int64(groupID), firstIndex),
+		makeRaftLogKey(int64(groupID), lastIndex+1), 0)
+	if err == nil && len(kvs) != lastIndex-firstIndex+1 {
+		err = util.Errorf("raft log of group %d is missing entries in [%d, %d]", groupID, firstIndex, lastIndex)
+	}
+	if err != nil {
+		ch <- &multiraft.LogEntryState{Error: err}
+		return
+	}
+	for i, kv := range kvs {
+		entry := multiraft.LogEntry{}
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&entry); err != nil {
+			ch <- &multiraft.LogEntryState{Error: err}
+			return
+		}
+		ch <- &multiraft.LogEntryState{Index: firstIndex + i, Entry: entry}
+	}
+}
+
+// loadAppliedIndex returns the index of the last raft log entry
+// applied to the range, or zero if none has been.
+func loadAppliedIndex(e engine.Engine, rangeID int64) (int, error) {
+	var index int
+	if _, err := engine.GetI(e, makeRaftAppliedIndexKey(rangeID), &index); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// clearRaftState removes the raft log, persistent raft state and
+// applied index of the range from the engine.
+func clearRaftState(e engine.Engine, rangeID int64) error {
+	prefix := makeRaftLogPrefix(rangeID)
+	if _, err := engine.ClearRange(e, prefix, engine.PrefixEndKey(prefix), 0); err != nil {
+		return err
+	}
+	if err := e.Clear(makeRaftStateKey(rangeID)); err != nil {
+		return err
+	}
+	return e.Clear(makeRaftAppliedIndexKey(rangeID))
+}
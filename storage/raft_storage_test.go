@@ -0,0 +1,125 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestRaftStorage verifies that raft log entries and election state
+// are persisted in the engine and loaded again.
+func TestRaftStorage(t *testing.T) {
+	rs := &raftStorage{engine: engine.NewInMem(engine.Attributes{}, 1<<20)}
+	groupID := multiraft.GroupID(1)
+	var entries []*multiraft.LogEntry
+	for i := 1; i <= 3; i++ {
+		entries = append(entries, &multiraft.LogEntry{Term: 1 + i/3, Index: i, Payload: []byte{byte(i)}})
+	}
+	if err := rs.AppendLogEntries(groupID, entries[:2]); err != nil {
+		t.Fatal(err)
+	}
+	// Entries must follow the end of the log.
+	if err := rs.AppendLogEntries(groupID, entries[:1]); err == nil {
+		t.Error("expected appending an entry out of order to fail")
+	}
+	if err := rs.AppendLogEntries(groupID, entries[2:]); err != nil {
+		t.Fatal(err)
+	}
+	electionState := multiraft.GroupElectionState{CurrentTerm: 2, VotedFor: MakeRaftNodeID(1, 2)}
+	if err := rs.SetGroupElectionState(groupID, &electionState); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded []*multiraft.GroupPersistentState
+	for gs := range rs.LoadGroups() {
+		loaded = append(loaded, gs)
+	}
+	expected := &multiraft.GroupPersistentState{
+		GroupID:       groupID,
+		ElectionState: electionState,
+		LastLogIndex:  3,
+		LastLogTerm:   2,
+	}
+	if len(loaded) != 1 || !reflect.DeepEqual(loaded[0], expected) {
+		t.Errorf("expected loaded state %+v; got %+v", expected, loaded)
+	}
+
+	ch := make(chan *multiraft.LogEntryState, 3)
+	go rs.GetLogEntries(groupID, 2, 3, ch)
+	var got []multiraft.LogEntry
+	for es := range ch {
+		if es.Error != nil {
+			t.Fatal(es.Error)
+		}
+		got = append(got, es.Entry)
+	}
+	if len(got) != 2 || !reflect.DeepEqual(got[0], *entries[1]) || !reflect.DeepEqual(got[1], *entries[2]) {
+		t.Errorf("expected entries 2 and 3; got %+v", got)
+	}
+
+	// Truncation removes the tail of the log.
+	if err := rs.TruncateLog(groupID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.GetLogEntry(groupID, 2); err == nil {
+		t.Error("expected truncated entry to be removed")
+	}
+	if gs, err := rs.loadState(groupID); err != nil || gs.LastLogIndex != 1 || gs.LastLogTerm != 1 {
+		t.Errorf("expected last index 1 at term 1; got %+v, %v", gs, err)
+	}
+	if err := rs.AppendLogEntries(groupID, entries[1:2]); err != nil {
+		t.Errorf("expected appending after truncation to succeed: %v", err)
+	}
+
+	if err := clearRaftState(rs.engine, int64(groupID)); err != nil {
+		t.Fatal(err)
+	}
+	if kvs, err := rs.engine.Scan(engine.KeyMin, engine.KeyMax, 0); err != nil || len(kvs) != 0 {
+		t.Errorf("expected raft state to be cleared; got %d keys, %v", len(kvs), err)
+	}
+}
+
+// TestGroupMembers verifies that raft groups are formed of stores, so
+// that replicas on distinct stores of one node are distinct members,
+// and that REBALANCING replicas don't vote.
+func TestGroupMembers(t *testing.T) {
+	for _, ids := range [][2]int32{{1, 1}, {2, 3}, {1<<31 - 1, 1<<31 - 1}} {
+		if nodeID, storeID := DecodeRaftNodeID(MakeRaftNodeID(ids[0], ids[1])); nodeID != ids[0] || storeID != ids[1] {
+			t.Errorf("expected node %d, store %d; got %d, %d", ids[0], ids[1], nodeID, storeID)
+		}
+	}
+	meta := RangeMetadata{RangeDescriptor: RangeDescriptor{Replicas: []Replica{
+		{NodeID: 1, StoreID: 1},
+		{NodeID: 1, StoreID: 2, State: PENDING_DELETION},
+		{NodeID: 2, StoreID: 1, State: REBALANCING},
+	}}}
+	expected := multiraft.GroupMembers{
+		Members:          []multiraft.NodeID{MakeRaftNodeID(1, 1), MakeRaftNodeID(1, 2)},
+		NonVotingMembers: []multiraft.NodeID{MakeRaftNodeID(2, 1)},
+	}
+	if members := groupMembers(meta, 1, 2); !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected members %+v; got %+v", expected, members)
+	}
+	// Without replicas, the local store is the only member.
+	expected = multiraft.GroupMembers{Members: []multiraft.NodeID{MakeRaftNodeID(3, 4)}}
+	if members := groupMembers(RangeMetadata{}, 3, 4); !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected members %+v; got %+v", expected, members)
+	}
+}
@@ -20,6 +20,7 @@ package storage
 import (
 	"bytes"
 	"encoding/gob"
+	"math/rand"
 	"reflect"
 	"sync"
 	"time"
@@ -27,6 +28,7 @@ import (
 	"github.com/cockroachdb/cockroach/gossip"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
 	"github.com/cockroachdb/cockroach/util/hlc"
 	"github.com/cockroachdb/cockroach/util/log"
 )
@@ -65,21 +67,27 @@ var configPrefixes = []struct {
 
 // The following are the method names supported by the KV API.
 const (
-	Contains             = "Contains"
-	Get                  = "Get"
-	Put                  = "Put"
-	ConditionalPut       = "ConditionalPut"
-	Increment            = "Increment"
-	Scan                 = "Scan"
-	Delete               = "Delete"
-	DeleteRange          = "DeleteRange"
-	EndTransaction       = "EndTransaction"
-	AccumulateTS         = "AccumulateTS"
-	ReapQueue            = "ReapQueue"
-	EnqueueUpdate        = "EnqueueUpdate"
-	EnqueueMessage       = "EnqueueMessage"
-	InternalRangeLookup  = "InternalRangeLookup"
-	HeartbeatTransaction = "HeartbeatTransaction"
+	Contains               = "Contains"
+	Get                    = "Get"
+	Put                    = "Put"
+	ConditionalPut         = "ConditionalPut"
+	Increment              = "Increment"
+	Scan                   = "Scan"
+	Delete                 = "Delete"
+	DeleteRange            = "DeleteRange"
+	Watch                  = "Watch"
+	EndTransaction         = "EndTransaction"
+	AccumulateTS           = "AccumulateTS"
+	ReapQueue              = "ReapQueue"
+	EnqueueUpdate          = "EnqueueUpdate"
+	EnqueueMessage         = "EnqueueMessage"
+	InternalRangeLookup    = "InternalRangeLookup"
+	InternalResolveIntent  = "InternalResolveIntent"
+	HeartbeatTransaction   = "HeartbeatTransaction"
+	InternalLeaderLease    = "InternalLeaderLease"
+	InternalChangeReplicas = "InternalChangeReplicas"
+	InternalDequeueUpdates = "InternalDequeueUpdates"
+	Batch                  = "Batch"
 )
 
 // readMethods specifies the set of methods which read and return data.
@@ -89,23 +97,53 @@ var readMethods = map[string]struct{}{
 	ConditionalPut:      struct{}{},
 	Increment:           struct{}{},
 	Scan:                struct{}{},
+	Watch:               struct{}{},
 	ReapQueue:           struct{}{},
 	InternalRangeLookup: struct{}{},
 }
 
 // writeMethods specifies the set of methods which write data.
 var writeMethods = map[string]struct{}{
-	Put:                  struct{}{},
-	ConditionalPut:       struct{}{},
-	Increment:            struct{}{},
-	Delete:               struct{}{},
-	DeleteRange:          struct{}{},
-	EndTransaction:       struct{}{},
-	AccumulateTS:         struct{}{},
-	ReapQueue:            struct{}{},
-	EnqueueUpdate:        struct{}{},
-	EnqueueMessage:       struct{}{},
-	HeartbeatTransaction: struct{}{},
+	Put:                    struct{}{},
+	ConditionalPut:         struct{}{},
+	Increment:              struct{}{},
+	Delete:                 struct{}{},
+	DeleteRange:            struct{}{},
+	EndTransaction:         struct{}{},
+	AccumulateTS:           struct{}{},
+	ReapQueue:              struct{}{},
+	EnqueueUpdate:          struct{}{},
+	EnqueueMessage:         struct{}{},
+	InternalResolveIntent:  struct{}{},
+	HeartbeatTransaction:   struct{}{},
+	InternalLeaderLease:    struct{}{},
+	InternalChangeReplicas: struct{}{},
+	InternalDequeueUpdates: struct{}{},
+	Batch:                  struct{}{}, // Permissions are verified per request of the batch
+}
+
+// intentMethods specifies the set of methods which read and write
+// keys subject to the write intents of transactions (see txnEngine).
+var intentMethods = map[string]struct{}{
+	Contains:       struct{}{},
+	Get:            struct{}{},
+	Put:            struct{}{},
+	ConditionalPut: struct{}{},
+	Increment:      struct{}{},
+	Delete:         struct{}{},
+	DeleteRange:    struct{}{},
+	Scan:           struct{}{},
+}
+
+// internalMethods specifies the set of methods which may only be
+// invoked by nodes of the cluster.
+var internalMethods = map[string]struct{}{
+	InternalRangeLookup:    struct{}{},
+	InternalResolveIntent:  struct{}{},
+	HeartbeatTransaction:   struct{}{},
+	InternalLeaderLease:    struct{}{},
+	InternalChangeReplicas: struct{}{},
+	InternalDequeueUpdates: struct{}{},
 }
 
 // NeedReadPerm returns true if the specified method requires read permissions.
@@ -125,6 +163,13 @@ func IsReadOnly(method string) bool {
 	return !NeedWritePerm(method)
 }
 
+// IsPublic returns true if the specified method is part of the public
+// KV API; all other methods are internal to the cluster.
+func IsPublic(method string) bool {
+	_, ok := internalMethods[method]
+	return !ok
+}
+
 // A RangeMetadata holds information about the range.  This includes the cluster
 // ID, the range ID, and a RangeDescriptor describing the contents of the range.
 type RangeMetadata struct {
@@ -141,62 +186,226 @@ type RangeMetadata struct {
 // as appropriate.
 type Range struct {
 	Meta      RangeMetadata
+	clock     *hlc.Clock
 	engine    engine.Engine  // The underlying key-value store
 	allocator *allocator     // Makes allocation decisions
 	gossip    *gossip.Gossip // Range may gossip based on contents
-	raft      chan *Cmd      // Raft commands
+	rm        RangeManager   // Submits commands to the range's raft group
 	closer    chan struct{}  // Channel for closing the range
 
-	sync.RWMutex                     // Protects readQ, tsCache & respCache.
-	readQ        *ReadQueue          // Reads queued behind pending writes
+	raftMu      sync.Mutex     // Protects pendingCmds, isLeader, leader & lease
+	pendingCmds map[int64]*Cmd // Commands proposed by this replica awaiting commit
+	isLeader    bool           // True if this replica is the raft leader
+	leader      Replica        // The leader's replica, if known
+	lease       Lease          // The most recently granted leader lease
+	elected     chan struct{}  // Closed once a leader is first known
+
+	applyMu      sync.Mutex // Serializes applying commands with taking snapshots
+	appliedIndex int        // Index of the last raft log entry applied; protected by applyMu
+
+	changingReplicas int32 // Set while a replica change is in flight; accessed atomically
+
+	sync.RWMutex                     // Protects cmdQ, tsCache, respCache & replica changes.
+	cmdQ         *CommandQueue       // Commands queued behind overlapping commands
 	tsCache      *ReadTimestampCache // Most recent read timestamps for keys / key ranges
 	respCache    *ResponseCache      // Provides idempotence for retries
+
+	events *eventLog // Recently applied writes, for watchers
 }
 
-// NewRange initializes the range starting at key.
+// NewRange initializes the range starting at key. Commands are
+// submitted to the range's raft group via rm.
 func NewRange(meta RangeMetadata, clock *hlc.Clock, engine engine.Engine,
-	allocator *allocator, gossip *gossip.Gossip) *Range {
+	allocator *allocator, gossip *gossip.Gossip, rm RangeManager) *Range {
 	r := &Range{
-		Meta:      meta,
-		engine:    engine,
-		allocator: allocator,
-		gossip:    gossip,
-		raft:      make(chan *Cmd, 10), // TODO(spencer): remove
-		closer:    make(chan struct{}),
-		readQ:     NewReadQueue(),
-		tsCache:   NewReadTimestampCache(clock),
-		respCache: NewResponseCache(meta.RangeID, engine),
+		Meta:        meta,
+		clock:       clock,
+		engine:      engine,
+		allocator:   allocator,
+		gossip:      gossip,
+		rm:          rm,
+		closer:      make(chan struct{}),
+		pendingCmds: map[int64]*Cmd{},
+		elected:     make(chan struct{}),
+		cmdQ:        NewCommandQueue(),
+		tsCache:     NewReadTimestampCache(clock),
+		respCache:   NewResponseCache(meta.RangeID, engine),
+		events:      newEventLog(clock.Now()),
 	}
 	return r
 }
 
-// Start begins gossiping and starts the raft command processing
-// loop in a goroutine.
+// Start loads the range's leader lease and begins maintaining it.
+// Configs and the cluster ID are gossipped once this replica is
+// elected leader; see setLeader.
 func (r *Range) Start() {
-	r.maybeGossipClusterID()
-	r.maybeGossipFirstRange()
-	r.maybeGossipConfigs()
-	go r.processRaft() // TODO(spencer): remove
+	if err := r.loadLeaderLease(); err != nil {
+		log.Errorf("range %d: unable to load leader lease: %v", r.Meta.RangeID, err)
+	}
+	index, err := loadAppliedIndex(r.engine, r.Meta.RangeID)
+	if err != nil {
+		log.Errorf("range %d: unable to load applied raft index: %v", r.Meta.RangeID, err)
+	}
+	r.appliedIndex = index
+	go r.maintainLeaderLease()
 	// Only start gossiping if this range is the first range.
 	if r.IsFirstRange() {
 		go r.startGossip()
 	}
 }
 
-// Stop ends the log processing loop.
+// Stop ends gossiping and lease maintenance and fails any commands
+// waiting on raft.
 func (r *Range) Stop() {
 	close(r.closer)
 }
 
+// Destroy clears the range's data, response cache, update queue,
+// leader lease, raft state and local metadata from the engine. The range must have been stopped
+// and removed from its store.
+func (r *Range) Destroy() error {
+	start, end := r.Meta.StartKey, r.Meta.EndKey
+	// Local keys sort before all others, so the first range's data
+	// begins at the end of the local keys.
+	if start.Less(engine.KeyLocalMax) {
+		start = engine.KeyLocalMax
+	}
+	if _, err := engine.ClearRange(r.engine, start, end, 0); err != nil {
+		return util.Errorf("range %d: unable to clear data: %v", r.Meta.RangeID, err)
+	}
+	if err := r.respCache.ClearData(); err != nil {
+		return util.Errorf("range %d: unable to clear response cache: %v", r.Meta.RangeID, err)
+	}
+	updateQueuePrefix := makeUpdateQueuePrefix(r.Meta.RangeID)
+	if _, err := engine.ClearRange(r.engine, updateQueuePrefix, engine.PrefixEndKey(updateQueuePrefix), 0); err != nil {
+		return util.Errorf("range %d: unable to clear update queue: %v", r.Meta.RangeID, err)
+	}
+	if err := r.engine.Clear(makeLeaseKey(r.Meta.RangeID)); err != nil {
+		return err
+	}
+	if err := clearRaftState(r.engine, r.Meta.RangeID); err != nil {
+		return util.Errorf("range %d: unable to clear raft state: %v", r.Meta.RangeID, err)
+	}
+	return r.engine.Clear(makeRangeKey(r.Meta.RangeID))
+}
+
 // IsFirstRange returns true if this is the first range.
 func (r *Range) IsFirstRange() bool {
 	return bytes.Equal(r.Meta.StartKey, engine.KeyMin)
 }
 
 // IsLeader returns true if this range replica is the raft leader.
-// TODO(spencer): this is always true for now.
 func (r *Range) IsLeader() bool {
-	return true
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	return r.isLeader
+}
+
+// localReplica returns the replica of this range which resides on
+// the store managing it.
+func (r *Range) localReplica() Replica {
+	nodeID, storeID := r.rm.NodeID(), r.rm.StoreID()
+	for _, replica := range r.Meta.Replicas {
+		if replica.NodeID == nodeID && replica.StoreID == storeID {
+			return replica
+		}
+	}
+	return Replica{NodeID: nodeID, StoreID: storeID, RangeID: r.Meta.RangeID}
+}
+
+// newNotLeaderError returns a NotLeaderError naming the replica
+// holding the leader lease if its lease hasn't expired, or otherwise
+// the raft leader's replica, if known.
+func (r *Range) newNotLeaderError() error {
+	now := r.clock.Now()
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	if !sameReplica(r.lease.Replica, r.localReplica()) && now.Less(r.lease.Expiration) {
+		return &NotLeaderError{Leader: r.lease.Replica}
+	}
+	return &NotLeaderError{Leader: r.leader}
+}
+
+// waitForLeader waits up to timeout for the range's raft group to
+// elect its first leader and for the range to process the election.
+// It returns immediately if a leader has already been elected.
+func (r *Range) waitForLeader(timeout time.Duration) {
+	select {
+	case <-r.elected:
+	case <-time.After(timeout):
+	}
+}
+
+// setLeader records the election of the replica on the specified
+// node and store as leader of the range's raft group. isLocal is true if that
+// replica is this one.
+//
+// When this replica gains or loses leadership, the read timestamp
+// cache, the command queue and the response cache's inflight
+// commands are cleared. Otherwise, a read which was previously gated
+// on the former leader waiting for overlapping writes to commit to
+// the underlying state machine, might transit to the new leader and
+// be able to access the new leader's state machine BEFORE the
+// overlapping writes are applied. Clearing the read timestamp cache
+// resets its high water mark, so that writes on the new leader can't
+// invalidate reads served by the old.
+//
+// TODO(bdarnell): before the range is allowed to believe it's the
+//   leader and begin to accept writes and reads, push a noop command
+//   to raft followers in order to verify the committed entries in the
+//   log and apply all committed log entries to the state machine.
+func (r *Range) setLeader(nodeID, storeID int32, isLocal bool) {
+	r.raftMu.Lock()
+	changed := r.isLeader != isLocal
+	r.isLeader = isLocal
+	r.leader = Replica{NodeID: nodeID, StoreID: storeID}
+	if isLocal {
+		r.leader = r.localReplica()
+	} else {
+		for _, replica := range r.Meta.Replicas {
+			if replica.NodeID == nodeID && replica.StoreID == storeID {
+				r.leader = replica
+				break
+			}
+		}
+	}
+	r.raftMu.Unlock()
+
+	if changed {
+		r.Lock()
+		r.cmdQ.Clear()
+		r.tsCache.Clear()
+		r.Unlock()
+		r.respCache.ClearInflight()
+	}
+	if isLocal {
+		r.maybeGossipClusterID()
+		r.maybeGossipFirstRange()
+		r.maybeGossipConfigs()
+		r.maybeGossipUsage()
+		// The lease is granted via raft, whose events are delivered by
+		// the caller, so it mustn't be awaited here.
+		go func() {
+			if err := r.requestLeaderLease(); err != nil {
+				log.Warningf("range %d: unable to acquire leader lease: %v", r.Meta.RangeID, err)
+			}
+		}()
+	}
+	select {
+	case <-r.elected:
+	default:
+		close(r.elected)
+	}
+}
+
+// Descriptor returns a copy of the range's descriptor, which is
+// updated as replicas are added and removed.
+func (r *Range) Descriptor() RangeDescriptor {
+	r.RLock()
+	defer r.RUnlock()
+	desc := r.Meta.RangeDescriptor
+	desc.Replicas = append([]Replica(nil), desc.Replicas...)
+	return desc
 }
 
 // ContainsKey returns whether this range contains the specified key.
@@ -210,32 +419,104 @@ func (r *Range) ContainsKeyRange(start, end engine.Key) bool {
 	return r.Meta.ContainsKeyRange(start, end)
 }
 
-// EnqueueCmd enqueues a command to Raft.
+// EnqueueCmd submits a command to the range's raft group and waits
+// for it to be committed and applied. Only the leader may submit
+// commands.
 func (r *Range) EnqueueCmd(cmd *Cmd) error {
-	r.raft <- cmd
-	return <-cmd.done
+	if !r.IsLeader() {
+		return r.newNotLeaderError()
+	}
+	cmd.RangeID = r.Meta.RangeID
+	r.raftMu.Lock()
+	for {
+		cmd.ID = rand.Int63()
+		if _, ok := r.pendingCmds[cmd.ID]; !ok {
+			break
+		}
+	}
+	r.pendingCmds[cmd.ID] = cmd
+	r.raftMu.Unlock()
+
+	if err := r.rm.ProposeRaftCommand(cmd); err != nil {
+		r.raftMu.Lock()
+		delete(r.pendingCmds, cmd.ID)
+		r.raftMu.Unlock()
+		return err
+	}
+	select {
+	case err := <-cmd.done:
+		return err
+	case <-r.closer:
+		return util.Errorf("range %d stopped while command %s was pending", r.Meta.RangeID, cmd.Method)
+	}
+}
+
+// applyRaftCommand executes a command committed at index to the
+// range's raft log. If the command was proposed by this replica, it's
+// executed with the original args and reply and the waiting caller is
+// signaled; otherwise, the decoded args and reply are used. Commands
+// which were already applied, as raft commits them again after a
+// restart, are skipped. The applied index is persisted after the
+// command executes; a command interrupted in between is applied again
+// on restart, which the response cache makes idempotent.
+func (r *Range) applyRaftCommand(index int, cmd *Cmd) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	if index <= r.appliedIndex {
+		return
+	}
+	r.raftMu.Lock()
+	if pending, ok := r.pendingCmds[cmd.ID]; ok {
+		delete(r.pendingCmds, cmd.ID)
+		cmd = pending
+	}
+	r.raftMu.Unlock()
+
+	// Errors are returned in the reply, which is also recorded in the
+	// response cache.
+	err := r.executeCmd(cmd.Method, cmd.Args, cmd.Reply)
+	r.appliedIndex = index
+	if err := engine.PutI(r.engine, makeRaftAppliedIndexKey(r.Meta.RangeID), index); err != nil {
+		log.Errorf("range %d: unable to persist applied raft index: %v", r.Meta.RangeID, err)
+	}
+	r.flushUsage(cmd)
+	r.events.publish(cmd.Args.Header().Timestamp)
+	if cmd.done != nil {
+		cmd.done <- err
+	}
 }
 
 // ReadOnlyCmd updates the read timestamp cache and waits for any
 // overlapping writes currently processing through Raft ahead of us to
-// clear via the read queue.
+// clear via the command queue.
 func (r *Range) ReadOnlyCmd(method string, args Request, reply Response) error {
 	header := args.Header()
 	r.Lock()
 	r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
 	var wg sync.WaitGroup
-	r.readQ.AddRead(header.Key, header.EndKey, &wg)
+	r.cmdQ.GetWait(header.Key, header.EndKey, true /* readOnly */, &wg)
+	cmdKey := r.cmdQ.Add(header.Key, header.EndKey, true /* readOnly */)
 	r.Unlock()
 	wg.Wait()
 
+	// Once the read has executed, remove it from the command queue so
+	// that overlapping writes waiting on it may proceed.
+	defer func() {
+		r.Lock()
+		r.cmdQ.Remove(cmdKey)
+		r.Unlock()
+	}()
+
 	// It's possible that arbitrary delays (e.g. major GC, VM
 	// de-prioritization, etc.) could cause the execution of this read
 	// command to occur AFTER the range replica has lost leadership.
 	//
 	// There is a chance that we waited on writes, and although they
 	// were committed to the log, they weren't successfully applied to
-	// this replica's state machine. We re-verify leadership before
-	// reading to make sure that all pending writes are persisted.
+	// this replica's state machine. We re-verify the leader lease
+	// before reading to make sure that all pending writes are
+	// persisted. A valid lease also guarantees that no other replica
+	// can have accepted writes which this read would miss.
 	//
 	// There are some elaborate cases where we might have lost
 	// leadership and then regained it during the delay, but this is ok
@@ -243,9 +524,8 @@ func (r *Range) ReadOnlyCmd(method string, args Request, reply Response) error {
 	// timestamps. This is because the read-timestamp-cache prevents it
 	// for the active leader and leadership changes force the
 	// read-timestamp-cache to reset its high water mark.
-	if !r.IsLeader() {
-		// TODO(spencer): when we happen to know the leader, fill it in here via replica.
-		return &NotLeaderError{}
+	if !r.HasLeaderLease() {
+		return r.newNotLeaderError()
 	}
 	return r.executeCmd(method, args, reply)
 }
@@ -255,10 +535,11 @@ func (r *Range) ReadOnlyCmd(method string, args Request, reply Response) error {
 // found, it's returned immediately and not submitted to raft. Next,
 // the read timestamp cache is checked to determine if any newer reads
 // to this command's affected keys have been made. If so, this
-// command's timestamp is moved forward. Finally the keys affected by
-// this command are added as pending writes to the read queue and the
-// command is submitted to Raft. Upon completion, the write is removed
-// from the read queue and the reply is added to the repsonse cache.
+// command's timestamp is moved forward. Finally the command waits for
+// any overlapping reads and writes ahead of it in the command queue,
+// is added to the command queue itself and is submitted to Raft. Upon
+// completion, the write is removed from the command queue and the
+// reply is added to the repsonse cache.
 func (r *Range) ReadWriteCmd(method string, args Request, reply Response) error {
 	// Check the response cache in case this is a replay. This call
 	// may block if the same command is already underway.
@@ -282,7 +563,7 @@ func (r *Range) ReadWriteCmd(method string, args Request, reply Response) error
 	// write's timestamp before enqueuing it for execution. When the write
 	// returns, the updated timestamp will inform the final commit
 	// timestamp.
-	r.Lock() // Protect access to timestamp cache and read queue.
+	r.Lock() // Protect access to timestamp cache and command queue.
 	if ts := r.tsCache.GetMax(header.Key, header.EndKey); header.Timestamp.Less(ts) {
 		// Update both the incoming request and outgoing reply timestamps.
 		ts.Logical++ // increment logical component by one to differentiate.
@@ -290,65 +571,50 @@ func (r *Range) ReadWriteCmd(method string, args Request, reply Response) error
 		reply.Header().Timestamp = ts
 	}
 
-	// The next step is to add the write to the read queue to inform
-	// subsequent reads that there is a pending write. Reads which
-	// overlap pending writes must wait for those writes to complete.
-	wKey := r.readQ.AddWrite(header.Key, header.EndKey)
+	// The next step is to wait for overlapping reads and writes ahead
+	// of this command and to add the write to the command queue to
+	// inform subsequent commands that there is a pending write.
+	// Overlapping writes are thereby proposed to Raft in order.
+	var wg sync.WaitGroup
+	r.cmdQ.GetWait(header.Key, header.EndKey, false /* !readOnly */, &wg)
+	cmdKey := r.cmdQ.Add(header.Key, header.EndKey, false /* !readOnly */)
 	r.Unlock()
+	wg.Wait()
 
-	// Create command and enqueue for Raft.
-	cmd := &Cmd{
-		Method:   method,
-		Args:     args,
-		Reply:    reply,
-		ReadOnly: IsReadOnly(method),
-		done:     make(chan error, 1),
+	// With overlapping commands cleared, compute the changes in usage
+	// of accounting configs which the command will cause, and reject
+	// it if they would exceed the configs' quotas.
+	usage, err := r.computeUsage(args)
+	if err == nil {
+		err = r.checkQuota(usage)
+	}
+	if err == nil {
+		// Updates must be enqueued with the same command IDs on every
+		// replica, so those left empty are chosen before proposing.
+		assignUpdateCmdIDs(args)
+		// Create command and enqueue for Raft.
+		cmd := &Cmd{
+			Method:   method,
+			Args:     args,
+			Reply:    reply,
+			ReadOnly: IsReadOnly(method),
+			Usage:    usage,
+			done:     make(chan error, 1),
+		}
+		// This waits for the command to complete.
+		err = r.EnqueueCmd(cmd)
+	} else {
+		reply.Header().Error = err
 	}
-	// This waits for the command to complete.
-	err := r.EnqueueCmd(cmd)
 
 	// Now that the command has completed, remove the pending write.
 	r.Lock()
-	r.readQ.RemoveWrite(wKey)
+	r.cmdQ.Remove(cmdKey)
 	r.Unlock()
 
 	return err
 }
 
-// processRaft processes read/write commands, sending them to the Raft
-// consensus algorithm. This method processes indefinitely or until
-// Range.Stop() is invoked.
-//
-// TODO(spencer): this is pretty temporary. Just executing commands
-//   immediately until Raft is in place.
-//
-// TODO(bdarnell): when Raft elects this range replica as the leader,
-//   we need to be careful to do the following before the range is
-//   allowed to believe it's the leader and begin to accept writes and
-//   reads:
-//     - Push noop command to raft followers in order to verify the
-//       committed entries in the log.
-//     - Apply all committed log entries to the state machine.
-//     - Signal the range to clear its read timestamp, response caches
-//       and pending read queue.
-//     - Signal the range that it's now the leader with the duration
-//       of its leader lease.
-//   If we don't do this, then a read which was previously gated on
-//   the former leader waiting for overlapping writes to commit to
-//   the underlying state machine, might transit to the new leader
-//   and be able to access the new leader's state machine BEFORE
-//   the overlapping writes are applied.
-func (r *Range) processRaft() {
-	for {
-		select {
-		case cmd := <-r.raft:
-			cmd.done <- r.executeCmd(cmd.Method, cmd.Args, cmd.Reply)
-		case <-r.closer:
-			return
-		}
-	}
-}
-
 // startGossip periodically gossips the cluster ID if it's the
 // first range and the raft leader.
 func (r *Range) startGossip() {
@@ -423,7 +689,7 @@ func (r *Range) loadConfigMap(keyPrefix engine.Key, configI interface{}) (Prefix
 		// Instantiate an instance of the config type by unmarshalling
 		// gob encoded config from the Value into a new instance of configI.
 		config := reflect.New(reflect.TypeOf(configI)).Interface()
-		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(config); err != nil {
+		if err := gob.NewDecoder(bytes.NewBuffer(engine.DecodeValue(kv.Key, kv.Value).Bytes)).Decode(config); err != nil {
 			return nil, util.Errorf("unable to unmarshal config key %s: %v", string(kv.Key), err)
 		}
 		configs = append(configs, &PrefixConfig{Prefix: bytes.TrimPrefix(kv.Key, keyPrefix), Config: config})
@@ -431,9 +697,42 @@ func (r *Range) loadConfigMap(keyPrefix engine.Key, configI interface{}) (Prefix
 	return NewPrefixConfigMap(configs)
 }
 
-// executeCmd switches over the method and multiplexes to execute the
-// appropriate storage API command.
+// executeCmd executes the command and, if it's a read/write method,
+// records its result in the response cache.
 func (r *Range) executeCmd(method string, args Request, reply Response) error {
+	if err := r.dispatchCmd(method, args, reply); err != nil {
+		return err
+	}
+
+	// Add this command's result to the response cache if this is a
+	// read/write method. This must be done as part of the execution of
+	// raft commands so that every replica maintains the same responses
+	// to continue request idempotence when leadership changes.
+	// Commands failing with a retryable error, such as a conflicting
+	// write intent, had no effect and are executed anew when retried.
+	if !IsReadOnly(method) {
+		header := args.Header()
+		if retryErr, ok := reply.Header().Error.(util.Retryable); ok && retryErr.CanRetry() {
+			r.respCache.DiscardResponse(header.CmdID)
+		} else if putErr := r.respCache.PutResponse(header.CmdID, header.Timestamp, reply); putErr != nil {
+			log.Errorf("unable to write result of %+v: %+v to the response cache: %v",
+				args, reply, putErr)
+		}
+	}
+
+	// Return the error (if any) set in the reply.
+	return reply.Header().Error
+}
+
+// dispatchCmd switches over the method and multiplexes to execute the
+// appropriate storage API command. Errors of the command are set in
+// reply; an error is returned only for unrecognized methods.
+func (r *Range) dispatchCmd(method string, args Request, reply Response) error {
+	if _, ok := intentMethods[method]; ok {
+		if _, ok := r.engine.(*txnEngine); !ok {
+			return r.dispatchTxnCmd(method, args, reply)
+		}
+	}
 	switch method {
 	case Contains:
 		r.Contains(args.(*ContainsRequest), reply.(*ContainsResponse))
@@ -451,6 +750,8 @@ func (r *Range) executeCmd(method string, args Request, reply Response) error {
 		r.DeleteRange(args.(*DeleteRangeRequest), reply.(*DeleteRangeResponse))
 	case Scan:
 		r.Scan(args.(*ScanRequest), reply.(*ScanResponse))
+	case Watch:
+		r.Watch(args.(*WatchRequest), reply.(*WatchResponse))
 	case EndTransaction:
 		r.EndTransaction(args.(*EndTransactionRequest), reply.(*EndTransactionResponse))
 	case AccumulateTS:
@@ -463,28 +764,60 @@ func (r *Range) executeCmd(method string, args Request, reply Response) error {
 		r.EnqueueMessage(args.(*EnqueueMessageRequest), reply.(*EnqueueMessageResponse))
 	case InternalRangeLookup:
 		r.InternalRangeLookup(args.(*InternalRangeLookupRequest), reply.(*InternalRangeLookupResponse))
+	case InternalResolveIntent:
+		r.InternalResolveIntent(args.(*InternalResolveIntentRequest), reply.(*InternalResolveIntentResponse))
 	case HeartbeatTransaction:
 		r.HeartbeatTransaction(args.(*HeartbeatTransactionRequest), reply.(*HeartbeatTransactionResponse))
+	case InternalLeaderLease:
+		r.InternalLeaderLease(args.(*InternalLeaderLeaseRequest), reply.(*InternalLeaderLeaseResponse))
+	case InternalChangeReplicas:
+		r.InternalChangeReplicas(args.(*InternalChangeReplicasRequest), reply.(*InternalChangeReplicasResponse))
+	case InternalDequeueUpdates:
+		r.InternalDequeueUpdates(args.(*InternalDequeueUpdatesRequest), reply.(*InternalDequeueUpdatesResponse))
+	case Batch:
+		r.Batch(args.(*BatchRequest), reply.(*BatchResponse))
 	default:
 		return util.Errorf("unrecognized command type: %s", method)
 	}
+	return nil
+}
 
-	// Add this command's result to the response cache if this is a
-	// read/write method. This must be done as part of the execution of
-	// raft commands so that every replica maintains the same responses
-	// to continue request idempotence when leadership changes.
-	if !IsReadOnly(method) {
-		if putErr := r.respCache.PutResponse(args.Header().CmdID, reply); putErr != nil {
-			log.Errorf("unable to write result of %+v: %+v to the response cache: %v",
-				args, reply, putErr)
-		}
+// dispatchTxnCmd executes a command on the view of the range by the
+// command's transaction, if any (see txnEngine). The writes of a
+// transaction are stored as intents, which are hidden from watchers;
+// other writes are recorded for watchers as usual.
+func (r *Range) dispatchTxnCmd(method string, args Request, reply Response) error {
+	header := args.Header()
+	view := r.view(newTxnEngine(r.engine, header.TxID, header.Timestamp))
+	if len(header.TxID) > 0 {
+		// Intents don't modify configuration maps until committed.
+		view.gossip = nil
 	}
+	err := view.dispatchCmd(method, args, reply)
+	if len(header.TxID) == 0 && !IsReadOnly(method) {
+		r.events.addPending(view.events)
+		r.maybeGossipConfigs()
+	}
+	return err
+}
 
-	// Return the error (if any) set in the reply.
-	return reply.Header().Error
+// view returns a view of the range which executes commands on eng in
+// place of the range's engine. The writes executed by the view are
+// recorded in its own event log.
+func (r *Range) view(eng engine.Engine) *Range {
+	return &Range{
+		Meta:   r.Meta,
+		clock:  r.clock,
+		engine: eng,
+		gossip: r.gossip,
+		rm:     r.rm,
+		closer: r.closer,
+		events: newEventLog(r.clock.Now()),
+	}
 }
 
-// Contains verifies the existence of a key in the key value store.
+// Contains verifies the existence of a key in the key value store
+// and reports the type of its value.
 func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 	val, err := r.engine.Get(args.Key)
 	if err != nil {
@@ -493,19 +826,31 @@ func (r *Range) Contains(args *ContainsRequest, reply *ContainsResponse) {
 	}
 	if val != nil {
 		reply.Exists = true
+		reply.Tag = engine.DecodeValue(args.Key, val).Tag
 	}
 }
 
 // Get returns the value for a specified key.
 func (r *Range) Get(args *GetRequest, reply *GetResponse) {
 	val, err := r.engine.Get(args.Key)
-	reply.Value = engine.Value{Bytes: val}
-	reply.Error = err
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	// Counters must be read using Increment.
+	value := engine.DecodeValue(args.Key, val)
+	if value.Tag != engine.TagBytes {
+		reply.Error = &engine.ValueTypeError{Key: args.Key, Expected: engine.TagBytes, Actual: value.Tag}
+		return
+	}
+	reply.Value = value
+	reply.Value.InitChecksum()
 }
 
-// Put sets the value for a specified key.
+// Put sets the value for a specified key. The value is stored along
+// with the timestamp of the request.
 func (r *Range) Put(args *PutRequest, reply *PutResponse) {
-	reply.Error = r.internalPut(args.Key, args.Value)
+	reply.Error = r.internalPut(args.Key, args.Value, args.Timestamp)
 }
 
 // ConditionalPut sets the value for a specified key only if
@@ -518,35 +863,68 @@ func (r *Range) ConditionalPut(args *ConditionalPutRequest, reply *ConditionalPu
 		reply.Error = err
 		return
 	}
+	actual := engine.DecodeValue(args.Key, val)
 	if args.ExpValue.Bytes == nil && val != nil {
-		reply.Error = util.Errorf("key %q already exists", args.Key)
-		return
+		reply.ActualValue = &actual
 	} else if args.ExpValue.Bytes != nil {
 		// Handle check for existence when there is no key.
 		if val == nil {
-			reply.Error = util.Errorf("key %q does not exist", args.Key)
-			return
-		} else if !bytes.Equal(args.ExpValue.Bytes, val) {
-			// TODO(Jiang-Ming): provide the correct timestamp once switch to use MVCC
-			reply.ActualValue = &engine.Value{Bytes: val}
-			reply.Error = util.Errorf("key %q does not match existing", args.Key)
+			reply.Error = &ConditionFailedError{}
 			return
+		} else if !valueMatches(args.ExpValue, actual) {
+			reply.ActualValue = &actual
 		}
 	}
+	if reply.ActualValue != nil {
+		reply.ActualValue.InitChecksum()
+		reply.Error = &ConditionFailedError{ActualValue: reply.ActualValue}
+		return
+	}
+
+	reply.Error = r.internalPut(args.Key, args.Value, args.Timestamp)
+}
 
-	reply.Error = r.internalPut(args.Key, args.Value)
+// valueMatches returns true if the actual value of a key is a byte
+// string equal to the expected value of a conditional write and, if
+// the expected value carries a timestamp, was written at it.
+func valueMatches(expValue, actual engine.Value) bool {
+	if actual.Tag != engine.TagBytes || !bytes.Equal(expValue.Bytes, actual.Bytes) {
+		return false
+	}
+	return expValue.Timestamp == (hlc.Timestamp{}) || expValue.Timestamp == actual.Timestamp
 }
 
 // internalPut is the guts of the put method, called from both Put()
-// and ConditionalPut().
-func (r *Range) internalPut(key engine.Key, value engine.Value) error {
-	// Put the value.
+// and ConditionalPut(). The value is stored along with timestamp.
+func (r *Range) internalPut(key engine.Key, value engine.Value, timestamp hlc.Timestamp) error {
+	// Only byte string values may be put, and they may not replace a
+	// value of another type, such as a counter.
+	if value.Tag != engine.TagBytes {
+		return util.Errorf("cannot put value of type %s at key %q", value.Tag, key)
+	}
+	existing, err := r.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if tag := engine.DecodeValue(key, existing).Tag; tag != engine.TagBytes {
+		return &engine.ValueTypeError{Key: key, Expected: engine.TagBytes, Actual: tag}
+	}
+	// Put the value, tagged with its type.
 	// TODO(Tobias): Turn this into a writebatch with account stats in a reusable way.
 	// This requires use of RocksDB's merge operator to implement increasable counters
-	if err := r.engine.Put(key, value.Bytes); err != nil {
+	value.Timestamp = timestamp
+	encoded := engine.EncodeValue(key, value)
+	if err := r.engine.Put(key, encoded); err != nil {
 		return err
 	}
-	// Check whether this put has modified a configuration map.
+	r.events.record(key, encoded)
+	r.configWritten(key)
+	return nil
+}
+
+// configWritten gossips the configuration map holding key, if any, as
+// key has been written.
+func (r *Range) configWritten(key engine.Key) {
 	for _, cp := range configPrefixes {
 		if bytes.HasPrefix(key, cp.keyPrefix) {
 			cp.dirty = true
@@ -554,7 +932,6 @@ func (r *Range) internalPut(key engine.Key, value engine.Value) error {
 			break
 		}
 	}
-	return nil
 }
 
 // Increment increments the value (interpreted as varint64 encoded) and
@@ -562,19 +939,61 @@ func (r *Range) internalPut(key engine.Key, value engine.Value) error {
 // exists for the key, zero is incremented.
 func (r *Range) Increment(args *IncrementRequest, reply *IncrementResponse) {
 	reply.NewValue, reply.Error = engine.Increment(r.engine, args.Key, args.Increment)
+	if reply.Error == nil && args.Increment != 0 {
+		if encoded, err := encoding.Encode(args.Key, reply.NewValue); err == nil {
+			r.events.record(args.Key, encoded)
+		}
+	}
 }
 
-// Delete deletes the key and value specified by key.
+// Delete deletes the key and value specified by key. If an expected
+// value is specified and the existing value doesn't match, the key is
+// left in place and the return value contains the actual value.
 func (r *Range) Delete(args *DeleteRequest, reply *DeleteResponse) {
+	existing, err := r.engine.Get(args.Key)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	actual := engine.DecodeValue(args.Key, existing)
+	if args.ExpValue.Bytes != nil && !valueMatches(args.ExpValue, actual) {
+		cfErr := &ConditionFailedError{}
+		if existing != nil {
+			cfErr.ActualValue = &actual
+			cfErr.ActualValue.InitChecksum()
+		}
+		reply.Error = cfErr
+		return
+	}
 	if err := r.engine.Clear(args.Key); err != nil {
 		reply.Error = err
+		return
+	}
+	if existing != nil {
+		r.events.recordDelete(args.Key)
 	}
 }
 
 // DeleteRange deletes the range of key/value pairs specified by
 // start and end keys.
 func (r *Range) DeleteRange(args *DeleteRangeRequest, reply *DeleteRangeResponse) {
-	reply.Error = util.Error("unimplemented")
+	kvs, err := r.engine.Scan(args.Key, args.EndKey, args.MaxEntriesToDelete)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	deletes := make([]interface{}, len(kvs))
+	for i, kv := range kvs {
+		deletes[i] = engine.BatchDelete(kv.Key)
+	}
+	if err := r.engine.WriteBatch(deletes); err != nil {
+		reply.Error = err
+		return
+	}
+	for _, kv := range kvs {
+		r.events.recordDelete(kv.Key)
+	}
+	reply.NumDeleted = int64(len(kvs))
 }
 
 // Scan scans the key range specified by start key through end key up
@@ -589,26 +1008,194 @@ func (r *Range) Scan(args *ScanRequest, reply *ScanResponse) {
 	reply.Rows = make([]engine.KeyValue, len(kvs))
 	for idx, kv := range kvs {
 		// TODO(Jiang-Ming): provide the correct timestamp and checksum once switch to mvcc
-		reply.Rows[idx] = engine.KeyValue{Key: kv.Key, Value: engine.Value{Bytes: kv.Value}}
+		reply.Rows[idx] = engine.KeyValue{Key: kv.Key, Value: engine.DecodeValue(kv.Key, kv.Value)}
+		reply.Rows[idx].InitChecksum()
 	}
 }
 
 // EndTransaction either commits or aborts (rolls back) an extant
-// transaction according to the args.Commit parameter.
+// transaction according to the args.Commit parameter. The transaction
+// record is stored at args.Key. Aborting an already-aborted
+// transaction is a noop; all other attempts to end a transaction
+// which is no longer pending return an error.
 func (r *Range) EndTransaction(args *EndTransactionRequest, reply *EndTransactionResponse) {
-	reply.Error = util.Error("unimplemented")
+	var txn Transaction
+	ok, err := engine.GetI(r.engine, args.Key, &txn)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if !ok {
+		txn = Transaction{TxID: args.TxID, Status: PENDING, Timestamp: args.Timestamp}
+	}
+	switch txn.Status {
+	case COMMITTED:
+		reply.Error = &TransactionStatusError{TxID: args.TxID, Status: txn.Status}
+		return
+	case ABORTED:
+		if args.Commit {
+			reply.Error = &TransactionStatusError{TxID: args.TxID, Status: txn.Status}
+		}
+		return
+	}
+	if txn.Timestamp.Less(args.Timestamp) {
+		txn.Timestamp = args.Timestamp
+	}
+	if args.Commit {
+		txn.Status = COMMITTED
+	} else {
+		txn.Status = ABORTED
+	}
+	if err := engine.PutI(r.engine, args.Key, txn); err != nil {
+		reply.Error = err
+		return
+	}
+	reply.CommitTimestamp = txn.Timestamp
 }
 
 // AccumulateTS is used internally to aggregate statistics over key
-// ranges throughout the distributed cluster.
+// ranges throughout the distributed cluster. The counts are merged
+// into the existing value at args.Key as an engine.TimeSeries, which
+// adds them element-wise.
 func (r *Range) AccumulateTS(args *AccumulateTSRequest, reply *AccumulateTSResponse) {
-	reply.Error = util.Error("unimplemented")
+	update, err := encoding.GobEncode(engine.TimeSeries(args.Counts))
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	if reply.Error = r.engine.Merge(args.Key, update); reply.Error != nil {
+		return
+	}
+	// Gossip the change if this is the usage of an accounting config.
+	if bytes.HasPrefix(args.Key, engine.KeyAccountingUsagePrefix) {
+		r.maybeGossipUsage()
+	}
+}
+
+// makeTimestampKey returns the key formed by appending the
+// key-encoded timestamp to prefix. Keys with the same prefix sort by
+// timestamp.
+func makeTimestampKey(prefix engine.Key, timestamp hlc.Timestamp) engine.Key {
+	b := encoding.EncodeInt(nil, timestamp.WallTime)
+	b = encoding.EncodeInt(b, int64(timestamp.Logical))
+	return engine.MakeKey(prefix, b)
+}
+
+// putAtTimestampKey stores the value returned by makeValue at the
+// timestamp key under prefix for the supplied timestamp. If that key
+// is already occupied, the logical component of the timestamp is
+// incremented until a free key is found. makeValue is invoked with
+// the timestamp actually used, which is also returned.
+func putAtTimestampKey(e engine.Engine, prefix engine.Key, timestamp hlc.Timestamp,
+	makeValue func(hlc.Timestamp) interface{}) (hlc.Timestamp, error) {
+	for {
+		key := makeTimestampKey(prefix, timestamp)
+		ok, err := engine.GetI(e, key, nil)
+		if err != nil {
+			return timestamp, err
+		}
+		if !ok {
+			return timestamp, engine.PutI(e, key, makeValue(timestamp))
+		}
+		timestamp.Logical++
+	}
+}
+
+// makeInboxMessagePrefix returns the prefix of the keys of all
+// messages queued to the inbox at the specified key.
+func makeInboxMessagePrefix(inbox engine.Key) engine.Key {
+	return engine.MakeKey(inbox, engine.KeyInboxMessageInfix)
 }
 
 // ReapQueue destructively queries messages from a delivery inbox
-// queue. This method must be called from within a transaction.
+// queue. This method must be called from within a transaction. Up to
+// args.MaxResults messages are returned in the order they were
+// enqueued. Reaped messages are deleted via updates enqueued within
+// the transaction (see EnqueueUpdate), so they're removed only once
+// the transaction commits and are delivered again if it aborts. Until
+// then, a message whose delete is queued is claimed and isn't returned
+// to other reapers. Commands on a range execute serially, so
+// concurrent reapers never receive the same message; replays of the
+// same command are answered from the response cache, so each message
+// is delivered at most once to a committed transaction. Only messages
+// within the range's bounds are reaped.
 func (r *Range) ReapQueue(args *ReapQueueRequest, reply *ReapQueueResponse) {
-	reply.Error = util.Error("unimplemented")
+	if len(args.TxID) == 0 {
+		reply.Error = util.Errorf("ReapQueue of inbox %q must be called from within a transaction", args.Key)
+		return
+	}
+	if args.MaxResults <= 0 {
+		reply.Error = util.Errorf("ReapQueue of inbox %q requires MaxResults > 0; got %d", args.Key, args.MaxResults)
+		return
+	}
+	claimed, err := r.claimedMessages()
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	prefix := makeInboxMessagePrefix(args.Key)
+	end := engine.PrefixEndKey(prefix)
+	if r.Meta.EndKey.Less(end) {
+		end = r.Meta.EndKey
+	}
+	// Claimed messages are skipped, so scan enough to make up for them.
+	kvs, err := r.engine.Scan(prefix, end, args.MaxResults+int64(len(claimed)))
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	messages := []engine.Value{}
+	var deletes []queuedUpdate
+	for _, kv := range kvs {
+		if int64(len(messages)) == args.MaxResults {
+			break
+		}
+		if _, ok := claimed[string(kv.Key)]; ok {
+			continue
+		}
+		var message engine.Value
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&message); err != nil {
+			reply.Error = util.Errorf("unable to decode message at key %q: %v", kv.Key, err)
+			return
+		}
+		messages = append(messages, message)
+		deletes = append(deletes, queuedUpdate{
+			TxID:  args.TxID,
+			CmdID: makeUpdateCmdID(args.Timestamp.WallTime, []byte(args.TxID), kv.Key),
+			Update: &DeleteRequest{
+				RequestHeader: RequestHeader{Key: kv.Key, User: UserRoot},
+			},
+		})
+	}
+	for _, qu := range deletes {
+		if err := r.enqueueUpdate(qu, args.Timestamp); err != nil {
+			reply.Error = err
+			return
+		}
+	}
+	reply.Messages = messages
+}
+
+// claimedMessages returns the keys of the messages reaped by
+// transactions which haven't yet been deleted, as their deletes remain
+// in the range's update queue.
+func (r *Range) claimedMessages() (map[string]struct{}, error) {
+	prefix := makeUpdateQueuePrefix(r.Meta.RangeID)
+	kvs, err := r.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+	claimed := map[string]struct{}{}
+	for _, kv := range kvs {
+		var qu queuedUpdate
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&qu); err != nil {
+			continue
+		}
+		if update, ok := qu.Update.(*DeleteRequest); ok && len(qu.TxID) > 0 {
+			claimed[string(update.Key)] = struct{}{}
+		}
+	}
+	return claimed, nil
 }
 
 // EnqueueUpdate sidelines an update for asynchronous execution.
@@ -616,14 +1203,41 @@ func (r *Range) ReapQueue(args *ReapQueueRequest, reply *ReapQueueResponse) {
 // are also built using update queues. Crucially, the enqueue happens
 // as part of the caller's transaction, so is guaranteed to be
 // executed if the transaction succeeded.
+//
+// Updates are stored in the range's update queue keyed by the
+// command's timestamp and executed by the update queue processor of
+// the store holding the range's leader lease (see updateQueue).
+// Updates enqueued within a transaction are executed only once the
+// transaction has committed and are discarded if it aborts. The
+// update is executed with its own command ID, which is chosen by the
+// replica proposing the command if left empty, so that it's executed
+// at most once however many replicas enqueue it.
 func (r *Range) EnqueueUpdate(args *EnqueueUpdateRequest, reply *EnqueueUpdateResponse) {
-	reply.Error = util.Error("unimplemented")
+	_, update, _, err := newUpdateCmd(args.Update)
+	if err != nil {
+		reply.Error = err
+		return
+	}
+	cmdID := update.Header().CmdID
+	if cmdID.IsEmpty() {
+		reply.Error = util.Errorf("update enqueued at key %q has no command ID", args.Key)
+		return
+	}
+	reply.Error = r.enqueueUpdate(queuedUpdate{TxID: args.TxID, CmdID: cmdID, Update: args.Update}, args.Timestamp)
 }
 
 // EnqueueMessage enqueues a message (Value) for delivery to a
-// recipient inbox.
+// recipient inbox. The message is keyed under the inbox by the
+// command's timestamp; if another message already occupies that
+// timestamp, the logical component is incremented until a free key is
+// found. The message's Timestamp is set to the timestamp used.
 func (r *Range) EnqueueMessage(args *EnqueueMessageRequest, reply *EnqueueMessageResponse) {
-	reply.Error = util.Error("unimplemented")
+	_, reply.Error = putAtTimestampKey(r.engine, makeInboxMessagePrefix(args.Key), args.Timestamp,
+		func(timestamp hlc.Timestamp) interface{} {
+			message := args.Message
+			message.Timestamp = timestamp
+			return message
+		})
 }
 
 // InternalRangeLookup is used to look up RangeDescriptors - a RangeDescriptor
@@ -692,7 +1306,7 @@ func (r *Range) InternalRangeLookup(args *InternalRangeLookupRequest, reply *Int
 	rds := make([]*RangeDescriptor, 0, len(kvs))
 	for i := range kvs {
 		rds = append(rds, &RangeDescriptor{})
-		if err = gob.NewDecoder(bytes.NewBuffer(kvs[i].Value)).Decode(rds[i]); err != nil {
+		if err = gob.NewDecoder(bytes.NewBuffer(engine.DecodeValue(kvs[i].Key, kvs[i].Value).Bytes)).Decode(rds[i]); err != nil {
 			reply.Error = err
 			return
 		}
@@ -724,3 +1338,60 @@ func (r *Range) HeartbeatTransaction(args *HeartbeatTransactionRequest, reply *H
 
 	reply.Status = txn.Status
 }
+
+// Batch executes the requests of a batch in order as part of a single
+// raft command. Each request is executed with the batch's timestamp,
+// user, replica and transaction. The requests' writes are buffered in
+// an engine batch, which is committed only if every request succeeds,
+// so either all or none of them are applied. Execution stops at the
+// first request which fails; its error is also returned in the batch
+// reply, and the responses of requests after it are left empty.
+// Watches and internal methods may not be batched, as they act on the
+// replica's state outside of the engine.
+func (r *Range) Batch(args *BatchRequest, reply *BatchResponse) {
+	batch := engine.NewBatch(r.engine)
+	br := r.view(batch)
+	reply.Responses = make([]Response, len(args.Requests))
+	for i, req := range args.Requests {
+		method, err := MethodForRequest(req)
+		if err == nil && (method == Batch || method == Watch || !IsPublic(method)) {
+			err = util.Errorf("%s may not be batched", method)
+		}
+		if err != nil {
+			reply.Error = err
+			return
+		}
+		subReply, err := NewResponse(method)
+		if err != nil {
+			reply.Error = err
+			return
+		}
+		reply.Responses[i] = subReply
+		header := req.Header()
+		header.Timestamp = args.Timestamp
+		header.User = args.User
+		header.Replica = args.Replica
+		header.TxID = args.TxID
+		subReply.Header().Timestamp = args.Timestamp
+		if !r.ContainsKeyRange(header.Key, header.EndKey) {
+			subReply.Header().Error = NewRangeKeyMismatchError(header.Key, header.EndKey, r.Meta)
+		} else if NeedReadPerm(method) {
+			// Reads within the batch must be recorded in the read
+			// timestamp cache, just as a read-only command would be.
+			r.Lock()
+			r.tsCache.Add(header.Key, header.EndKey, header.Timestamp)
+			r.Unlock()
+		}
+		if subReply.Header().Error == nil {
+			br.dispatchCmd(method, req, subReply)
+		}
+		if err := subReply.Header().Error; err != nil {
+			reply.Error = err
+			return
+		}
+	}
+	if reply.Error = batch.Commit(); reply.Error == nil {
+		r.events.addPending(br.events)
+		r.maybeGossipConfigs()
+	}
+}
@@ -20,15 +20,20 @@ package storage
 import (
 	"bytes"
 	"encoding/gob"
+	"hash/crc32"
 	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/rpc"
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
 	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
@@ -43,12 +48,6 @@ var (
 				RangeID: 1,
 				Attrs:   engine.Attributes([]string{"dc1", "mem"}),
 			},
-			{
-				NodeID:  2,
-				StoreID: 1,
-				RangeID: 1,
-				Attrs:   engine.Attributes([]string{"dc2", "mem"}),
-			},
 		},
 	}
 	testDefaultAcctConfig = AcctConfig{}
@@ -81,24 +80,36 @@ func createTestEngine(t *testing.T) engine.Engine {
 }
 
 // createTestRange creates a new range initialized to the full extent
-// of the keyspace. The gossip instance is also returned for testing.
-func createTestRange(engine engine.Engine, t *testing.T) (*Range, *gossip.Gossip) {
-	rm := RangeMetadata{
-		RangeID:         0,
-		RangeDescriptor: testRangeDescriptor,
-	}
+// of the keyspace on a store using the supplied engine, and waits for
+// the range to be elected raft leader. The gossip instance is also
+// returned for testing. The caller is responsible for closing the store.
+func createTestRange(engine engine.Engine, t *testing.T) (*Store, *Range, *gossip.Gossip) {
 	g := gossip.New(rpc.LoadInsecureTLSConfig())
 	clock := hlc.NewClock(hlc.UnixNano)
-	r := NewRange(rm, clock, engine, nil, g)
-	r.Start()
-	return r, g
+	store := NewStore(clock, engine, g, multiraft.NewLocalRPCTransport())
+	store.Ident = testIdent
+	r, err := store.CreateRange(testRangeDescriptor.StartKey, testRangeDescriptor.EndKey, testRangeDescriptor.Replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, r)
+	return store, r, g
+}
+
+// waitForLeader waits for the range to be elected raft leader and
+// to acquire the leader lease.
+func waitForLeader(t *testing.T, r *Range) {
+	r.waitForLeader(raftLeaderWait)
+	if err := util.IsTrueWithin(r.HasLeaderLease, raftLeaderWait); err != nil {
+		t.Fatalf("range %d not granted leader lease: %v", r.Meta.RangeID, err)
+	}
 }
 
 // TestRangeContains verifies methods to check whether a key or key range
 // is contained within the range.
 func TestRangeContains(t *testing.T) {
-	r, _ := createTestRange(createTestEngine(t), t)
-	defer r.Stop()
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
 	r.Meta.StartKey = engine.Key("a")
 	r.Meta.EndKey = engine.Key("b")
 
@@ -137,8 +148,8 @@ func TestRangeContains(t *testing.T) {
 
 // TestRangeGossipFirstRange verifies that the first range gossips its location.
 func TestRangeGossipFirstRange(t *testing.T) {
-	r, g := createTestRange(createTestEngine(t), t)
-	defer r.Stop()
+	s, _, g := createTestRange(createTestEngine(t), t)
+	defer s.Close()
 	info, err := g.GetInfo(gossip.KeyFirstRangeMetadata)
 	if err != nil {
 		t.Fatal(err)
@@ -151,8 +162,8 @@ func TestRangeGossipFirstRange(t *testing.T) {
 // TestRangeGossipAllConfigs verifies that all config types are
 // gossipped.
 func TestRangeGossipAllConfigs(t *testing.T) {
-	r, g := createTestRange(createTestEngine(t), t)
-	defer r.Stop()
+	s, _, g := createTestRange(createTestEngine(t), t)
+	defer s.Close()
 	testData := []struct {
 		gossipKey string
 		configs   []*PrefixConfig
@@ -187,8 +198,8 @@ func TestRangeGossipConfigWithMultipleKeyPrefixes(t *testing.T) {
 	if err := engine.PutI(e, key, db1Perm); err != nil {
 		t.Fatal(err)
 	}
-	r, g := createTestRange(e, t)
-	defer r.Stop()
+	s, _, g := createTestRange(e, t)
+	defer s.Close()
 
 	info, err := g.GetInfo(gossip.KeyConfigPermission)
 	if err != nil {
@@ -208,8 +219,8 @@ func TestRangeGossipConfigWithMultipleKeyPrefixes(t *testing.T) {
 // TestRangeGossipConfigUpdates verifies that writes to the
 // permissions cause the updated configs to be re-gossipped.
 func TestRangeGossipConfigUpdates(t *testing.T) {
-	r, g := createTestRange(createTestEngine(t), t)
-	defer r.Stop()
+	s, r, g := createTestRange(createTestEngine(t), t)
+	defer s.Close()
 	// Add a permission for a new key prefix.
 	db1Perm := PermConfig{
 		Read:  []string{"spencer"},
@@ -281,15 +292,22 @@ func (be *blockingEngine) put(key engine.Key, value []byte) error {
 	return be.InMem.Put(key, value)
 }
 
-// createTestRange creates a range using a blocking engine. Returns
-// the range clock's manual unix nanos time and the range.
-func createTestRangeWithClock(t *testing.T) (*Range, *hlc.ManualClock, *blockingEngine) {
+// createTestRangeWithClock creates a range using a blocking engine
+// on a new store and waits for it to be elected raft leader. Returns
+// the store, the range, the range clock's manual unix nanos time and
+// the engine. The caller is responsible for closing the store.
+func createTestRangeWithClock(t *testing.T) (*Store, *Range, *hlc.ManualClock, *blockingEngine) {
 	manual := hlc.ManualClock(0)
 	clock := hlc.NewClock(manual.UnixNano)
-	engine := newBlockingEngine()
-	rng := NewRange(RangeMetadata{}, clock, engine, nil, nil)
-	rng.Start()
-	return rng, &manual, engine
+	be := newBlockingEngine()
+	store := NewStore(clock, be, nil, multiraft.NewLocalRPCTransport())
+	store.Ident = testIdent
+	rng, err := store.CreateRange(engine.KeyMin, engine.KeyMax, []Replica{{NodeID: 1, StoreID: 1, RangeID: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, rng)
+	return store, rng, &manual, be
 }
 
 // getArgs returns a GetRequest and GetResponse pair addressed to
@@ -338,8 +356,8 @@ func incrementArgs(key string, inc int64, rangeID int64) (*IncrementRequest, *In
 // TestRangeUpdateTSCache verifies that reads update the read
 // timestamp cache.
 func TestRangeUpdateTSCache(t *testing.T) {
-	rng, mc, _ := createTestRangeWithClock(t)
-	defer rng.Stop()
+	store, rng, mc, _ := createTestRangeWithClock(t)
+	defer store.Close()
 	// Set clock to time 1s and do the read.
 	t0 := 1 * time.Second
 	*mc = hlc.ManualClock(t0.Nanoseconds())
@@ -364,8 +382,8 @@ func TestRangeUpdateTSCache(t *testing.T) {
 // TestRangeReadQueue verifies that reads must wait for writes to
 // complete through Raft before being executed on range.
 func TestRangeReadQueue(t *testing.T) {
-	rng, _, be := createTestRangeWithClock(t)
-	defer rng.Stop()
+	store, rng, _, be := createTestRangeWithClock(t)
+	defer store.Close()
 
 	// Asynchronously put a value to the rng with blocking enabled.
 	be.setBlock(true)
@@ -424,11 +442,150 @@ func TestRangeReadQueue(t *testing.T) {
 	}
 }
 
+// TestRangeLeadershipChange verifies that a deposed leader serves
+// reads until its leader lease expires, that commands are then
+// rejected with a NotLeaderError naming the raft leader, and that the
+// read timestamp cache is cleared when leadership changes.
+func TestRangeLeadershipChange(t *testing.T) {
+	store, rng, mc, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	*mc = hlc.ManualClock(10)
+	gArgs, gReply := getArgs("a", 0)
+	gArgs.Timestamp = rng.clock.Now()
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+
+	rng.setLeader(2, 1, false)
+	if rng.IsLeader() {
+		t.Fatal("expected range not to be leader")
+	}
+	pArgs, pReply := putArgs("a", "value", 0)
+	err := rng.ReadWriteCmd(Put, pArgs, pReply)
+	if nlErr, ok := err.(*NotLeaderError); !ok || nlErr.Leader.NodeID != 2 {
+		t.Fatalf("expected not leader error naming node 2; got %v", err)
+	}
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatalf("expected read to succeed under unexpired lease: %v", err)
+	}
+	*mc = hlc.ManualClock(leaderLeaseDuration.Nanoseconds() + 10)
+	err = rng.ReadOnlyCmd(Get, gArgs, gReply)
+	if nlErr, ok := err.(*NotLeaderError); !ok || nlErr.Leader.NodeID != 2 {
+		t.Fatalf("expected not leader error naming node 2 after lease expiration; got %v", err)
+	}
+
+	// Regaining leadership resets the read timestamp cache's high
+	// water mark to the current time and reacquires the lease.
+	rng.setLeader(1, 1, true)
+	if ts := rng.tsCache.GetMax(engine.Key("a"), nil); ts.WallTime != int64(*mc) {
+		t.Errorf("expected cleared timestamp cache with high water %d; got %+v", *mc, ts)
+	}
+	waitForLeader(t, rng)
+	pArgs, pReply = putArgs("a", "value", 0)
+	pArgs.Timestamp = rng.clock.Now()
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRangeLeaderLease verifies that leases are persisted, that the
+// holder may extend its lease, and that a lease is only granted to
+// another replica once the existing lease has expired.
+func TestRangeLeaderLease(t *testing.T) {
+	store, rng, mc, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	other := Replica{NodeID: 2, StoreID: 2, RangeID: rng.Meta.RangeID}
+	leaseAt := func(start int64, replica Replica) Lease {
+		return Lease{
+			Start:      hlc.Timestamp{WallTime: start},
+			Expiration: hlc.Timestamp{WallTime: start + leaderLeaseDuration.Nanoseconds()},
+			Replica:    replica,
+		}
+	}
+	grant := func(lease Lease) error {
+		args := &InternalLeaderLeaseRequest{Lease: lease}
+		reply := &InternalLeaderLeaseResponse{}
+		rng.InternalLeaderLease(args, reply)
+		return reply.Error
+	}
+
+	// The lease acquired on election may be extended by its holder.
+	extension := leaseAt(1, rng.localReplica())
+	if err := grant(extension); err != nil {
+		t.Fatal(err)
+	}
+	// Another replica can't acquire the lease until it expires.
+	if err := grant(leaseAt(2, other)); err == nil {
+		t.Fatal("expected lease request to be rejected")
+	} else if _, ok := err.(*LeaseRejectedError); !ok {
+		t.Fatalf("expected lease rejected error; got %v", err)
+	}
+	// Reads are served only while the lease is valid, allowing for
+	// the maximum clock drift.
+	rng.clock.SetMaxDrift(time.Second)
+	*mc = hlc.ManualClock(extension.Expiration.WallTime - time.Second.Nanoseconds() - 1)
+	if !rng.HasLeaderLease() {
+		t.Error("expected lease to be valid")
+	}
+	*mc++
+	if rng.HasLeaderLease() {
+		t.Error("expected lease to be invalid within max drift of expiration")
+	}
+	newLease := leaseAt(extension.Expiration.WallTime+1, other)
+	if err := grant(newLease); err != nil {
+		t.Fatal(err)
+	}
+	if rng.HasLeaderLease() {
+		t.Error("expected lease to be held by other replica")
+	}
+	if err := rng.newNotLeaderError().(*NotLeaderError); !sameReplica(err.Leader, other) {
+		t.Errorf("expected not leader error to name leaseholder %+v; got %+v", other, err.Leader)
+	}
+
+	// The lease is reloaded from the engine.
+	rng.lease = Lease{}
+	if err := rng.loadLeaderLease(); err != nil {
+		t.Fatal(err)
+	}
+	if !sameReplica(rng.lease.Replica, other) || rng.lease.Start != newLease.Start {
+		t.Errorf("expected to load lease %+v; got %+v", newLease, rng.lease)
+	}
+}
+
+// TestRangeApplyRaftCommand verifies that a committed command which
+// wasn't proposed by the range, as on a follower, is decoded and
+// applied.
+func TestRangeApplyRaftCommand(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", 0)
+	b, err := encodeCmd(&Cmd{RangeID: rng.Meta.RangeID, ID: 1, Method: Put, Args: pArgs, Reply: pReply})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := decodeCmd(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng.applyRaftCommand(rng.appliedIndex+1, cmd)
+
+	gArgs, gReply := getArgs("a", 0)
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected applied value %q; got %q", "value", gReply.Value.Bytes)
+	}
+}
+
 // TestRangeUseTSCache verifies that write timestamps are upgraded
 // based on the read timestamp cache.
 func TestRangeUseTSCache(t *testing.T) {
-	rng, mc, _ := createTestRangeWithClock(t)
-	defer rng.Stop()
+	store, rng, mc, _ := createTestRangeWithClock(t)
+	defer store.Close()
 	// Set clock to time 1s and do the read.
 	t0 := 1 * time.Second
 	*mc = hlc.ManualClock(t0.Nanoseconds())
@@ -451,8 +608,8 @@ func TestRangeUseTSCache(t *testing.T) {
 // TestRangeIdempotence verifies that a retry increment with
 // same client command ID receives same reply.
 func TestRangeIdempotence(t *testing.T) {
-	rng, _, _ := createTestRangeWithClock(t)
-	defer rng.Stop()
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
 
 	// Run the same increment 100 times, 50 with identical command ID,
 	// interleaved with 50 using a sequence of different command IDs.
@@ -498,3 +655,644 @@ func TestRangeIdempotence(t *testing.T) {
 		t.Errorf("expected sum of all increments to be 1325; got %d", count)
 	}
 }
+
+// endTxnArgs returns an EndTransactionRequest and response pair
+// addressed to the transaction record for txID.
+func endTxnArgs(txID string, commit bool, rangeID int64) (*EndTransactionRequest, *EndTransactionResponse) {
+	args := &EndTransactionRequest{
+		RequestHeader: RequestHeader{
+			Key:     engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txID)),
+			Replica: Replica{RangeID: rangeID},
+			TxID:    txID,
+		},
+		Commit: commit,
+	}
+	reply := &EndTransactionResponse{}
+	return args, reply
+}
+
+// TestRangeEndTransaction verifies that transactions may be committed
+// or aborted once, that repeated aborts are noops, and that the final
+// status is reported to heartbeats.
+func TestRangeEndTransaction(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	testCases := []struct {
+		txID      string
+		commit    bool
+		expStatus TransactionStatus
+		expErr    bool
+	}{
+		{"txn1", true, COMMITTED, false},
+		{"txn1", true, COMMITTED, true},
+		{"txn1", false, COMMITTED, true},
+		{"txn2", false, ABORTED, false},
+		{"txn2", false, ABORTED, false},
+		{"txn2", true, ABORTED, true},
+	}
+	for i, test := range testCases {
+		args, reply := endTxnArgs(test.txID, test.commit, 0)
+		err := rng.ReadWriteCmd(EndTransaction, args, reply)
+		if (err != nil) != test.expErr {
+			t.Errorf("%d: expected error %t; got %v", i, test.expErr, err)
+		}
+		hArgs := &HeartbeatTransactionRequest{RequestHeader: args.RequestHeader}
+		hReply := &HeartbeatTransactionResponse{}
+		if err := rng.ReadWriteCmd(HeartbeatTransaction, hArgs, hReply); err != nil {
+			t.Fatal(err)
+		}
+		if hReply.Status != test.expStatus {
+			t.Errorf("%d: expected status %d; got %d", i, test.expStatus, hReply.Status)
+		}
+	}
+}
+
+// TestRangeAccumulateTS verifies that time series counts are added
+// element-wise to the existing value.
+func TestRangeAccumulateTS(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	updates := [][]int64{{1, 2}, {0, 3, 4}, {-1}}
+	for _, counts := range updates {
+		args := &AccumulateTSRequest{
+			RequestHeader: RequestHeader{
+				Key:     engine.Key("ts"),
+				Replica: Replica{RangeID: 0},
+			},
+			Counts: counts,
+		}
+		if err := rng.ReadWriteCmd(AccumulateTS, args, &AccumulateTSResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gArgs, gReply := getArgs("ts", 0)
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := encoding.GobDecode(gReply.Value.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (engine.TimeSeries{0, 5, 4}); !reflect.DeepEqual(ts, expected) {
+		t.Errorf("expected %v; got %v", expected, ts)
+	}
+}
+
+func enqueueMessageArgs(inbox, message string, rangeID int64) (*EnqueueMessageRequest, *EnqueueMessageResponse) {
+	args := &EnqueueMessageRequest{
+		RequestHeader: RequestHeader{
+			Key:     engine.Key(inbox),
+			Replica: Replica{RangeID: rangeID},
+		},
+		Message: engine.Value{Bytes: []byte(message)},
+	}
+	reply := &EnqueueMessageResponse{}
+	return args, reply
+}
+
+func reapQueueArgs(inbox, txID string, maxResults int64, rangeID int64) (*ReapQueueRequest, *ReapQueueResponse) {
+	args := &ReapQueueRequest{
+		RequestHeader: RequestHeader{
+			Key:     engine.Key(inbox),
+			TxID:    txID,
+			Replica: Replica{RangeID: rangeID},
+		},
+		MaxResults: maxResults,
+	}
+	reply := &ReapQueueResponse{}
+	return args, reply
+}
+
+// TestRangeEnqueueReapQueue verifies that messages are reaped in the
+// order enqueued, at most MaxResults at a time, aren't reaped again
+// once reaped, and are kept separate per inbox.
+func TestRangeEnqueueReapQueue(t *testing.T) {
+	store, rng, mc, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	// Enqueue several messages at the same timestamp and one into a
+	// different inbox which shares a prefix.
+	*mc = hlc.ManualClock(1)
+	for _, msg := range []string{"a", "b", "c"} {
+		args, reply := enqueueMessageArgs("inbox", msg, 0)
+		args.Timestamp = rng.tsCache.clock.Now()
+		if err := rng.ReadWriteCmd(EnqueueMessage, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args, reply := enqueueMessageArgs("inbox2", "z", 0)
+	if err := rng.ReadWriteCmd(EnqueueMessage, args, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reaping outside of a transaction or with no results is an error.
+	rArgs, rReply := reapQueueArgs("inbox", "", 2, 0)
+	if err := rng.ReadWriteCmd(ReapQueue, rArgs, rReply); err == nil {
+		t.Error("expected error reaping outside of a transaction")
+	}
+	rArgs, rReply = reapQueueArgs("inbox", "txn", 0, 0)
+	if err := rng.ReadWriteCmd(ReapQueue, rArgs, rReply); err == nil {
+		t.Error("expected error reaping with MaxResults of zero")
+	}
+
+	testCases := []struct {
+		maxResults int64
+		expected   []string
+	}{
+		{2, []string{"a", "b"}},
+		{2, []string{"c"}},
+		{2, []string{}},
+	}
+	for i, test := range testCases {
+		rArgs, rReply := reapQueueArgs("inbox", "txn", test.maxResults, 0)
+		if err := rng.ReadWriteCmd(ReapQueue, rArgs, rReply); err != nil {
+			t.Fatal(err)
+		}
+		messages := []string{}
+		for j, msg := range rReply.Messages {
+			messages = append(messages, string(msg.Bytes))
+			if j > 0 && !rReply.Messages[j-1].Timestamp.Less(msg.Timestamp) {
+				t.Errorf("%d: expected increasing message timestamps; got %+v", i, rReply.Messages)
+			}
+		}
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("%d: expected messages %q; got %q", i, test.expected, messages)
+		}
+	}
+
+	rArgs, rReply = reapQueueArgs("inbox2", "txn", 10, 0)
+	if err := rng.ReadWriteCmd(ReapQueue, rArgs, rReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(rReply.Messages) != 1 || string(rReply.Messages[0].Bytes) != "z" {
+		t.Errorf("expected single message \"z\" in inbox2; got %+v", rReply.Messages)
+	}
+}
+
+// TestRangeReapQueueConcurrent verifies that concurrent reapers of the
+// same inbox never receive the same message and that every message is
+// eventually delivered.
+func TestRangeReapQueueConcurrent(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	const numMessages = 100
+	const numReapers = 5
+	for i := 0; i < numMessages; i++ {
+		args, reply := enqueueMessageArgs("inbox", strconv.Itoa(i), 0)
+		if err := rng.ReadWriteCmd(EnqueueMessage, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	reaped := make([][]engine.Value, numReapers)
+	errs := make(chan error, numReapers)
+	for i := 0; i < numReapers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				args, reply := reapQueueArgs("inbox", "txn"+strconv.Itoa(i), 3, 0)
+				if err := rng.ReadWriteCmd(ReapQueue, args, reply); err != nil {
+					errs <- err
+					return
+				}
+				if len(reply.Messages) == 0 {
+					return
+				}
+				reaped[i] = append(reaped[i], reply.Messages...)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	delivered := map[string]int{}
+	for _, messages := range reaped {
+		for _, msg := range messages {
+			delivered[string(msg.Bytes)]++
+		}
+	}
+	if len(delivered) != numMessages {
+		t.Errorf("expected %d distinct messages to be delivered; got %d", numMessages, len(delivered))
+	}
+	for msg, count := range delivered {
+		if count != 1 {
+			t.Errorf("message %q delivered %d times", msg, count)
+		}
+	}
+}
+
+// TestRangeReapQueueAbort verifies that messages reaped by a
+// transaction are deleted only once it commits and are delivered
+// again if it aborts.
+func TestRangeReapQueueAbort(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+	uq := newUpdateQueue(store, func(method string, args Request, reply Response) error {
+		args.Header().Replica = Replica{RangeID: rng.Meta.RangeID}
+		if err := store.ExecuteCmd(method, args, reply); err != nil {
+			return err
+		}
+		return reply.Header().Error
+	})
+	for _, msg := range []string{"a", "b"} {
+		args, reply := enqueueMessageArgs("inbox", msg, 0)
+		if err := rng.ReadWriteCmd(EnqueueMessage, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reap reaps the inbox within txID, verifying the messages received.
+	reap := func(txID string, expected ...string) {
+		args, reply := reapQueueArgs("inbox", txID, 10, 0)
+		if err := rng.ReadWriteCmd(ReapQueue, args, reply); err != nil {
+			t.Fatal(err)
+		}
+		messages := []string{}
+		for _, msg := range reply.Messages {
+			messages = append(messages, string(msg.Bytes))
+		}
+		if !reflect.DeepEqual(messages, append([]string{}, expected...)) {
+			t.Errorf("%s: expected messages %q; got %q", txID, expected, messages)
+		}
+	}
+	// endTxn ends txID and processes the update queue.
+	endTxn := func(txID string, commit bool) {
+		args, reply := endTxnArgs(txID, commit, 0)
+		if err := rng.ReadWriteCmd(EndTransaction, args, reply); err != nil {
+			t.Fatal(err)
+		}
+		if err := uq.process(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages reaped by a pending transaction are claimed.
+	reap("txn1", "a", "b")
+	reap("txn2")
+	// Once the transaction aborts, they're delivered again.
+	endTxn("txn1", false)
+	reap("txn2", "a", "b")
+	// Once the reaping transaction commits, they're gone.
+	endTxn("txn2", true)
+	reap("txn3")
+	prefix := makeInboxMessagePrefix(engine.Key("inbox"))
+	kvs, err := store.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Errorf("expected reaped messages to be deleted; got %d", len(kvs))
+	}
+}
+
+// TestRangeReapQueueBounds verifies that messages beyond the range's
+// end key aren't reaped.
+func TestRangeReapQueueBounds(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+	for _, msg := range []string{"a", "b"} {
+		args, reply := enqueueMessageArgs("inbox", msg, 0)
+		if err := rng.ReadWriteCmd(EnqueueMessage, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefix := makeInboxMessagePrefix(engine.Key("inbox"))
+	kvs, err := store.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("expected two messages; got %d", len(kvs))
+	}
+	// End the range between the two messages.
+	rng.Meta.EndKey = kvs[1].Key
+	args, reply := reapQueueArgs("inbox", "txn", 10, 0)
+	if err := rng.ReadWriteCmd(ReapQueue, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Messages) != 1 || string(reply.Messages[0].Bytes) != "a" {
+		t.Errorf("expected only message \"a\" within the range; got %+v", reply.Messages)
+	}
+}
+
+// TestRangeBatch verifies that the requests of a batch are executed
+// in order as a single command, that the batch spans the keys of its
+// requests and that execution stops at the first failed request.
+func TestRangeBatch(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, _ := putArgs("a", "value", 0)
+	iArgs, _ := incrementArgs("c", 2, 0)
+	gArgs, _ := getArgs("a", 0)
+	args := &BatchRequest{}
+	for _, req := range []Request{pArgs, iArgs, gArgs} {
+		args.Add(req)
+	}
+	if !bytes.Equal(args.Key, engine.Key("a")) || !bytes.Equal(args.EndKey, engine.Key("c\x00")) {
+		t.Errorf("expected batch to span [a, c\\x00); got [%q, %q)", args.Key, args.EndKey)
+	}
+	reply := &BatchResponse{}
+	if err := rng.ReadWriteCmd(Batch, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Responses) != 3 {
+		t.Fatalf("expected 3 responses; got %d", len(reply.Responses))
+	}
+	if _, ok := reply.Responses[0].(*PutResponse); !ok {
+		t.Errorf("expected put response; got %T", reply.Responses[0])
+	}
+	if iReply := reply.Responses[1].(*IncrementResponse); iReply.NewValue != 2 {
+		t.Errorf("expected increment to 2; got %d", iReply.NewValue)
+	}
+	if gReply := reply.Responses[2].(*GetResponse); !bytes.Equal(gReply.Value.Bytes, []byte("value")) {
+		t.Errorf("expected get to read value written earlier in batch; got %q", gReply.Value.Bytes)
+	}
+
+	// A failed conditional put stops execution of the batch.
+	cpArgs := &ConditionalPutRequest{
+		RequestHeader: RequestHeader{Key: engine.Key("a")},
+		Value:         engine.Value{Bytes: []byte("new")},
+		ExpValue:      engine.Value{Bytes: []byte("wrong")},
+	}
+	pArgs, _ = putArgs("b", "value", 0)
+	args = &BatchRequest{}
+	args.Add(cpArgs)
+	args.Add(pArgs)
+	reply = &BatchResponse{}
+	if err := rng.ReadWriteCmd(Batch, args, reply); err == nil {
+		t.Fatal("expected batch to fail on conditional put")
+	}
+	if reply.Responses[0].Header().Error == nil || reply.Responses[1] != nil {
+		t.Errorf("expected error in conditional put response and no put response; got %+v", reply.Responses)
+	}
+	if val, err := store.engine.Get(engine.Key("b")); err != nil || val != nil {
+		t.Errorf("expected put after failed request not to execute; got %q, %v", val, err)
+	}
+
+	// A failed request discards the writes of the requests before it.
+	pArgs, _ = putArgs("b", "value", 0)
+	dArgs := &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}}
+	cpArgs.Key = engine.Key("c")
+	args = &BatchRequest{}
+	for _, req := range []Request{pArgs, dArgs, cpArgs} {
+		args.Add(req)
+	}
+	if err := rng.ReadWriteCmd(Batch, args, &BatchResponse{}); err == nil {
+		t.Fatal("expected batch to fail on conditional put")
+	}
+	if val, err := store.engine.Get(engine.Key("b")); err != nil || val != nil {
+		t.Errorf("expected put before failed request not to be applied; got %q, %v", val, err)
+	}
+	if val, err := store.engine.Get(engine.Key("a")); err != nil || val == nil {
+		t.Errorf("expected delete before failed request not to be applied; got %q, %v", val, err)
+	}
+
+	// Batches may not be nested, nor contain internal methods.
+	for _, req := range []Request{
+		&BatchRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}},
+		&InternalResolveIntentRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}},
+	} {
+		args = &BatchRequest{}
+		args.Add(req)
+		if err := rng.ReadWriteCmd(Batch, args, &BatchResponse{}); err == nil {
+			t.Errorf("expected batch of %T to fail", req)
+		}
+	}
+}
+
+// TestRangeDeleteRange verifies that keys within the range are
+// deleted, up to the maximum number of entries if specified.
+func TestRangeDeleteRange(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		pArgs, pReply := putArgs(key, "value", 0)
+		if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := &DeleteRangeRequest{
+		RequestHeader:      RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("d")},
+		MaxEntriesToDelete: 2,
+	}
+	reply := &DeleteRangeResponse{}
+	if err := rng.ReadWriteCmd(DeleteRange, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumDeleted != 2 {
+		t.Errorf("expected 2 deleted entries; got %d", reply.NumDeleted)
+	}
+	args.MaxEntriesToDelete = 0
+	if err := rng.ReadWriteCmd(DeleteRange, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.NumDeleted != 1 {
+		t.Errorf("expected 1 deleted entry; got %d", reply.NumDeleted)
+	}
+	kvs, err := store.engine.Scan(engine.Key("a"), engine.Key("e"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || !bytes.Equal(kvs[0].Key, engine.Key("d")) {
+		t.Errorf("expected only key \"d\" to remain; got %+v", kvs)
+	}
+}
+
+// TestRangeConditionalPut verifies that a conditional put fails with
+// a ConditionFailedError holding the actual value unless the existing
+// value matches the expected value.
+func TestRangeConditionalPut(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", 0)
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		key, expValue string
+		expActual     string // "" if no actual value is expected
+		expSuccess    bool
+	}{
+		{"a", "", "value", false},
+		{"a", "wrong", "value", false},
+		{"b", "value", "", false},
+		{"a", "value", "", true},
+		{"b", "", "", true},
+	}
+	for i, test := range testCases {
+		args := &ConditionalPutRequest{
+			RequestHeader: RequestHeader{Key: engine.Key(test.key), Replica: pArgs.Replica},
+			Value:         engine.Value{Bytes: []byte("new")},
+		}
+		if test.expValue != "" {
+			args.ExpValue.Bytes = []byte(test.expValue)
+		}
+		reply := &ConditionalPutResponse{}
+		err := rng.ReadWriteCmd(ConditionalPut, args, reply)
+		if test.expSuccess {
+			if err != nil {
+				t.Errorf("%d: unexpected error %v", i, err)
+			}
+			continue
+		}
+		cfErr, ok := err.(*ConditionFailedError)
+		if !ok {
+			t.Errorf("%d: expected condition failed error; got %v", i, err)
+			continue
+		}
+		if test.expActual == "" {
+			if cfErr.ActualValue != nil {
+				t.Errorf("%d: expected no actual value; got %+v", i, cfErr.ActualValue)
+			}
+		} else if cfErr.ActualValue == nil || string(cfErr.ActualValue.Bytes) != test.expActual ||
+			cfErr.ActualValue.Checksum != crc32.ChecksumIEEE([]byte(test.expActual)) {
+			t.Errorf("%d: expected actual value %q; got %+v", i, test.expActual, cfErr.ActualValue)
+		}
+	}
+}
+
+// TestRangePutTimestamp verifies that values are stored along with
+// the timestamp of the put and that a conditional put expecting a
+// timestamp succeeds only if the value was written at it.
+func TestRangePutTimestamp(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", 0)
+	pArgs.Timestamp = hlc.Timestamp{WallTime: 5}
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	written := pReply.Timestamp
+	if written.WallTime == 0 {
+		written = pArgs.Timestamp
+	}
+	gArgs, gReply := getArgs("a", 0)
+	gArgs.Timestamp = written
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil {
+		t.Fatal(err)
+	}
+	if string(gReply.Value.Bytes) != "value" || gReply.Value.Timestamp != written {
+		t.Fatalf("expected value written at %+v; got %+v", written, gReply.Value)
+	}
+
+	for i, expTS := range []hlc.Timestamp{{WallTime: written.WallTime - 1}, written} {
+		args := &ConditionalPutRequest{
+			RequestHeader: RequestHeader{Key: engine.Key("a"), Replica: pArgs.Replica},
+			Value:         engine.Value{Bytes: []byte("new")},
+			ExpValue:      engine.Value{Bytes: []byte("value"), Timestamp: expTS},
+		}
+		err := rng.ReadWriteCmd(ConditionalPut, args, &ConditionalPutResponse{})
+		if expSuccess := i == 1; (err == nil) != expSuccess {
+			t.Errorf("%d: expected success %t; got %v", i, expSuccess, err)
+		}
+	}
+}
+
+// TestRangeConditionalDelete verifies that a delete with an expected
+// value removes the key only if its value matches.
+func TestRangeConditionalDelete(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", 0)
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		key, expValue string
+		expActual     string // "" if no actual value is expected
+		expSuccess    bool
+	}{
+		{"a", "wrong", "value", false},
+		{"b", "value", "", false},
+		{"a", "value", "", true},
+		{"a", "", "", true},
+	}
+	for i, test := range testCases {
+		args := &DeleteRequest{
+			RequestHeader: RequestHeader{Key: engine.Key(test.key), Replica: pArgs.Replica},
+		}
+		if test.expValue != "" {
+			args.ExpValue.Bytes = []byte(test.expValue)
+		}
+		err := rng.ReadWriteCmd(Delete, args, &DeleteResponse{})
+		if test.expSuccess {
+			if err != nil {
+				t.Errorf("%d: unexpected error %v", i, err)
+			}
+			continue
+		}
+		cfErr, ok := err.(*ConditionFailedError)
+		if !ok {
+			t.Errorf("%d: expected condition failed error; got %v", i, err)
+			continue
+		}
+		if test.expActual == "" {
+			if cfErr.ActualValue != nil {
+				t.Errorf("%d: expected no actual value; got %+v", i, cfErr.ActualValue)
+			}
+		} else if cfErr.ActualValue == nil || string(cfErr.ActualValue.Bytes) != test.expActual {
+			t.Errorf("%d: expected actual value %q; got %+v", i, test.expActual, cfErr.ActualValue)
+		}
+	}
+	gArgs, gReply := getArgs("a", 0)
+	if err := rng.ReadOnlyCmd(Get, gArgs, gReply); err != nil || gReply.Value.Bytes != nil {
+		t.Errorf("expected key to be deleted; got %q, %v", gReply.Value.Bytes, err)
+	}
+}
+
+// TestRangeValueTypes verifies that counters can't be read or
+// overwritten by Get and Put, that byte string values can't be
+// incremented, and that scanned values report their type.
+func TestRangeValueTypes(t *testing.T) {
+	store, rng, _, _ := createTestRangeWithClock(t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", 0)
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	iArgs, iReply := incrementArgs("b", 1, 0)
+	if err := rng.ReadWriteCmd(Increment, iArgs, iReply); err != nil {
+		t.Fatal(err)
+	}
+
+	expTypeErr := func(err error, expected, actual engine.ValueTag) {
+		if typeErr, ok := err.(*engine.ValueTypeError); !ok || typeErr.Expected != expected || typeErr.Actual != actual {
+			t.Errorf("expected %s value where %s was expected; got %v", actual, expected, err)
+		}
+	}
+	iArgs, iReply = incrementArgs("a", 1, 0)
+	expTypeErr(rng.ReadWriteCmd(Increment, iArgs, iReply), engine.TagInteger, engine.TagBytes)
+	gArgs, gReply := getArgs("b", 0)
+	expTypeErr(rng.ReadOnlyCmd(Get, gArgs, gReply), engine.TagBytes, engine.TagInteger)
+	pArgs, pReply = putArgs("b", "value", 0)
+	expTypeErr(rng.ReadWriteCmd(Put, pArgs, pReply), engine.TagBytes, engine.TagInteger)
+
+	// Only byte string values may be put.
+	pArgs, pReply = putArgs("c", "value", 0)
+	pArgs.Value.Tag = engine.TagInteger
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err == nil {
+		t.Error("expected put of integer value to fail")
+	}
+
+	sArgs := &ScanRequest{RequestHeader: RequestHeader{Key: engine.Key("a"), EndKey: engine.Key("c")}}
+	sReply := &ScanResponse{}
+	if err := rng.ReadOnlyCmd(Scan, sArgs, sReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(sReply.Rows) != 2 || sReply.Rows[0].Tag != engine.TagBytes || sReply.Rows[1].Tag != engine.TagInteger {
+		t.Errorf("expected scan of bytes and integer values; got %+v", sReply.Rows)
+	}
+}
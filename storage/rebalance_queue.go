@@ -0,0 +1,143 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// rebalanceQueueInterval is the interval at which the store's ranges
+// are scanned for replicas to rebalance.
+const rebalanceQueueInterval = 1 * time.Minute
+
+// A rebalanceQueue periodically scans the ranges of a store and moves
+// replicas away from the store if it's amongst the most utilized
+// stores in the cluster. Each move adds a rebalance target to the
+// range, waits for the target to catch up and then removes the local
+// replica. Only ranges for which the local replica holds the leader
+// lease are rebalanced, and only one replica change per range is in
+// flight at a time.
+type rebalanceQueue struct {
+	store    *Store
+	changer  ReplicaChanger
+	opts     util.RetryOptions
+	interval time.Duration
+	closer   chan struct{}
+}
+
+// newRebalanceQueue returns a rebalance queue for the ranges of store,
+// which carries out replica changes via changer.
+func newRebalanceQueue(store *Store, changer ReplicaChanger) *rebalanceQueue {
+	return &rebalanceQueue{
+		store:    store,
+		changer:  changer,
+		opts:     defaultCatchUpRetryOptions,
+		interval: rebalanceQueueInterval,
+		closer:   make(chan struct{}),
+	}
+}
+
+// start launches a goroutine which periodically scans the store's
+// ranges until stop is invoked.
+func (rq *rebalanceQueue) start() {
+	go func() {
+		ticker := time.NewTicker(rq.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rq.scan()
+			case <-rq.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops scanning. Rebalances already in flight run to completion.
+func (rq *rebalanceQueue) stop() {
+	close(rq.closer)
+}
+
+// scan starts a rebalance of each range for which the local replica
+// holds the leader lease.
+func (rq *rebalanceQueue) scan() {
+	for _, rng := range rq.store.GetRanges() {
+		if !rng.HasLeaderLease() {
+			continue
+		}
+		go func(rng *Range) {
+			if err := rq.maybeRebalance(rng); err != nil {
+				log.Warningf("range %d: unable to rebalance: %v", rng.Meta.RangeID, err)
+			}
+		}(rng)
+	}
+}
+
+// maybeRebalance rebalances the local replica of rng if the allocator
+// finds a target for it. A replica change left in flight, for example
+// by a previous leader, is completed instead. Returns immediately if
+// another change of rng is in flight.
+func (rq *rebalanceQueue) maybeRebalance(rng *Range) error {
+	if !rng.beginReplicaChange() {
+		return nil
+	}
+	defer rng.endReplicaChange()
+
+	if !replicaChangeInFlight(rng.Descriptor().Replicas) {
+		started, err := rq.startRebalance(rng)
+		if err != nil || !started {
+			return err
+		}
+	}
+	return completeReplicaChange(rng, rq.changer, rq.opts)
+}
+
+// startRebalance adds a rebalance target to rng and marks the local
+// replica for deletion. Returns false if no target was found.
+func (rq *rebalanceQueue) startRebalance(rng *Range) (bool, error) {
+	desc := rng.Descriptor()
+	source := rng.localReplica()
+	isMember := false
+	for _, replica := range desc.Replicas {
+		if sameReplica(replica, source) {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		return false, nil
+	}
+	store, err := rq.store.allocator.rebalanceTarget(source, desc.Replicas)
+	if err != nil || store == nil {
+		return false, err
+	}
+	target := Replica{
+		NodeID:  store.Node.NodeID,
+		StoreID: store.StoreID,
+		RangeID: rng.Meta.RangeID,
+		Attrs:   store.CombinedAttrs(),
+	}
+	log.Infof("range %d: rebalancing replica from store %d:%d to %d:%d", rng.Meta.RangeID,
+		source.NodeID, source.StoreID, target.NodeID, target.StoreID)
+	if err := startReplicaChange(rng, rq.changer, target, source); err != nil {
+		return false, err
+	}
+	return true, nil
+}
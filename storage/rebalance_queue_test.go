@@ -0,0 +1,230 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// testReplicaChanger records the replicas added and the descriptors
+// written. Replicas are created on those of stores which hold the
+// target store IDs. Targets are reported as caught up according to
+// caughtUp if set, or otherwise once their store's replica has
+// applied the raft log far enough.
+type testReplicaChanger struct {
+	sync.Mutex
+	stores   map[int32]*Store
+	added    []Replica
+	descs    []RangeDescriptor
+	caughtUp func(replica Replica) bool
+}
+
+func (tc *testReplicaChanger) AddReplica(replica Replica, snap *RangeSnapshot) error {
+	tc.Lock()
+	tc.added = append(tc.added, replica)
+	store := tc.stores[replica.StoreID]
+	tc.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.AddReplica(snap)
+}
+
+func (tc *testReplicaChanger) IsCaughtUp(replica Replica, appliedIndex int) (bool, error) {
+	if tc.caughtUp != nil {
+		return tc.caughtUp(replica), nil
+	}
+	tc.Lock()
+	store := tc.stores[replica.StoreID]
+	tc.Unlock()
+	if store == nil {
+		return false, util.Errorf("store %d not found", replica.StoreID)
+	}
+	rng, err := store.GetRange(replica.RangeID)
+	if err != nil {
+		return false, nil
+	}
+	return rng.AppliedIndex() >= appliedIndex, nil
+}
+
+func (tc *testReplicaChanger) UpdateRangeDescriptor(desc RangeDescriptor) error {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.descs = append(tc.descs, desc)
+	return nil
+}
+
+func (tc *testReplicaChanger) addedCount() int {
+	tc.Lock()
+	defer tc.Unlock()
+	return len(tc.added)
+}
+
+// createTestStores creates a store for each of storeIDs, on the node
+// of the same ID, sharing the raft transport of store. Returns a map
+// of the stores, including store, by store ID.
+func createTestStores(t *testing.T, store *Store, storeIDs ...int32) map[int32]*Store {
+	stores := map[int32]*Store{store.Ident.StoreID: store}
+	for _, storeID := range storeIDs {
+		s := NewStore(store.clock, engine.NewInMem(engine.Attributes{}, 1<<20), nil, store.transport)
+		if err := s.Bootstrap(StoreIdent{ClusterID: store.Ident.ClusterID, NodeID: storeID, StoreID: storeID}); err != nil {
+			t.Fatal(err)
+		}
+		stores[storeID] = s
+	}
+	return stores
+}
+
+// closeTestStores closes the stores created by createTestStores.
+func closeTestStores(stores map[int32]*Store) {
+	for _, s := range stores {
+		s.Close()
+	}
+}
+
+// createTestRebalanceQueue creates a test range on a store which is
+// the most utilized of two, and a rebalance queue for the store which
+// uses changer. Replicas are added to the second store via changer.
+func createTestRebalanceQueue(t *testing.T, changer *testReplicaChanger) (*Store, *Range, *rebalanceQueue) {
+	store, rng, _ := createTestRange(createTestEngine(t), t)
+	changer.stores = createTestStores(t, store, 2)
+	store.allocator.storeFinder = func(engine.Attributes) ([]*StoreDescriptor, error) {
+		return []*StoreDescriptor{
+			{StoreID: 1, Node: NodeDescriptor{NodeID: 1}, Capacity: engine.StoreCapacity{Capacity: 100, Available: 10}},
+			{StoreID: 2, Node: NodeDescriptor{NodeID: 2}, Capacity: engine.StoreCapacity{Capacity: 100, Available: 90}},
+		}, nil
+	}
+	rq := newRebalanceQueue(store, changer)
+	rq.opts = util.RetryOptions{Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Constant: 1, MaxAttempts: 3}
+	return store, rng, rq
+}
+
+// TestRebalanceQueue verifies that a replica is moved from the most
+// utilized store to the least once the target has caught up, and that
+// the moved replica takes over the range's raft group.
+func TestRebalanceQueue(t *testing.T) {
+	changer := &testReplicaChanger{}
+	store, rng, rq := createTestRebalanceQueue(t, changer)
+	defer closeTestStores(changer.stores)
+	pArgs, pReply := putArgs("a", "value", rng.Meta.RangeID)
+	if err := store.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rq.maybeRebalance(rng); err != nil {
+		t.Fatal(err)
+	}
+	if len(changer.added) != 1 || changer.added[0].StoreID != 2 || changer.added[0].State != REBALANCING {
+		t.Errorf("expected rebalancing replica added on store 2; got %+v", changer.added)
+	}
+	// The addressing record is updated on adding the target and again
+	// on removing the source.
+	if len(changer.descs) != 2 || len(changer.descs[0].Replicas) != 2 {
+		t.Fatalf("expected two addressing record updates; got %+v", changer.descs)
+	}
+	if states := []ReplicaState{changer.descs[0].Replicas[0].State, changer.descs[0].Replicas[1].State}; states[0] != PENDING_DELETION || states[1] != REBALANCING {
+		t.Errorf("expected source pending deletion and target rebalancing; got %v", states)
+	}
+	replicas := rng.Descriptor().Replicas
+	if len(replicas) != 1 || replicas[0].StoreID != 2 || replicas[0].State != OK {
+		t.Errorf("expected only an OK replica on store 2; got %+v", replicas)
+	}
+	// The change must also be persisted to the range's local metadata.
+	var meta RangeMetadata
+	if _, err := engine.GetI(rng.engine, makeRangeKey(rng.Meta.RangeID), &meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Replicas) != 1 || meta.Replicas[0].StoreID != 2 {
+		t.Errorf("expected persisted replica on store 2; got %+v", meta.Replicas)
+	}
+
+	// The replica on store 2 holds the range's data and, as the only
+	// member of the range's raft group, is elected leader.
+	newRng, err := changer.stores[2].GetRange(rng.Meta.RangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.IsTrueWithin(newRng.IsLeader, 2*raftLeaderWait); err != nil {
+		t.Fatalf("expected replica on store 2 to be elected leader: %v", err)
+	}
+	if replicas := newRng.Descriptor().Replicas; len(replicas) != 1 || replicas[0].StoreID != 2 {
+		t.Errorf("expected store 2 to see only its own replica; got %+v", replicas)
+	}
+	gArgs, gReply := getArgs("a", rng.Meta.RangeID)
+	if newRng.Get(gArgs, gReply); gReply.Error != nil || string(gReply.Value.Bytes) != "value" {
+		t.Errorf("expected replica on store 2 to hold %q; got %+v", "value", gReply)
+	}
+}
+
+// TestRebalanceQueueAbandon verifies that a rebalance is abandoned if
+// the target doesn't catch up.
+func TestRebalanceQueueAbandon(t *testing.T) {
+	changer := &testReplicaChanger{caughtUp: func(Replica) bool { return false }}
+	_, rng, rq := createTestRebalanceQueue(t, changer)
+	defer closeTestStores(changer.stores)
+
+	if err := rq.maybeRebalance(rng); err == nil {
+		t.Error("expected rebalance to fail")
+	}
+	replicas := rng.Descriptor().Replicas
+	if len(replicas) != 1 || replicas[0].StoreID != 1 || replicas[0].State != OK {
+		t.Errorf("expected only an OK replica on store 1; got %+v", replicas)
+	}
+}
+
+// TestRebalanceQueueOneChangeInFlight verifies that only one replica
+// change per range may be in flight.
+func TestRebalanceQueueOneChangeInFlight(t *testing.T) {
+	release := make(chan struct{})
+	changer := &testReplicaChanger{caughtUp: func(Replica) bool {
+		<-release
+		return true
+	}}
+	_, rng, rq := createTestRebalanceQueue(t, changer)
+	defer closeTestStores(changer.stores)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- rq.maybeRebalance(rng)
+	}()
+	if err := util.IsTrueWithin(func() bool { return changer.addedCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// A second rebalance of the range is skipped.
+	if err := rq.maybeRebalance(rng); err != nil {
+		t.Fatal(err)
+	}
+	if count := changer.addedCount(); count != 1 {
+		t.Errorf("expected one replica added; got %d", count)
+	}
+	// Neither may another change begin via raft.
+	replicas := append(rng.Descriptor().Replicas, Replica{NodeID: 3, StoreID: 3, State: REBALANCING})
+	if err := rng.changeReplicas(replicas); err == nil {
+		t.Error("expected replica change to be rejected while another is in flight")
+	}
+	close(release)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if replicas := rng.Descriptor().Replicas; len(replicas) != 1 || replicas[0].StoreID != 2 {
+		t.Errorf("expected only a replica on store 2; got %+v", replicas)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// defaultCatchUpRetryOptions specifies how long to wait for a new
+// replica to catch up with the range leader. If the replica hasn't
+// caught up after the maximum attempts, the change which added it is
+// abandoned.
+var defaultCatchUpRetryOptions = util.RetryOptions{
+	Tag:         "waiting for new replica to catch up",
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  5 * time.Second,
+	Constant:    2,
+	MaxAttempts: 20,
+}
+
+// A ReplicaChanger carries out the parts of a replica change which
+// involve other stores or the cluster's range addressing records.
+type ReplicaChanger interface {
+	// AddReplica creates replica on its store from snap, a snapshot of
+	// the range taken from the leader's replica; see Store.AddReplica.
+	// The new replica catches up with the range leader asynchronously.
+	AddReplica(replica Replica, snap *RangeSnapshot) error
+	// IsCaughtUp returns whether replica has applied the range's raft
+	// log up to and including appliedIndex.
+	IsCaughtUp(replica Replica, appliedIndex int) (bool, error)
+	// UpdateRangeDescriptor rewrites the addressing records of the
+	// range described by desc.
+	UpdateRangeDescriptor(desc RangeDescriptor) error
+}
+
+// A RangeSnapshot holds the state of a range replica from which a new
+// replica is created: the range's metadata, its data, response cache,
+// update queue and leader lease, and the index of the last raft log entry applied
+// to them.
+type RangeSnapshot struct {
+	Meta         RangeMetadata
+	AppliedIndex int
+	Data         []engine.RawKeyValue
+}
+
+// Snapshot returns a snapshot of the range's state, consistent with
+// the index of the last raft log entry applied.
+func (r *Range) Snapshot() (*RangeSnapshot, error) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.RLock()
+	snap := &RangeSnapshot{Meta: r.Meta, AppliedIndex: r.appliedIndex}
+	snap.Meta.Replicas = append([]Replica(nil), r.Meta.Replicas...)
+	r.RUnlock()
+
+	start := snap.Meta.StartKey
+	// Local keys sort before all others, so the first range's data
+	// begins at the end of the local keys.
+	if start.Less(engine.KeyLocalMax) {
+		start = engine.KeyLocalMax
+	}
+	respCachePrefix := r.respCache.makePrefix()
+	updateQueuePrefix := makeUpdateQueuePrefix(snap.Meta.RangeID)
+	leaseKey := makeLeaseKey(snap.Meta.RangeID)
+	for _, span := range [][2]engine.Key{
+		{start, snap.Meta.EndKey},
+		{respCachePrefix, engine.PrefixEndKey(respCachePrefix)},
+		{updateQueuePrefix, engine.PrefixEndKey(updateQueuePrefix)},
+		{leaseKey, engine.NextKey(leaseKey)},
+	} {
+		kvs, err := r.engine.Scan(span[0], span[1], 0)
+		if err != nil {
+			return nil, util.Errorf("range %d: unable to snapshot: %v", snap.Meta.RangeID, err)
+		}
+		snap.Data = append(snap.Data, kvs...)
+	}
+	return snap, nil
+}
+
+// AppliedIndex returns the index of the last raft log entry applied
+// to the range.
+func (r *Range) AppliedIndex() int {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	return r.appliedIndex
+}
+
+// beginReplicaChange returns true if no other replica change of the
+// range is being carried out by this replica. On success, the caller
+// must invoke endReplicaChange once done.
+func (r *Range) beginReplicaChange() bool {
+	return atomic.CompareAndSwapInt32(&r.changingReplicas, 0, 1)
+}
+
+// endReplicaChange ends a replica change begun with
+// beginReplicaChange.
+func (r *Range) endReplicaChange() {
+	atomic.StoreInt32(&r.changingReplicas, 0)
+}
+
+// changeReplicas replaces the range's replicas via raft. Only the
+// range leader may change replicas.
+func (r *Range) changeReplicas(replicas []Replica) error {
+	args := &InternalChangeReplicasRequest{
+		RequestHeader: RequestHeader{
+			Key:       r.Meta.StartKey,
+			Timestamp: r.clock.Now(),
+			User:      UserRoot,
+			Replica:   r.localReplica(),
+		},
+		Replicas: replicas,
+	}
+	cmd := &Cmd{
+		Method: InternalChangeReplicas,
+		Args:   args,
+		Reply:  &InternalChangeReplicasResponse{},
+		done:   make(chan error, 1),
+	}
+	return r.EnqueueCmd(cmd)
+}
+
+// InternalChangeReplicas replaces the range's replicas with
+// args.Replicas, persists the change to the range's local metadata
+// and changes the membership of the range's raft group to match. As
+// the change is applied by all replicas as it commits, each makes the
+// same change at the same point in the raft log. Only one replica
+// change may be in flight: while any replica is REBALANCING or
+// PENDING_DELETION, the only changes accepted are those completing or
+// abandoning the change in flight.
+func (r *Range) InternalChangeReplicas(args *InternalChangeReplicasRequest, reply *InternalChangeReplicasResponse) {
+	r.Lock()
+	defer r.Unlock()
+	if replicas := r.Meta.Replicas; replicaChangeInFlight(replicas) &&
+		!sameReplicaStates(args.Replicas, finishedReplicas(replicas)) &&
+		!sameReplicaStates(args.Replicas, abandonedReplicas(replicas)) {
+		reply.Error = util.Errorf("range %d: replica change already in flight: %+v",
+			r.Meta.RangeID, replicas)
+		return
+	}
+	meta := r.Meta
+	meta.Replicas = args.Replicas
+	if err := engine.PutI(r.engine, makeRangeKey(meta.RangeID), meta); err != nil {
+		reply.Error = err
+		return
+	}
+	r.Meta = meta
+	// The change is committed; failing to apply it to the raft group
+	// leaves the group's membership stale until the store restarts.
+	if err := r.rm.ChangeRaftMembership(meta); err != nil {
+		log.Errorf("range %d: unable to change raft membership: %v", meta.RangeID, err)
+	}
+}
+
+// startReplicaChange adds target to the replicas of rng in state
+// REBALANCING, marking the replicas it replaces, if any, as
+// PENDING_DELETION, and creates the target via changer.
+func startReplicaChange(rng *Range, changer ReplicaChanger, target Replica, sources ...Replica) error {
+	var replicas []Replica
+	for _, replica := range rng.Descriptor().Replicas {
+		for _, source := range sources {
+			if sameReplica(replica, source) {
+				replica.State = PENDING_DELETION
+			}
+		}
+		replicas = append(replicas, replica)
+	}
+	target.State = REBALANCING
+	replicas = append(replicas, target)
+	if err := changeReplicas(rng, changer, replicas); err != nil {
+		return err
+	}
+	snap, err := rng.Snapshot()
+	if err != nil {
+		return abandonReplicaChange(rng, changer, err)
+	}
+	if err := changer.AddReplica(target, snap); err != nil {
+		return abandonReplicaChange(rng, changer, err)
+	}
+	return nil
+}
+
+// completeReplicaChange waits for the REBALANCING replicas of rng to
+// catch up, having applied the raft log as far as the local replica
+// had on starting to wait, and then removes the replicas
+// PENDING_DELETION. If the new replicas don't catch up, the change is
+// abandoned.
+func completeReplicaChange(rng *Range, changer ReplicaChanger, opts util.RetryOptions) error {
+	desc := rng.Descriptor()
+	appliedIndex := rng.AppliedIndex()
+	err := util.RetryWithBackoff(opts, func() (bool, error) {
+		for _, replica := range desc.Replicas {
+			if replica.State != REBALANCING {
+				continue
+			}
+			if caughtUp, err := changer.IsCaughtUp(replica, appliedIndex); !caughtUp || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return abandonReplicaChange(rng, changer, err)
+	}
+	return changeReplicas(rng, changer, finishedReplicas(desc.Replicas))
+}
+
+// abandonReplicaChange removes the REBALANCING replicas of rng and
+// restores those PENDING_DELETION. Returns the error which caused the
+// change to be abandoned.
+func abandonReplicaChange(rng *Range, changer ReplicaChanger, cause error) error {
+	if err := changeReplicas(rng, changer, abandonedReplicas(rng.Descriptor().Replicas)); err != nil {
+		log.Errorf("range %d: unable to abandon replica change: %v", rng.Meta.RangeID, err)
+	}
+	return cause
+}
+
+// changeReplicas replaces the replicas of rng and rewrites the range's
+// addressing records to match.
+func changeReplicas(rng *Range, changer ReplicaChanger, replicas []Replica) error {
+	if err := rng.changeReplicas(replicas); err != nil {
+		return err
+	}
+	return changer.UpdateRangeDescriptor(rng.Descriptor())
+}
+
+// replicaChangeInFlight returns true if any of replicas is
+// REBALANCING or PENDING_DELETION.
+func replicaChangeInFlight(replicas []Replica) bool {
+	for _, replica := range replicas {
+		if replica.State != OK {
+			return true
+		}
+	}
+	return false
+}
+
+// finishedReplicas returns replicas with REBALANCING replicas moved
+// into state OK and PENDING_DELETION replicas removed.
+func finishedReplicas(replicas []Replica) []Replica {
+	var finished []Replica
+	for _, replica := range replicas {
+		if replica.State == PENDING_DELETION {
+			continue
+		}
+		replica.State = OK
+		finished = append(finished, replica)
+	}
+	return finished
+}
+
+// abandonedReplicas returns replicas with REBALANCING replicas removed
+// and PENDING_DELETION replicas restored to state OK.
+func abandonedReplicas(replicas []Replica) []Replica {
+	var abandoned []Replica
+	for _, replica := range replicas {
+		if replica.State == REBALANCING {
+			continue
+		}
+		replica.State = OK
+		abandoned = append(abandoned, replica)
+	}
+	return abandoned
+}
+
+// sameReplicaStates returns true if a and b list the same replicas,
+// in the same order and states.
+func sameReplicaStates(a, b []Replica) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameReplica(a[i], b[i]) || a[i].State != b[i].State {
+			return false
+		}
+	}
+	return true
+}
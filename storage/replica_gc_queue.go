@@ -0,0 +1,118 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// replicaGCQueueInterval is the interval at which the store's ranges
+// are checked against their addressing records.
+const replicaGCQueueInterval = 10 * time.Minute
+
+// A replicaGCQueue periodically checks each range of a store against
+// the range's authoritative addressing record. Replicas which have
+// been removed from their range, for example by rebalancing, are
+// destroyed: the range is removed from the store and its data,
+// response cache and local metadata are cleared.
+type replicaGCQueue struct {
+	store    *Store
+	exec     UpdateExecutor
+	interval time.Duration
+	closer   chan struct{}
+}
+
+// newReplicaGCQueue returns a replica GC queue for the ranges of
+// store, which reads addressing records via exec.
+func newReplicaGCQueue(store *Store, exec UpdateExecutor) *replicaGCQueue {
+	return &replicaGCQueue{
+		store:    store,
+		exec:     exec,
+		interval: replicaGCQueueInterval,
+		closer:   make(chan struct{}),
+	}
+}
+
+// start launches a goroutine which periodically scans the store's
+// ranges until stop is invoked.
+func (gcq *replicaGCQueue) start() {
+	go func() {
+		ticker := time.NewTicker(gcq.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				gcq.scan()
+			case <-gcq.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops scanning.
+func (gcq *replicaGCQueue) stop() {
+	close(gcq.closer)
+}
+
+// scan checks each of the store's ranges, destroying those of which
+// the store is no longer a replica.
+func (gcq *replicaGCQueue) scan() {
+	for _, rng := range gcq.store.GetRanges() {
+		if err := gcq.process(rng); err != nil {
+			log.Warningf("range %d: unable to garbage collect replica: %v", rng.Meta.RangeID, err)
+		}
+	}
+}
+
+// process looks up the addressing record of rng and destroys the
+// local replica if the store isn't listed amongst the range's
+// replicas. If no addressing record is found, the replica is kept.
+func (gcq *replicaGCQueue) process(rng *Range) error {
+	desc := rng.Descriptor()
+	args := &GetRequest{
+		RequestHeader: RequestHeader{
+			Key:  desc.LookupKey(),
+			User: UserRoot,
+		},
+	}
+	reply := &GetResponse{}
+	if err := gcq.exec(Get, args, reply); err != nil {
+		return err
+	}
+	if len(reply.Value.Bytes) == 0 {
+		return nil
+	}
+	var current RangeDescriptor
+	if err := gob.NewDecoder(bytes.NewBuffer(reply.Value.Bytes)).Decode(&current); err != nil {
+		return err
+	}
+	local := rng.localReplica()
+	for _, replica := range current.Replicas {
+		if sameReplica(replica, local) {
+			return nil
+		}
+	}
+	log.Infof("range %d: replica on store %d:%d removed; destroying", rng.Meta.RangeID, local.NodeID, local.StoreID)
+	if err := gcq.store.RemoveRange(rng); err != nil {
+		return err
+	}
+	return rng.Destroy()
+}
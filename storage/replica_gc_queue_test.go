@@ -0,0 +1,80 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/storage/engine"
+)
+
+// TestReplicaGCQueue verifies that a replica is kept while listed in
+// its range's addressing record and destroyed once it's not.
+func TestReplicaGCQueue(t *testing.T) {
+	store, rng, _ := createTestRange(createTestEngine(t), t)
+	defer store.Close()
+
+	pArgs, pReply := putArgs("a", "value", rng.Meta.RangeID)
+	pArgs.Timestamp = store.clock.Now()
+	pArgs.CmdID = ClientCmdID{WallTime: 1, Random: 1}
+	if err := rng.ReadWriteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+
+	// The addressing record read by the queue lists desc's replicas.
+	desc := rng.Descriptor()
+	gcq := newReplicaGCQueue(store, func(method string, args Request, reply Response) error {
+		if method != Get || !bytes.Equal(args.Header().Key, desc.LookupKey()) {
+			t.Fatalf("unexpected lookup %s %q", method, args.Header().Key)
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(desc); err != nil {
+			t.Fatal(err)
+		}
+		reply.(*GetResponse).Value = engine.Value{Bytes: buf.Bytes()}
+		return nil
+	})
+
+	gcq.scan()
+	if _, err := store.GetRange(rng.Meta.RangeID); err != nil {
+		t.Fatalf("expected listed replica to be kept: %v", err)
+	}
+
+	desc.Replicas = []Replica{{NodeID: 2, StoreID: 2, RangeID: rng.Meta.RangeID}}
+	gcq.scan()
+	if _, err := store.GetRange(rng.Meta.RangeID); err == nil {
+		t.Fatal("expected removed replica to be destroyed")
+	}
+	if err := store.multiraft.RemoveGroup(multiraft.GroupID(rng.Meta.RangeID)); err == nil {
+		t.Error("expected removed replica to have left its raft group")
+	}
+	for _, prefix := range []engine.Key{engine.Key("a"), makeRangeKey(rng.Meta.RangeID), rng.respCache.makePrefix()} {
+		kvs, err := store.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kvs) != 0 {
+			t.Errorf("expected keys with prefix %q to be cleared; got %d", prefix, len(kvs))
+		}
+	}
+	// The store's own local keys must survive.
+	if ok, err := engine.GetI(store.engine, engine.KeyLocalRangeIDGenerator, nil); !ok || err != nil {
+		t.Errorf("expected range ID generator to remain: %t, %v", ok, err)
+	}
+}
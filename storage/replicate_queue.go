@@ -0,0 +1,256 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/log"
+)
+
+// replicateQueueInterval is the interval at which all of the store's
+// ranges are queued to be checked against their zone configs. Ranges
+// are also queued each time the zone configs change.
+const replicateQueueInterval = 10 * time.Minute
+
+// A replicateQueue brings the replicas of a store's ranges in line
+// with the replicas required by their zone configs. For each range
+// for which the local replica holds the leader lease, missing
+// replicas are added via the allocator and excess replicas, including
+// those not matching any of the zone's required attributes, are
+// removed. Ranges are queued periodically and whenever the zone
+// configs are gossiped.
+type replicateQueue struct {
+	store    *Store
+	changer  ReplicaChanger
+	opts     util.RetryOptions
+	interval time.Duration
+	closer   chan struct{}
+	ready    chan struct{} // Signaled when ranges are queued
+
+	mu     sync.Mutex
+	queued map[int64]struct{} // IDs of ranges awaiting a check
+}
+
+// newReplicateQueue returns a replicate queue for the ranges of store,
+// which carries out replica changes via changer.
+func newReplicateQueue(store *Store, changer ReplicaChanger) *replicateQueue {
+	return &replicateQueue{
+		store:    store,
+		changer:  changer,
+		opts:     defaultCatchUpRetryOptions,
+		interval: replicateQueueInterval,
+		closer:   make(chan struct{}),
+		ready:    make(chan struct{}, 1),
+		queued:   map[int64]struct{}{},
+	}
+}
+
+// start queues all of the store's ranges, re-queueing them whenever
+// the zone configs are gossiped, and launches a goroutine which
+// processes queued ranges until stop is invoked.
+func (rq *replicateQueue) start() {
+	if rq.store.gossip != nil {
+		rq.store.gossip.RegisterCallback(gossip.KeyConfigZone, func(string) { rq.addAll() })
+	}
+	go func() {
+		rq.addAll()
+		ticker := time.NewTicker(rq.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rq.addAll()
+			case <-rq.ready:
+				rq.processQueued()
+			case <-rq.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops processing queued ranges.
+func (rq *replicateQueue) stop() {
+	close(rq.closer)
+}
+
+// addAll queues all of the store's ranges.
+func (rq *replicateQueue) addAll() {
+	rq.mu.Lock()
+	for _, rng := range rq.store.GetRanges() {
+		rq.queued[rng.Meta.RangeID] = struct{}{}
+	}
+	rq.mu.Unlock()
+	select {
+	case rq.ready <- struct{}{}:
+	default:
+	}
+}
+
+// processQueued checks each queued range for which the local replica
+// holds the leader lease.
+func (rq *replicateQueue) processQueued() {
+	rq.mu.Lock()
+	queued := rq.queued
+	rq.queued = map[int64]struct{}{}
+	rq.mu.Unlock()
+	for rangeID := range queued {
+		rng, err := rq.store.GetRange(rangeID)
+		if err != nil || !rng.HasLeaderLease() {
+			continue
+		}
+		if err := rq.replicate(rng); err != nil {
+			log.Warningf("range %d: unable to replicate: %v", rangeID, err)
+		}
+	}
+}
+
+// replicate adds missing replicas to rng and removes excess replicas,
+// one at a time, until the replicas match those required by the
+// range's zone config. A replica change left in flight is completed
+// first. Returns immediately if another change of rng is in flight.
+func (rq *replicateQueue) replicate(rng *Range) error {
+	if !rng.beginReplicaChange() {
+		return nil
+	}
+	defer rng.endReplicaChange()
+
+	if replicaChangeInFlight(rng.Descriptor().Replicas) {
+		if err := completeReplicaChange(rng, rq.changer, rq.opts); err != nil {
+			return err
+		}
+	}
+	zone, err := rq.lookupZoneConfig(rng)
+	if err != nil {
+		return err
+	}
+	// Each iteration adds or removes a replica; bound the iterations
+	// in case changes don't converge.
+	for i := len(zone.Replicas) + len(rng.Descriptor().Replicas); i >= 0; i-- {
+		desc := rng.Descriptor()
+		missing, excess := compareReplicas(zone.Replicas, desc.Replicas)
+		switch {
+		case len(missing) > 0:
+			store, err := rq.store.allocator.allocate(missing[0], desc.Replicas)
+			if err != nil {
+				return err
+			}
+			target := Replica{
+				NodeID:  store.Node.NodeID,
+				StoreID: store.StoreID,
+				RangeID: rng.Meta.RangeID,
+				Attrs:   store.CombinedAttrs(),
+			}
+			log.Infof("range %d: adding replica on store %d:%d", rng.Meta.RangeID, target.NodeID, target.StoreID)
+			if err := startReplicaChange(rng, rq.changer, target); err != nil {
+				return err
+			}
+			if err := completeReplicaChange(rng, rq.changer, rq.opts); err != nil {
+				return err
+			}
+		case len(excess) > 0:
+			// Remove the local replica last, as it's the leader.
+			remove := excess[0]
+			for _, replica := range excess {
+				if !sameReplica(replica, rng.localReplica()) {
+					remove = replica
+					break
+				}
+			}
+			var replicas []Replica
+			for _, replica := range desc.Replicas {
+				if !sameReplica(replica, remove) {
+					replicas = append(replicas, replica)
+				}
+			}
+			log.Infof("range %d: removing replica on store %d:%d", rng.Meta.RangeID, remove.NodeID, remove.StoreID)
+			if err := changeReplicas(rng, rq.changer, replicas); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return util.Errorf("range %d: replicas %+v didn't converge on zone config %+v",
+		rng.Meta.RangeID, rng.Descriptor().Replicas, zone)
+}
+
+// lookupZoneConfig returns the zone config for rng from the gossiped
+// zone config map. The zone is that of the range's start key.
+//
+// TODO(spencer): ranges must be split at zone boundaries.
+func (rq *replicateQueue) lookupZoneConfig(rng *Range) (*ZoneConfig, error) {
+	if rq.store.gossip == nil {
+		return nil, util.Error("no gossip network from which to look up zone configs")
+	}
+	info, err := rq.store.gossip.GetInfo(gossip.KeyConfigZone)
+	if err != nil {
+		return nil, err
+	}
+	configMap, ok := info.(PrefixConfigMap)
+	if !ok {
+		return nil, util.Errorf("gossiped zone config map has unexpected type %T", info)
+	}
+	zone, ok := configMap.MatchByPrefix(rng.Meta.StartKey).Config.(*ZoneConfig)
+	if !ok {
+		return nil, util.Errorf("zone config for range %d has unexpected type", rng.Meta.RangeID)
+	}
+	return zone, nil
+}
+
+// compareReplicas matches replicas against the attributes required by
+// a zone config. Returns the required attributes for which no replica
+// was found and the replicas which matched no required attributes.
+// Required attributes are matched most specific first, so that a
+// replica satisfying several is kept for the most demanding.
+func compareReplicas(required []engine.Attributes, replicas []Replica) ([]engine.Attributes, []Replica) {
+	sorted := append([]engine.Attributes(nil), required...)
+	sort.Stable(bySpecificity(sorted))
+	matched := make([]bool, len(replicas))
+	var missing []engine.Attributes
+	for _, attrs := range sorted {
+		found := false
+		for i, replica := range replicas {
+			if !matched[i] && attrs.IsSubset(replica.Attrs) {
+				matched[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, attrs)
+		}
+	}
+	var excess []Replica
+	for i, replica := range replicas {
+		if !matched[i] {
+			excess = append(excess, replica)
+		}
+	}
+	return missing, excess
+}
+
+// bySpecificity sorts attribute lists from longest to shortest.
+type bySpecificity []engine.Attributes
+
+func (b bySpecificity) Len() int           { return len(b) }
+func (b bySpecificity) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySpecificity) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
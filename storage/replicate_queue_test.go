@@ -0,0 +1,152 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// gossipZoneConfig gossips a zone config map with zone as the default.
+func gossipZoneConfig(t *testing.T, g *gossip.Gossip, zone ZoneConfig) {
+	configMap, err := NewPrefixConfigMap([]*PrefixConfig{{Prefix: engine.KeyMin, Config: &zone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AddInfo(gossip.KeyConfigZone, configMap, 0*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestReplicateQueue creates a test range, whose replica is on a
+// store with attributes "dc1" & "mem", and a replicate queue for its
+// store. Stores in "dc2" and "dc3" on nodes 2 & 3 are available for
+// new replicas, which are created there via the returned changer. The
+// range's zone config is gossiped as zone.
+func createTestReplicateQueue(t *testing.T, zone ZoneConfig) (*Store, *Range, *replicateQueue, *testReplicaChanger) {
+	store, rng, g := createTestRange(createTestEngine(t), t)
+	store.allocator.storeFinder = func(a engine.Attributes) ([]*StoreDescriptor, error) {
+		var stores []*StoreDescriptor
+		for i, dc := range []string{"dc1", "dc2", "dc3"} {
+			stores = append(stores, &StoreDescriptor{
+				StoreID:  int32(i + 1),
+				Attrs:    engine.Attributes([]string{"mem"}),
+				Node:     NodeDescriptor{NodeID: int32(i + 1), Attrs: engine.Attributes([]string{dc})},
+				Capacity: engine.StoreCapacity{Capacity: 100, Available: 50},
+			})
+		}
+		return filterStores(a, stores)
+	}
+	gossipZoneConfig(t, g, zone)
+	changer := &testReplicaChanger{stores: createTestStores(t, store, 2, 3)}
+	rq := newReplicateQueue(store, changer)
+	rq.opts = util.RetryOptions{Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Constant: 1, MaxAttempts: 3}
+	return store, rng, rq, changer
+}
+
+// replicaStores returns the store IDs of the range's replicas.
+func replicaStores(rng *Range) []int32 {
+	var storeIDs []int32
+	for _, replica := range rng.Descriptor().Replicas {
+		storeIDs = append(storeIDs, replica.StoreID)
+	}
+	return storeIDs
+}
+
+// TestReplicateQueue verifies that replicas are added, replaced and
+// removed to match the range's zone config.
+func TestReplicateQueue(t *testing.T) {
+	dc1 := engine.Attributes([]string{"dc1", "mem"})
+	dc2 := engine.Attributes([]string{"dc2"})
+	dc3 := engine.Attributes([]string{"dc3", "mem"})
+	testCases := []struct {
+		zone      []engine.Attributes
+		expStores []int32
+	}{
+		// Add a missing replica.
+		{[]engine.Attributes{dc1, dc2}, []int32{1, 2}},
+		// Replace a mismatched replica.
+		{[]engine.Attributes{dc1, dc3}, []int32{1, 3}},
+		// Remove an excess replica.
+		{[]engine.Attributes{dc3}, []int32{3}},
+	}
+	store, rng, rq, changer := createTestReplicateQueue(t, ZoneConfig{Replicas: []engine.Attributes{dc1}})
+	defer closeTestStores(changer.stores)
+	for i, test := range testCases {
+		gossipZoneConfig(t, store.gossip, ZoneConfig{Replicas: test.zone})
+		if err := rq.replicate(rng); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		storeIDs := replicaStores(rng)
+		if len(storeIDs) != len(test.expStores) {
+			t.Errorf("%d: expected replicas on stores %v; got %v", i, test.expStores, storeIDs)
+			continue
+		}
+		for j := range storeIDs {
+			if storeIDs[j] != test.expStores[j] {
+				t.Errorf("%d: expected replicas on stores %v; got %v", i, test.expStores, storeIDs)
+				break
+			}
+		}
+		if replicaChangeInFlight(rng.Descriptor().Replicas) {
+			t.Errorf("%d: expected all replicas OK; got %+v", i, rng.Descriptor().Replicas)
+		}
+	}
+}
+
+// TestReplicateQueueZoneChange verifies that ranges are re-queued
+// when the zone config is gossiped.
+func TestReplicateQueueZoneChange(t *testing.T) {
+	zone := ZoneConfig{Replicas: []engine.Attributes{engine.Attributes([]string{"dc1"})}}
+	store, rng, rq, changer := createTestReplicateQueue(t, zone)
+	defer closeTestStores(changer.stores)
+	rq.start()
+	defer rq.stop()
+
+	zone.Replicas = append(zone.Replicas, engine.Attributes([]string{"dc2"}))
+	gossipZoneConfig(t, store.gossip, zone)
+	if err := util.IsTrueWithin(func() bool { return changer.addedCount() == 1 }, 1*time.Second); err != nil {
+		t.Fatalf("expected replica to be added on zone change: %v", err)
+	}
+	if err := util.IsTrueWithin(func() bool { return len(replicaStores(rng)) == 2 }, 1*time.Second); err != nil {
+		t.Errorf("expected two replicas; got %+v", rng.Descriptor().Replicas)
+	}
+}
+
+// TestCompareReplicas verifies matching of replicas against required
+// attributes.
+func TestCompareReplicas(t *testing.T) {
+	a := engine.Attributes([]string{"a"})
+	ab := engine.Attributes([]string{"a", "b"})
+	c := engine.Attributes([]string{"c"})
+	replicaWith := func(storeID int32, attrs engine.Attributes) Replica {
+		return Replica{NodeID: storeID, StoreID: storeID, Attrs: attrs}
+	}
+	// The replica with "a" & "b" must be kept for the more specific
+	// requirement, leaving "a" missing.
+	missing, excess := compareReplicas([]engine.Attributes{a, ab},
+		[]Replica{replicaWith(1, ab), replicaWith(2, c)})
+	if len(missing) != 1 || missing[0].SortedString() != a.SortedString() {
+		t.Errorf("expected %v missing; got %v", a, missing)
+	}
+	if len(excess) != 1 || excess[0].StoreID != 2 {
+		t.Errorf("expected replica on store 2 to be excess; got %+v", excess)
+	}
+}
@@ -18,13 +18,29 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
 )
 
+// A responseCacheEntry is the value stored in the engine for each
+// cached response. The timestamp of the command which wrote the
+// response allows entries to be garbage collected once older than the
+// window over which idempotence is guaranteed. It's carried in the
+// raft command, so every replica stores the same timestamp.
+type responseCacheEntry struct {
+	Timestamp hlc.Timestamp // Timestamp of the command whose response was cached
+	Reply     []byte        // Gob-encoded response
+}
+
 // A ResponseCache provides idempotence for request retries. Each
 // request to a range specifies a ClientCmdID in the request header
 // which uniquely identifies a client command. After commands have
@@ -33,7 +49,9 @@ import (
 //
 // The ResponseCache stores responses in the underlying engine, using
 // keys derived from KeyLocalRangeResponseCachePrefix, range ID and
-// the ClientCmdID.
+// the ClientCmdID. Each response is stored along with the timestamp
+// of the command which wrote it; entries older than the idempotence window
+// are removed by the store's response cache GC queue.
 //
 // A ResponseCache is safe for concurrent access.
 type ResponseCache struct {
@@ -41,6 +59,14 @@ type ResponseCache struct {
 	engine   engine.Engine
 	inflight map[ClientCmdID]*sync.Cond
 	sync.Mutex
+
+	entries int64      // Number of cached responses; protected by mutex
+	bytes   int64      // Size in bytes of cached responses; protected by mutex
+	sized   bool       // True once entries & bytes have been counted; protected by mutex
+	gcKey   engine.Key // Key from which GC resumes, if not done; protected by mutex
+
+	lookups int64 // Lookups of non-empty command IDs; accessed atomically
+	hits    int64 // Lookups which found a cached response; accessed atomically
 }
 
 // NewResponseCache returns a new response cache. Every range replica
@@ -95,7 +121,14 @@ func (rc *ResponseCache) GetResponse(cmdID ClientCmdID, reply interface{}) (bool
 	rc.Unlock()
 
 	// If the response is in the cache or we experienced an error, return.
-	if ok, err := engine.GetI(rc.engine, rc.makeKey(cmdID), reply); ok || err != nil {
+	atomic.AddInt64(&rc.lookups, 1)
+	var entry responseCacheEntry
+	if ok, err := engine.GetI(rc.engine, rc.makeKey(cmdID), &entry); ok || err != nil {
+		if ok && err == nil {
+			atomic.AddInt64(&rc.hits, 1)
+			metrics.Metrics.Counter("respcache.replays", 1)
+			err = gob.NewDecoder(bytes.NewBuffer(entry.Reply)).Decode(reply)
+		}
 		rc.Lock() // Take lock after fetching response from cache.
 		defer rc.Unlock()
 		rc.removeInflightLocked(cmdID)
@@ -105,29 +138,132 @@ func (rc *ResponseCache) GetResponse(cmdID ClientCmdID, reply interface{}) (bool
 	return false, nil
 }
 
-// PutResponse writes a response to the cache for the specified cmdID.
-// The inflight entry corresponding to cmdID is removed from the
+// PutResponse writes a response to the cache for the specified cmdID,
+// along with the timestamp of the command. The inflight entry corresponding to cmdID is removed from the
 // inflight map. Any requests waiting on the outcome of the inflight
 // command will be signaled to wakeup and read the command response
 // from the cache.
-func (rc *ResponseCache) PutResponse(cmdID ClientCmdID, reply interface{}) error {
+func (rc *ResponseCache) PutResponse(cmdID ClientCmdID, timestamp hlc.Timestamp, reply interface{}) error {
 	// Do nothing if command ID is empty.
 	if cmdID.IsEmpty() {
 		return nil
 	}
-	// Write the response value to the engine.
+	// Write the response value, along with the command's timestamp, to the engine.
 	key := rc.makeKey(cmdID)
-	err := engine.PutI(rc.engine, key, reply)
+	var buf, value bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(reply)
+	if err == nil {
+		entry := responseCacheEntry{Timestamp: timestamp, Reply: buf.Bytes()}
+		if err = gob.NewEncoder(&value).Encode(entry); err == nil {
+			err = rc.engine.Put(key, value.Bytes())
+		}
+	}
 
 	// Take lock after writing response to cache!
 	rc.Lock()
 	defer rc.Unlock()
 	// Even on error, we remove the entry from the inflight map.
 	rc.removeInflightLocked(cmdID)
+	if err == nil && rc.sized {
+		rc.entries++
+		rc.bytes += int64(len(key) + value.Len())
+	}
 
 	return err
 }
 
+// Size returns the number and total size in bytes of the cached
+// responses. Both are zero until the cache has been garbage
+// collected once.
+func (rc *ResponseCache) Size() (entries, bytes int64) {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.entries, rc.bytes
+}
+
+// GC removes cached responses of commands timestamped before cutoff,
+// a wall time in nanoseconds, and returns the number removed. Keys
+// sort by the wall time of the client command, so only entries of
+// commands issued before cutoff are visited; an entry is removed only
+// if the timestamp of the command which wrote it also precedes cutoff.
+// A command may be executed long after it was issued, for example an
+// update which lagged in an update queue, and its response must be
+// kept for the full window after execution. At most max entries are
+// visited per call; the next call resumes where this one stopped.
+// Entries which can't be decoded are removed as well.
+//
+// The first call also counts the cache's entries and bytes, which
+// are maintained from then on.
+func (rc *ResponseCache) GC(cutoff int64, max int64) (int, error) {
+	rc.Lock()
+	defer rc.Unlock()
+	prefix := rc.makePrefix()
+	if !rc.sized {
+		kvs, err := rc.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+		if err != nil {
+			return 0, err
+		}
+		for _, kv := range kvs {
+			rc.entries++
+			rc.bytes += int64(len(kv.Key) + len(kv.Value))
+		}
+		rc.sized = true
+	}
+
+	start := rc.gcKey
+	if start == nil {
+		start = prefix
+	}
+	end := encoding.EncodeInt(append(engine.Key(nil), prefix...), cutoff)
+	kvs, err := rc.engine.Scan(start, end, max)
+	if err != nil {
+		return 0, err
+	}
+	var deletes []interface{}
+	var size int64
+	for _, kv := range kvs {
+		var entry responseCacheEntry
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&entry); err != nil {
+			log.Errorf("discarding undecodable response cache entry at key %q: %v", kv.Key, err)
+		} else if entry.Timestamp.WallTime >= cutoff {
+			continue
+		}
+		deletes = append(deletes, engine.BatchDelete(kv.Key))
+		size += int64(len(kv.Key) + len(kv.Value))
+	}
+	if len(deletes) > 0 {
+		if err := rc.engine.WriteBatch(deletes); err != nil {
+			return 0, err
+		}
+		rc.entries -= int64(len(deletes))
+		rc.bytes -= size
+	}
+	rc.gcKey = nil
+	if int64(len(kvs)) == max {
+		rc.gcKey = engine.NextKey(kvs[len(kvs)-1].Key)
+	}
+	return len(deletes), nil
+}
+
+// Stats returns the number of lookups of non-empty command IDs and
+// the number of those which found a cached response.
+func (rc *ResponseCache) Stats() (lookups, hits int64) {
+	return atomic.LoadInt64(&rc.lookups), atomic.LoadInt64(&rc.hits)
+}
+
+// ClearData removes all cached responses for the range from the
+// underlying engine.
+func (rc *ResponseCache) ClearData() error {
+	rc.Lock()
+	defer rc.Unlock()
+	prefix := rc.makePrefix()
+	if _, err := engine.ClearRange(rc.engine, prefix, engine.PrefixEndKey(prefix), 0); err != nil {
+		return err
+	}
+	rc.entries, rc.bytes, rc.sized, rc.gcKey = 0, 0, true, nil
+	return nil
+}
+
 // addInflightLocked adds the supplied ClientCmdID to the inflight
 // map. Any subsequent invocations of GetResponse for the same client
 // command will block on the inflight cond var until either the
@@ -141,6 +277,16 @@ func (rc *ResponseCache) addInflightLocked(cmdID ClientCmdID) {
 	rc.inflight[cmdID] = sync.NewCond(&rc.Mutex)
 }
 
+// DiscardResponse removes cmdID from the inflight map without caching
+// a response, for commands which had no effect and may be executed
+// anew when retried. Requests waiting on the outcome of the inflight
+// command are signaled to continue.
+func (rc *ResponseCache) DiscardResponse(cmdID ClientCmdID) {
+	rc.Lock()
+	defer rc.Unlock()
+	rc.removeInflightLocked(cmdID)
+}
+
 // removeInflightLocked removes an entry matching cmdID from the
 // inflight map and broadcasts a wakeup to all waiters.
 func (rc *ResponseCache) removeInflightLocked(cmdID ClientCmdID) {
@@ -154,14 +300,18 @@ func (rc *ResponseCache) removeInflightLocked(cmdID ClientCmdID) {
 // for storage in the underlying engine. Note that the prefix for
 // response cache keys sorts them at the very top of the engine's
 // keyspace.
-// TODO(spencer): going to need to encode the server timestamp
-//   for when the value was written for GC.
 func (rc *ResponseCache) makeKey(cmdID ClientCmdID) engine.Key {
-	// The max length of encoded int is 12.
-	b := make([]byte, 0, len(engine.KeyLocalRangeResponseCachePrefix)+3*12)
-	b = append(b, engine.KeyLocalRangeResponseCachePrefix...)
-	b = encoding.EncodeInt(b, rc.rangeID)
+	b := rc.makePrefix()
 	b = encoding.EncodeInt(b, cmdID.WallTime) // wall time helps sort for locality
 	b = encoding.EncodeInt(b, cmdID.Random)   // TODO(spencer): encode as Fixed64
 	return b
 }
+
+// makePrefix returns the key prefix shared by all of the range's
+// cached responses.
+func (rc *ResponseCache) makePrefix() engine.Key {
+	// The max length of encoded int is 12.
+	b := make([]byte, 0, len(engine.KeyLocalRangeResponseCachePrefix)+3*12)
+	b = append(b, engine.KeyLocalRangeResponseCachePrefix...)
+	return encoding.EncodeInt(b, rc.rangeID)
+}
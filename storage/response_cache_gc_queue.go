@@ -0,0 +1,161 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+const (
+	// DefaultResponseCacheWindow is the default age beyond which
+	// cached responses are garbage collected. It matches the window
+	// over which ClientCmdID guarantees idempotence.
+	DefaultResponseCacheWindow = 1 * time.Hour
+	// responseCacheGCInterval is the maximum interval at which the
+	// response caches of a store's ranges are garbage collected.
+	responseCacheGCInterval = 1 * time.Minute
+	// responseCacheGCBatchSize is the maximum number of entries visited
+	// per range each time the response caches are garbage collected.
+	responseCacheGCBatchSize = 10000
+)
+
+// A responseCacheGCQueue periodically removes cached responses older
+// than the configured window from the response cache of each of a
+// store's ranges.
+//
+// The age of a cached response is measured from the timestamp of the
+// command which wrote it to the start of the range's most recent
+// leader lease, rather than to the local clock, so that replicas
+// agree on which responses are expired regardless of clock skew; a
+// replica lagging behind in applying leases only retains responses
+// longer. Updates drained from an update queue are executed with the
+// command ID assigned when they were enqueued, and their responses
+// are timestamped when executed. An update whose execution succeeded
+// but which hasn't yet been dequeued is re-executed idempotently only
+// while its response is cached, so the window must exceed the maximum
+// update queue lag (see the store's updateq.lag gauge).
+//
+// The size of the caches, in entries and bytes, and
+// the rate at which lookups find a cached response to replay are
+// exported as gauges.
+type responseCacheGCQueue struct {
+	store    *Store
+	window   time.Duration
+	interval time.Duration
+	closer   chan struct{}
+
+	entriesName, bytesName, hitRateName string // Gauge metric names
+	entries                             int64  // Number of cached responses, as of the last GC; accessed atomically
+	bytes                               int64  // Size in bytes of cached responses, as of the last GC; accessed atomically
+}
+
+// newResponseCacheGCQueue returns a GC queue for the response caches
+// of store which removes responses older than window.
+func newResponseCacheGCQueue(store *Store, window time.Duration) *responseCacheGCQueue {
+	interval := responseCacheGCInterval
+	if window < interval {
+		interval = window
+	}
+	storeID := store.Ident.StoreID
+	return &responseCacheGCQueue{
+		store:       store,
+		window:      window,
+		interval:    interval,
+		closer:      make(chan struct{}),
+		entriesName: fmt.Sprintf("store.%d.respcache.entries", storeID),
+		bytesName:   fmt.Sprintf("store.%d.respcache.bytes", storeID),
+		hitRateName: fmt.Sprintf("store.%d.respcache.hitrate", storeID),
+	}
+}
+
+// start registers the queue's gauges and launches a goroutine which
+// periodically garbage collects until stop is invoked.
+func (gcq *responseCacheGCQueue) start() {
+	metrics.Metrics.RegisterGaugeFunc(gcq.entriesName, func() float64 {
+		return float64(atomic.LoadInt64(&gcq.entries))
+	})
+	metrics.Metrics.RegisterGaugeFunc(gcq.bytesName, func() float64 {
+		return float64(atomic.LoadInt64(&gcq.bytes))
+	})
+	metrics.Metrics.RegisterGaugeFunc(gcq.hitRateName, gcq.hitRate)
+	go func() {
+		ticker := time.NewTicker(gcq.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := gcq.process(); err != nil {
+					log.Errorf("failed to garbage collect response cache: %v", err)
+				}
+			case <-gcq.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops garbage collection and deregisters the queue's gauges.
+func (gcq *responseCacheGCQueue) stop() {
+	close(gcq.closer)
+	metrics.Metrics.DeregisterGaugeFunc(gcq.entriesName)
+	metrics.Metrics.DeregisterGaugeFunc(gcq.bytesName)
+	metrics.Metrics.DeregisterGaugeFunc(gcq.hitRateName)
+}
+
+// process garbage collects the response cache of each of the
+// store's ranges and updates the size gauges. Ranges which have never
+// been granted a leader lease aren't garbage collected.
+func (gcq *responseCacheGCQueue) process() error {
+	var removed int
+	var entries, size int64
+	for _, rng := range gcq.store.GetRanges() {
+		if start := rng.leaderLeaseStart(); start.WallTime > 0 {
+			n, err := rng.respCache.GC(start.WallTime-gcq.window.Nanoseconds(), responseCacheGCBatchSize)
+			if err != nil {
+				return err
+			}
+			removed += n
+		}
+		e, b := rng.respCache.Size()
+		entries, size = entries+e, size+b
+	}
+	if removed > 0 {
+		metrics.Metrics.Counter("respcache.gc", uint64(removed))
+	}
+	atomic.StoreInt64(&gcq.entries, entries)
+	atomic.StoreInt64(&gcq.bytes, size)
+	return nil
+}
+
+// hitRate returns the fraction of lookups across the store's response
+// caches which found a cached response, or zero if there have been
+// no lookups.
+func (gcq *responseCacheGCQueue) hitRate() float64 {
+	var lookups, hits int64
+	for _, rng := range gcq.store.GetRanges() {
+		l, h := rng.respCache.Stats()
+		lookups, hits = lookups+l, hits+h
+	}
+	if lookups == 0 {
+		return 0
+	}
+	return float64(hits) / float64(lookups)
+}
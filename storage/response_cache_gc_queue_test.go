@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// TestResponseCacheGC verifies that cached responses of commands
+// timestamped more than the window before the start of the range's
+// leader lease are removed, regardless of the local clock, and that
+// size and hit rate are reported.
+func TestResponseCacheGC(t *testing.T) {
+	store, rng, manual, _ := createTestRangeWithClock(t)
+	defer store.Close()
+	window := 1 * time.Hour
+
+	oldCmdID, newCmdID := makeCmdID(1, 1), makeCmdID(2, 2)
+	if err := rng.respCache.PutResponse(oldCmdID, hlc.Timestamp{WallTime: 1}, int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rng.respCache.PutResponse(newCmdID, hlc.Timestamp{WallTime: window.Nanoseconds()}, int64(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local clock remains at zero, so responses are expired only
+	// relative to the lease. Leave the lease's expiration untouched so
+	// it isn't renewed.
+	if *manual != 0 {
+		t.Fatalf("expected manual clock at zero; got %d", *manual)
+	}
+	setLeaseStart := func(wallTime int64) {
+		rng.raftMu.Lock()
+		defer rng.raftMu.Unlock()
+		rng.lease.Start = hlc.Timestamp{WallTime: wallTime}
+	}
+	setLeaseStart(window.Nanoseconds() + 1)
+
+	gcq := newResponseCacheGCQueue(store, window)
+	if err := gcq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := atomic.LoadInt64(&gcq.entries); entries != 2 {
+		t.Errorf("expected 2 cached responses; got %d", entries)
+	}
+
+	setLeaseStart(window.Nanoseconds() + 2)
+	if err := gcq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := atomic.LoadInt64(&gcq.entries); entries != 1 {
+		t.Errorf("expected 1 cached response; got %d", entries)
+	}
+	if bytes := atomic.LoadInt64(&gcq.bytes); bytes <= 0 {
+		t.Errorf("expected cached responses to have positive size; got %d", bytes)
+	}
+
+	var val int64
+	if ok, err := rng.respCache.GetResponse(newCmdID, &val); !ok || err != nil || val != 2 {
+		t.Errorf("expected response within window to be kept: %t, %v, %d", ok, err, val)
+	}
+	if ok, err := rng.respCache.GetResponse(oldCmdID, &val); ok || err != nil {
+		t.Errorf("expected response beyond window to be removed: %t, %v", ok, err)
+	}
+	if rate := gcq.hitRate(); rate != 0.5 {
+		t.Errorf("expected hit rate of 0.5; got %f", rate)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
 // createTestResponseCache creates an in-memory engine and
@@ -47,7 +48,7 @@ func TestResponseCachePutAndGet(t *testing.T) {
 		t.Errorf("expected no response for id %+v; got %+v, %v", cmdID, val, err)
 	}
 	// Put value of 1 for test response.
-	if err := rc.PutResponse(cmdID, int64(1)); err != nil {
+	if err := rc.PutResponse(cmdID, hlc.Timestamp{}, int64(1)); err != nil {
 		t.Errorf("unexpected error putting response: %v", err)
 	}
 	// Get should now return 1.
@@ -63,7 +64,7 @@ func TestResponseCacheEmptyCmdID(t *testing.T) {
 	cmdID := ClientCmdID{}
 	var val int64
 	// Put value of 1 for test response.
-	if err := rc.PutResponse(cmdID, int64(1)); err != nil {
+	if err := rc.PutResponse(cmdID, hlc.Timestamp{}, int64(1)); err != nil {
 		t.Errorf("unexpected error putting response: %v", err)
 	}
 	// Add inflight, which would otherwise block the get.
@@ -109,7 +110,7 @@ func TestResponseCacheInflight(t *testing.T) {
 	case <-doneChans[1]:
 		t.Fatal("2nd get should not complete; it blocks until we put")
 	case <-time.After(2 * time.Millisecond):
-		if err := rc.PutResponse(cmdID1, int64(1)); err != nil {
+		if err := rc.PutResponse(cmdID1, hlc.Timestamp{}, int64(1)); err != nil {
 			t.Fatalf("unexpected error putting responpse: %v", err)
 		}
 	}
@@ -164,3 +165,53 @@ func TestResponseCacheClear(t *testing.T) {
 		t.Fatalf("get response failed to complete in 500ms")
 	}
 }
+
+// TestResponseCacheGCBatch verifies that garbage collection visits at most
+// the specified number of entries per call, resuming where the last
+// call stopped, and skips entries of commands issued after the cutoff.
+func TestResponseCacheGCBatch(t *testing.T) {
+	rc := NewResponseCache(1, engine.NewInMem(engine.Attributes{}, 1<<20))
+	for i := int64(1); i <= 3; i++ {
+		if err := rc.PutResponse(makeCmdID(i, i), hlc.Timestamp{WallTime: i}, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The command issued after the cutoff isn't visited, although its
+	// response was cached before the cutoff.
+	if err := rc.PutResponse(makeCmdID(100, 4), hlc.Timestamp{WallTime: 4}, int64(4)); err != nil {
+		t.Fatal(err)
+	}
+	// The command issued before the cutoff but executed after it is
+	// visited but kept.
+	if err := rc.PutResponse(makeCmdID(5, 5), hlc.Timestamp{WallTime: 10}, int64(5)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expRemoved := range []int{2, 1, 0} {
+		removed, err := rc.GC(10, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != expRemoved {
+			t.Errorf("%d: expected %d removed; got %d", i, expRemoved, removed)
+		}
+	}
+	if entries, bytes := rc.Size(); entries != 2 || bytes <= 0 {
+		t.Errorf("expected 2 cached responses of positive size; got %d, %d", entries, bytes)
+	}
+	var val int64
+	if ok, err := rc.GetResponse(makeCmdID(100, 4), &val); !ok || err != nil || val != 4 {
+		t.Errorf("expected response of later command to be kept: %t, %v, %d", ok, err, val)
+	}
+	if ok, err := rc.GetResponse(makeCmdID(5, 5), &val); !ok || err != nil || val != 5 {
+		t.Errorf("expected response of later execution to be kept: %t, %v, %d", ok, err, val)
+	}
+
+	// Entries cached after the first GC are counted.
+	if err := rc.PutResponse(makeCmdID(200, 6), hlc.Timestamp{WallTime: 200}, int64(6)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := rc.Size(); entries != 3 {
+		t.Errorf("expected 3 cached responses; got %d", entries)
+	}
+}
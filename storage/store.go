@@ -19,14 +19,18 @@ package storage
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/cockroachdb/cockroach/gossip"
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util"
 	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
 )
 
 // rangeMetadataKeyPrefix and hexadecimal-formatted range ID.
@@ -64,32 +68,142 @@ type StoreIdent struct {
 type Store struct {
 	Ident     StoreIdent
 	clock     *hlc.Clock
-	engine    engine.Engine  // The underlying key-value store
-	allocator *allocator     // Makes allocation decisions
-	gossip    *gossip.Gossip // Passed to new ranges
+	engine    engine.Engine       // The underlying key-value store
+	allocator *allocator          // Makes allocation decisions
+	gossip    *gossip.Gossip      // Passed to new ranges
+	transport multiraft.Transport // Carries raft traffic to other stores
 
-	mu     sync.RWMutex     // Protects ranges
-	ranges map[int64]*Range // Map of ranges by range ID
+	mu         sync.RWMutex          // Protects ranges, queues and multiraft
+	ranges     map[int64]*Range      // Map of ranges by range ID
+	updateQ    *updateQueue          // Drains updates enqueued via EnqueueUpdate
+	rebalanceQ *rebalanceQueue       // Moves replicas away from this store when overfull
+	replicateQ *replicateQueue       // Matches replicas to zone configs
+	replicaGCQ *replicaGCQueue       // Destroys replicas removed from their ranges
+	respCacheQ *responseCacheGCQueue // Removes expired cached responses
+	multiraft  *multiraft.MultiRaft  // Raft groups of all ranges; started with the first range
+	closer     chan struct{}         // Stops processing of raft events
 }
 
-// NewStore returns a new instance of a store.
-func NewStore(clock *hlc.Clock, engine engine.Engine, gossip *gossip.Gossip) *Store {
+// NewStore returns a new instance of a store. The raft groups of the
+// store's ranges communicate via transport, which is normally shared
+// by all stores of a node.
+func NewStore(clock *hlc.Clock, engine engine.Engine, gossip *gossip.Gossip,
+	transport multiraft.Transport) *Store {
 	return &Store{
 		clock:     clock,
 		engine:    engine,
-		allocator: &allocator{},
+		allocator: newAllocator(gossip),
 		gossip:    gossip,
+		transport: transport,
 		ranges:    make(map[int64]*Range),
 	}
 }
 
-// Close calls Range.Stop() on all active ranges.
+// Close calls Range.Stop() on all active ranges and stops the update,
+// rebalance, replicate, replica GC and response cache GC queues and
+// raft, if started.
 func (s *Store) Close() {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, rng := range s.ranges {
 		rng.Stop()
 	}
+	if s.updateQ != nil {
+		s.updateQ.stop()
+	}
+	if s.rebalanceQ != nil {
+		s.rebalanceQ.stop()
+	}
+	if s.replicateQ != nil {
+		s.replicateQ.stop()
+	}
+	if s.replicaGCQ != nil {
+		s.replicaGCQ.stop()
+	}
+	if s.respCacheQ != nil {
+		s.respCacheQ.stop()
+	}
+	if s.multiraft != nil {
+		s.multiraft.Stop()
+		close(s.closer)
+	}
+}
+
+// StartUpdateQueue starts processing updates enqueued via
+// EnqueueUpdate on the ranges for which this store holds the leader
+// lease, executing them with exec. The store must have
+// been initialized or bootstrapped. It is an error to start the
+// update queue more than once.
+func (s *Store) StartUpdateQueue(exec UpdateExecutor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.updateQ != nil {
+		return util.Errorf("update queue already started for %s", s)
+	}
+	s.updateQ = newUpdateQueue(s, exec)
+	s.updateQ.start()
+	return nil
+}
+
+// StartRebalanceQueue starts periodically rebalancing replicas away
+// from this store, should it be amongst the most utilized stores in
+// the cluster. Replica changes involving other stores are carried out
+// via changer. It is an error to start the rebalance queue more than
+// once.
+func (s *Store) StartRebalanceQueue(changer ReplicaChanger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rebalanceQ != nil {
+		return util.Errorf("rebalance queue already started for %s", s)
+	}
+	s.rebalanceQ = newRebalanceQueue(s, changer)
+	s.rebalanceQ.start()
+	return nil
+}
+
+// StartReplicateQueue starts adding and removing replicas of the
+// store's ranges to match their zone configs. Replica changes
+// involving other stores are carried out via changer. It is an error
+// to start the replicate queue more than once.
+func (s *Store) StartReplicateQueue(changer ReplicaChanger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replicateQ != nil {
+		return util.Errorf("replicate queue already started for %s", s)
+	}
+	s.replicateQ = newReplicateQueue(s, changer)
+	s.replicateQ.start()
+	return nil
+}
+
+// StartReplicaGCQueue starts periodically checking the store's ranges
+// against their addressing records, destroying those of which the
+// store is no longer a replica. Addressing records are read via exec.
+// It is an error to start the replica GC queue more than once.
+func (s *Store) StartReplicaGCQueue(exec UpdateExecutor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replicaGCQ != nil {
+		return util.Errorf("replica GC queue already started for %s", s)
+	}
+	s.replicaGCQ = newReplicaGCQueue(s, exec)
+	s.replicaGCQ.start()
+	return nil
+}
+
+// StartResponseCacheGC starts periodically removing responses cached
+// longer than window from the response caches of the store's ranges.
+// The store must have been initialized or bootstrapped. It is an
+// error to start response cache GC more than once.
+func (s *Store) StartResponseCacheGC(window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.respCacheQ != nil {
+		return util.Errorf("response cache GC already started for %s", s)
+	}
+	s.respCacheQ = newResponseCacheGCQueue(s, window)
+	s.respCacheQ.start()
+	return nil
 }
 
 // String formats a store for debug output.
@@ -108,7 +222,12 @@ func (s *Store) IsBootstrapped() bool {
 	return false
 }
 
-// Init reads the StoreIdent from the underlying engine.
+// Init reads the StoreIdent from the underlying engine and starts
+// every range found in the store's local range metadata. Ranges which
+// can't be loaded, either because their metadata is corrupt or
+// because it disagrees with the range's addressing record, are
+// skipped; once all other ranges have been started, they're reported
+// via a *RangeLoadError.
 func (s *Store) Init() error {
 	ok, err := engine.GetI(s.engine, engine.KeyLocalIdent, &s.Ident)
 	if err != nil {
@@ -117,21 +236,93 @@ func (s *Store) Init() error {
 		return util.Error("store has not been bootstrapped")
 	}
 
-	// TODO(spencer): scan through all range metadata and instantiate
-	//   ranges. Right now we just get range ID hardcoded as 1.
-	var meta RangeMetadata
-	ok, err = engine.GetI(s.engine, makeRangeKey(1), &meta)
-	if err != nil || !ok {
+	metas, failed, err := s.loadRangeMetadata()
+	if err != nil {
 		return err
 	}
+	for _, meta := range metas {
+		if err := s.validateRangeMetadata(meta, metas); err != nil {
+			failed[meta.RangeID] = err
+			continue
+		}
+		if err := s.addRange(meta); err != nil {
+			failed[meta.RangeID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &RangeLoadError{Ranges: failed}
+	}
+	return nil
+}
 
-	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip)
-	rng.Start()
+// loadRangeMetadata scans the store's local range metadata. Returns
+// the decoded metadata as well as a map from range ID to error for
+// entries which couldn't be decoded.
+func (s *Store) loadRangeMetadata() ([]RangeMetadata, map[int64]error, error) {
+	start := engine.KeyLocalRangeMetadataPrefix
+	kvs, err := s.engine.Scan(start, engine.PrefixEndKey(start), 0)
+	if err != nil {
+		return nil, nil, util.Errorf("unable to scan range metadata: %v", err)
+	}
+	var metas []RangeMetadata
+	failed := map[int64]error{}
+	for _, kv := range kvs {
+		// The range ID generator shares the range metadata prefix.
+		if bytes.Equal(kv.Key, engine.KeyLocalRangeIDGenerator) {
+			continue
+		}
+		rangeID, err := strconv.ParseInt(string(kv.Key[len(start):]), 10, 64)
+		if err != nil {
+			log.Warningf("skipping unexpected key %q in range metadata", kv.Key)
+			continue
+		}
+		var meta RangeMetadata
+		if err = gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&meta); err == nil && meta.RangeID != rangeID {
+			err = util.Errorf("metadata has mismatched range ID %d", meta.RangeID)
+		}
+		if err != nil {
+			failed[rangeID] = err
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	return metas, failed, nil
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.ranges[meta.RangeID] = rng
-	return nil
+// validateRangeMetadata verifies meta against the range's addressing
+// record. The record can only be checked if it's stored by one of
+// the ranges in metas; otherwise it lives on another store and meta
+// is accepted as is. Likewise, a range may not yet have an addressing
+// record if the store stopped just after the range was created. An
+// existing record must match meta's key range and list a replica on
+// this store.
+func (s *Store) validateRangeMetadata(meta RangeMetadata, metas []RangeMetadata) error {
+	metaKey := meta.LookupKey()
+	local := false
+	for _, m := range metas {
+		if m.ContainsKey(metaKey) {
+			local = true
+			break
+		}
+	}
+	if !local {
+		return nil
+	}
+	var desc RangeDescriptor
+	ok, err := engine.GetI(s.engine, metaKey, &desc)
+	if err != nil || !ok {
+		return err
+	}
+	if !bytes.Equal(desc.StartKey, meta.StartKey) || !bytes.Equal(desc.EndKey, meta.EndKey) {
+		return util.Errorf("key range [%q, %q) doesn't match addressing record [%q, %q)",
+			meta.StartKey, meta.EndKey, desc.StartKey, desc.EndKey)
+	}
+	for _, replica := range desc.Replicas {
+		if replica.NodeID == s.Ident.NodeID && replica.StoreID == s.Ident.StoreID {
+			return nil
+		}
+	}
+	return util.Errorf("addressing record has no replica on %s", s)
 }
 
 // Bootstrap writes a new store ident to the underlying engine. To
@@ -199,12 +390,200 @@ func (s *Store) CreateRange(startKey, endKey engine.Key, replicas []Replica) (*R
 	if err != nil {
 		return nil, err
 	}
-	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip)
-	rng.Start()
+	if err := s.addRange(meta); err != nil {
+		return nil, err
+	}
+	return s.GetRange(rangeID)
+}
+
+// RemoveRange stops the range, removes it from the store's map of
+// ranges and leaves its raft group. The range's data is left in
+// place; see Range.Destroy.
+func (s *Store) RemoveRange(rng *Range) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.ranges[rangeID] = rng
-	return rng, nil
+	if _, ok := s.ranges[rng.Meta.RangeID]; !ok {
+		return NewRangeNotFoundError(rng.Meta.RangeID)
+	}
+	delete(s.ranges, rng.Meta.RangeID)
+	rng.Stop()
+	if s.multiraft == nil {
+		return nil
+	}
+	return s.multiraft.RemoveGroup(multiraft.GroupID(rng.Meta.RangeID))
+}
+
+// addRange starts a range described by meta and joins its raft
+// group, starting raft on first use.
+func (s *Store) addRange(meta RangeMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.startRaftLocked(); err != nil {
+		return err
+	}
+	rng := NewRange(meta, s.clock, s.engine, s.allocator, s.gossip, s)
+	rng.Start()
+	// Add the range before creating its group so that it's found when
+	// the group elects a leader.
+	s.ranges[meta.RangeID] = rng
+	groupID := multiraft.GroupID(meta.RangeID)
+	members := groupMembers(meta, s.Ident.NodeID, s.Ident.StoreID)
+	err := s.multiraft.CreateGroup(groupID, members.Members)
+	if err == nil && len(members.NonVotingMembers) > 0 {
+		err = s.multiraft.ChangeGroupMembership(groupID, members)
+	}
+	if err != nil {
+		rng.Stop()
+		delete(s.ranges, meta.RangeID)
+		return err
+	}
+	return nil
+}
+
+// AddReplica creates a replica of a range on this store from snap,
+// taken from an existing replica via Range.Snapshot, and joins the
+// range's raft group. The new replica catches up by applying the raft
+// log entries which follow snap.AppliedIndex.
+func (s *Store) AddReplica(snap *RangeSnapshot) error {
+	meta := snap.Meta
+	if meta.ClusterID != s.Ident.ClusterID {
+		return util.Errorf("range %d belongs to cluster %q, not %q", meta.RangeID, meta.ClusterID, s.Ident.ClusterID)
+	}
+	if _, err := s.GetRange(meta.RangeID); err == nil {
+		return util.Errorf("%s already has a replica of range %d", s, meta.RangeID)
+	}
+	batch := make([]interface{}, len(snap.Data))
+	for i, kv := range snap.Data {
+		batch[i] = engine.BatchPut(kv)
+	}
+	if err := s.engine.WriteBatch(batch); err != nil {
+		return err
+	}
+	if err := engine.PutI(s.engine, makeRaftAppliedIndexKey(meta.RangeID), snap.AppliedIndex); err != nil {
+		return err
+	}
+	// The range metadata is written last, as it marks the range as
+	// present when the store is initialized.
+	if err := engine.PutI(s.engine, makeRangeKey(meta.RangeID), meta); err != nil {
+		return err
+	}
+	return s.addRange(meta)
+}
+
+// startRaftLocked starts raft for the store, if not already started,
+// along with a goroutine to process raft events. Raft state is
+// persisted in the store's engine. The store ident must be set.
+// Requires that s.mu be locked.
+func (s *Store) startRaftLocked() error {
+	if s.multiraft != nil {
+		return nil
+	}
+	if s.transport == nil {
+		return util.Errorf("no raft transport for %s", s)
+	}
+	mr, err := multiraft.NewMultiRaft(s.raftNodeID(), &multiraft.Config{
+		Storage:            &raftStorage{engine: s.engine},
+		Transport:          s.transport,
+		ElectionTimeoutMin: raftElectionTimeoutMin,
+		ElectionTimeoutMax: raftElectionTimeoutMax,
+	})
+	if err != nil {
+		return util.Errorf("unable to start raft for %s: %v", s, err)
+	}
+	s.multiraft = mr
+	s.closer = make(chan struct{})
+	mr.Start()
+	go s.processRaft(mr, s.closer)
+	return nil
+}
+
+// raftNodeID returns the store's ID in the raft groups of its ranges.
+func (s *Store) raftNodeID() multiraft.NodeID {
+	return MakeRaftNodeID(s.Ident.NodeID, s.Ident.StoreID)
+}
+
+// processRaft processes raft events until closer is closed. Committed
+// commands are applied to the range they address, and leadership
+// changes are relayed to the affected range.
+func (s *Store) processRaft(mr *multiraft.MultiRaft, closer chan struct{}) {
+	for {
+		select {
+		case e := <-mr.Events:
+			switch e := e.(type) {
+			case *multiraft.EventLeaderElection:
+				rng, err := s.GetRange(int64(e.GroupID))
+				if err != nil {
+					log.Errorf("leader elected for unknown range: %v", err)
+					continue
+				}
+				nodeID, storeID := DecodeRaftNodeID(e.NodeID)
+				rng.setLeader(nodeID, storeID, e.NodeID == s.raftNodeID())
+			case *multiraft.EventCommandCommitted:
+				rng, err := s.GetRange(int64(e.GroupID))
+				if err != nil {
+					log.Errorf("unable to apply committed raft command: %v", err)
+					continue
+				}
+				cmd, err := decodeCmd(e.Command)
+				if err != nil {
+					log.Errorf("range %d: unable to decode committed raft command: %v", rng.Meta.RangeID, err)
+					continue
+				}
+				rng.applyRaftCommand(e.Index, cmd)
+			}
+		case <-closer:
+			return
+		}
+	}
+}
+
+// NodeID implements the RangeManager interface.
+func (s *Store) NodeID() int32 {
+	return s.Ident.NodeID
+}
+
+// StoreID implements the RangeManager interface.
+func (s *Store) StoreID() int32 {
+	return s.Ident.StoreID
+}
+
+// ProposeRaftCommand implements the RangeManager interface.
+func (s *Store) ProposeRaftCommand(cmd *Cmd) error {
+	b, err := encodeCmd(cmd)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	mr := s.multiraft
+	s.mu.RUnlock()
+	if mr == nil {
+		return util.Errorf("raft not started for %s", s)
+	}
+	return mr.SubmitCommand(multiraft.GroupID(cmd.RangeID), b)
+}
+
+// ChangeRaftMembership implements the RangeManager interface.
+func (s *Store) ChangeRaftMembership(meta RangeMetadata) error {
+	s.mu.RLock()
+	mr := s.multiraft
+	s.mu.RUnlock()
+	if mr == nil {
+		return util.Errorf("raft not started for %s", s)
+	}
+	members := groupMembers(meta, s.Ident.NodeID, s.Ident.StoreID)
+	return mr.ChangeGroupMembership(multiraft.GroupID(meta.RangeID), members)
+}
+
+// ExecuteUpdate implements the RangeManager interface, executing the
+// command via the executor with which the update queue was started.
+func (s *Store) ExecuteUpdate(method string, args Request, reply Response) error {
+	s.mu.RLock()
+	uq := s.updateQ
+	s.mu.RUnlock()
+	if uq == nil {
+		return util.Errorf("update queue not started for %s", s)
+	}
+	return uq.exec(method, args, reply)
 }
 
 // Attrs returns the attributes of the underlying store.
@@ -263,9 +642,26 @@ func (s *Store) ExecuteCmd(method string, args Request, reply Response) error {
 	if !rng.ContainsKeyRange(header.Key, header.EndKey) {
 		return NewRangeKeyMismatchError(header.Key, header.EndKey, rng.Meta)
 	}
-	if !rng.IsLeader() {
-		// TODO(spencer): when we happen to know the leader, fill it in here via replica.
-		return &NotLeaderError{}
+	// Commands are only accepted by the replica holding the leader
+	// lease. A newly started range must first elect a leader, which
+	// then acquires the lease; the leader also reacquires an expired
+	// lease on demand.
+	rng.waitForLeader(raftLeaderWait)
+	if !rng.HasLeaderLease() {
+		if !rng.IsLeader() {
+			return rng.newNotLeaderError()
+		}
+		if err := rng.requestLeaderLease(); err != nil {
+			log.Warningf("range %d: unable to acquire leader lease: %v", rng.Meta.RangeID, err)
+		}
+		if !rng.HasLeaderLease() {
+			return rng.newNotLeaderError()
+		}
+	}
+
+	// Watches wait for events outside of the command queue.
+	if method == Watch {
+		return rng.WatchCmd(args.(*WatchRequest), reply.(*WatchResponse))
 	}
 
 	// Differentiate between read-only and read-write.
@@ -20,10 +20,13 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sort"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/multiraft"
 	"github.com/cockroachdb/cockroach/storage/engine"
 	"github.com/cockroachdb/cockroach/util/hlc"
 )
@@ -40,7 +43,7 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 	manual := hlc.ManualClock(0)
 	clock := hlc.NewClock(manual.UnixNano)
 	eng := engine.NewInMem(engine.Attributes{}, 1<<20)
-	store := NewStore(clock, eng, nil)
+	store := NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
 	defer store.Close()
 
 	// Can't init as haven't bootstrapped.
@@ -67,7 +70,7 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 	}
 
 	// Now, attempt to initialize a store with a now-bootstrapped engine.
-	store = NewStore(clock, eng, nil)
+	store = NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
 	if err := store.Init(); err != nil {
 		t.Errorf("failure initializing bootstrapped store: %v", err)
 	}
@@ -77,6 +80,124 @@ func TestStoreInitAndBootstrap(t *testing.T) {
 	}
 }
 
+// TestStoreInitLoadsRanges verifies that on restart, a store built
+// on a durable engine starts all ranges found in its range metadata
+// and reports those which don't match their addressing records.
+func TestStoreInitLoadsRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manual := hlc.ManualClock(0)
+	clock := hlc.NewClock(manual.UnixNano)
+	eng, err := engine.NewRocksDB(engine.Attributes{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create three ranges. The first holds the addressing records of
+	// all three, but the record for the third range is stale.
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID}
+	bounds := []engine.Key{engine.KeyMin, engine.Key("m"), engine.Key("z"), engine.KeyMax}
+	for i := 0; i < 3; i++ {
+		rng, err := store.CreateRange(bounds[i], bounds[i+1], []Replica{replica})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := rng.Meta.RangeDescriptor
+		if i == 2 {
+			desc.StartKey = engine.Key("y")
+		}
+		if err := engine.PutI(eng, desc.LookupKey(), desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, rangeID := range map[string]int64{"a": 1, "n": 2} {
+		pArgs, pReply := putArgs(key, "value-"+key, rangeID)
+		if err := store.ExecuteCmd("Put", pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+	eng.Close()
+
+	// Restart the store on the same data directory.
+	eng, err = engine.NewRocksDB(engine.Attributes{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+	store = NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
+	defer store.Close()
+	err = store.Init()
+	loadErr, ok := err.(*RangeLoadError)
+	if !ok {
+		t.Fatalf("expected range load error; got %v", err)
+	}
+	if _, ok := loadErr.Ranges[3]; !ok || len(loadErr.Ranges) != 1 {
+		t.Errorf("expected only range 3 to fail loading; got %v", loadErr)
+	}
+	if _, err := store.GetRange(3); err == nil {
+		t.Error("expected range 3 not to be loaded")
+	}
+	for key, rangeID := range map[string]int64{"a": 1, "n": 2} {
+		gArgs, gReply := getArgs(key, rangeID)
+		if err := store.ExecuteCmd("Get", gArgs, gReply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gReply.Value.Bytes, []byte("value-"+key)) {
+			t.Errorf("expected %q; got %q", "value-"+key, gReply.Value.Bytes)
+		}
+	}
+}
+
+// TestStoreRestartResumesRaft verifies that a restarted store's
+// ranges resume their raft groups from the state persisted in the
+// engine, without applying committed commands again.
+func TestStoreRestartResumesRaft(t *testing.T) {
+	clock := hlc.NewClock(hlc.UnixNano)
+	eng := engine.NewInMem(engine.Attributes{}, 1<<20)
+	store := NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	replica := Replica{NodeID: testIdent.NodeID, StoreID: testIdent.StoreID}
+	rng, err := store.CreateRange(engine.KeyMin, engine.KeyMax, []Replica{replica})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, rng)
+	increment := func(s *Store) int64 {
+		args, reply := incrementArgs("a", 1, rng.Meta.RangeID)
+		if err := s.ExecuteCmd(Increment, args, reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.NewValue
+	}
+	increment(store)
+	increment(store)
+	store.Close()
+
+	store = NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
+	defer store.Close()
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	rng, err = store.GetRange(rng.Meta.RangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, rng)
+	if val := increment(store); val != 3 {
+		t.Errorf("expected counter 3 after restart; got %d", val)
+	}
+}
+
 // TestBootstrapOfNonEmptyStore verifies bootstrap failure if engine
 // is not empty.
 func TestBootstrapOfNonEmptyStore(t *testing.T) {
@@ -88,7 +209,7 @@ func TestBootstrapOfNonEmptyStore(t *testing.T) {
 	}
 	manual := hlc.ManualClock(0)
 	clock := hlc.NewClock(manual.UnixNano)
-	store := NewStore(clock, eng, nil)
+	store := NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
 	defer store.Close()
 
 	// Can't init as haven't bootstrapped.
@@ -131,7 +252,10 @@ func createTestStore(t *testing.T) (*Store, *hlc.ManualClock) {
 	manual := hlc.ManualClock(0)
 	clock := hlc.NewClock(manual.UnixNano)
 	eng := engine.NewInMem(engine.Attributes{}, 1<<20)
-	store := NewStore(clock, eng, nil)
+	store := NewStore(clock, eng, nil, multiraft.NewLocalRPCTransport())
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
 	replica := Replica{RangeID: 1}
 	_, err := store.CreateRange(engine.Key("a"), engine.Key("z"), []Replica{replica})
 	if err != nil {
@@ -18,9 +18,17 @@
 package storage
 
 import (
+	"time"
+
 	"github.com/cockroachdb/cockroach/util/hlc"
 )
 
+// TxnHeartbeatTimeout is the time after which a pending transaction
+// which hasn't been heartbeat by its coordinator is considered
+// abandoned, and may be aborted by others. Transactions without a
+// record are aged from the time of their writes.
+const TxnHeartbeatTimeout = 20 * time.Second
+
 // IsolationType TODO(jiajia) Needs documentation.
 type IsolationType int
 
@@ -0,0 +1,492 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/encoding"
+	"github.com/cockroachdb/cockroach/util/hlc"
+	"github.com/cockroachdb/cockroach/util/log"
+	"github.com/cockroachdb/cockroach/util/metrics"
+)
+
+// init registers the request types which may be enqueued as updates.
+func init() {
+	gob.Register(&PutRequest{})
+	gob.Register(&IncrementRequest{})
+	gob.Register(&DeleteRequest{})
+	gob.Register(&DeleteRangeRequest{})
+	gob.Register(&AccumulateTSRequest{})
+}
+
+const (
+	// updateQueueInterval is the interval at which the update queue is
+	// scanned for updates ready to execute.
+	updateQueueInterval = 1 * time.Second
+	// updateQueueMaxBatch is the maximum number of updates executed
+	// per scan of the update queue.
+	updateQueueMaxBatch = 100
+)
+
+// defaultUpdateRetryOptions specifies the backoff applied to updates
+// which fail to execute. An update which still fails after
+// MaxAttempts is discarded, logged and counted by the
+// updateq.deadletter counter. The initial backoff is also the
+// interval at which updates of pending transactions are rechecked.
+var defaultUpdateRetryOptions = util.RetryOptions{
+	Backoff:     100 * time.Millisecond,
+	MaxBackoff:  1 * time.Minute,
+	Constant:    2,
+	MaxAttempts: 25,
+}
+
+// An UpdateExecutor synchronously executes a command against the
+// cluster, copying the result into reply. The returned error is the
+// error from the reply header, if any. Updates drained from a store's
+// update queue are executed via an UpdateExecutor, as they may address
+// keys anywhere in the cluster.
+type UpdateExecutor func(method string, args Request, reply Response) error
+
+// A queuedUpdate is the value stored in a range's update queue for
+// each update enqueued via EnqueueUpdate.
+type queuedUpdate struct {
+	TxID     string        // Transaction which enqueued the update; may be empty
+	CmdID    ClientCmdID   // Command ID used to execute the update idempotently
+	Update   interface{}   // One of the request types accepted by newUpdateCmd
+	Enqueued hlc.Timestamp // Timestamp at which the update was enqueued
+}
+
+// An updateRetry holds the retry state of a queued update. It's kept
+// in memory by the replica executing the update, as the range's
+// update queue is modified only through raft.
+type updateRetry struct {
+	attempts    int   // Failed attempts to execute the update so far
+	nextAttempt int64 // Wall time before which the update isn't retried
+}
+
+// makeUpdateQueuePrefix returns the prefix of the local keys at which
+// the updates enqueued on the specified range are stored.
+func makeUpdateQueuePrefix(rangeID int64) engine.Key {
+	return engine.MakeKey(engine.KeyLocalUpdateQueuePrefix, encoding.EncodeInt(nil, rangeID))
+}
+
+// makeUpdateCmdID returns the command ID of an update enqueued as a
+// command is applied. It's derived from parts, which must identify
+// the update uniquely, so that every replica enqueues the update with
+// the same command ID.
+func makeUpdateCmdID(wallTime int64, parts ...[]byte) ClientCmdID {
+	h := fnv.New64a()
+	for _, part := range parts {
+		binary.Write(h, binary.BigEndian, int64(len(part)))
+		h.Write(part)
+	}
+	return ClientCmdID{WallTime: wallTime, Random: int64(h.Sum64() >> 1)}
+}
+
+// assignUpdateCmdIDs sets the command ID of each update enqueued by
+// args, or by the requests of args if it's a batch, which doesn't
+// already have one. It's invoked by the replica proposing args, so
+// that every replica enqueues the update with the same command ID.
+func assignUpdateCmdIDs(args Request) {
+	reqs := []Request{args}
+	if batch, ok := args.(*BatchRequest); ok {
+		reqs = batch.Requests
+	}
+	wallTime := args.Header().Timestamp.WallTime
+	for _, req := range reqs {
+		eu, ok := req.(*EnqueueUpdateRequest)
+		if !ok {
+			continue
+		}
+		if update, ok := eu.Update.(Request); ok && update.Header().CmdID.IsEmpty() {
+			update.Header().CmdID = ClientCmdID{WallTime: wallTime, Random: rand.Int63()}
+		}
+	}
+}
+
+// newUpdateCmd returns the method name, args and an empty reply for
+// executing update, which must be one of the request types supported
+// by EnqueueUpdate.
+func newUpdateCmd(update interface{}) (string, Request, Response, error) {
+	switch t := update.(type) {
+	case *PutRequest:
+		return Put, t, &PutResponse{}, nil
+	case *IncrementRequest:
+		return Increment, t, &IncrementResponse{}, nil
+	case *DeleteRequest:
+		return Delete, t, &DeleteResponse{}, nil
+	case *DeleteRangeRequest:
+		return DeleteRange, t, &DeleteRangeResponse{}, nil
+	case *AccumulateTSRequest:
+		return AccumulateTS, t, &AccumulateTSResponse{}, nil
+	}
+	return "", nil, nil, util.Errorf("unsupported update type %T", update)
+}
+
+// An updateQueue drains the updates enqueued on the ranges of a
+// store, executing each via an UpdateExecutor once the enqueuing
+// transaction (if any) has committed. Every replica of a range holds
+// the same queued updates, but only the replica holding the range's
+// leader lease executes them; updates are removed from all replicas
+// by dequeueing them through raft once executed, or once their
+// transaction has aborted. Updates which fail to execute are retried
+// with exponential backoff, up to a maximum number of attempts. The
+// queue's depth and lag (the age of the oldest queued update) are
+// exported as gauges.
+type updateQueue struct {
+	store    *Store
+	exec     UpdateExecutor
+	opts     util.RetryOptions
+	interval time.Duration
+	closer   chan struct{}
+	retries  map[string]*updateRetry // Retry state of updates by key; used only by process
+
+	depthName, lagName string // Gauge metric names
+	depth              int64  // Number of queued updates, as of the last scan; accessed atomically
+	lag                int64  // Age in nanoseconds of the oldest queued update; accessed atomically
+}
+
+// newUpdateQueue returns an update queue which drains updates
+// enqueued on the ranges of store.
+func newUpdateQueue(store *Store, exec UpdateExecutor) *updateQueue {
+	storeID := store.Ident.StoreID
+	return &updateQueue{
+		store:     store,
+		exec:      exec,
+		opts:      defaultUpdateRetryOptions,
+		interval:  updateQueueInterval,
+		closer:    make(chan struct{}),
+		retries:   map[string]*updateRetry{},
+		depthName: fmt.Sprintf("store.%d.updateq.depth", storeID),
+		lagName:   fmt.Sprintf("store.%d.updateq.lag", storeID),
+	}
+}
+
+// start registers the queue's gauges and launches a goroutine which
+// periodically processes the queue until stop is invoked.
+func (uq *updateQueue) start() {
+	metrics.Metrics.RegisterGaugeFunc(uq.depthName, func() float64 {
+		return float64(atomic.LoadInt64(&uq.depth))
+	})
+	metrics.Metrics.RegisterGaugeFunc(uq.lagName, func() float64 {
+		return time.Duration(atomic.LoadInt64(&uq.lag)).Seconds()
+	})
+	go func() {
+		ticker := time.NewTicker(uq.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := uq.process(); err != nil {
+					log.Errorf("failed to process update queue: %v", err)
+				}
+			case <-uq.closer:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops processing and deregisters the queue's gauges.
+func (uq *updateQueue) stop() {
+	close(uq.closer)
+	metrics.Metrics.DeregisterGaugeFunc(uq.depthName)
+	metrics.Metrics.DeregisterGaugeFunc(uq.lagName)
+}
+
+// process scans the update queues of the store's ranges for which
+// this store holds the leader lease, updating the depth and lag
+// gauges, and attempts each update which is due, up to
+// updateQueueMaxBatch per range.
+func (uq *updateQueue) process() error {
+	now := uq.store.clock.Now().WallTime
+	var depth, lag int64
+	seen := map[string]struct{}{}
+	for _, rng := range uq.store.GetRanges() {
+		if !rng.HasLeaderLease() {
+			continue
+		}
+		n, oldest, err := uq.processRange(rng, now, seen)
+		if err != nil {
+			return err
+		}
+		depth += n
+		if n > 0 && now-oldest > lag {
+			lag = now - oldest
+		}
+	}
+	// Forget the retry state of updates which are no longer queued,
+	// or whose range's lease is held elsewhere.
+	for key := range uq.retries {
+		if _, ok := seen[key]; !ok {
+			delete(uq.retries, key)
+		}
+	}
+	atomic.StoreInt64(&uq.depth, depth)
+	atomic.StoreInt64(&uq.lag, lag)
+	return nil
+}
+
+// processRange scans the update queue of rng and attempts each update
+// which is due, up to updateQueueMaxBatch, recording the key of each
+// queued update in seen. Updates which are done with are then
+// dequeued. Returns the number of queued updates, as of the scan, and
+// the wall time at which the oldest was enqueued.
+func (uq *updateQueue) processRange(rng *Range, now int64, seen map[string]struct{}) (int64, int64, error) {
+	prefix := makeUpdateQueuePrefix(rng.Meta.RangeID)
+	kvs, err := uq.store.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	var oldest int64
+	var done []engine.Key
+	attempted := 0
+	for i, kv := range kvs {
+		seen[string(kv.Key)] = struct{}{}
+		var qu queuedUpdate
+		if err := gob.NewDecoder(bytes.NewBuffer(kv.Value)).Decode(&qu); err != nil {
+			log.Errorf("discarding undecodable update at key %q: %v", kv.Key, err)
+			done = append(done, kv.Key)
+			continue
+		}
+		// Updates are keyed by enqueue timestamp, so the first is the oldest.
+		if i == 0 {
+			oldest = qu.Enqueued.WallTime
+		}
+		if attempted >= updateQueueMaxBatch {
+			continue
+		}
+		if retry, ok := uq.retries[string(kv.Key)]; ok && retry.nextAttempt > now {
+			continue
+		}
+		attempted++
+		if uq.processUpdate(kv.Key, &qu, now) {
+			done = append(done, kv.Key)
+		}
+	}
+	if len(done) > 0 {
+		if err := rng.dequeueUpdates(done); err != nil {
+			return 0, 0, err
+		}
+		for _, key := range done {
+			delete(uq.retries, string(key))
+		}
+	}
+	return int64(len(kvs)), oldest, nil
+}
+
+// processUpdate attempts a single queued update stored at key.
+// Returns true if the update should be dequeued, as it was executed
+// or its transaction aborted; otherwise, it's rescheduled with
+// backoff.
+func (uq *updateQueue) processUpdate(key engine.Key, qu *queuedUpdate, now int64) bool {
+	if len(qu.TxID) > 0 {
+		status, err := uq.txnStatus(qu.TxID, qu.Enqueued, now)
+		if err != nil {
+			return uq.retry(key, now, err)
+		}
+		switch status {
+		case ABORTED:
+			metrics.Metrics.Counter("updateq.aborted", 1)
+			return true
+		case PENDING:
+			// Wait for the transaction to finish without counting an attempt.
+			uq.retryState(key).nextAttempt = now + uq.opts.Backoff.Nanoseconds()
+			return false
+		}
+	}
+
+	method, args, reply, err := newUpdateCmd(qu.Update)
+	if err != nil {
+		log.Errorf("discarding update at key %q: %v", key, err)
+		return true
+	}
+	// Execute the update outside of the enqueuing transaction, which
+	// has already committed, using the stored command ID so that
+	// retries are idempotent.
+	header := args.Header()
+	header.TxID = ""
+	header.CmdID = qu.CmdID
+	header.Replica = Replica{}
+	header.Timestamp = hlc.Timestamp{}
+	if err := uq.exec(method, args, reply); err != nil {
+		return uq.retry(key, now, err)
+	}
+	metrics.Metrics.Counter("updateq.executed", 1)
+	return true
+}
+
+// retryState returns the retry state of the update at key, creating
+// it if necessary.
+func (uq *updateQueue) retryState(key engine.Key) *updateRetry {
+	retry, ok := uq.retries[string(key)]
+	if !ok {
+		retry = &updateRetry{}
+		uq.retries[string(key)] = retry
+	}
+	return retry
+}
+
+// retry records a failed attempt of the update at key and reschedules
+// it with exponential backoff. Returns true if the update should
+// instead be discarded, as the maximum number of attempts has been
+// reached.
+func (uq *updateQueue) retry(key engine.Key, now int64, cause error) bool {
+	retry := uq.retryState(key)
+	retry.attempts++
+	if uq.opts.MaxAttempts > 0 && retry.attempts >= uq.opts.MaxAttempts {
+		log.Errorf("discarding update at key %q after %d attempts: %v", key, retry.attempts, cause)
+		metrics.Metrics.Counter("updateq.deadletter", 1)
+		return true
+	}
+	backoff := uq.opts.Backoff
+	for i := 1; i < retry.attempts && backoff < uq.opts.MaxBackoff; i++ {
+		backoff = time.Duration(float64(backoff) * uq.opts.Constant)
+	}
+	if backoff > uq.opts.MaxBackoff {
+		backoff = uq.opts.MaxBackoff
+	}
+	log.Infof("update at key %q failed; retrying in %s: %v", key, backoff, cause)
+	metrics.Metrics.Counter("updateq.retried", 1)
+	retry.nextAttempt = now + backoff.Nanoseconds()
+	return false
+}
+
+// txnStatus looks up the status of the specified transaction, which
+// enqueued an update at the enqueued timestamp. A pending transaction
+// whose last heartbeat, or whose update if it has no record yet, is
+// older than TxnHeartbeatTimeout was abandoned by its coordinator; it's
+// aborted so that its updates and claimed messages are released.
+func (uq *updateQueue) txnStatus(txID string, enqueued hlc.Timestamp, now int64) (TransactionStatus, error) {
+	key := engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txID))
+	txn, err := uq.getTxnRecord(key)
+	if err != nil {
+		return PENDING, err
+	}
+	lastActive := enqueued
+	if txn != nil {
+		if txn.Status != PENDING {
+			return txn.Status, nil
+		}
+		if lastActive.Less(txn.LastHeartbeat) {
+			lastActive = txn.LastHeartbeat
+		}
+	}
+	if now-lastActive.WallTime < TxnHeartbeatTimeout.Nanoseconds() {
+		return PENDING, nil
+	}
+	// Abort the transaction through its record, so that it's decided
+	// against a concurrent commit by its coordinator.
+	log.Warningf("aborting transaction %q, inactive since %s", txID, time.Unix(0, lastActive.WallTime))
+	args := &EndTransactionRequest{
+		RequestHeader: RequestHeader{
+			Key:  key,
+			User: UserRoot,
+			TxID: txID,
+		},
+		Commit: false,
+	}
+	if err := uq.exec(EndTransaction, args, &EndTransactionResponse{}); err != nil {
+		// The coordinator may have committed the transaction first.
+		if txn, _ := uq.getTxnRecord(key); txn != nil && txn.Status == COMMITTED {
+			return COMMITTED, nil
+		}
+		return PENDING, err
+	}
+	return ABORTED, nil
+}
+
+// getTxnRecord reads the transaction record stored at key. Returns
+// nil if the transaction has no record.
+func (uq *updateQueue) getTxnRecord(key engine.Key) (*Transaction, error) {
+	args := &GetRequest{
+		RequestHeader: RequestHeader{
+			Key:  key,
+			User: UserRoot,
+		},
+	}
+	reply := &GetResponse{}
+	if err := uq.exec(Get, args, reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Value.Bytes) == 0 {
+		return nil, nil
+	}
+	txn := &Transaction{}
+	if err := gob.NewDecoder(bytes.NewBuffer(reply.Value.Bytes)).Decode(txn); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// enqueueUpdate stores qu in the range's update queue, keyed by
+// timestamp. It's invoked as commands are applied, so every replica
+// stores the same update at the same key.
+func (r *Range) enqueueUpdate(qu queuedUpdate, timestamp hlc.Timestamp) error {
+	_, err := putAtTimestampKey(r.engine, makeUpdateQueuePrefix(r.Meta.RangeID), timestamp,
+		func(timestamp hlc.Timestamp) interface{} {
+			qu.Enqueued = timestamp
+			return qu
+		})
+	return err
+}
+
+// dequeueUpdates proposes the removal of the updates stored at keys
+// from the range's update queue to the range's raft group and waits
+// for it to be applied.
+func (r *Range) dequeueUpdates(keys []engine.Key) error {
+	args := &InternalDequeueUpdatesRequest{
+		RequestHeader: RequestHeader{
+			Key:       r.Meta.StartKey,
+			Timestamp: r.clock.Now(),
+			User:      UserRoot,
+			Replica:   r.localReplica(),
+		},
+		Keys: keys,
+	}
+	cmd := &Cmd{
+		Method: InternalDequeueUpdates,
+		Args:   args,
+		Reply:  &InternalDequeueUpdatesResponse{},
+		done:   make(chan error, 1),
+	}
+	return r.EnqueueCmd(cmd)
+}
+
+// InternalDequeueUpdates removes the updates stored at args.Keys from
+// the range's update queue.
+func (r *Range) InternalDequeueUpdates(args *InternalDequeueUpdatesRequest, reply *InternalDequeueUpdatesResponse) {
+	prefix := makeUpdateQueuePrefix(r.Meta.RangeID)
+	deletes := make([]interface{}, len(args.Keys))
+	for i, key := range args.Keys {
+		if !bytes.HasPrefix(key, prefix) {
+			reply.Error = util.Errorf("key %q is not in the update queue of range %d", key, r.Meta.RangeID)
+			return
+		}
+		deletes[i] = engine.BatchDelete(key)
+	}
+	reply.Error = r.engine.WriteBatch(deletes)
+}
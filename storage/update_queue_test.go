@@ -0,0 +1,391 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/multiraft"
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// createTestUpdateQueue creates a store with a single range spanning
+// the entire key space and an update queue which executes updates
+// against the store. Each execution increments the returned counter;
+// while *fail is non-zero, executions fail instead.
+func createTestUpdateQueue(t *testing.T) (*Store, *updateQueue, *hlc.ManualClock, *int32, *int32) {
+	manual := hlc.ManualClock(1)
+	clock := hlc.NewClock(manual.UnixNano)
+	store := NewStore(clock, engine.NewInMem(engine.Attributes{}, 1<<20), nil, multiraft.NewLocalRPCTransport())
+	if err := store.Bootstrap(testIdent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateRange(engine.KeyMin, engine.KeyMax, []Replica{{RangeID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	var count, fail int32
+	uq := newUpdateQueue(store, func(method string, args Request, reply Response) error {
+		atomic.AddInt32(&count, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			return util.Errorf("injected failure")
+		}
+		args.Header().Replica = Replica{RangeID: 1}
+		if err := store.ExecuteCmd(method, args, reply); err != nil {
+			return err
+		}
+		return reply.Header().Error
+	})
+	return store, uq, &manual, &count, &fail
+}
+
+// enqueuePut enqueues a put of value at key within the specified
+// transaction (if non-empty).
+func enqueuePut(t *testing.T, store *Store, txID, key, value string) {
+	args := &EnqueueUpdateRequest{
+		RequestHeader: RequestHeader{
+			Key:     engine.Key(key),
+			TxID:    txID,
+			Replica: Replica{RangeID: 1},
+		},
+		Update: &PutRequest{
+			RequestHeader: RequestHeader{Key: engine.Key(key)},
+			Value:         engine.Value{Bytes: []byte(value)},
+		},
+	}
+	if err := store.ExecuteCmd(EnqueueUpdate, args, &EnqueueUpdateResponse{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectValue verifies the value at key.
+func expectValue(t *testing.T, store *Store, key, value string) {
+	args, reply := getArgs(key, 1)
+	if err := store.ExecuteCmd(Get, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply.Value.Bytes, []byte(value)) {
+		t.Errorf("expected value %q at key %q; got %q", value, key, reply.Value.Bytes)
+	}
+}
+
+// TestEnqueueUpdateUnsupported verifies that only supported update
+// types may be enqueued.
+func TestEnqueueUpdateUnsupported(t *testing.T) {
+	store, _, _, _, _ := createTestUpdateQueue(t)
+	defer store.Close()
+	args := &EnqueueUpdateRequest{
+		RequestHeader: RequestHeader{Key: engine.Key("a"), Replica: Replica{RangeID: 1}},
+		Update:        &GetRequest{},
+	}
+	if err := store.ExecuteCmd(EnqueueUpdate, args, &EnqueueUpdateResponse{}); err == nil {
+		t.Error("expected error enqueueing a get")
+	}
+}
+
+// TestEnqueueUpdateCmdID verifies that updates enqueued without a
+// command ID are assigned one by the proposing replica, and that
+// applying an update without one fails.
+func TestEnqueueUpdateCmdID(t *testing.T) {
+	store, _, _, _, _ := createTestUpdateQueue(t)
+	defer store.Close()
+	update := &PutRequest{RequestHeader: RequestHeader{Key: engine.Key("a")}}
+	args := &EnqueueUpdateRequest{
+		RequestHeader: RequestHeader{Key: engine.Key("a"), Replica: Replica{RangeID: 1}},
+		Update:        update,
+	}
+	if err := store.ExecuteCmd(EnqueueUpdate, args, &EnqueueUpdateResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if update.CmdID.IsEmpty() {
+		t.Error("expected command ID to be assigned to update")
+	}
+
+	rng, err := store.GetRange(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update.CmdID = ClientCmdID{}
+	reply := &EnqueueUpdateResponse{}
+	if rng.EnqueueUpdate(args, reply); reply.Error == nil {
+		t.Error("expected error applying update without command ID")
+	}
+}
+
+// queueDepth returns the number of updates queued on the store's
+// replica of the specified range.
+func queueDepth(t *testing.T, store *Store, rangeID int64) int {
+	prefix := makeUpdateQueuePrefix(rangeID)
+	kvs, err := store.engine.Scan(prefix, engine.PrefixEndKey(prefix), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(kvs)
+}
+
+// TestUpdateQueueReplicated verifies that an update enqueued on a
+// range with three replicas is executed exactly once, by the replica
+// holding the leader lease, and is then removed from the update
+// queues of all replicas.
+func TestUpdateQueueReplicated(t *testing.T) {
+	zone := ZoneConfig{Replicas: []engine.Attributes{
+		engine.Attributes([]string{"dc1"}),
+		engine.Attributes([]string{"dc2"}),
+		engine.Attributes([]string{"dc3"}),
+	}}
+	store, rng, rq, changer := createTestReplicateQueue(t, zone)
+	defer closeTestStores(changer.stores)
+	if err := rq.replicate(rng); err != nil {
+		t.Fatal(err)
+	}
+	if storeIDs := replicaStores(rng); len(storeIDs) != 3 {
+		t.Fatalf("expected three replicas; got %v", storeIDs)
+	}
+	// waitForReplicas waits for all replicas to apply the commands
+	// applied by the leader.
+	waitForReplicas := func() {
+		index := rng.AppliedIndex()
+		for storeID, s := range changer.stores {
+			replica, err := s.GetRange(rng.Meta.RangeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := util.IsTrueWithin(func() bool { return replica.AppliedIndex() >= index }, 1*time.Second); err != nil {
+				t.Fatalf("replica on store %d didn't catch up: %v", storeID, err)
+			}
+		}
+	}
+
+	var count int32
+	exec := func(method string, args Request, reply Response) error {
+		atomic.AddInt32(&count, 1)
+		args.Header().Replica = Replica{RangeID: rng.Meta.RangeID}
+		if err := store.ExecuteCmd(method, args, reply); err != nil {
+			return err
+		}
+		return reply.Header().Error
+	}
+	args := &EnqueueUpdateRequest{
+		RequestHeader: RequestHeader{Key: engine.Key("a"), Replica: Replica{RangeID: rng.Meta.RangeID}},
+		Update: &IncrementRequest{
+			RequestHeader: RequestHeader{Key: engine.Key("a")},
+			Increment:     5,
+		},
+	}
+	if err := store.ExecuteCmd(EnqueueUpdate, args, &EnqueueUpdateResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplicas()
+	for storeID, s := range changer.stores {
+		if depth := queueDepth(t, s, rng.Meta.RangeID); depth != 1 {
+			t.Fatalf("expected update queued on store %d; got depth %d", storeID, depth)
+		}
+	}
+
+	// Each store processes its queue twice; only the leaseholder's
+	// executes the update.
+	for i := 0; i < 2; i++ {
+		for _, s := range changer.stores {
+			if err := newUpdateQueue(s, exec).process(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitForReplicas()
+	if c := atomic.LoadInt32(&count); c != 1 {
+		t.Errorf("expected update to be executed once; got %d executions", c)
+	}
+	for storeID, s := range changer.stores {
+		if depth := queueDepth(t, s, rng.Meta.RangeID); depth != 0 {
+			t.Errorf("expected empty update queue on store %d; got depth %d", storeID, depth)
+		}
+	}
+	iArgs, iReply := incrementArgs("a", 0, rng.Meta.RangeID)
+	if err := store.ExecuteCmd(Increment, iArgs, iReply); err != nil {
+		t.Fatal(err)
+	}
+	if iReply.NewValue != 5 {
+		t.Errorf("expected value 5; got %d", iReply.NewValue)
+	}
+}
+
+// TestUpdateQueueExecute verifies that updates enqueued outside of a
+// transaction are executed in order and removed from the queue, and
+// that the depth and lag are updated.
+func TestUpdateQueueExecute(t *testing.T) {
+	store, uq, manual, count, _ := createTestUpdateQueue(t)
+	defer store.Close()
+
+	enqueuePut(t, store, "", "a", "1")
+	enqueuePut(t, store, "", "a", "2")
+	*manual = hlc.ManualClock(10)
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if *count != 2 {
+		t.Errorf("expected 2 executions; got %d", *count)
+	}
+	expectValue(t, store, "a", "2")
+	if depth, lag := atomic.LoadInt64(&uq.depth), atomic.LoadInt64(&uq.lag); depth != 2 || lag != 9 {
+		t.Errorf("expected depth 2 and lag 9 as of the scan; got %d, %d", depth, lag)
+	}
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if depth, lag := atomic.LoadInt64(&uq.depth), atomic.LoadInt64(&uq.lag); depth != 0 || lag != 0 {
+		t.Errorf("expected empty queue; got depth %d, lag %d", depth, lag)
+	}
+}
+
+// TestUpdateQueueTransactions verifies that updates enqueued within a
+// transaction wait for it to commit and are discarded if it aborts.
+func TestUpdateQueueTransactions(t *testing.T) {
+	store, uq, manual, _, _ := createTestUpdateQueue(t)
+	defer store.Close()
+
+	enqueuePut(t, store, "txn1", "a", "1")
+	enqueuePut(t, store, "txn2", "b", "2")
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "")
+	expectValue(t, store, "b", "")
+
+	for _, txn := range []struct {
+		txID   string
+		commit bool
+	}{{"txn1", true}, {"txn2", false}} {
+		args, reply := endTxnArgs(txn.txID, txn.commit, 1)
+		args.Key = engine.MakeKey(engine.KeyTransactionPrefix, engine.Key(txn.txID))
+		if err := store.ExecuteCmd(EndTransaction, args, reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Updates aren't rechecked until the backoff has elapsed.
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "")
+	*manual += hlc.ManualClock(uq.opts.Backoff.Nanoseconds())
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+	expectValue(t, store, "b", "")
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := atomic.LoadInt64(&uq.depth); depth != 0 {
+		t.Errorf("expected empty queue; got depth %d", depth)
+	}
+}
+
+// TestUpdateQueueRetry verifies that failed updates are retried with
+// exponential backoff until they succeed.
+func TestUpdateQueueRetry(t *testing.T) {
+	store, uq, manual, count, fail := createTestUpdateQueue(t)
+	defer store.Close()
+
+	enqueuePut(t, store, "", "a", "1")
+	*fail = 1
+	backoff := uq.opts.Backoff
+	for i := 0; i < 4; i++ {
+		if err := uq.process(); err != nil {
+			t.Fatal(err)
+		}
+		if *count != int32(i+1) {
+			t.Fatalf("%d: expected %d executions; got %d", i, i+1, *count)
+		}
+		// Not retried before the backoff has elapsed.
+		*manual += hlc.ManualClock(backoff.Nanoseconds() - 1)
+		if err := uq.process(); err != nil {
+			t.Fatal(err)
+		}
+		if *count != int32(i+1) {
+			t.Fatalf("%d: expected no retry before %s backoff", i, backoff)
+		}
+		*manual++
+		backoff = time.Duration(float64(backoff) * uq.opts.Constant)
+	}
+	*fail = 0
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, store, "a", "1")
+}
+
+// TestUpdateQueueAbandonedTransaction verifies that the updates of a
+// transaction which is neither committed nor heartbeat within
+// TxnHeartbeatTimeout are discarded, and that the transaction is
+// aborted so that its coordinator can no longer commit it.
+func TestUpdateQueueAbandonedTransaction(t *testing.T) {
+	store, uq, manual, _, _ := createTestUpdateQueue(t)
+	defer store.Close()
+
+	enqueuePut(t, store, "txn1", "a", "1")
+	*manual += hlc.ManualClock(TxnHeartbeatTimeout.Nanoseconds() - 1)
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := atomic.LoadInt64(&uq.depth); depth != 1 {
+		t.Fatalf("expected update of pending transaction to be queued; got depth %d", depth)
+	}
+	*manual += hlc.ManualClock(uq.opts.Backoff.Nanoseconds())
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if err := uq.process(); err != nil {
+		t.Fatal(err)
+	}
+	if depth := atomic.LoadInt64(&uq.depth); depth != 0 {
+		t.Errorf("expected empty queue; got depth %d", depth)
+	}
+	expectValue(t, store, "a", "")
+
+	args, reply := endTxnArgs("txn1", true, 1)
+	args.Key = engine.MakeKey(engine.KeyTransactionPrefix, engine.Key("txn1"))
+	if err := store.ExecuteCmd(EndTransaction, args, reply); err == nil {
+		t.Error("expected commit of abandoned transaction to fail")
+	}
+}
+
+// TestUpdateQueueMaxAttempts verifies that an update which keeps
+// failing is discarded once the maximum number of attempts is
+// reached.
+func TestUpdateQueueMaxAttempts(t *testing.T) {
+	store, uq, manual, count, fail := createTestUpdateQueue(t)
+	defer store.Close()
+	uq.opts = util.RetryOptions{Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Constant: 1, MaxAttempts: 3}
+
+	enqueuePut(t, store, "", "a", "1")
+	*fail = 1
+	for i := 0; i < 5; i++ {
+		if err := uq.process(); err != nil {
+			t.Fatal(err)
+		}
+		*manual += hlc.ManualClock(time.Millisecond)
+	}
+	if *count != 3 {
+		t.Errorf("expected 3 executions; got %d", *count)
+	}
+	if depth := atomic.LoadInt64(&uq.depth); depth != 0 {
+		t.Errorf("expected empty queue; got depth %d", depth)
+	}
+}
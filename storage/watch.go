@@ -0,0 +1,256 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+func init() {
+	gob.Register(&WatchTimestampError{})
+}
+
+const (
+	// maxWatchEvents is the number of most recently applied writes
+	// retained by each range replica for watchers. Events are held in
+	// memory only; see eventLog.
+	maxWatchEvents = 10000
+	// maxWatchWait bounds the time a watch waits for events. It's
+	// shorter than the timeout of RPCs and HTTP requests, so that
+	// watches waiting the full time aren't cut short.
+	maxWatchWait = 10 * time.Second
+)
+
+// A WatchEvent is a write committed to a key. Value holds the bytes
+// written and the timestamp of the write. If Deleted is true, the key
+// was deleted and Value holds only the timestamp.
+type WatchEvent struct {
+	Key     engine.Key
+	Value   engine.Value
+	Deleted bool
+}
+
+// A WatchTimestampError indicates that a watch started before the
+// oldest write retained by the range, so writes of interest may have
+// been forgotten. The watcher must rescan the watched keys and watch
+// again from the scan's timestamp.
+type WatchTimestampError struct {
+	StartTimestamp hlc.Timestamp
+	Oldest         hlc.Timestamp // Writes after Oldest are retained
+}
+
+// Error formats error.
+func (e *WatchTimestampError) Error() string {
+	return fmt.Sprintf("watch starting at %d.%d precedes the writes retained since %d.%d; rescan and watch from the scan's timestamp",
+		e.StartTimestamp.WallTime, e.StartTimestamp.Logical, e.Oldest.WallTime, e.Oldest.Logical)
+}
+
+// An eventLog holds the writes most recently applied to a range
+// replica, in the order applied. Writes are recorded while a command
+// is applied and published, stamped with the command's timestamp,
+// once it has been applied. Only committed writes are recorded: those
+// outside of transactions and, as their intents are resolved, those
+// of committed transactions. The log is held in memory and retains at
+// most maxWatchEvents (up to twice as many between trims); it starts
+// empty when the replica is created, as on restart or when it's added
+// to the range, and watches starting before its oldest retained write
+// fail with a WatchTimestampError.
+type eventLog struct {
+	sync.Mutex
+	events  []WatchEvent  // Published events, in the order applied
+	pending []WatchEvent  // Events recorded by the command being applied
+	oldest  hlc.Timestamp // Events at or before oldest may have been dropped
+	changed chan struct{} // Closed when events are next published
+}
+
+// newEventLog returns an empty event log. Writes at or before
+// oldest, which were applied before the log was created, are
+// unknown to it.
+func newEventLog(oldest hlc.Timestamp) *eventLog {
+	return &eventLog{oldest: oldest, changed: make(chan struct{})}
+}
+
+// record records the write of val to key by the command being
+// applied.
+func (l *eventLog) record(key engine.Key, val []byte) {
+	value := engine.DecodeValue(key, val)
+	value.InitChecksum()
+	l.Lock()
+	l.pending = append(l.pending, WatchEvent{Key: key, Value: value})
+	l.Unlock()
+}
+
+// recordDelete records the deletion of key by the command being
+// applied.
+func (l *eventLog) recordDelete(key engine.Key) {
+	l.Lock()
+	l.pending = append(l.pending, WatchEvent{Key: key, Deleted: true})
+	l.Unlock()
+}
+
+// addPending adds the events recorded in o, which buffered the writes
+// of a batch, to those recorded by the command being applied.
+func (l *eventLog) addPending(o *eventLog) {
+	o.Lock()
+	events := o.pending
+	o.Unlock()
+	l.Lock()
+	l.pending = append(l.pending, events...)
+	l.Unlock()
+}
+
+// publish stamps the events recorded by the command just applied
+// with its timestamp and makes them available to watchers, waking
+// any which are waiting. If more than maxWatchEvents are retained,
+// the oldest are dropped.
+func (l *eventLog) publish(timestamp hlc.Timestamp) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.pending) == 0 {
+		return
+	}
+	for _, e := range l.pending {
+		e.Value.Timestamp = timestamp
+		l.events = append(l.events, e)
+	}
+	l.pending = nil
+	// Trim the log once it's twice its maximum size, so that events
+	// aren't copied on every publish.
+	if len(l.events) >= 2*maxWatchEvents {
+		drop := len(l.events) - maxWatchEvents
+		for _, e := range l.events[:drop] {
+			if l.oldest.Less(e.Value.Timestamp) {
+				l.oldest = e.Value.Timestamp
+			}
+		}
+		l.events = append([]WatchEvent(nil), l.events[drop:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// changedChan returns a channel which is closed when events are next
+// published.
+func (l *eventLog) changedChan() <-chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	return l.changed
+}
+
+// since returns the events to key, or to the keys from key to endKey
+// (exclusive) if endKey is not empty, with timestamps after start and
+// at or before end, in timestamp order. Events with equal timestamps
+// are returned in the order applied.
+func (l *eventLog) since(key, endKey engine.Key, start, end hlc.Timestamp) ([]WatchEvent, error) {
+	l.Lock()
+	defer l.Unlock()
+	if start.Less(l.oldest) {
+		return nil, &WatchTimestampError{StartTimestamp: start, Oldest: l.oldest}
+	}
+	var events []WatchEvent
+	for _, e := range l.events {
+		if len(endKey) == 0 {
+			if !bytes.Equal(e.Key, key) {
+				continue
+			}
+		} else if e.Key.Less(key) || !e.Key.Less(endKey) {
+			continue
+		}
+		if start.Less(e.Value.Timestamp) && !end.Less(e.Value.Timestamp) {
+			events = append(events, e)
+		}
+	}
+	sort.Stable(WatchEventSlice(events))
+	return events, nil
+}
+
+// A WatchEventSlice is a slice of WatchEvents used for sorting
+// events by timestamp.
+type WatchEventSlice []WatchEvent
+
+// Len implements sort.Interface.
+func (s WatchEventSlice) Len() int { return len(s) }
+
+// Swap implements sort.Interface.
+func (s WatchEventSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less implements sort.Interface, ordering events by timestamp.
+func (s WatchEventSlice) Less(i, j int) bool {
+	return s[i].Value.Timestamp.Less(s[j].Value.Timestamp)
+}
+
+// prevTimestamp returns the timestamp immediately preceding t.
+func prevTimestamp(t hlc.Timestamp) hlc.Timestamp {
+	if t.Logical > 0 {
+		return hlc.Timestamp{WallTime: t.WallTime, Logical: t.Logical - 1}
+	}
+	return hlc.Timestamp{WallTime: t.WallTime - 1, Logical: math.MaxInt64}
+}
+
+// Watch returns the writes to the watched keys which were committed
+// after args.StartTimestamp and before the watch's timestamp. It's
+// executed as a read-only command: the watch's timestamp is added to
+// the read timestamp cache, so that later writes to the watched keys
+// are pushed past it, and overlapping writes in flight are awaited.
+// Every write to the watched keys at a timestamp before the watch's
+// has therefore been applied, and its timestamp is resolved.
+func (r *Range) Watch(args *WatchRequest, reply *WatchResponse) {
+	reply.ResolvedTimestamp = prevTimestamp(args.Timestamp)
+	reply.Events, reply.Error = r.events.since(args.Key, args.EndKey, args.StartTimestamp, reply.ResolvedTimestamp)
+}
+
+// WatchCmd executes a watch as a read-only command. If no events are
+// returned, it waits up to args.Wait (bounded by maxWatchWait) for
+// writes to be applied to the range, executing the watch anew at the
+// current time after each, and returns as soon as events are
+// returned. The watch waits outside of the command queue, so as not
+// to hold up the writes it's waiting for. A watch with a zero start
+// timestamp starts at its own timestamp.
+func (r *Range) WatchCmd(args *WatchRequest, reply *WatchResponse) error {
+	if args.StartTimestamp.Equal(hlc.Timestamp{}) {
+		args.StartTimestamp = prevTimestamp(args.Timestamp)
+	}
+	wait := args.Wait
+	if wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	deadline := time.After(wait)
+	for {
+		changed := r.events.changedChan()
+		if err := r.ReadOnlyCmd(Watch, args, reply); err != nil || len(reply.Events) > 0 {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil
+		case <-r.closer:
+			return nil
+		}
+		now := r.clock.Now()
+		args.Timestamp = now
+		reply.Timestamp = now
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied.  See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package storage
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/storage/engine"
+	"github.com/cockroachdb/cockroach/util/hlc"
+)
+
+// watchArgs returns a WatchRequest and WatchResponse pair addressed
+// to the default replica for the specified key range. The single key
+// is watched if endKey is empty.
+func watchArgs(key, endKey string, start hlc.Timestamp, wait time.Duration, rangeID int64) (*WatchRequest, *WatchResponse) {
+	args := &WatchRequest{
+		RequestHeader: RequestHeader{
+			Key:     []byte(key),
+			Replica: Replica{RangeID: rangeID},
+		},
+		StartTimestamp: start,
+		Wait:           wait,
+	}
+	if endKey != "" {
+		args.EndKey = []byte(endKey)
+	}
+	reply := &WatchResponse{}
+	return args, reply
+}
+
+// watchedKeys returns the keys of events, suffixed with "-" if
+// deleted.
+func watchedKeys(events []WatchEvent) []string {
+	var keys []string
+	for _, e := range events {
+		if e.Deleted {
+			keys = append(keys, string(e.Key)+"-")
+		} else {
+			keys = append(keys, string(e.Key))
+		}
+	}
+	return keys
+}
+
+// TestRangeWatch verifies that a watch returns the writes to the
+// watched keys committed since its start timestamp, in timestamp
+// order, and a resolved timestamp from which to continue.
+func TestRangeWatch(t *testing.T) {
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+	start := r.clock.Now()
+
+	for _, key := range []string{"a", "b", "c"} {
+		pArgs, pReply := putArgs(key, "value-"+key, r.Meta.RangeID)
+		if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dArgs := &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key("a"), Replica: Replica{RangeID: r.Meta.RangeID}}}
+	if err := s.ExecuteCmd(Delete, dArgs, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	wArgs, wReply := watchArgs("a", "c", start, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil {
+		t.Fatal(err)
+	}
+	if keys := watchedKeys(wReply.Events); !reflect.DeepEqual(keys, []string{"a", "b", "a-"}) {
+		t.Fatalf("expected events [a b a-]; got %v", keys)
+	}
+	if e := wReply.Events[1]; string(e.Value.Bytes) != "value-b" || e.Value.Checksum == 0 {
+		t.Errorf("expected value of b with checksum; got %+v", e.Value)
+	}
+	for i, e := range wReply.Events {
+		if !start.Less(e.Value.Timestamp) || wReply.ResolvedTimestamp.Less(e.Value.Timestamp) ||
+			(i > 0 && e.Value.Timestamp.Less(wReply.Events[i-1].Value.Timestamp)) {
+			t.Errorf("event %d at %+v out of order or unresolved (start %+v, resolved %+v)",
+				i, e.Value.Timestamp, start, wReply.ResolvedTimestamp)
+		}
+	}
+
+	// A single key may be watched.
+	wArgs, wReply = watchArgs("b", "", start, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil {
+		t.Fatal(err)
+	}
+	if keys := watchedKeys(wReply.Events); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("expected events [b]; got %v", keys)
+	}
+
+	// Writes at or before the resolved timestamp may no longer be
+	// committed: a write in the past is pushed beyond it.
+	resolved := wReply.ResolvedTimestamp
+	pArgs, pReply := putArgs("b", "late", r.Meta.RangeID)
+	pArgs.Timestamp = start
+	if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.Less(pReply.Timestamp) {
+		t.Errorf("expected write at %+v to be pushed beyond resolved timestamp %+v", start, resolved)
+	}
+	wArgs, wReply = watchArgs("b", "", resolved, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(wReply.Events) != 1 || string(wReply.Events[0].Value.Bytes) != "late" {
+		t.Errorf("expected pushed write; got %+v", wReply.Events)
+	}
+}
+
+// TestRangeWatchTransaction verifies that the writes of a transaction
+// are hidden from watchers until its intents are resolved, and that
+// only committed writes are then returned.
+func TestRangeWatchTransaction(t *testing.T) {
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+	pArgs, pReply := putArgs("b", "value", r.Meta.RangeID)
+	if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	start := r.clock.Now()
+
+	pArgs, pReply = putArgs("a", "txn1", r.Meta.RangeID)
+	pArgs.TxID = "txn1"
+	if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	dArgs := &DeleteRequest{RequestHeader: RequestHeader{Key: engine.Key("b"), Replica: Replica{RangeID: r.Meta.RangeID}, TxID: "txn1"}}
+	if err := s.ExecuteCmd(Delete, dArgs, &DeleteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	pArgs, pReply = putArgs("c", "txn2", r.Meta.RangeID)
+	pArgs.TxID = "txn2"
+	if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	wArgs, wReply := watchArgs("a", "z", start, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil || len(wReply.Events) != 0 {
+		t.Fatalf("expected no events before intents are resolved; got %+v, %v", wReply.Events, err)
+	}
+
+	args, reply := resolveArgs("a", "z", "txn1", true)
+	args.Replica.RangeID = r.Meta.RangeID
+	if err := s.ExecuteCmd(InternalResolveIntent, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	args, reply = resolveArgs("a", "z", "txn2", false)
+	args.Replica.RangeID = r.Meta.RangeID
+	if err := s.ExecuteCmd(InternalResolveIntent, args, reply); err != nil {
+		t.Fatal(err)
+	}
+	wArgs, wReply = watchArgs("a", "z", start, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil {
+		t.Fatal(err)
+	}
+	if keys := watchedKeys(wReply.Events); !reflect.DeepEqual(keys, []string{"a", "b-"}) {
+		t.Fatalf("expected events [a b-]; got %v", keys)
+	}
+	if e := wReply.Events[0]; string(e.Value.Bytes) != "txn1" {
+		t.Errorf("expected committed value of a; got %+v", e.Value)
+	}
+}
+
+// TestRangeWatchWait verifies that a watch without events waits for
+// writes to the watched keys.
+func TestRangeWatchWait(t *testing.T) {
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+	start := r.clock.Now()
+
+	wArgs, wReply := watchArgs("a", "b", start, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil || len(wReply.Events) != 0 {
+		t.Fatalf("expected no events; got %+v, %v", wReply.Events, err)
+	}
+
+	errChan := make(chan error, 1)
+	wArgs, wReply = watchArgs("a", "b", start, 5*time.Second, r.Meta.RangeID)
+	go func() {
+		errChan <- s.ExecuteCmd(Watch, wArgs, wReply)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// A write outside of the watched keys doesn't satisfy the watch.
+	for _, key := range []string{"b", "aa"} {
+		pArgs, pReply := putArgs(key, "value", r.Meta.RangeID)
+		if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := watchedKeys(wReply.Events); !reflect.DeepEqual(keys, []string{"aa"}) {
+			t.Errorf("expected events [aa]; got %v", keys)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch didn't return after write")
+	}
+}
+
+// TestRangeWatchTimestampError verifies that a watch starting before
+// the writes retained by the range fails, while a watch without a
+// start timestamp starts at the time of the watch.
+func TestRangeWatchTimestampError(t *testing.T) {
+	s, r, _ := createTestRange(createTestEngine(t), t)
+	defer s.Close()
+	wArgs, wReply := watchArgs("a", "b", hlc.Timestamp{WallTime: 1}, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err == nil {
+		t.Error("expected watch from before range creation to fail")
+	} else if _, ok := err.(*WatchTimestampError); !ok {
+		t.Errorf("expected WatchTimestampError; got %v", err)
+	}
+	pArgs, pReply := putArgs("a", "value", r.Meta.RangeID)
+	if err := s.ExecuteCmd(Put, pArgs, pReply); err != nil {
+		t.Fatal(err)
+	}
+	wArgs, wReply = watchArgs("a", "b", hlc.Timestamp{}, 0, r.Meta.RangeID)
+	if err := s.ExecuteCmd(Watch, wArgs, wReply); err != nil || len(wReply.Events) != 0 {
+		t.Errorf("expected watch from now to return no events; got %+v, %v", wReply.Events, err)
+	}
+
+	// Once the log is trimmed, dropped events may no longer be watched.
+	l := newEventLog(hlc.Timestamp{})
+	for i := 1; i <= 2*maxWatchEvents; i++ {
+		l.record(engine.Key("a"), []byte("value"))
+		l.publish(hlc.Timestamp{WallTime: int64(i)})
+	}
+	if _, err := l.since(engine.Key("a"), nil, hlc.Timestamp{}, hlc.Timestamp{WallTime: math.MaxInt64}); err == nil {
+		t.Error("expected watch of trimmed events to fail")
+	}
+	events, err := l.since(engine.Key("a"), nil, hlc.Timestamp{WallTime: maxWatchEvents}, hlc.Timestamp{WallTime: math.MaxInt64})
+	if err != nil || len(events) != maxWatchEvents {
+		t.Errorf("expected %d retained events; got %d, %v", maxWatchEvents, len(events), err)
+	}
+}
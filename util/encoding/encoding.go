@@ -112,21 +112,51 @@ func wrapChecksum(k []byte, b []byte) []byte {
 	return chk.Sum(b)
 }
 
+// Tags identifying the type of an encoded value. The tag is the last
+// byte of the value's internal representation, preceding the checksum.
+// Tags have the high bit set, which the last byte of a varint never
+// has, so they tell tagged values apart from the bare varints encoded
+// before values were tagged.
+const (
+	int64Tag byte = 0x80 + iota + 1
+	bytesTag
+	timestampedBytesTag
+)
+
+// TimestampedBytes is a byte string stored along with the wall time
+// and logical component of the timestamp at which it was written.
+type TimestampedBytes struct {
+	Bytes    []byte
+	WallTime int64
+	Logical  int64
+}
+
+// timestampSize is the size of the timestamp suffix of an encoded
+// TimestampedBytes value.
+const timestampSize = 16
+
 // Encode translates the given value into a byte representation used to store
 // it in the underlying key-value store. It typically applies to user-level
 // keys, but not to keys operated on internally, such as accounting keys.
 // It returns a byte slice containing, in order, the internal representation
-// of v and a checksum of (k+v).
+// of v, a tag identifying its type and a checksum of (k+v+tag).
 func Encode(k []byte, v interface{}) ([]byte, error) {
 	result := []byte(nil)
 	switch value := v.(type) {
 	case int64:
 		// int64 are encoded as varint.
-		encoded := make([]byte, binary.MaxVarintLen64)
+		encoded := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+1)
 		numBytes := binary.PutVarint(encoded, value)
-		result = encoded[:numBytes]
+		result = append(encoded[:numBytes], int64Tag)
 	case []byte:
-		result = value
+		result = append(append([]byte(nil), value...), bytesTag)
+	case TimestampedBytes:
+		// The timestamp follows the bytes at a fixed size.
+		result = make([]byte, len(value.Bytes)+timestampSize, len(value.Bytes)+timestampSize+1)
+		copy(result, value.Bytes)
+		binary.BigEndian.PutUint64(result[len(value.Bytes):], uint64(value.WallTime))
+		binary.BigEndian.PutUint64(result[len(value.Bytes)+8:], uint64(value.Logical))
+		result = append(result, timestampedBytesTag)
 	default:
 		panic(fmt.Sprintf("unable to encode type '%v' of value '%s'", reflect.TypeOf(v), v))
 	}
@@ -134,22 +164,49 @@ func Encode(k []byte, v interface{}) ([]byte, error) {
 }
 
 // Decode decodes a Go datatype from a value stored in the key-value store. It returns
-// either an error or a variable of the decoded value.
+// either an error or a variable of the decoded value, according to the
+// type tag with which it was encoded. Untagged values, encoded before
+// values were tagged, are decoded as the varints they held.
 func Decode(k []byte, wrappedValue []byte) (interface{}, error) {
 	v, err := unwrapChecksum(k, wrappedValue)
 	if err != nil {
 		return nil, util.Errorf("integrity error: %v", err)
 	}
+	if len(v) == 0 {
+		return nil, util.Errorf("%v cannot be decoded; missing type tag", wrappedValue)
+	}
+	tag := v[len(v)-1]
+	if tag&0x80 == 0 {
+		return decodeVarint(v)
+	}
+	v = v[:len(v)-1]
+
+	switch tag {
+	case int64Tag:
+		return decodeVarint(v)
+	case bytesTag:
+		return v, nil
+	case timestampedBytesTag:
+		if len(v) < timestampSize {
+			return nil, util.Errorf("%v cannot be decoded; missing timestamp", v)
+		}
+		n := len(v) - timestampSize
+		return TimestampedBytes{
+			Bytes:    v[:n],
+			WallTime: int64(binary.BigEndian.Uint64(v[n:])),
+			Logical:  int64(binary.BigEndian.Uint64(v[n+8:])),
+		}, nil
+	}
+	return nil, util.Errorf("%v cannot be decoded; unknown type tag %d", v, tag)
+}
 
-	// TODO(Tobias): This is highly provisional, interpreting everything as a
-	// varint until we have decided upon and implemented the actual encoding.
-	// If the value exists, attempt to decode it as a varint.
-	var numBytes int
+// decodeVarint decodes v, which must hold exactly one varint.
+func decodeVarint(v []byte) (interface{}, error) {
 	int64Val, numBytes := binary.Varint(v)
-	if numBytes == 0 {
-		return nil, util.Errorf("%v cannot be decoded; not varint-encoded", v)
-	} else if numBytes < 0 {
+	if numBytes < 0 {
 		return nil, util.Errorf("%v cannot be decoded; integer overflow", v)
+	} else if numBytes == 0 || numBytes != len(v) {
+		return nil, util.Errorf("%v cannot be decoded; not varint-encoded", v)
 	}
 	return int64Val, nil
 }
@@ -18,6 +18,8 @@
 package encoding
 
 import (
+	"bytes"
+	"encoding/binary"
 	"math"
 	"reflect"
 	"testing"
@@ -42,6 +44,36 @@ func TestEncoding(t *testing.T) {
 	default:
 		t.Errorf("int64 decoding error, did not get a uint64 back but instead type %v: %v", reflect.TypeOf(v), v)
 	}
+
+	b := []byte("bytes")
+	if encoded, err = Encode(k, b); err != nil {
+		t.Errorf("encoding error for %q", b)
+	}
+	if decoded, err = Decode(k, encoded); err != nil {
+		t.Errorf("decoding error for %q", b)
+	}
+	if v, ok := decoded.([]byte); !ok || !bytes.Equal(v, b) {
+		t.Errorf("[]byte decoding error, got %v: %v", reflect.TypeOf(decoded), decoded)
+	}
+	tb := TimestampedBytes{Bytes: []byte("bytes"), WallTime: 1 << 40, Logical: 3}
+	if encoded, err = Encode(k, tb); err != nil {
+		t.Errorf("encoding error for %+v", tb)
+	}
+	if decoded, err = Decode(k, encoded); err != nil || !reflect.DeepEqual(decoded, tb) {
+		t.Errorf("timestamped bytes decoding error, got %v: %v", decoded, err)
+	}
+	// A value without a valid type tag can't be decoded.
+	if _, err := Decode(k, wrapChecksum(k, []byte{0x02, 0xff})); err == nil {
+		t.Error("expected error decoding value with unknown type tag")
+	}
+	// Untagged integers, encoded before values were tagged, are decoded.
+	for _, legacy := range []int64{0, 1, -1, n} {
+		varint := make([]byte, binary.MaxVarintLen64)
+		varint = varint[:binary.PutVarint(varint, legacy)]
+		if decoded, err = Decode(k, wrapChecksum(k, varint)); err != nil || decoded != legacy {
+			t.Errorf("expected untagged integer %d; got %v, %v", legacy, decoded, err)
+		}
+	}
 }
 
 func TestChecksums(t *testing.T) {
@@ -89,7 +89,7 @@ func DecodeString(b []byte) ([]byte, string) {
 	}
 	for i, v := range b[1:] {
 		if v == orderedEncodingTerminator {
-			return b[1+i:], string(b[1 : 1+i])
+			return b[2+i:], string(b[1 : 1+i])
 		}
 	}
 	panic("encoded string must have terminator byte")
@@ -48,8 +48,10 @@ func TestEncodeDecodeString(t *testing.T) {
 		if buf[n-1] != orderedEncodingTerminator {
 			t.Errorf("expected terminating byte (%#x), got %#x", orderedEncodingTerminator, buf[n-1])
 		}
-		_, s := DecodeString(buf)
-
+		remainder, s := DecodeString(append(buf, 'x'))
+		if !bytes.Equal(remainder, []byte("x")) {
+			t.Errorf("expected remainder %q after decoding %q, got %q", "x", c.text, remainder)
+		}
 		if s != c.text {
 			t.Errorf("error decoding string: expected %q, got %q", c.text, s)
 		}